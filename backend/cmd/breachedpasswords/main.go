@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+)
+
+const usage = `Builds and checks the corpus of BREACHED_PASSWORDS_FILE, e.g.
+
+	go run ./cmd/breachedpasswords build-filter -in pwned-passwords-sha1.txt -out data/breached.bloom -fp 0.001
+	go run ./cmd/breachedpasswords check -file data/breached.bloom < password.txt
+
+build-filter reads HASH:COUNT lines, like the HIBP downloads, and writes a Bloom filter of the hashes
+seen at least -min-count times. check reads a password from stdin and tells whether the corpus has it.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "build-filter":
+		err = buildFilter(os.Args[2:])
+	case "check":
+		err = check(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func buildFilter(args []string) error {
+	flags := flag.NewFlagSet("build-filter", flag.ExitOnError)
+	in := flags.String("in", "", "file of HASH:COUNT lines")
+	out := flags.String("out", "", "Bloom filter to write")
+	falsePositiveRate := flags.Float64("fp", 0.001, "false positive rate of the filter")
+	minCount := flags.Int("min-count", 1, "skip the hashes seen fewer times, for a smaller filter")
+	_ = flags.Parse(args)
+
+	if *in == "" || *out == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// The first pass counts the hashes to size the filter.
+	var n uint64
+	err := eachHash(*in, *minCount, func(string) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	filter, err := password.NewBloomFilter(n, *falsePositiveRate)
+	if err != nil {
+		return err
+	}
+	if err := eachHash(*in, *minCount, filter.AddHash); err != nil {
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	size, err := filter.WriteTo(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", *out, err)
+	}
+
+	fmt.Printf("%d hashes written to %s (%d bytes)\n", n, *out, size)
+	return nil
+}
+
+func eachHash(path string, minCount int, visit func(hash string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		hash, count, err := password.ParseHashLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if count < minCount {
+			continue
+		}
+		if err := visit(hash); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	path := flags.String("file", "", "corpus to check, in any format BREACHED_PASSWORDS_FILE takes")
+	_ = flags.Parse(args)
+
+	if *path == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	corpus, err := password.OpenBreachedPasswords(*path)
+	if err != nil {
+		return err
+	}
+
+	// The password comes from stdin, to keep it out of the shell history.
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	breached, err := corpus.Contains(line)
+	if err != nil {
+		return err
+	}
+	if breached {
+		fmt.Println("breached")
+		os.Exit(1)
+	}
+	fmt.Println("not found")
+	return nil
+}
@@ -52,9 +52,16 @@ func main() {
 		util.LogFatalErr(logger, err, "failed to create user service")
 	}
 
+	// Deletes the accounts whose deletion grace period is over
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	go userService.RunAccountPurge(purgeCtx)
+
 	// router
 	r := routers.SetupRouter(dep)
 	routers.UsersRouter(r.Group("/api/users"), userService)
+	routers.OidcRouter(r.Group("/api/oidc"), userService)
+	routers.WellKnownRouter(r.Group("/.well-known"), userService)
 
 	// Health check
 	r.GET("/api/ping", func(c *gin.Context) {
@@ -84,6 +91,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit // consume the signal, blocking here
 	logger.Info("shutting down server...")
+	stopPurge()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
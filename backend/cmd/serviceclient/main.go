@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
+)
+
+// Registers or removes a service client, e.g.
+//
+//	go run ./cmd/serviceclient -id game -name "Game service"
+//	go run ./cmd/serviceclient -id game -delete
+func main() {
+	clientID := flag.String("id", "", "client id of the service")
+	name := flag.String("name", "", "human readable name of the service")
+	remove := flag.Bool("delete", false, "delete the client instead of creating it")
+	flag.Parse()
+
+	if *clientID == "" || (!*remove && *name == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	_ = godotenv.Load()
+
+	logger := util.GetLogger(slog.LevelWarn)
+
+	dep, err := dependency.InitDependency(logger)
+	if err != nil {
+		util.LogFatalErr(logger, err, "failed to create dependency")
+	}
+	defer dependency.CloseDependency(dep)
+
+	userService, err := service.NewUserService(dep)
+	if err != nil {
+		util.LogFatalErr(logger, err, "failed to create user service")
+	}
+
+	ctx := context.Background()
+
+	if *remove {
+		if err := userService.DeleteServiceClient(ctx, *clientID); err != nil {
+			util.LogFatalErr(logger, err, "failed to delete service client")
+		}
+		fmt.Printf("service client %s deleted\n", *clientID)
+		return
+	}
+
+	secret, err := userService.CreateServiceClient(ctx, *clientID, *name)
+	if err != nil {
+		util.LogFatalErr(logger, err, "failed to create service client")
+	}
+
+	fmt.Printf("client_id:     %s\nclient_secret: %s\n\nThe secret is not stored, keep it now.\n", *clientID, secret)
+}
@@ -1,8 +1,26 @@
 package authError
 
+// Codes for the errors a client has to tell apart from others of the same status.
+const (
+	CodeReauthRequired = "reauth_required"
+	CodePasswordPolicy = "password_policy"
+	// The stored password can no longer be checked, e.g. after its pepper was dropped
+	CodePasswordResetRequired = "password_reset_required"
+)
+
+// Violation is one rule a field of the request breaks, sent in "violations".
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
 type AuthError struct {
-	Status  int
-	Message string
+	Status     int
+	Message    string
+	RetryAfter int         // In seconds, sent as the Retry-After header when set
+	Code       string      // Sent as "code" next to the message when set
+	Violations []Violation // Sent as "violations", with their messages as "error", when set
 }
 
 func (e *AuthError) Error() string {
@@ -15,3 +33,29 @@ func NewAuthError(status int, message string) *AuthError {
 		Message: message,
 	}
 }
+
+func NewAuthErrorWithCode(status int, code string, message string) *AuthError {
+	return &AuthError{
+		Status:  status,
+		Message: message,
+		Code:    code,
+	}
+}
+
+// NewValidationError is a 400 listing every rule the request breaks.
+func NewValidationError(code string, violations []Violation) *AuthError {
+	return &AuthError{
+		Status:     400,
+		Message:    violations[0].Message,
+		Code:       code,
+		Violations: violations,
+	}
+}
+
+func NewRetryAfterError(status int, message string, retryAfter int) *AuthError {
+	return &AuthError{
+		Status:     status,
+		Message:    message,
+		RetryAfter: retryAfter,
+	}
+}
@@ -4,27 +4,109 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// EMAIL_VERIFICATION_POLICY values.
+const (
+	// EmailVerificationPolicyNone trusts any email, verification only shows in the user profile.
+	EmailVerificationPolicyNone = "none"
+	// EmailVerificationPolicyActions lets unverified users log in, but not use the routes behind RequireVerifiedEmail.
+	EmailVerificationPolicyActions = "actions"
+	// EmailVerificationPolicyLogin also refuses password logins of unverified users.
+	EmailVerificationPolicyLogin = "login"
+)
+
+// OauthProviderConfig is one external login provider of OAUTH_PROVIDERS, read from the OAUTH_<NAME>_* variables.
+// Type picks the preset that fills in the URLs and the claim mapping, anything set explicitly wins.
+type OauthProviderConfig struct {
+	Name               string
+	Type               string
+	ClientID           string
+	ClientSecret       string
+	Issuer             string
+	AuthorizeURL       string
+	TokenURL           string
+	UserInfoURL        string
+	RedirectURI        string
+	Scopes             []string
+	ClaimSubject       string
+	ClaimEmail         string
+	ClaimEmailVerified string
+	ClaimUsername      string
+	ClaimAvatar        string
+}
+
 type Config struct {
 	GinMode                         string
 	DbAddress                       string
 	JwtSecret                       string
+	JwtSigningKeyFile               string
+	JwtVerificationKeyFiles         []string
+	JwtSecretAcceptedUntil          time.Time
 	UserTokenExpiry                 int
 	OauthStateTokenExpiry           int
 	GoogleClientId                  string
 	GoogleClientSecret              string
 	GoogleRedirectUri               string
 	FrontendUrl                     string
-	TwoFaUrlPrefix                  string
+	TwoFaIssuer                     string
+	TwoFaDigits                     int
+	TwoFaPeriod                     int
+	TwoFaAlgorithm                  string
+	TwoFaSkew                       int
 	TwoFaTokenExpiry                int
+	TwoFaMaxAttempts                int
+	TwoFaEmailMaxSends              int
+	TwoFaEmailResendCooldown        int
+	TrustedDeviceExpiry             int
 	RedisURL                        string
 	IsRedisEnabled                  bool
 	UserTokenAbsoluteExpiry         int
+	RefreshTokenExpiry              int
+	OidcIssuer                      string
+	OidcClients                     []string
+	OidcCodeExpiry                  int
+	LoginCodeExpiry                 int
+	ReauthMaxAge                    int
+	AccountDeletionGracePeriodInSec int
+	AccountPurgeIntervalInSec       int
+	ServiceTokenExpiry              int
 	Port                            int
 	RateLimiterDurationInSec        int
 	RateLimiterRequestLimit         int
 	RateLimiterCleanupIntervalInSec int
+	LoginFreeAttempts               int
+	LoginMaxAttempts                int
+	LoginMaxAttemptsPerIP           int
+	LoginBackoffBaseInSec           int
+	LoginLockoutDurationInSec       int
+	PasswordHashAlgorithm           string
+	Argon2MemoryKiB                 int
+	Argon2Iterations                int
+	Argon2Parallelism               int
+	BcryptCost                      int
+	PasswordPepper                  string
+	PasswordPreviousPeppers         []string
+	RecoveryCodeKey                 string
+	PasswordMinLength               int
+	PasswordMaxLength               int
+	PasswordBlocklistFile           string
+	PasswordMinStrength             int
+	BreachedPasswordCheck           bool
+	BreachedPasswordsFile           string
+	PasswordResetTokenExpiry        int
+	EmailVerificationTokenExpiry    int
+	EmailVerificationPolicy         string
+	MailerDriver                    string
+	MailFrom                        string
+	MailFilePath                    string
+	SmtpHost                        string
+	SmtpPort                        int
+	SmtpUsername                    string
+	SmtpPassword                    string
+	OauthProviders                  []OauthProviderConfig
 }
 
 func getEnvStrOrDefault(key string, defaultValue string) string {
@@ -58,6 +140,78 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 	return intValue
 }
 
+// getEnvListOrDefault reads a comma separated list, empty items are dropped.
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+
+	if value == "" {
+		return defaultValue
+	}
+
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func oauthProviderEnvPrefix(name string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+
+	return "OAUTH_" + prefix + "_"
+}
+
+// loadOauthProviders reads the providers listed in OAUTH_PROVIDERS, e.g. OAUTH_PROVIDERS=github,42.
+func loadOauthProviders(publicURL string) ([]OauthProviderConfig, error) {
+	providers := make([]OauthProviderConfig, 0)
+
+	for _, name := range getEnvListOrDefault("OAUTH_PROVIDERS", nil) {
+		name = strings.ToLower(name)
+		if name == "google" {
+			return nil, fmt.Errorf("OAUTH_PROVIDERS: google is configured with GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET")
+		}
+
+		prefix := oauthProviderEnvPrefix(name)
+		clientID, err := getEnvStrOrError(prefix + "CLIENT_ID")
+		if err != nil {
+			return nil, err
+		}
+		clientSecret, err := getEnvStrOrError(prefix + "CLIENT_SECRET")
+		if err != nil {
+			return nil, err
+		}
+
+		providers = append(providers, OauthProviderConfig{
+			Name:               name,
+			Type:               getEnvStrOrDefault(prefix+"TYPE", name),
+			ClientID:           clientID,
+			ClientSecret:       clientSecret,
+			Issuer:             getEnvStrOrDefault(prefix+"ISSUER", ""),
+			AuthorizeURL:       getEnvStrOrDefault(prefix+"AUTHORIZE_URL", ""),
+			TokenURL:           getEnvStrOrDefault(prefix+"TOKEN_URL", ""),
+			UserInfoURL:        getEnvStrOrDefault(prefix+"USERINFO_URL", ""),
+			RedirectURI:        getEnvStrOrDefault(prefix+"REDIRECT_URI", publicURL+"/api/users/oauth/"+name+"/callback"),
+			Scopes:             getEnvListOrDefault(prefix+"SCOPES", nil),
+			ClaimSubject:       getEnvStrOrDefault(prefix+"CLAIM_SUBJECT", ""),
+			ClaimEmail:         getEnvStrOrDefault(prefix+"CLAIM_EMAIL", ""),
+			ClaimEmailVerified: getEnvStrOrDefault(prefix+"CLAIM_EMAIL_VERIFIED", ""),
+			ClaimUsername:      getEnvStrOrDefault(prefix+"CLAIM_USERNAME", ""),
+			ClaimAvatar:        getEnvStrOrDefault(prefix+"CLAIM_AVATAR", ""),
+		})
+	}
+
+	return providers, nil
+}
+
 func LoadConfigFromEnv() (*Config, error) {
 	jwtSecret, err := getEnvStrOrError("JWT_SECRET")
 	if err != nil {
@@ -74,24 +228,101 @@ func LoadConfigFromEnv() (*Config, error) {
 		return nil, err
 	}
 
+	// A key of its own, rotating JWT_SECRET must not invalidate every recovery code.
+	recoveryCodeKey, err := getEnvStrOrError("RECOVERY_CODE_KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	oidcIssuer := getEnvStrOrDefault("OIDC_ISSUER", "http://localhost:3003")
+	oauthProviders, err := loadOauthProviders(oidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Relying parties verify ID tokens with the JWKS, a token signed with the shared secret could not be verified by them.
+	oidcClients := getEnvListOrDefault("OIDC_CLIENTS", nil)
+	if len(oidcClients) > 0 && getEnvStrOrDefault("JWT_SIGNING_KEY_FILE", "") == "" {
+		return nil, fmt.Errorf("OIDC_CLIENTS needs JWT_SIGNING_KEY_FILE, ID tokens are signed with an RS256 or EdDSA key")
+	}
+
+	// Once a signing key is configured, tokens signed with the shared secret are only accepted until this time.
+	var jwtSecretAcceptedUntil time.Time
+	if value := getEnvStrOrDefault("JWT_SECRET_ACCEPTED_UNTIL", ""); value != "" {
+		jwtSecretAcceptedUntil, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_SECRET_ACCEPTED_UNTIL must be an RFC 3339 time, err: %w", err)
+		}
+	}
+
 	return &Config{
 		GinMode:                         getEnvStrOrDefault("GIN_MODE", "debug"),
 		DbAddress:                       getEnvStrOrDefault("DB_ADDRESS", "data/auth_service_db.sqlite"),
 		JwtSecret:                       jwtSecret,
+		JwtSigningKeyFile:               getEnvStrOrDefault("JWT_SIGNING_KEY_FILE", ""),
+		JwtVerificationKeyFiles:         getEnvListOrDefault("JWT_VERIFICATION_KEY_FILES", nil),
+		JwtSecretAcceptedUntil:          jwtSecretAcceptedUntil,
 		UserTokenExpiry:                 getEnvIntOrDefault("USER_TOKEN_EXPIRY", 3600),
 		OauthStateTokenExpiry:           getEnvIntOrDefault("OAUTH_STATE_TOKEN_EXPIRY", 600),
 		GoogleClientId:                  GoogleClientId,
 		GoogleClientSecret:              GoogleClientSecret,
 		GoogleRedirectUri:               getEnvStrOrDefault("GOOGLE_REDIRECT_URI", "test-google-redirect-uri"),
 		FrontendUrl:                     getEnvStrOrDefault("FRONTEND_URL", "http://localhost:5173"),
-		TwoFaUrlPrefix:                  getEnvStrOrDefault("TWO_FA_URL_PREFIX", "otpauth://totp/Transcendence?secret="),
+		TwoFaIssuer:                     getEnvStrOrDefault("TWO_FA_ISSUER", "Transcendence"),
+		TwoFaDigits:                     getEnvIntOrDefault("TWO_FA_DIGITS", 6),
+		TwoFaPeriod:                     getEnvIntOrDefault("TWO_FA_PERIOD", 30),
+		TwoFaAlgorithm:                  getEnvStrOrDefault("TWO_FA_ALGORITHM", "SHA1"),
+		TwoFaSkew:                       getEnvIntOrDefault("TWO_FA_SKEW", 1),
 		TwoFaTokenExpiry:                getEnvIntOrDefault("TWO_FA_TOKEN_EXPIRY", 600),
+		TwoFaMaxAttempts:                getEnvIntOrDefault("TWO_FA_MAX_ATTEMPTS", 5),
+		TwoFaEmailMaxSends:              getEnvIntOrDefault("TWO_FA_EMAIL_MAX_SENDS", 5),
+		TwoFaEmailResendCooldown:        getEnvIntOrDefault("TWO_FA_EMAIL_RESEND_COOLDOWN", 60),
+		TrustedDeviceExpiry:             getEnvIntOrDefault("TRUSTED_DEVICE_EXPIRY", 2592000),
 		RedisURL:                        getEnvStrOrDefault("REDIS_URL", ""),
 		IsRedisEnabled:                  getEnvStrOrDefault("REDIS_URL", "") != "",
 		UserTokenAbsoluteExpiry:         getEnvIntOrDefault("USER_TOKEN_ABSOLUTE_EXPIRY", 2592000),
+		RefreshTokenExpiry:              getEnvIntOrDefault("REFRESH_TOKEN_EXPIRY", 604800),
+		OidcIssuer:                      oidcIssuer,
+		OidcClients:                     oidcClients,
+		OidcCodeExpiry:                  getEnvIntOrDefault("OIDC_CODE_EXPIRY", 60),
+		LoginCodeExpiry:                 getEnvIntOrDefault("LOGIN_CODE_EXPIRY", 30),
+		ReauthMaxAge:                    getEnvIntOrDefault("REAUTH_MAX_AGE", 300),
+		AccountDeletionGracePeriodInSec: getEnvIntOrDefault("ACCOUNT_DELETION_GRACE_PERIOD_IN_SECONDS", 2592000),
+		AccountPurgeIntervalInSec:       getEnvIntOrDefault("ACCOUNT_PURGE_INTERVAL_IN_SECONDS", 3600),
+		ServiceTokenExpiry:              getEnvIntOrDefault("SERVICE_TOKEN_EXPIRY", 3600),
 		Port:                            getEnvIntOrDefault("PORT", 3003),
 		RateLimiterDurationInSec:        getEnvIntOrDefault("RATE_LIMITER_DURATION_IN_SECONDS", 60),
 		RateLimiterRequestLimit:         getEnvIntOrDefault("RATE_LIMITER_REQUEST_LIMIT", 1000),
 		RateLimiterCleanupIntervalInSec: getEnvIntOrDefault("RATE_LIMITER_CLEANUP_INTERVAL_IN_SECONDS", 300),
+		LoginFreeAttempts:               getEnvIntOrDefault("LOGIN_FREE_ATTEMPTS", 3),
+		LoginMaxAttempts:                getEnvIntOrDefault("LOGIN_MAX_ATTEMPTS", 10),
+		LoginMaxAttemptsPerIP:           getEnvIntOrDefault("LOGIN_MAX_ATTEMPTS_PER_IP", 100),
+		LoginBackoffBaseInSec:           getEnvIntOrDefault("LOGIN_BACKOFF_BASE_IN_SECONDS", 1),
+		LoginLockoutDurationInSec:       getEnvIntOrDefault("LOGIN_LOCKOUT_DURATION_IN_SECONDS", 900),
+		PasswordHashAlgorithm:           getEnvStrOrDefault("PASSWORD_HASH_ALGORITHM", "argon2id"),
+		Argon2MemoryKiB:                 getEnvIntOrDefault("ARGON2_MEMORY_KIB", 19456),
+		Argon2Iterations:                getEnvIntOrDefault("ARGON2_ITERATIONS", 2),
+		Argon2Parallelism:               getEnvIntOrDefault("ARGON2_PARALLELISM", 1),
+		BcryptCost:                      getEnvIntOrDefault("BCRYPT_COST", 10),
+		PasswordPepper:                  getEnvStrOrDefault("PASSWORD_PEPPER", ""),
+		PasswordPreviousPeppers:         getEnvListOrDefault("PASSWORD_PREVIOUS_PEPPERS", nil),
+		RecoveryCodeKey:                 recoveryCodeKey,
+		PasswordMinLength:               getEnvIntOrDefault("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxLength:               getEnvIntOrDefault("PASSWORD_MAX_LENGTH", 128),
+		PasswordBlocklistFile:           getEnvStrOrDefault("PASSWORD_BLOCKLIST_FILE", ""),
+		PasswordMinStrength:             getEnvIntOrDefault("PASSWORD_MIN_STRENGTH", 0),
+		BreachedPasswordCheck:           getEnvStrOrDefault("BREACHED_PASSWORD_CHECK", "false") == "true",
+		BreachedPasswordsFile:           getEnvStrOrDefault("BREACHED_PASSWORDS_FILE", ""),
+		PasswordResetTokenExpiry:        getEnvIntOrDefault("PASSWORD_RESET_TOKEN_EXPIRY", 3600),
+		EmailVerificationTokenExpiry:    getEnvIntOrDefault("EMAIL_VERIFICATION_TOKEN_EXPIRY", 86400),
+		EmailVerificationPolicy:         getEnvStrOrDefault("EMAIL_VERIFICATION_POLICY", "none"),
+		MailerDriver:                    getEnvStrOrDefault("MAILER_DRIVER", "stdout"),
+		MailFrom:                        getEnvStrOrDefault("MAIL_FROM", "Transcendence <no-reply@localhost>"),
+		MailFilePath:                    getEnvStrOrDefault("MAIL_FILE_PATH", "data/mail.log"),
+		SmtpHost:                        getEnvStrOrDefault("SMTP_HOST", ""),
+		SmtpPort:                        getEnvIntOrDefault("SMTP_PORT", 587),
+		SmtpUsername:                    getEnvStrOrDefault("SMTP_USERNAME", ""),
+		SmtpPassword:                    getEnvStrOrDefault("SMTP_PASSWORD", ""),
+		OauthProviders:                  oauthProviders,
 	}, nil
 }
@@ -148,10 +148,37 @@ func TestGetEnvStrOrError(t *testing.T) {
 	}
 }
 
+func TestGetEnvListOrDefault(t *testing.T) {
+	defaultValue := []string{"d"}
+
+	testCases := []struct {
+		name     string
+		envValue string
+		expected []string
+	}{
+		{name: "single item", envValue: "a.pem", expected: []string{"a.pem"}},
+		{name: "several items", envValue: "a.pem, b.pem,,c.pem ", expected: []string{"a.pem", "b.pem", "c.pem"}},
+		{name: "empty env string", envValue: "", expected: defaultValue},
+		{name: "env not set", envValue: notSet, expected: defaultValue},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnv(t, tc.envValue)
+
+			got := getEnvListOrDefault(testKey, defaultValue)
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
 var mandatoryItems = []string{
 	"JWT_SECRET",
 	"GOOGLE_CLIENT_ID",
 	"GOOGLE_CLIENT_SECRET",
+	"RECOVERY_CODE_KEY",
 }
 
 func setEnvForMandatoryItem(t *testing.T, keys []string) {
@@ -214,3 +241,98 @@ func TestLoadConfigFromEnv_MissingMandatory(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfigFromEnv_OidcNeedsSigningKey(t *testing.T) {
+	setEnvForMandatoryItem(t, mandatoryItems)
+	t.Setenv("OIDC_CLIENTS", "app=https://app.example.com/callback")
+
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected an error without a signing key")
+	}
+
+	t.Setenv("JWT_SIGNING_KEY_FILE", "keys/signing.pem")
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if len(cfg.OidcClients) != 1 {
+		t.Fatalf("expected one client, got %v", cfg.OidcClients)
+	}
+}
+
+func TestLoadConfigFromEnv_JwtSecretAcceptedUntil(t *testing.T) {
+	setEnvForMandatoryItem(t, mandatoryItems)
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if !cfg.JwtSecretAcceptedUntil.IsZero() {
+		t.Fatalf("expected no transition by default, got %v", cfg.JwtSecretAcceptedUntil)
+	}
+
+	t.Setenv("JWT_SECRET_ACCEPTED_UNTIL", "2026-01-02T15:04:05Z")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if cfg.JwtSecretAcceptedUntil.Unix() != 1767366245 {
+		t.Fatalf("unexpected transition end: %v", cfg.JwtSecretAcceptedUntil)
+	}
+
+	t.Setenv("JWT_SECRET_ACCEPTED_UNTIL", "tomorrow")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Fatalf("expected an error for an invalid time")
+	}
+}
+
+func TestLoadOauthProviders(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("OAUTH_PROVIDERS", "GitHub, my-idp")
+		t.Setenv("OAUTH_GITHUB_CLIENT_ID", "gh-id")
+		t.Setenv("OAUTH_GITHUB_CLIENT_SECRET", "gh-secret")
+		t.Setenv("OAUTH_MY_IDP_CLIENT_ID", "idp-id")
+		t.Setenv("OAUTH_MY_IDP_CLIENT_SECRET", "idp-secret")
+		t.Setenv("OAUTH_MY_IDP_TYPE", "oidc")
+		t.Setenv("OAUTH_MY_IDP_SCOPES", "openid,email")
+
+		providers, err := loadOauthProviders("http://localhost:3003")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(providers) != 2 {
+			t.Fatalf("expected 2 providers, got %v", providers)
+		}
+
+		github := providers[0]
+		if github.Name != "github" || github.Type != "github" || github.ClientID != "gh-id" {
+			t.Fatalf("unexpected github config %+v", github)
+		}
+		if github.RedirectURI != "http://localhost:3003/api/users/oauth/github/callback" {
+			t.Fatalf("unexpected redirect uri %s", github.RedirectURI)
+		}
+
+		idp := providers[1]
+		if idp.Type != "oidc" || idp.ClientSecret != "idp-secret" || fmt.Sprint(idp.Scopes) != "[openid email]" {
+			t.Fatalf("unexpected my-idp config %+v", idp)
+		}
+	})
+
+	t.Run("missing client secret", func(t *testing.T) {
+		t.Setenv("OAUTH_PROVIDERS", "github")
+		t.Setenv("OAUTH_GITHUB_CLIENT_ID", "gh-id")
+		t.Setenv("OAUTH_GITHUB_CLIENT_SECRET", "")
+
+		if _, err := loadOauthProviders("http://localhost:3003"); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("google is not a generic provider", func(t *testing.T) {
+		t.Setenv("OAUTH_PROVIDERS", "google")
+
+		if _, err := loadOauthProviders("http://localhost:3003"); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
@@ -19,10 +19,31 @@ func GetDB(dbName string, logger *slog.Logger) (*gorm.DB, error) {
 
 	db.Exec("PRAGMA foreign_keys = ON")
 
+	if err := migrateTwoFATokens(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate 2fa tokens: %w", err)
+	}
+
+	// Checked before the column is added, the backfill must only run once.
+	backfillEmailVerified := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "email_verified_at")
+
 	for _, model := range []any{
 		&User{},
+		&UserIdentity{},
+		&ServiceClient{},
 		&Friend{},
 		&Token{},
+		&RefreshToken{},
+		&PasswordResetToken{},
+		&EmailVerificationToken{},
+		&RecoveryCode{},
+		&OidcAuthorizationCode{},
+		&LoginCode{},
+		&OauthFlow{},
+		&EmailOtp{},
+		&TrustedDevice{},
+		&UsedTotpCode{},
+		&TwoFASession{},
+		&LoginAttempt{},
 		&HeartBeat{},
 	} {
 		if err := db.AutoMigrate(model); err != nil {
@@ -30,11 +51,69 @@ func GetDB(dbName string, logger *slog.Logger) (*gorm.DB, error) {
 		}
 	}
 
+	if err := migrateGoogleOauthIDs(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate google oauth ids: %w", err)
+	}
+
+	if backfillEmailVerified {
+		if err := migrateEmailVerifiedAt(db); err != nil {
+			return nil, fmt.Errorf("failed to migrate email verification: %w", err)
+		}
+	}
+
 	logger.Info("connected to db")
 
 	return db, nil
 }
 
+// migrateGoogleOauthIDs moves the google_oauth_id column of users, from before linked identities, into user_identities.
+func migrateGoogleOauthIDs(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&User{}, "google_oauth_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`INSERT INTO user_identities (created_at, updated_at, user_id, provider, subject, email, linked_at, profile)
+			SELECT CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, id, 'google', google_oauth_id, email, created_at, '{}'
+			FROM users WHERE google_oauth_id IS NOT NULL AND google_oauth_id != ''`).Error
+		if err != nil {
+			return err
+		}
+
+		// SQLite refuses to drop an indexed column, and a migrator DropColumn would recreate the users table.
+		if tx.Migrator().HasIndex(&User{}, "idx_users_google_oauth_id") {
+			if err := tx.Migrator().DropIndex(&User{}, "idx_users_google_oauth_id"); err != nil {
+				return err
+			}
+		}
+
+		return tx.Exec("ALTER TABLE users DROP COLUMN google_oauth_id").Error
+	})
+}
+
+// migrateEmailVerifiedAt treats the emails of users from before email verification as verified since their registration,
+// so EMAIL_VERIFICATION_POLICY does not lock them out.
+func migrateEmailVerifiedAt(db *gorm.DB) error {
+	return db.Exec("UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL").Error
+}
+
+// migrateTwoFATokens renames the two_fa_token column of users, from before email 2FA, to totp_secret.
+// The column held the secret of an unconfirmed setup with a "pre-" prefix, the setup token carries it now.
+func migrateTwoFATokens(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&User{}) || !db.Migrator().HasColumn(&User{}, "two_fa_token") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("UPDATE users SET two_fa_token = NULL WHERE two_fa_token = '' OR two_fa_token LIKE 'pre-%'").Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec("ALTER TABLE users RENAME COLUMN two_fa_token TO totp_secret").Error
+	})
+}
+
 func CloseDB(db *gorm.DB, logger *slog.Logger) {
 	sqlDB, err := db.DB()
 	if err != nil {
@@ -55,9 +134,23 @@ func ResetDB(db *gorm.DB, logger *slog.Logger) {
 	ctx := context.Background()
 	tables := []string{
 		"heart_beats",
+		"password_reset_tokens",
+		"email_verification_tokens",
+		"recovery_codes",
+		"oidc_authorization_codes",
+		"login_codes",
+		"oauth_flows",
+		"email_otps",
+		"trusted_devices",
+		"used_totp_codes",
+		"two_fa_sessions",
+		"login_attempts",
+		"refresh_tokens",
 		"tokens",
 		"friends",
+		"user_identities",
 		"users",
+		"service_clients",
 	}
 
 	for _, table := range tables {
@@ -0,0 +1,211 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// legacyUser is the users table from before linked identities.
+type legacyUser struct {
+	gorm.Model
+
+	Username      string  `gorm:"uniqueIndex;not null"`
+	Email         string  `gorm:"uniqueIndex;not null"`
+	GoogleOauthID *string `gorm:"uniqueIndex"`
+}
+
+func (legacyUser) TableName() string {
+	return "users"
+}
+
+func TestGetDB_MigratesGoogleOauthIDs(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "legacy.sqlite")
+
+	legacyDB, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open legacy db, err: %v", err)
+	}
+	if err := legacyDB.AutoMigrate(&legacyUser{}, &db.Token{}); err != nil {
+		t.Fatalf("failed to migrate legacy db, err: %v", err)
+	}
+	googleID := "gid-legacy"
+	users := []legacyUser{
+		{Username: "googler", Email: "googler@example.com", GoogleOauthID: &googleID},
+		{Username: "local", Email: "local@example.com"},
+	}
+	if err := legacyDB.Create(&users).Error; err != nil {
+		t.Fatalf("failed to create legacy users, err: %v", err)
+	}
+	if err := legacyDB.Create(&db.Token{UserID: users[0].ID, Token: "session"}).Error; err != nil {
+		t.Fatalf("failed to create legacy token, err: %v", err)
+	}
+	sqlDB, _ := legacyDB.DB()
+	_ = sqlDB.Close()
+
+	myDB, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to migrate db, err: %v", err)
+	}
+	t.Cleanup(func() { db.CloseDB(myDB, testutil.NewTestLogger()) })
+
+	if myDB.Migrator().HasColumn(&db.User{}, "google_oauth_id") {
+		t.Fatalf("expected google_oauth_id to be dropped")
+	}
+
+	identities, err := gorm.G[db.UserIdentity](myDB).Find(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load identities, err: %v", err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("expected 1 identity, got %d", len(identities))
+	}
+	identity := identities[0]
+	if identity.UserID != users[0].ID || identity.Provider != "google" || identity.Subject != googleID || identity.Email != "googler@example.com" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	if identity.LinkedAt.IsZero() {
+		t.Fatalf("expected linked at to be set")
+	}
+
+	// The users table is altered in place, rows pointing at it survive.
+	tokens, err := gorm.G[db.Token](myDB).Where("user_id = ?", users[0].ID).Count(context.Background(), "id")
+	if err != nil || tokens != 1 {
+		t.Fatalf("expected the session to survive the migration, got %d, err: %v", tokens, err)
+	}
+
+	// A second start has nothing left to migrate.
+	again, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to reopen db, err: %v", err)
+	}
+	db.CloseDB(again, testutil.NewTestLogger())
+}
+
+// legacyTwoFAUser is the users table from before email 2FA, with the overloaded two_fa_token.
+type legacyTwoFAUser struct {
+	gorm.Model
+
+	Username   string `gorm:"uniqueIndex;not null"`
+	Email      string `gorm:"uniqueIndex;not null"`
+	TwoFAToken *string
+}
+
+func (legacyTwoFAUser) TableName() string {
+	return "users"
+}
+
+func TestGetDB_MigratesTwoFATokens(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "legacy.sqlite")
+
+	legacyDB, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open legacy db, err: %v", err)
+	}
+	if err := legacyDB.AutoMigrate(&legacyTwoFAUser{}); err != nil {
+		t.Fatalf("failed to migrate legacy db, err: %v", err)
+	}
+	enabled := "JBSWY3DPEHPK3PXP"
+	pending := "pre-JBSWY3DPEHPK3PXP"
+	users := []legacyTwoFAUser{
+		{Username: "enabled", Email: "enabled@example.com", TwoFAToken: &enabled},
+		{Username: "pending", Email: "pending@example.com", TwoFAToken: &pending},
+		{Username: "none", Email: "none@example.com"},
+	}
+	if err := legacyDB.Create(&users).Error; err != nil {
+		t.Fatalf("failed to create legacy users, err: %v", err)
+	}
+	sqlDB, _ := legacyDB.DB()
+	_ = sqlDB.Close()
+
+	myDB, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to migrate db, err: %v", err)
+	}
+	t.Cleanup(func() { db.CloseDB(myDB, testutil.NewTestLogger()) })
+
+	if myDB.Migrator().HasColumn(&db.User{}, "two_fa_token") {
+		t.Fatalf("expected two_fa_token to be renamed")
+	}
+
+	migrated, err := gorm.G[db.User](myDB).Order("id").Find(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load users, err: %v", err)
+	}
+	if len(migrated) != 3 {
+		t.Fatalf("expected 3 users, got %d", len(migrated))
+	}
+	if migrated[0].TotpSecret == nil || *migrated[0].TotpSecret != enabled {
+		t.Fatalf("expected the confirmed secret to be kept, got %v", migrated[0].TotpSecret)
+	}
+	// An unconfirmed setup is dropped, its setup token still carries the secret.
+	if migrated[1].TotpSecret != nil || migrated[2].TotpSecret != nil {
+		t.Fatalf("expected no secret for pending and disabled users")
+	}
+	for _, user := range migrated {
+		if user.EmailOtpEnabled {
+			t.Fatalf("expected email 2FA to start disabled")
+		}
+	}
+
+	again, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to reopen db, err: %v", err)
+	}
+	db.CloseDB(again, testutil.NewTestLogger())
+}
+
+func TestGetDB_MigratesEmailVerifiedAt(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "legacy.sqlite")
+
+	legacyDB, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open legacy db, err: %v", err)
+	}
+	if err := legacyDB.AutoMigrate(&legacyTwoFAUser{}); err != nil {
+		t.Fatalf("failed to migrate legacy db, err: %v", err)
+	}
+	if err := legacyDB.Create(&legacyTwoFAUser{Username: "old", Email: "old@example.com"}).Error; err != nil {
+		t.Fatalf("failed to create legacy user, err: %v", err)
+	}
+	sqlDB, _ := legacyDB.DB()
+	_ = sqlDB.Close()
+
+	myDB, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to migrate db, err: %v", err)
+	}
+
+	old, err := gorm.G[db.User](myDB).Where("username = ?", "old").First(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load user, err: %v", err)
+	}
+	if old.EmailVerifiedAt == nil || !old.EmailVerifiedAt.Equal(old.CreatedAt) {
+		t.Fatalf("expected the existing user to count as verified since registration, got %v", old.EmailVerifiedAt)
+	}
+
+	// Users registered after the migration verify their email, reopening does not backfill them.
+	if err := gorm.G[db.User](myDB).Create(context.Background(), &db.User{Username: "new", Email: "new@example.com"}); err != nil {
+		t.Fatalf("failed to create user, err: %v", err)
+	}
+	db.CloseDB(myDB, testutil.NewTestLogger())
+
+	again, err := db.GetDB(dbName, testutil.NewTestLogger())
+	if err != nil {
+		t.Fatalf("failed to reopen db, err: %v", err)
+	}
+	t.Cleanup(func() { db.CloseDB(again, testutil.NewTestLogger()) })
+
+	newUser, err := gorm.G[db.User](again).Where("username = ?", "new").First(context.Background())
+	if err != nil {
+		t.Fatalf("failed to load user, err: %v", err)
+	}
+	if newUser.EmailVerifiedAt != nil {
+		t.Fatalf("expected the new user to stay unverified")
+	}
+}
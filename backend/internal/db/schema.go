@@ -9,12 +9,44 @@ import (
 type User struct {
 	gorm.Model
 
-	Username      string `gorm:"uniqueIndex;not null"`
-	Email         string `gorm:"uniqueIndex;not null"`
-	PasswordHash  *string
-	Avatar        *string
-	GoogleOauthID *string `gorm:"uniqueIndex"`
-	TwoFAToken    *string
+	Username        string `gorm:"uniqueIndex;not null"`
+	Email           string `gorm:"uniqueIndex;not null"`
+	EmailVerifiedAt *time.Time
+	PasswordHash    *string
+	Avatar          *string
+	TotpSecret      *string // Set once the authenticator is confirmed
+	TotpDigits      int     // The parameters the authenticator was set up with, zero for the legacy defaults
+	TotpPeriod      int
+	TotpAlgorithm   string
+	EmailOtpEnabled bool `gorm:"not null;default:false"`
+
+	Identities []UserIdentity `gorm:"foreignKey:UserID"`
+}
+
+// UserIdentity is the account of a user at an external login provider, Google or one of OAUTH_PROVIDERS.
+// A user has at most one account per provider.
+type UserIdentity struct {
+	gorm.Model
+
+	UserID   uint      `gorm:"not null;uniqueIndex:idx_user_identities_user_provider"`
+	Provider string    `gorm:"not null;uniqueIndex:idx_user_identities_user_provider;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject  string    `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Email    string    `gorm:"not null"`
+	LinkedAt time.Time `gorm:"not null"`
+	Profile  string    `gorm:"not null"` // JSON snapshot of the provider profile, refreshed on every login
+
+	AuthenticatedAt *time.Time // Last login or re-authentication with the provider
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// ServiceClient is a backend service that authenticates as itself, instead of borrowing a user token.
+type ServiceClient struct {
+	gorm.Model
+
+	ClientID   string `gorm:"uniqueIndex;not null"`
+	Name       string `gorm:"not null"`
+	SecretHash string `gorm:"not null"`
 }
 
 type Friend struct {
@@ -31,9 +63,155 @@ type Token struct {
 	UserID uint   `gorm:"not null;index"`
 	Token  string `gorm:"uniqueIndex;not null"`
 
+	// Session metadata, a token row lives as long as the login, its access token is replaced on refresh.
+	LastUsedAt  time.Time
+	ClientIP    string
+	UserAgent   string
+	DeviceLabel string
+
+	ReauthenticatedAt *time.Time // Last step-up re-authentication in this session
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+type RefreshToken struct {
+	gorm.Model
+
+	UserID    uint      `gorm:"not null;index"`
+	TokenID   uint      `gorm:"not null;index"` // The login (token family) this refresh token belongs to
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+
+	User  User  `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Token Token `gorm:"foreignKey:TokenID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+type PasswordResetToken struct {
+	gorm.Model
+
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// EmailVerificationToken proves the ownership of Email, it stops working once the user changes their email.
+type EmailVerificationToken struct {
+	gorm.Model
+
+	UserID    uint      `gorm:"not null;index"`
+	Email     string    `gorm:"not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// OidcAuthorizationCode is a single-use code of the OIDC authorization code flow.
+type OidcAuthorizationCode struct {
+	gorm.Model
+
+	UserID        uint   `gorm:"not null;index"`
+	CodeHash      string `gorm:"uniqueIndex;not null"`
+	ClientID      string `gorm:"not null"`
+	RedirectURI   string `gorm:"not null"`
+	Scope         string `gorm:"not null"`
+	Nonce         string
+	CodeChallenge string    `gorm:"not null"`
+	ExpiresAt     time.Time `gorm:"not null"`
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// RecoveryCode lets a user with 2FA log in once without their authenticator.
+type RecoveryCode struct {
+	gorm.Model
+
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null"`
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// LoginCode hands a finished OAuth login over to the frontend, which redeems it once for the tokens.
+type LoginCode struct {
+	gorm.Model
+
+	UserID    uint      `gorm:"not null;index"`
+	CodeHash  string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// OauthFlow is a round trip with Google or another provider in progress, consumed by its callback so a state only works once.
+type OauthFlow struct {
+	gorm.Model
+
+	StateHash    string    `gorm:"uniqueIndex;not null"`
+	BindingHash  string    `gorm:"not null"` // The cookie of the browser that started the round trip
+	CodeVerifier string    `gorm:"not null"`
+	Nonce        string    `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"not null"`
+}
+
+// EmailOtp is the code emailed for the 2FA step of one login, it belongs to the session token of that login.
+type EmailOtp struct {
+	gorm.Model
+
+	UserID      uint      `gorm:"not null;index"`
+	SessionHash string    `gorm:"uniqueIndex;not null"`
+	CodeHash    string    `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"not null"`
+
 	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
 }
 
+// TrustedDevice is a browser that logs in without the 2FA code, it holds the device ID in a signed cookie.
+type TrustedDevice struct {
+	gorm.Model
+
+	UserID     uint      `gorm:"not null;index"`
+	DeviceHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+
+	LastUsedAt  time.Time
+	ClientIP    string
+	UserAgent   string
+	DeviceLabel string
+
+	User User `gorm:"foreignKey:UserID;references:ID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+// UsedTotpCode remembers a time step of a TOTP secret that was already used, until its code expires.
+type UsedTotpCode struct {
+	gorm.Model
+
+	CodeKey   string    `gorm:"uniqueIndex;not null"` // Hash of the secret and the time step
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// TwoFASession counts the codes submitted with one 2FA session token, right or wrong.
+type TwoFASession struct {
+	gorm.Model
+
+	Jti       string    `gorm:"uniqueIndex;not null"`
+	Attempts  int       `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// LoginAttempt counts the recent failed logins of one identifier or one IP.
+type LoginAttempt struct {
+	gorm.Model
+
+	CounterKey    string    `gorm:"uniqueIndex;not null"`
+	Failures      int       `gorm:"not null"`
+	LastFailureAt time.Time `gorm:"not null"`
+	BlockedUntil  time.Time
+}
+
 type HeartBeat struct {
 	gorm.Model
 
@@ -1,27 +1,44 @@
 package dependency
 
 import (
+	"context"
 	"log/slog"
 
 	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwks"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
 type Dependency struct {
-	Cfg    *config.Config
-	DB     *gorm.DB
-	Redis  *redis.Client
-	Logger *slog.Logger
+	Cfg            *config.Config
+	DB             *gorm.DB
+	Redis          *redis.Client
+	Logger         *slog.Logger
+	Keys           *jwks.KeySet
+	Mailer         mailer.Mailer
+	OauthProviders map[string]*oauth.Provider
+	Passwords      password.Hasher
+	PasswordPolicy *password.Policy
+	// Nil when BREACHED_PASSWORD_CHECK is off
+	BreachedPasswords password.BreachedPasswords
 }
 
 func NewDependency(cfg *config.Config, db *gorm.DB, redis *redis.Client, logger *slog.Logger) *Dependency {
 	return &Dependency{
-		Cfg:    cfg,
-		DB:     db,
-		Redis:  redis,
-		Logger: logger,
+		Cfg:            cfg,
+		DB:             db,
+		Redis:          redis,
+		Logger:         logger,
+		Keys:           jwks.NewKeySet(),
+		Mailer:         mailer.NewMemoryMailer(),
+		OauthProviders: map[string]*oauth.Provider{},
+		Passwords:      password.NewDefaultHasher(),
+		PasswordPolicy: password.NewDefaultPolicy(),
 	}
 }
 
@@ -41,7 +58,45 @@ func InitDependency(logger *slog.Logger) (*Dependency, error) {
 		return nil, err
 	}
 
-	return NewDependency(cfg, myDB, redis, logger), nil
+	keys, err := jwks.LoadKeySet(cfg.JwtSigningKeyFile, cfg.JwtVerificationKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	oauthProviders, err := oauth.LoadProviders(context.Background(), cfg.OauthProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	passwords, err := password.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordPolicy, err := password.NewPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	breachedPasswords, err := password.LoadBreachedPasswords(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dep := NewDependency(cfg, myDB, redis, logger)
+	dep.Keys = keys
+	dep.Mailer = mail
+	dep.OauthProviders = oauthProviders
+	dep.Passwords = passwords
+	dep.PasswordPolicy = passwordPolicy
+	dep.BreachedPasswords = breachedPasswords
+
+	return dep, nil
 }
 
 func CloseDependency(dep *Dependency) {
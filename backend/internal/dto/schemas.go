@@ -27,11 +27,10 @@ func InitValidator() {
 
 	_ = Validate.RegisterValidation("trim", trimValue) // SIDE EFFECT: trims the value
 	_ = Validate.RegisterValidation("username", validateUsername)
-	_ = Validate.RegisterValidation("password", validatePassword)
 	_ = Validate.RegisterValidation("identifier", validateIdentifier)
-	Validate.RegisterAlias("passwordField", "required,trim,min=6,max=20,password")
+	// Any characters, the rules for new passwords are in the password policy of the service
+	Validate.RegisterAlias("passwordField", "required,max=128")
 	registerUsernameTranslation(Validate, Trans)
-	registerPasswordTranslation(Validate, Trans)
 	registerIdentifierTranslation(Validate, Trans)
 }
 
@@ -92,33 +91,6 @@ type NewPassword struct {
 	NewPassword string `json:"newPassword" validate:"passwordField"`
 }
 
-// Contains only letters, numbers, ".", "_" or "-"
-var passwordRegex = regexp.MustCompile(`^[A-Za-z0-9,.#$%@^;|_!*&?]+$`)
-
-func validatePassword(fl validator.FieldLevel) bool {
-	password := fl.Field().String()
-
-	return passwordRegex.MatchString(password)
-}
-
-func registerPasswordTranslation(v *validator.Validate, trans ut.Translator) {
-	_ = v.RegisterTranslation(
-		"password",
-		trans,
-		func(ut ut.Translator) error {
-			return ut.Add(
-				"password",
-				"password may only contain letters, numbers, and the following symbols: ,.#$%@^;|_!*&?",
-				true,
-			)
-		},
-		func(ut ut.Translator, fe validator.FieldError) string {
-			msg, _ := ut.T("password")
-			return msg
-		},
-	)
-}
-
 // Identifier
 type Identifier struct {
 	Identifier string `json:"identifier" validate:"required,trim,min=3,max=100,identifier"` // username or email
@@ -179,9 +151,15 @@ type UpdateUserPasswordRequest struct {
 	NewPassword
 }
 
+// For users without a password yet, who proved themselves with a recent OAuth login instead
+type SetUserPasswordRequest struct {
+	NewPassword
+}
+
 type LoginUserRequest struct {
 	Identifier
 	Password
+	TrustedDeviceToken string `json:"-"` // From the trusted device cookie
 }
 
 type UpdateUserRequest struct {
@@ -193,30 +171,109 @@ type UsernameRequest struct {
 }
 
 type UserWithTokenResponse struct {
-	ID            uint    `json:"id"`
-	Username      string  `json:"username"`
-	Email         string  `json:"email"`
-	Avatar        *string `json:"avatar"`
-	TwoFA         bool    `json:"twoFa"`
-	GoogleOauthId *string `json:"googleOauthId,omitempty"`
-	CreatedAt     int64   `json:"createdAt"`
-	Token         string  `json:"token"`
+	ID              uint     `json:"id"`
+	Username        string   `json:"username"`
+	Email           string   `json:"email"`
+	Avatar          *string  `json:"avatar"`
+	TwoFA           bool     `json:"twoFa"`
+	TwoFAMethods    []string `json:"twoFaMethods"`
+	GoogleOauthId   *string  `json:"googleOauthId,omitempty"`
+	LinkedProviders []string `json:"linkedProviders"`
+	EmailVerified   bool     `json:"emailVerified"`
+	CreatedAt       int64    `json:"createdAt"`
+	Token           string   `json:"token"`
+	RefreshToken    string   `json:"refreshToken"`
 }
 
 type UserWithoutTokenResponse struct {
-	ID            uint    `json:"id"`
-	Username      string  `json:"username"`
-	Email         string  `json:"email"`
-	Avatar        *string `json:"avatar"`
-	TwoFA         bool    `json:"twoFa"`
-	GoogleOauthId *string `json:"googleOauthId,omitempty"`
-	CreatedAt     int64   `json:"createdAt"`
+	ID              uint     `json:"id"`
+	Username        string   `json:"username"`
+	Email           string   `json:"email"`
+	Avatar          *string  `json:"avatar"`
+	TwoFA           bool     `json:"twoFa"`
+	TwoFAMethods    []string `json:"twoFaMethods"`
+	GoogleOauthId   *string  `json:"googleOauthId,omitempty"`
+	LinkedProviders []string `json:"linkedProviders"`
+	EmailVerified   bool     `json:"emailVerified"`
+	CreatedAt       int64    `json:"createdAt"`
 }
 
 type UsersResponse struct {
 	Users []SimpleUser `json:"users"`
 }
 
+// For password reset
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,trim,email,max=100"`
+}
+
+type ResetPasswordRequest struct {
+	Token string `json:"token" validate:"required"`
+	NewPassword
+}
+
+// For email verification
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationEmailRequest struct {
+	Email string `json:"email" validate:"required,trim,email,max=100"`
+}
+
+// For Google account linking
+
+type GoogleLinkURLResponse struct {
+	URL string `json:"url"`
+}
+
+type GoogleLinkConfirmRequest struct {
+	LinkToken string `json:"linkToken" validate:"required"`
+	Password
+}
+
+// For the OAuth login handoff
+
+type LoginCodeRequest struct {
+	Code               string `json:"code" validate:"required"`
+	TrustedDeviceToken string `json:"-"` // From the trusted device cookie
+}
+
+// For external login providers
+
+type OauthProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+type OauthLinkURLResponse struct {
+	URL string `json:"url"`
+}
+
+// For token refresh
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+type RefreshTokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// For sessions
+
+type SessionResponse struct {
+	ID          string `json:"id"`
+	DeviceLabel string `json:"deviceLabel"`
+	ClientIP    string `json:"clientIp"`
+	UserAgent   string `json:"userAgent"`
+	CreatedAt   int64  `json:"createdAt"`
+	LastUsedAt  int64  `json:"lastUsedAt"`
+	Current     bool   `json:"current"`
+}
+
 // For 2FA
 
 type SetTwoFARequest struct {
@@ -228,24 +285,84 @@ type DisableTwoFARequest struct {
 }
 
 type TwoFAConfirmRequest struct {
-	TwoFACode  string `json:"twoFaCode" validate:"required,len=6,numeric"`
+	TwoFACode  string `json:"twoFaCode" validate:"required,min=6,max=8,numeric"`
 	SetupToken string `json:"setupToken" validate:"required"`
 }
 
+// TwoFAChallengeRequest takes the code of the authenticator, the emailed code or a recovery code
 type TwoFAChallengeRequest struct {
-	TwoFACode    string `json:"twoFaCode" validate:"required,len=6,numeric"`
+	TwoFACode      string `json:"twoFaCode" validate:"required_without_all=EmailCode RecoveryCode,omitempty,min=6,max=8,numeric"`
+	EmailCode      string `json:"emailCode" validate:"required_without_all=TwoFACode RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode   string `json:"recoveryCode" validate:"required_without_all=TwoFACode EmailCode,omitempty,max=32"`
+	SessionToken   string `json:"sessionToken" validate:"required"`
+	RememberDevice bool   `json:"rememberDevice"` // Skip the 2FA step on this device from now on
+}
+
+type TwoFAChallengeResponse struct {
+	UserWithTokenResponse
+	RecoveryCodesLeft  int    `json:"recoveryCodesLeft"`
+	TrustedDeviceToken string `json:"-"` // Set as a cookie when the device is remembered
+}
+
+type TrustedDeviceResponse struct {
+	ID          string `json:"id"`
+	DeviceLabel string `json:"deviceLabel"`
+	ClientIP    string `json:"clientIp"`
+	UserAgent   string `json:"userAgent"`
+	CreatedAt   int64  `json:"createdAt"`
+	LastUsedAt  int64  `json:"lastUsedAt"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Current     bool   `json:"current"`
+}
+
+// TwoFAConfirmResponse carries the recovery codes when the first 2FA method is turned on, shown this once only
+type TwoFAConfirmResponse struct {
+	UserWithTokenResponse
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+type EnableEmailTwoFARequest struct {
+	Password
+}
+
+type DisableEmailTwoFARequest struct {
+	Password
+}
+
+type TwoFAEmailCodeRequest struct {
 	SessionToken string `json:"sessionToken" validate:"required"`
 }
 
+// ReauthRequest takes the password or a TOTP code, an empty request relies on a recent login with a provider
+type ReauthRequest struct {
+	Password  string `json:"password" validate:"omitempty,max=128"`
+	TwoFACode string `json:"twoFaCode" validate:"omitempty,min=6,max=8,numeric"`
+}
+
+type ReauthResponse struct {
+	ReauthenticatedUntil int64 `json:"reauthenticatedUntil"`
+}
+
+type RegenerateRecoveryCodesRequest struct {
+	Password
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
 type TwoFASetupResponse struct {
 	TwoFASecret string `json:"twoFaSecret" validate:"required"`
 	SetupToken  string `json:"setupToken" validate:"required"`
 	TwoFaUri    string `json:"twoFaUri" validate:"required"`
+	TwoFaQrCode string `json:"twoFaQrCode" validate:"required"` // PNG data URI of the QR code of TwoFaUri
 }
 
 type TwoFAPendingUserResponse struct {
-	Message      string `json:"message"`
-	SessionToken string `json:"sessionToken"`
+	Message      string   `json:"message"`
+	SessionToken string   `json:"sessionToken"`
+	Method       string   `json:"method"`  // Method the code is expected from, "totp" or "email" when the code was emailed
+	Methods      []string `json:"methods"` // Every method the user can pass the step with, besides recovery codes
 }
 
 type AddNewFriendRequest struct {
@@ -271,10 +388,11 @@ type GoogleOauthCallback struct {
 }
 
 type GoogleUserData struct {
-	ID      string  `json:"id"`
-	Email   string  `json:"email"`
-	Name    string  `json:"name"`
-	Picture *string `json:"picture"`
+	ID            string  `json:"id"`
+	Email         string  `json:"email"`
+	EmailVerified bool    `json:"email_verified"`
+	Name          string  `json:"name"`
+	Picture       *string `json:"picture"`
 }
 
 type GoogleJwtPayload struct {
@@ -299,14 +417,29 @@ type UserJwtPayload struct {
 }
 
 type OauthStateJwtPayload struct {
-	Type string `json:"type"` // must be "GoogleOAuthState"
+	UserID   uint   `json:"userId,omitempty"`   // set when a logged in user links their account
+	Provider string `json:"provider,omitempty"` // set for the providers of OAUTH_PROVIDERS
+	Reauth   bool   `json:"reauth,omitempty"`   // set when a logged in user re-authenticates with their linked account
+	Session  string `json:"session,omitempty"`  // the login that re-authenticates, set with Reauth
+	Type     string `json:"type"`               // must be "GoogleOAuthState"
+	jwt.RegisteredClaims
+}
+
+type GoogleLinkJwtPayload struct {
+	UserID   uint   `json:"userId"`
+	GoogleID string `json:"googleId"`
+	Email    string `json:"email"`
+	Type     string `json:"type"` // must be "GOOGLE_LINK"
 	jwt.RegisteredClaims
 }
 
 type TwoFaSetupJwtPayload struct {
-	UserID uint   `json:"userId"`
-	Secret string `json:"secret"`
-	Type   string `json:"type"` // must be "2FA_SETUP"
+	UserID    uint   `json:"userId"`
+	Secret    string `json:"secret"`
+	Digits    int    `json:"digits,omitempty"` // The TOTP parameters the secret was issued with
+	Period    int    `json:"period,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Type      string `json:"type"` // must be "2FA_SETUP"
 	jwt.RegisteredClaims
 }
 
@@ -315,3 +448,133 @@ type TwoFaJwtPayload struct {
 	Type   string `json:"type"` // must be "2FA"
 	jwt.RegisteredClaims
 }
+
+type TrustedDeviceJwtPayload struct {
+	UserID   uint   `json:"userId"`
+	DeviceID string `json:"deviceId"`
+	Type     string `json:"type"` // must be "TRUSTED_DEVICE"
+	jwt.RegisteredClaims
+}
+
+type ServiceJwtPayload struct {
+	ClientID string `json:"clientId"`
+	Type     string `json:"type"` // must be "SERVICE"
+	jwt.RegisteredClaims
+}
+
+type OidcAccessJwtPayload struct {
+	UserID   uint   `json:"userId"`
+	ClientID string `json:"clientId"`
+	Scope    string `json:"scope"`
+	Type     string `json:"type"` // must be "OIDC_ACCESS"
+	jwt.RegisteredClaims
+}
+
+type OidcIDTokenClaims struct {
+	Nonce             string  `json:"nonce,omitempty"`
+	PreferredUsername string  `json:"preferred_username"`
+	Picture           *string `json:"picture,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// AnyJwtPayload reads the claims shared by our token types, fields a type does not have stay empty.
+type AnyJwtPayload struct {
+	UserID   uint   `json:"userId"`
+	ClientID string `json:"clientId"`
+	Type     string `json:"type"`
+	jwt.RegisteredClaims
+}
+
+// For OIDC, the fields follow the protocol names instead of our camelCase.
+
+type OidcAuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type" validate:"required,eq=code"`
+	ClientID            string `form:"client_id" json:"client_id" validate:"required"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri" validate:"required,url"`
+	Scope               string `form:"scope" json:"scope" validate:"required"`
+	State               string `form:"state" json:"state" validate:"max=512"`
+	Nonce               string `form:"nonce" json:"nonce" validate:"max=512"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge" validate:"required,min=43,max=128"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method" validate:"required,eq=S256"`
+}
+
+type OidcAuthorizeResponse struct {
+	RedirectURL string `json:"redirectUrl"`
+}
+
+// OidcTokenRequest covers both grants, the fields a grant needs are checked by the grant.
+type OidcTokenRequest struct {
+	GrantType    string `form:"grant_type" validate:"required"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	CodeVerifier string `form:"code_verifier" validate:"omitempty,min=43,max=128"`
+}
+
+type OidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+type OidcUserInfoResponse struct {
+	Sub               string  `json:"sub"`
+	PreferredUsername string  `json:"preferred_username"`
+	Picture           *string `json:"picture,omitempty"`
+}
+
+type OidcDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// For token introspection (RFC 7662)
+
+type IntrospectRequest struct {
+	Token         string `form:"token" validate:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+}
+
+// IntrospectResponse only carries `active` for inactive tokens.
+type IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// For JWKS
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/middleware"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+)
+
+// OidcDiscoveryHandler godoc
+// @Summary OpenID Connect discovery
+// @Description OpenID provider metadata for relying parties
+// @Tags well-known
+// @Produce json
+// @Success 200 {object} dto.OidcDiscoveryResponse
+// @Router /.well-known/openid-configuration [get]
+func (h *UserHandler) OidcDiscoveryHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, h.Service.GetOidcDiscovery())
+}
+
+// OidcAuthorizeHandler godoc
+// @Summary OIDC authorization endpoint
+// @Description Validate the authorization request and redirect to the frontend, where the logged in user continues
+// @Tags oidc
+// @Param response_type query string true "Must be code"
+// @Param client_id query string true "Registered client id"
+// @Param redirect_uri query string true "Registered redirect uri"
+// @Param scope query string true "Must contain openid"
+// @Param state query string false "Opaque value returned to the client"
+// @Param nonce query string false "Copied into the ID token"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Success 302 {string} string "Redirect to the frontend consent page"
+// @Router /oidc/authorize [get]
+func (h *UserHandler) OidcAuthorizeHandler(c *gin.Context) {
+	request := c.MustGet("validatedQuery").(dto.OidcAuthorizeRequest)
+
+	url, err := h.Service.GetOidcConsentURL(&request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Redirect(302, url)
+}
+
+// OidcAuthorizeConfirmHandler godoc
+// @Summary Issue OIDC authorization code
+// @Description Called by the frontend for the logged in user, returns the client redirect URL carrying the code
+// @Tags oidc
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.OidcAuthorizeRequest true "The authorization request"
+// @Success 200 {object} dto.OidcAuthorizeResponse
+// @Router /oidc/authorize [post]
+func (h *UserHandler) OidcAuthorizeConfirmHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.OidcAuthorizeRequest)
+	userID := c.MustGet("userID").(uint)
+
+	response, err := h.Service.CreateOidcAuthorizationCode(c.Request.Context(), userID, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, response)
+}
+
+// OidcTokenHandler godoc
+// @Summary OIDC token endpoint
+// @Description authorization_code: exchange a code and its PKCE verifier for an access token and an ID token.
+// @Description client_credentials: issue a service token to a registered service client.
+// @Tags oidc
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code or client_credentials"
+// @Param code formData string false "Authorization code"
+// @Param redirect_uri formData string false "Same redirect uri as in the authorization request"
+// @Param client_id formData string false "Client id, service clients may use HTTP Basic instead"
+// @Param client_secret formData string false "Secret of a service client"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Success 200 {object} dto.OidcTokenResponse
+// @Router /oidc/token [post]
+func (h *UserHandler) OidcTokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	// Bound here instead of by the middleware, errors must be OAuth error codes.
+	var request dto.OidcTokenRequest
+	if err := c.ShouldBind(&request); err != nil {
+		handleError(c, authError.NewAuthError(400, service.OidcErrInvalidRequest))
+		return
+	}
+	if err := dto.Validate.Struct(&request); err != nil {
+		handleError(c, authError.NewAuthError(400, service.OidcErrInvalidRequest))
+		return
+	}
+
+	var response *dto.OidcTokenResponse
+	var err error
+
+	if request.GrantType == "client_credentials" {
+		clientID, clientSecret, ok := c.Request.BasicAuth()
+		if !ok {
+			clientID, clientSecret = request.ClientID, request.ClientSecret
+		}
+		response, err = h.Service.IssueServiceToken(c.Request.Context(), clientID, clientSecret)
+	} else {
+		response, err = h.Service.ExchangeOidcCode(c.Request.Context(), &request)
+	}
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, response)
+}
+
+// OidcUserInfoHandler godoc
+// @Summary OIDC userinfo endpoint
+// @Description Return the claims of the user the OIDC access token was issued for
+// @Tags oidc
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} dto.OidcUserInfoResponse
+// @Router /oidc/userinfo [get]
+func (h *UserHandler) OidcUserInfoHandler(c *gin.Context) {
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, middleware.PrefixBearer) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		handleError(c, authError.NewAuthError(401, service.OidcErrInvalidToken))
+		return
+	}
+
+	userInfo, err := h.Service.GetOidcUserInfo(c.Request.Context(), authHeader[len(middleware.PrefixBearer):])
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, userInfo)
+}
+
+// IntrospectTokenHandler godoc
+// @Summary Token introspection (RFC 7662)
+// @Description Report whether a token issued by this service is active, for service clients only
+// @Tags oidc
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Security BasicAuth
+// @Security BearerAuth
+// @Param token formData string true "The token to introspect"
+// @Param token_type_hint formData string false "Ignored, every token type is recognised"
+// @Success 200 {object} dto.IntrospectResponse
+// @Router /oidc/introspect [post]
+func (h *UserHandler) IntrospectTokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	var request dto.IntrospectRequest
+	if err := c.ShouldBind(&request); err != nil {
+		handleError(c, authError.NewAuthError(400, service.OidcErrInvalidRequest))
+		return
+	}
+	if err := dto.Validate.Struct(&request); err != nil {
+		handleError(c, authError.NewAuthError(400, service.OidcErrInvalidRequest))
+		return
+	}
+
+	response, err := h.Service.IntrospectToken(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, response)
+}
@@ -2,6 +2,8 @@ package handler
 
 import (
 	"errors"
+	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 
@@ -14,6 +16,34 @@ type UserHandler struct {
 	Service *service.UserService
 }
 
+// The cookie that ties a Google or provider round trip to the browser that started it.
+const oauthBindingCookie = "oauth_binding"
+
+// setOauthBindingCookie sets the binding cookie, secure when the callback of the round trip is served over https.
+func (h *UserHandler) setOauthBindingCookie(c *gin.Context, binding string, maxAge int, redirectURI string) {
+	// Lax, so the browser still sends it on the redirect back from the provider.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthBindingCookie, binding, maxAge, "/", "", strings.HasPrefix(redirectURI, "https://"), true)
+}
+
+// providerRedirectURI is the callback of a provider of OAUTH_PROVIDERS, empty for an unknown one.
+func (h *UserHandler) providerRedirectURI(providerName string) string {
+	if provider, ok := h.Service.Dep.OauthProviders[providerName]; ok {
+		return provider.RedirectURI
+	}
+	return ""
+}
+
+// The cookie of a device that skips the 2FA step, see UserService.SubmitTwoFAChallenge.
+const trustedDeviceCookie = "trusted_device"
+
+func (h *UserHandler) setTrustedDeviceCookie(c *gin.Context, token string, maxAge int) {
+	cfg := h.Service.Dep.Cfg
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(trustedDeviceCookie, token, maxAge, "/", "", strings.HasPrefix(cfg.OidcIssuer, "https://"), true)
+}
+
 func handleError(c *gin.Context, err error) {
 	var authErr *authError.AuthError
 	if errors.As(err, &authErr) {
@@ -55,9 +85,11 @@ func (h *UserHandler) CreateUserHandler(c *gin.Context) {
 // @Param body body dto.LoginUserRequest true "Login user payload"
 // @Success 200 {object} dto.UserWithTokenResponse
 // @Failure 428 {object} dto.TwoFAPendingUserResponse
+// @Failure 429 {string} string "Too many failed attempts, see the Retry-After header"
 // @Router /loginByIdentifier [post]
 func (h *UserHandler) LoginUserHandler(c *gin.Context) {
 	request := c.MustGet("validatedBody").(dto.LoginUserRequest)
+	request.TrustedDeviceToken, _ = c.Cookie(trustedDeviceCookie)
 
 	user, e := h.Service.LoginUser(c.Request.Context(), &request)
 	if e != nil {
@@ -79,9 +111,146 @@ func (h *UserHandler) LoginUserHandler(c *gin.Context) {
 	c.JSON(200, user.User)
 }
 
+// LoginByCodeHandler godoc
+// @Summary Log in with an OAuth login code
+// @Description Redeem the single-use code of an OAuth login redirect for the tokens of the user, or for the 2FA challenge
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Param body body dto.LoginCodeRequest true "Login code payload"
+// @Success 200 {object} dto.UserWithTokenResponse
+// @Failure 428 {object} dto.TwoFAPendingUserResponse
+// @Router /loginByCode [post]
+func (h *UserHandler) LoginByCodeHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.LoginCodeRequest)
+	request.TrustedDeviceToken, _ = c.Cookie(trustedDeviceCookie)
+
+	user, err := h.Service.ExchangeLoginCode(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	if user.TwoFAPending != nil {
+		c.JSON(428, user.TwoFAPending)
+		c.Abort()
+		return
+	}
+
+	if user.User == nil {
+		handleError(c, errors.New("missing user payload"))
+		return
+	}
+
+	c.JSON(200, user.User)
+}
+
+// RefreshTokenHandler godoc
+// @Summary Refresh user token
+// @Description Exchange a refresh token for a new access token, the refresh token is rotated on every use
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Param body body dto.RefreshTokenRequest true "Refresh token payload"
+// @Success 200 {object} dto.RefreshTokenResponse
+// @Router /token/refresh [post]
+func (h *UserHandler) RefreshTokenHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.RefreshTokenRequest)
+
+	tokens, err := h.Service.RefreshUserToken(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, tokens)
+}
+
+// ForgotPasswordHandler godoc
+// @Summary Request a password reset
+// @Description Email a single-use password reset link, the response is the same whether the email is registered or not
+// @Tags auth/user
+// @Accept json
+// @Param body body dto.ForgotPasswordRequest true "Forgot password payload"
+// @Success 202
+// @Router /password/forgot [post]
+func (h *UserHandler) ForgotPasswordHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.ForgotPasswordRequest)
+
+	err := h.Service.RequestPasswordReset(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Status(202)
+}
+
+// ResetPasswordHandler godoc
+// @Summary Reset password
+// @Description Set a new password with a reset token, all sessions of the user are revoked. The user then logs in with the new password
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Param body body dto.ResetPasswordRequest true "Reset password payload"
+// @Success 200 {object} dto.UserWithoutTokenResponse
+// @Router /password/reset [post]
+func (h *UserHandler) ResetPasswordHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.ResetPasswordRequest)
+
+	user, err := h.Service.ResetPassword(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// VerifyEmailHandler godoc
+// @Summary Verify email
+// @Description Confirm the email of a user with the token from the verification email
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Param body body dto.VerifyEmailRequest true "Verify email payload"
+// @Success 200 {object} dto.UserWithoutTokenResponse
+// @Router /email/verify [post]
+func (h *UserHandler) VerifyEmailHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.VerifyEmailRequest)
+
+	user, err := h.Service.VerifyEmail(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// ResendVerificationEmailHandler godoc
+// @Summary Resend verification email
+// @Description Email a new verification link, the response is the same whether the email is registered or not
+// @Tags auth/user
+// @Accept json
+// @Param body body dto.ResendVerificationEmailRequest true "Resend verification email payload"
+// @Success 202
+// @Router /email/verify/resend [post]
+func (h *UserHandler) ResendVerificationEmailHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.ResendVerificationEmailRequest)
+
+	err := h.Service.ResendVerificationEmail(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Status(202)
+}
+
 // LogoutUserHandler godoc
 // @Summary Logout user
-// @Description Logout the authenticated user
+// @Description Logout the current session of the authenticated user
 // @Tags auth/user
 // @Produce json
 // @Security BearerAuth
@@ -89,8 +258,9 @@ func (h *UserHandler) LoginUserHandler(c *gin.Context) {
 // @Router /logout [delete]
 func (h *UserHandler) LogoutUserHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
 
-	err := h.Service.LogoutUser(c.Request.Context(), userID)
+	err := h.Service.LogoutUser(c.Request.Context(), userID, token)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -143,9 +313,34 @@ func (h *UserHandler) UpdateLoggedUserPasswordHandler(c *gin.Context) {
 	c.JSON(200, user)
 }
 
+// SetLoggedUserPasswordHandler godoc
+// @Summary Set password
+// @Description Set a first password for a user who only logs in with OAuth, after re-authenticating the session with a linked provider
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.SetUserPasswordRequest true "Set password payload"
+// @Success 200 {object} dto.UserWithTokenResponse
+// @Router /password [post]
+func (h *UserHandler) SetLoggedUserPasswordHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
+
+	request := c.MustGet("validatedBody").(dto.SetUserPasswordRequest)
+
+	user, err := h.Service.SetUserPassword(c.Request.Context(), userID, token, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
 // UpdateLoggedUserProfileHandler godoc
 // @Summary Update profile
-// @Description Update username or avatar for the authenticated user
+// @Description Update username, avatar or email for the authenticated user, changing the email requires a recent re-authentication
 // @Tags auth/user
 // @Accept json
 // @Produce json
@@ -155,10 +350,11 @@ func (h *UserHandler) UpdateLoggedUserPasswordHandler(c *gin.Context) {
 // @Router /me [put]
 func (h *UserHandler) UpdateLoggedUserProfileHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
 
 	request := c.MustGet("validatedBody").(dto.UpdateUserRequest)
 
-	user, err := h.Service.UpdateUserProfile(c.Request.Context(), userID, &request)
+	user, err := h.Service.UpdateUserProfile(c.Request.Context(), userID, token, &request)
 	if err != nil {
 		handleError(c, err)
 		return
@@ -167,9 +363,34 @@ func (h *UserHandler) UpdateLoggedUserProfileHandler(c *gin.Context) {
 	c.JSON(200, user)
 }
 
+// ReauthHandler godoc
+// @Summary Re-authenticate
+// @Description Confirm the identity with the password or a TOTP code, users without either use /google/reauth or /oauth/{provider}/reauth. Sensitive actions of the session are allowed for REAUTH_MAX_AGE seconds
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.ReauthRequest true "Re-authentication payload"
+// @Success 200 {object} dto.ReauthResponse
+// @Router /reauth [post]
+func (h *UserHandler) ReauthHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
+
+	request := c.MustGet("validatedBody").(dto.ReauthRequest)
+
+	resp, err := h.Service.Reauthenticate(c.Request.Context(), userID, token, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
 // DeleteLoggedUserHandler godoc
 // @Summary Delete account
-// @Description Delete the authenticated user's account
+// @Description Mark the authenticated user's account for deletion and log it out everywhere. Logging in within the grace period restores it
 // @Tags auth/user
 // @Produce json
 // @Security BearerAuth
@@ -187,6 +408,111 @@ func (h *UserHandler) DeleteLoggedUserHandler(c *gin.Context) {
 	c.Status(204)
 }
 
+// GetLoggedUserSessionsHandler godoc
+// @Summary List sessions
+// @Description Returns the active sessions of the authenticated user
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} dto.SessionResponse
+// @Router /me/sessions [get]
+func (h *UserHandler) GetLoggedUserSessionsHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
+
+	sessions, err := h.Service.GetUserSessions(c.Request.Context(), userID, token)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, sessions)
+}
+
+// RevokeLoggedUserSessionHandler godoc
+// @Summary Revoke session
+// @Description Revoke one session of the authenticated user
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Session ID"
+// @Success 204 {object} nil
+// @Router /me/sessions/{id} [delete]
+func (h *UserHandler) RevokeLoggedUserSessionHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	err := h.Service.RevokeUserSession(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// GetLoggedUserTrustedDevicesHandler godoc
+// @Summary List trusted devices
+// @Description Returns the devices of the authenticated user that skip the 2FA step
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} dto.TrustedDeviceResponse
+// @Router /me/trusted-devices [get]
+func (h *UserHandler) GetLoggedUserTrustedDevicesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	currentToken, _ := c.Cookie(trustedDeviceCookie)
+
+	devices, err := h.Service.GetTrustedDevices(c.Request.Context(), userID, currentToken)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, devices)
+}
+
+// RevokeLoggedUserTrustedDeviceHandler godoc
+// @Summary Revoke trusted device
+// @Description The device asks for the 2FA code again on its next login
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Trusted device ID"
+// @Success 204 {object} nil
+// @Router /me/trusted-devices/{id} [delete]
+func (h *UserHandler) RevokeLoggedUserTrustedDeviceHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	err := h.Service.RevokeTrustedDevice(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Status(204)
+}
+
+// RevokeLoggedUserTrustedDevicesHandler godoc
+// @Summary Revoke all trusted devices
+// @Description Every device of the authenticated user asks for the 2FA code again on its next login
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 204 {object} nil
+// @Router /me/trusted-devices [delete]
+func (h *UserHandler) RevokeLoggedUserTrustedDevicesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	err := h.Service.ForgetTrustedDevices(c.Request.Context(), userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setTrustedDeviceCookie(c, "", -1)
+	c.Status(204)
+}
+
 // StartTwoFaSetupHandler godoc
 // @Summary Start 2FA setup
 // @Description Initiate 2FA setup and return setup token and secret
@@ -215,7 +541,7 @@ func (h *UserHandler) StartTwoFaSetupHandler(c *gin.Context) {
 // @Produce json
 // @Security BearerAuth
 // @Param body body dto.TwoFAConfirmRequest true "2FA confirm payload"
-// @Success 200 {object} dto.UserWithTokenResponse
+// @Success 200 {object} dto.TwoFAConfirmResponse
 // @Router /2fa/confirm [post]
 func (h *UserHandler) ConfirmTwoFaSetupHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
@@ -231,9 +557,77 @@ func (h *UserHandler) ConfirmTwoFaSetupHandler(c *gin.Context) {
 	c.JSON(200, user)
 }
 
+// EnableEmailTwoFaHandler godoc
+// @Summary Enable email 2FA
+// @Description Send a code to the verified email of the authenticated user at each login, the recovery codes are returned when it is the first 2FA method
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.EnableEmailTwoFARequest true "Enable email 2FA payload"
+// @Success 200 {object} dto.TwoFAConfirmResponse
+// @Router /2fa/email/enable [post]
+func (h *UserHandler) EnableEmailTwoFaHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	request := c.MustGet("validatedBody").(dto.EnableEmailTwoFARequest)
+
+	user, err := h.Service.EnableEmailTwoFA(c.Request.Context(), userID, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// DisableEmailTwoFaHandler godoc
+// @Summary Disable email 2FA
+// @Description Stop sending login codes by email, the authenticator stays enabled if the user has one
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.DisableEmailTwoFARequest true "Disable email 2FA payload"
+// @Success 200 {object} dto.UserWithTokenResponse
+// @Router /2fa/email/disable [put]
+func (h *UserHandler) DisableEmailTwoFaHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	request := c.MustGet("validatedBody").(dto.DisableEmailTwoFARequest)
+
+	user, err := h.Service.DisableEmailTwoFA(c.Request.Context(), userID, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// SendTwoFaEmailCodeHandler godoc
+// @Summary Email a 2FA code
+// @Description Email a new code for a pending login, to users with both an authenticator and email 2FA
+// @Tags auth/user
+// @Accept json
+// @Param body body dto.TwoFAEmailCodeRequest true "2FA email code payload"
+// @Success 202
+// @Router /2fa/email/send [post]
+func (h *UserHandler) SendTwoFaEmailCodeHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.TwoFAEmailCodeRequest)
+
+	err := h.Service.SendTwoFAEmailCode(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.Status(202)
+}
+
 // DisableTwoFaHandler godoc
 // @Summary Disable 2FA
-// @Description Disable 2FA for the authenticated user
+// @Description Disable every 2FA method of the authenticated user
 // @Tags auth/user
 // @Accept json
 // @Produce json
@@ -255,14 +649,39 @@ func (h *UserHandler) DisableTwoFaHandler(c *gin.Context) {
 	c.JSON(200, user)
 }
 
+// RegenerateRecoveryCodesHandler godoc
+// @Summary Regenerate 2FA recovery codes
+// @Description Replace the recovery codes of the authenticated user after checking their password, the new codes are shown once
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body dto.RegenerateRecoveryCodesRequest true "Regenerate recovery codes payload"
+// @Success 200 {object} dto.RecoveryCodesResponse
+// @Router /2fa/recovery-codes [post]
+func (h *UserHandler) RegenerateRecoveryCodesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	request := c.MustGet("validatedBody").(dto.RegenerateRecoveryCodesRequest)
+
+	response, err := h.Service.RegenerateRecoveryCodes(c.Request.Context(), userID, &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, response)
+}
+
 // TwoFaSubmitHandler godoc
 // @Summary Submit 2FA challenge
-// @Description Submit 2FA code during login to obtain a user token
+// @Description Submit 2FA code or a recovery code during login to obtain a user token, rememberDevice sets a cookie that skips this step on later logins
 // @Tags auth/user
 // @Accept json
 // @Produce json
 // @Param body body dto.TwoFAChallengeRequest true "2FA challenge payload"
-// @Success 200 {object} dto.UserWithTokenResponse
+// @Success 200 {object} dto.TwoFAChallengeResponse
+// @Failure 429 {string} string "Too many failed attempts, see the Retry-After header"
 // @Router /2fa [post]
 func (h *UserHandler) TwoFaSubmitHandler(c *gin.Context) {
 	request := c.MustGet("validatedBody").(dto.TwoFAChallengeRequest)
@@ -273,6 +692,10 @@ func (h *UserHandler) TwoFaSubmitHandler(c *gin.Context) {
 		return
 	}
 
+	if user.TrustedDeviceToken != "" {
+		h.setTrustedDeviceCookie(c, user.TrustedDeviceToken, h.Service.Dep.Cfg.TrustedDeviceExpiry)
+	}
+
 	c.JSON(200, user)
 }
 
@@ -361,12 +784,13 @@ func (h *UserHandler) ValidateUserHandler(c *gin.Context) {
 // @Success 302 {string} string "Redirect to Google OAuth consent screen"
 // @Router /google/login [get]
 func (h *UserHandler) GoogleLoginHandler(c *gin.Context) {
-	url, err := h.Service.GetGoogleOAuthURL(c.Request.Context())
+	url, binding, err := h.Service.GetGoogleOAuthURL(c.Request.Context())
 	if err != nil {
 		handleError(c, err)
 		return
 	}
 
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.Service.Dep.Cfg.GoogleRedirectUri)
 	c.Redirect(302, url)
 }
 
@@ -387,7 +811,11 @@ func (h *UserHandler) GoogleCallbackHandler(c *gin.Context) {
 		return
 	}
 
-	url := h.Service.HandleGoogleOAuthCallback(c.Request.Context(), code, state)
+	// A missing cookie fails the callback like a wrong one.
+	binding, _ := c.Cookie(oauthBindingCookie)
+	h.setOauthBindingCookie(c, "", -1, h.Service.Dep.Cfg.GoogleRedirectUri)
+
+	url := h.Service.HandleGoogleOAuthCallback(c.Request.Context(), code, state, binding)
 
 	if url == "" {
 		handleError(c, authError.NewAuthError(500, "Failed to process Google OAuth callback"))
@@ -396,3 +824,245 @@ func (h *UserHandler) GoogleCallbackHandler(c *gin.Context) {
 
 	c.Redirect(302, url)
 }
+
+// GoogleLinkHandler godoc
+// @Summary Start linking a Google account
+// @Description Return the Google OAuth URL that links the Google account to the authenticated user, and set the cookie the callback expects
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} dto.GoogleLinkURLResponse
+// @Router /google/link [post]
+func (h *UserHandler) GoogleLinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	resp, binding, err := h.Service.GetGoogleLinkURL(c.Request.Context(), userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.Service.Dep.Cfg.GoogleRedirectUri)
+
+	c.JSON(200, resp)
+}
+
+// GoogleReauthHandler godoc
+// @Summary Start a Google re-authentication
+// @Description Return the Google OAuth URL where the authenticated user proves they still own their linked Google account, and set the cookie the callback expects. The callback re-authenticates this session for REAUTH_MAX_AGE seconds
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} dto.GoogleLinkURLResponse
+// @Router /google/reauth [post]
+func (h *UserHandler) GoogleReauthHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
+
+	resp, binding, err := h.Service.GetGoogleReauthURL(c.Request.Context(), userID, token)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.Service.Dep.Cfg.GoogleRedirectUri)
+
+	c.JSON(200, resp)
+}
+
+// GoogleLinkConfirmHandler godoc
+// @Summary Confirm linking a Google account
+// @Description Link the Google account of a link token with the password of the existing user, then log in
+// @Tags auth/user
+// @Accept json
+// @Produce json
+// @Param body body dto.GoogleLinkConfirmRequest true "Google link confirm payload"
+// @Success 200 {object} dto.UserWithTokenResponse
+// @Failure 428 {object} dto.TwoFAPendingUserResponse
+// @Router /google/link/confirm [post]
+func (h *UserHandler) GoogleLinkConfirmHandler(c *gin.Context) {
+	request := c.MustGet("validatedBody").(dto.GoogleLinkConfirmRequest)
+
+	user, err := h.Service.ConfirmGoogleLink(c.Request.Context(), &request)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	if user.TwoFAPending != nil {
+		c.JSON(428, user.TwoFAPending)
+		c.Abort()
+		return
+	}
+
+	if user.User == nil {
+		handleError(c, errors.New("missing user payload"))
+		return
+	}
+
+	c.JSON(200, user.User)
+}
+
+// GoogleUnlinkHandler godoc
+// @Summary Unlink the Google account
+// @Description Remove the Google account of the authenticated user, refused when it is their only login method
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} dto.UserWithoutTokenResponse
+// @Router /google/link [delete]
+func (h *UserHandler) GoogleUnlinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	user, err := h.Service.UnlinkGoogleAccount(c.Request.Context(), userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// OauthProvidersHandler godoc
+// @Summary List external login providers
+// @Description Return the names of the providers configured in OAUTH_PROVIDERS
+// @Tags auth/user
+// @Produce json
+// @Success 200 {object} dto.OauthProvidersResponse
+// @Router /oauth/providers [get]
+func (h *UserHandler) OauthProvidersHandler(c *gin.Context) {
+	c.JSON(200, h.Service.ListOauthProviders())
+}
+
+// OauthLoginHandler godoc
+// @Summary External provider login
+// @Description Start the OAuth flow of a configured provider
+// @Tags auth/user
+// @Param provider path string true "Provider name"
+// @Success 302 {string} string "Redirect to the provider consent screen"
+// @Router /oauth/{provider}/login [get]
+func (h *UserHandler) OauthLoginHandler(c *gin.Context) {
+	provider := c.Param("provider")
+
+	url, binding, err := h.Service.GetOauthLoginURL(c.Request.Context(), provider)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.providerRedirectURI(provider))
+	c.Redirect(302, url)
+}
+
+// OauthCallbackHandler godoc
+// @Summary External provider callback
+// @Description Handle the OAuth callback of a configured provider and issue user token
+// @Tags auth/user
+// @Param provider path string true "Provider name"
+// @Param code query string true "OAuth code"
+// @Param state query string true "OAuth state"
+// @Success 302 {string} string "Redirect to frontend with user token"
+// @Router /oauth/{provider}/callback [get]
+func (h *UserHandler) OauthCallbackHandler(c *gin.Context) {
+	code := c.Query("code")
+	state := c.Query("state")
+
+	if code == "" || state == "" {
+		handleError(c, authError.NewAuthError(400, "Missing code or state in callback"))
+		return
+	}
+
+	provider := c.Param("provider")
+
+	// A missing cookie fails the callback like a wrong one.
+	binding, _ := c.Cookie(oauthBindingCookie)
+	h.setOauthBindingCookie(c, "", -1, h.providerRedirectURI(provider))
+
+	url := h.Service.HandleOauthCallback(c.Request.Context(), provider, code, state, binding)
+
+	c.Redirect(302, url)
+}
+
+// OauthLinkHandler godoc
+// @Summary Start linking an external provider account
+// @Description Return the provider OAuth URL that links the provider account to the authenticated user, and set the cookie the callback expects
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Param provider path string true "Provider name"
+// @Success 200 {object} dto.OauthLinkURLResponse
+// @Router /oauth/{provider}/link [post]
+func (h *UserHandler) OauthLinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	provider := c.Param("provider")
+
+	resp, binding, err := h.Service.GetOauthLinkURL(c.Request.Context(), provider, userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.providerRedirectURI(provider))
+
+	c.JSON(200, resp)
+}
+
+// OauthReauthHandler godoc
+// @Summary Start a re-authentication with an external provider
+// @Description Return the provider OAuth URL where the authenticated user proves they still own their linked provider account, and set the cookie the callback expects. The callback re-authenticates this session for REAUTH_MAX_AGE seconds
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Param provider path string true "Provider name"
+// @Success 200 {object} dto.OauthLinkURLResponse
+// @Router /oauth/{provider}/reauth [post]
+func (h *UserHandler) OauthReauthHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	token := c.MustGet("token").(string)
+
+	provider := c.Param("provider")
+
+	resp, binding, err := h.Service.GetOauthReauthURL(c.Request.Context(), provider, userID, token)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	h.setOauthBindingCookie(c, binding, h.Service.Dep.Cfg.OauthStateTokenExpiry, h.providerRedirectURI(provider))
+
+	c.JSON(200, resp)
+}
+
+// OauthUnlinkHandler godoc
+// @Summary Unlink an external provider account
+// @Description Remove the provider account of the authenticated user, refused when it is their only login method
+// @Tags auth/user
+// @Produce json
+// @Security BearerAuth
+// @Param provider path string true "Provider name"
+// @Success 200 {object} dto.UserWithoutTokenResponse
+// @Router /oauth/{provider}/link [delete]
+func (h *UserHandler) OauthUnlinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+
+	user, err := h.Service.UnlinkOauthIdentity(c.Request.Context(), c.Param("provider"), userID)
+	if err != nil {
+		handleError(c, err)
+		return
+	}
+
+	c.JSON(200, user)
+}
+
+// JwksHandler godoc
+// @Summary JSON Web Key Set
+// @Description Public keys for verifying tokens issued by this service
+// @Tags well-known
+// @Produce json
+// @Success 200 {object} dto.JWKSResponse
+// @Router /.well-known/jwks.json [get]
+func (h *UserHandler) JwksHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, h.Service.GetJWKS())
+}
@@ -0,0 +1,52 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+)
+
+func TestWriterMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := mailer.NewWriterMailer(&buf, "no-reply@test.com")
+
+	err := m.Send(context.Background(), mailer.Message{To: "alice@test.com", Subject: "Hello", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"From: no-reply@test.com", "To: alice@test.com", "Subject: Hello", "line one\nline two"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output: %s", want, out)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		m, err := mailer.New(&config.Config{MailerDriver: mailer.DriverMemory})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if _, ok := m.(*mailer.MemoryMailer); !ok {
+			t.Fatalf("expected memory mailer, got %T", m)
+		}
+	})
+
+	t.Run("smtp requires a host", func(t *testing.T) {
+		if _, err := mailer.New(&config.Config{MailerDriver: mailer.DriverSMTP}); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("unknown driver", func(t *testing.T) {
+		if _, err := mailer.New(&config.Config{MailerDriver: "pigeon"}); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
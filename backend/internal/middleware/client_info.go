@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
+)
+
+// ClientInfo attaches the client IP and user agent to the request context, so services can record them.
+func ClientInfo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := util.WithClientInfo(c.Request.Context(), util.ClientInfo{
+			IP:        c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+		})
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
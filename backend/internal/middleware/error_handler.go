@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -24,9 +25,25 @@ func ErrorHandler() gin.HandlerFunc {
 
 		// Handle AuthError specifically
 		if errors.As(err, &authErr) {
-			c.AbortWithStatusJSON(authErr.Status, gin.H{
+			if authErr.RetryAfter > 0 {
+				c.Header("Retry-After", strconv.Itoa(authErr.RetryAfter))
+			}
+			body := gin.H{
 				"error": authErr.Message,
-			})
+			}
+			if authErr.Code != "" {
+				body["code"] = authErr.Code
+			}
+			// Like the validation errors below, "error" lists the messages
+			if len(authErr.Violations) > 0 {
+				messages := make([]string, 0, len(authErr.Violations))
+				for _, v := range authErr.Violations {
+					messages = append(messages, v.Message)
+				}
+				body["error"] = messages
+				body["violations"] = authErr.Violations
+			}
+			c.AbortWithStatusJSON(authErr.Status, body)
 			return
 		}
 
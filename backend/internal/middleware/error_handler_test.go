@@ -35,6 +35,8 @@ func errorGenerator(code int) gin.HandlerFunc {
 			}
 
 			_ = c.AbortWithError(400, err)
+		case 429:
+			_ = c.AbortWithError(429, authError.NewRetryAfterError(429, "too many attempts", 30))
 		case 500:
 			_ = c.AbortWithError(500, fmt.Errorf("unknown error"))
 		default:
@@ -69,3 +71,60 @@ func TestErrorHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorHandlerRetryAfter(t *testing.T) {
+	r := testutil.NewMiddlewareTestRouter(middleware.ErrorHandler(), errorGenerator(429))
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/middleware-test", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 429 {
+		t.Fatalf("expected: 429, got: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("expected Retry-After: 30, got: %q", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestErrorHandlerCode(t *testing.T) {
+	reauthRequired := func(c *gin.Context) {
+		_ = c.AbortWithError(401, authError.NewAuthErrorWithCode(401, authError.CodeReauthRequired, "recent authentication required"))
+	}
+	r := testutil.NewMiddlewareTestRouter(middleware.ErrorHandler(), reauthRequired)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/middleware-test", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("expected: 401, got: %d", w.Code)
+	}
+	if w.Body.String() != `{"code":"reauth_required","error":"recent authentication required"}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestErrorHandlerViolations(t *testing.T) {
+	r := testutil.NewMiddlewareTestRouter(middleware.ErrorHandler(), func(c *gin.Context) {
+		_ = c.AbortWithError(400, authError.NewValidationError(authError.CodePasswordPolicy, []authError.Violation{
+			{Field: "password", Rule: "min_length", Message: "password must be at least 8 characters long"},
+			{Field: "password", Rule: "common", Message: "password is too common"},
+		}))
+	})
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/middleware-test", nil)
+	r.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("expected: 400, got: %d", w.Code)
+	}
+	expected := `{"code":"password_policy",` +
+		`"error":["password must be at least 8 characters long","password is too common"],` +
+		`"violations":[{"field":"password","rule":"min_length","message":"password must be at least 8 characters long"},` +
+		`{"field":"password","rule":"common","message":"password is too common"}]}`
+	if w.Body.String() != expected {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
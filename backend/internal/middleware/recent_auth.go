@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+)
+
+type RecentAuthService interface {
+	HasRecentAuth(ctx context.Context, userID uint, token string) (bool, error)
+	GetDependency() *dependency.Dependency
+}
+
+// RequireRecentAuth refuses sessions that did not re-authenticate with POST /reauth within REAUTH_MAX_AGE.
+// It must run after Auth.
+func RequireRecentAuth(recentAuthService RecentAuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		recent, err := recentAuthService.HasRecentAuth(c.Request.Context(), c.MustGet("userID").(uint), c.MustGet("token").(string))
+		if err != nil {
+			_ = c.AbortWithError(500, err)
+			return
+		}
+
+		if !recent {
+			_ = c.AbortWithError(401, authError.NewAuthErrorWithCode(401, authError.CodeReauthRequired, "recent authentication required"))
+			return
+		}
+
+		c.Next()
+	}
+}
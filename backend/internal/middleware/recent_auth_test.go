@@ -0,0 +1,60 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/middleware"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+)
+
+type testRecentAuthService struct {
+	dep    *dependency.Dependency
+	recent bool
+}
+
+func (ts *testRecentAuthService) GetDependency() *dependency.Dependency {
+	return ts.dep
+}
+
+func (ts *testRecentAuthService) HasRecentAuth(ctx context.Context, userID uint, token string) (bool, error) {
+	return ts.recent, nil
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	testCases := []struct {
+		name           string
+		recent         bool
+		expectedStatus int
+	}{
+		{name: "recent auth", recent: true, expectedStatus: 200},
+		{name: "no recent auth", recent: false, expectedStatus: 401},
+	}
+
+	setSession := func(c *gin.Context) {
+		c.Set("userID", uint(userID))
+		c.Set("token", "session")
+		c.Next()
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dep := testutil.NewTestDependency(testutil.NewTestConfig(), nil, nil, nil)
+
+			r := testutil.NewMiddlewareTestRouter(setSession, middleware.RequireRecentAuth(&testRecentAuthService{dep: dep, recent: tc.recent}))
+			req, _ := http.NewRequest("POST", "/middleware-test", nil)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected: %d, got: %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+)
+
+type ServiceAuthService interface {
+	AuthenticateServiceClient(ctx context.Context, clientID string, clientSecret string) error
+	ValidateServiceClient(ctx context.Context, clientID string) error
+	GetDependency() *dependency.Dependency
+}
+
+// ServiceAuth only lets through service clients, user tokens are rejected.
+// A service proves its identity with a service token, or with its client credentials over HTTP Basic.
+func ServiceAuth(authService ServiceAuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var clientID string
+		var err error
+
+		if id, secret, ok := c.Request.BasicAuth(); ok {
+			clientID = id
+			err = authService.AuthenticateServiceClient(c.Request.Context(), id, secret)
+		} else if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, PrefixBearer) {
+			claims, jwtErr := jwt.ValidateServiceToken(authService.GetDependency(), authHeader[len(PrefixBearer):])
+			if jwtErr != nil {
+				err = authError.NewAuthError(401, "Invalid or expired token")
+			} else {
+				clientID = claims.ClientID
+				err = authService.ValidateServiceClient(c.Request.Context(), clientID)
+			}
+		} else {
+			err = authError.NewAuthError(401, "service authentication required")
+		}
+
+		if err != nil {
+			var authErr *authError.AuthError
+			if errors.As(err, &authErr) && authErr.Status == 401 {
+				c.Header("WWW-Authenticate", `Basic realm="auth-service", Bearer`)
+				_ = c.AbortWithError(401, authErr)
+				return
+			}
+			_ = c.AbortWithError(500, err)
+			return
+		}
+
+		c.Set("serviceClientID", clientID)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package middleware_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/middleware"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+)
+
+const serviceClientID = "game"
+const serviceClientSecret = "game-secret"
+
+type testServiceAuthService struct {
+	clientExists bool
+}
+
+func (ts *testServiceAuthService) GetDependency() *dependency.Dependency {
+	return testDep
+}
+
+func (ts *testServiceAuthService) AuthenticateServiceClient(ctx context.Context, clientID string, clientSecret string) error {
+	if !ts.clientExists || clientID != serviceClientID || clientSecret != serviceClientSecret {
+		return authError.NewAuthError(401, "invalid_client")
+	}
+	return nil
+}
+
+func (ts *testServiceAuthService) ValidateServiceClient(ctx context.Context, clientID string) error {
+	if !ts.clientExists || clientID != serviceClientID {
+		return authError.NewAuthError(401, "invalid service client")
+	}
+	return nil
+}
+
+func TestServiceAuth(t *testing.T) {
+	serviceToken, err := jwt.SignServiceToken(testDep, serviceClientID)
+	if err != nil {
+		t.Fatalf("failed to sign test token, err: %v", err)
+	}
+	userToken, err := jwt.SignUserToken(testDep, userID)
+	if err != nil {
+		t.Fatalf("failed to sign test token, err: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		bearer         string
+		basicID        string
+		basicSecret    string
+		clientExists   bool
+		expectedStatus int
+	}{
+		{name: "service token", bearer: serviceToken, clientExists: true, expectedStatus: 200},
+		{name: "service token of a deleted client", bearer: serviceToken, clientExists: false, expectedStatus: 401},
+		{name: "user token", bearer: userToken, clientExists: true, expectedStatus: 401},
+		{name: "client credentials", basicID: serviceClientID, basicSecret: serviceClientSecret, clientExists: true, expectedStatus: 200},
+		{name: "wrong client secret", basicID: serviceClientID, basicSecret: "nope", clientExists: true, expectedStatus: 401},
+		{name: "nothing set", clientExists: true, expectedStatus: 401},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testutil.NewMiddlewareTestRouter(middleware.ErrorHandler(), middleware.ServiceAuth(&testServiceAuthService{clientExists: tc.clientExists}))
+			req, _ := http.NewRequest("POST", "/middleware-test", nil)
+
+			if tc.bearer != "" {
+				req.Header.Add("Authorization", fmt.Sprintf("%s%s", middleware.PrefixBearer, tc.bearer))
+			}
+			if tc.basicID != "" {
+				req.SetBasicAuth(tc.basicID, tc.basicSecret)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected: %d, got: %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
@@ -24,3 +24,22 @@ func ValidateBody[T any]() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+func ValidateQuery[T any]() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query T
+		if err := c.ShouldBindQuery(&query); err != nil {
+			_ = c.AbortWithError(400, authError.NewAuthError(400, err.Error()))
+			return
+		}
+
+		if err := dto.Validate.Struct(&query); err != nil {
+			_ = c.AbortWithError(400, err)
+			return
+		}
+
+		c.Set("validatedQuery", query)
+
+		c.Next()
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+)
+
+type VerifiedEmailService interface {
+	IsEmailVerified(ctx context.Context, userID uint) (bool, error)
+	GetDependency() *dependency.Dependency
+}
+
+// RequireVerifiedEmail refuses users with an unverified email, unless EMAIL_VERIFICATION_POLICY is "none".
+// It must run after Auth.
+func RequireVerifiedEmail(verifiedEmailService VerifiedEmailService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if verifiedEmailService.GetDependency().Cfg.EmailVerificationPolicy == config.EmailVerificationPolicyNone {
+			c.Next()
+			return
+		}
+
+		verified, err := verifiedEmailService.IsEmailVerified(c.Request.Context(), c.MustGet("userID").(uint))
+		if err != nil {
+			_ = c.AbortWithError(500, err)
+			return
+		}
+
+		if !verified {
+			_ = c.AbortWithError(403, authError.NewAuthError(403, "email not verified"))
+			return
+		}
+
+		c.Next()
+	}
+}
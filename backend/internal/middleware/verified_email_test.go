@@ -0,0 +1,65 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/middleware"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+)
+
+type testVerifiedEmailService struct {
+	dep      *dependency.Dependency
+	verified bool
+}
+
+func (ts *testVerifiedEmailService) GetDependency() *dependency.Dependency {
+	return ts.dep
+}
+
+func (ts *testVerifiedEmailService) IsEmailVerified(ctx context.Context, userID uint) (bool, error) {
+	return ts.verified, nil
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		verified       bool
+		expectedStatus int
+	}{
+		{name: "policy none", policy: config.EmailVerificationPolicyNone, verified: false, expectedStatus: 200},
+		{name: "policy actions, verified", policy: config.EmailVerificationPolicyActions, verified: true, expectedStatus: 200},
+		{name: "policy actions, unverified", policy: config.EmailVerificationPolicyActions, verified: false, expectedStatus: 403},
+		{name: "policy login, unverified", policy: config.EmailVerificationPolicyLogin, verified: false, expectedStatus: 403},
+	}
+
+	setUser := func(c *gin.Context) {
+		c.Set("userID", uint(userID))
+		c.Next()
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testutil.NewTestConfig()
+			cfg.EmailVerificationPolicy = tc.policy
+			dep := testutil.NewTestDependency(cfg, nil, nil, nil)
+
+			r := testutil.NewMiddlewareTestRouter(setUser, middleware.RequireVerifiedEmail(&testVerifiedEmailService{dep: dep, verified: tc.verified}))
+			req, _ := http.NewRequest("POST", "/middleware-test", nil)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("expected: %d, got: %d", tc.expectedStatus, w.Code)
+			}
+		})
+	}
+}
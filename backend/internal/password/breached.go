@@ -0,0 +1,295 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+)
+
+// RuleBreached is the rule of passwords found in a breach corpus.
+const RuleBreached = "breached"
+
+// BreachedPasswords is a corpus of passwords known from data breaches, checked without calling any external service.
+// Passwords are looked up by their SHA-1, like the Have I Been Pwned downloads.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+// LoadBreachedPasswords opens the corpus of BREACHED_PASSWORDS_FILE, or returns nil when BREACHED_PASSWORD_CHECK is off.
+func LoadBreachedPasswords(cfg *config.Config) (BreachedPasswords, error) {
+	if !cfg.BreachedPasswordCheck {
+		return nil, nil
+	}
+	if cfg.BreachedPasswordsFile == "" {
+		return nil, fmt.Errorf("BREACHED_PASSWORDS_FILE is required by the breached password check")
+	}
+
+	return OpenBreachedPasswords(cfg.BreachedPasswordsFile)
+}
+
+// OpenBreachedPasswords opens a corpus in any of the supported formats:
+//   - a directory of HIBP range files, <first 5 hex of the SHA-1>.txt holding the SUFFIX:COUNT lines of that range;
+//   - a Bloom filter written by BloomFilter.WriteTo, loaded in memory;
+//   - a file of HASH:COUNT lines sorted by hash, the "ordered by hash" HIBP download, searched on disk.
+func OpenBreachedPasswords(path string) (BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached passwords: %w", err)
+	}
+	if info.IsDir() {
+		return &rangeDirectory{dir: path}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached passwords: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(file, magic); err == nil && string(magic) == bloomMagic {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return ReadBloomFilter(bufio.NewReader(file))
+	}
+
+	return &sortedHashFile{path: path}, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// rangeDirectory is the k-anonymity layout of HIBP: one file per 5 hex prefix.
+type rangeDirectory struct {
+	dir string
+}
+
+func (d *rangeDirectory) Contains(password string) (bool, error) {
+	hash := sha1Hex(password)
+
+	file, err := os.Open(filepath.Join(d.dir, hash[:5]+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		suffix, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(suffix, hash[5:]) {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// sortedHashFile is searched by bisecting the file, so it is never loaded in memory.
+type sortedHashFile struct {
+	path string
+}
+
+func (f *sortedHashFile) Contains(password string) (bool, error) {
+	target := sha1Hex(password)
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// The line of the target, if any, starts within [lo, hi), and lo is always the start of a line.
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAtOrAfter(file, mid, lo, info.Size())
+		if err != nil {
+			return false, err
+		}
+		if start >= hi || line == "" {
+			hi = mid
+			continue
+		}
+
+		hash, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ":")
+		if len(hash) != 40 {
+			return false, fmt.Errorf("invalid line in breached passwords at offset %d", start)
+		}
+		switch strings.Compare(strings.ToUpper(hash), target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = start + int64(len(line))
+		default:
+			hi = start
+		}
+	}
+
+	return false, nil
+}
+
+// lineAtOrAfter returns the first line starting at or after offset, with its newline, and where it starts.
+func lineAtOrAfter(file *os.File, offset int64, lineStart int64, size int64) (int64, string, error) {
+	start := offset
+	if offset > lineStart {
+		// Back one byte, so a line starting right at offset is not skipped.
+		start = offset - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+
+	if offset > lineStart {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, line, nil
+}
+
+const bloomMagic = "PWBLOOM1"
+
+// BloomFilter is a compact corpus: it never misses a breached password, and wrongly flags another one
+// with the false positive rate it was built for.
+type BloomFilter struct {
+	bits   []byte
+	m      uint64 // number of bits
+	hashes uint32
+}
+
+// NewBloomFilter sizes a filter for n passwords at the false positive rate.
+func NewBloomFilter(n uint64, falsePositiveRate float64) (*BloomFilter, error) {
+	if n == 0 {
+		return nil, fmt.Errorf("a Bloom filter needs at least one password")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false positive rate must be between 0 and 1, got %v", falsePositiveRate)
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &BloomFilter{bits: make([]byte, (m+7)/8), m: m, hashes: hashes}, nil
+}
+
+// positions derives the bits of a SHA-1 by double hashing, the digest is already uniform.
+func (b *BloomFilter) positions(sum []byte, visit func(bit uint64) bool) bool {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		if !visit((h1 + i*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+// AddHash adds a password by its SHA-1 in hex, as found in the HIBP files.
+func (b *BloomFilter) AddHash(hexHash string) error {
+	sum, err := hex.DecodeString(hexHash)
+	if err != nil || len(sum) != sha1.Size {
+		return fmt.Errorf("invalid SHA-1 %q", hexHash)
+	}
+
+	b.positions(sum, func(bit uint64) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+	return nil
+}
+
+func (b *BloomFilter) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	return b.positions(sum[:], func(bit uint64) bool {
+		return b.bits[bit/8]&(1<<(bit%8)) != 0
+	}), nil
+}
+
+// WriteTo writes the filter: the magic, the number of hashes and of bits, then the bits.
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, 0, len(bloomMagic)+12)
+	header = append(header, bloomMagic...)
+	header = binary.LittleEndian.AppendUint32(header, b.hashes)
+	header = binary.LittleEndian.AppendUint64(header, b.m)
+
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	written, err := w.Write(b.bits)
+	return int64(n + written), err
+}
+
+// ReadBloomFilter reads a filter written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read Bloom filter: %w", err)
+	}
+	if !bytes.Equal(header[:len(bloomMagic)], []byte(bloomMagic)) {
+		return nil, fmt.Errorf("not a Bloom filter of breached passwords")
+	}
+
+	b := &BloomFilter{
+		hashes: binary.LittleEndian.Uint32(header[len(bloomMagic):]),
+		m:      binary.LittleEndian.Uint64(header[len(bloomMagic)+4:]),
+	}
+	if b.hashes == 0 || b.m == 0 {
+		return nil, fmt.Errorf("invalid Bloom filter header")
+	}
+
+	b.bits = make([]byte, (b.m+7)/8)
+	if _, err := io.ReadFull(r, b.bits); err != nil {
+		return nil, fmt.Errorf("failed to read Bloom filter: %w", err)
+	}
+
+	return b, nil
+}
+
+// ParseHashLine splits a HASH:COUNT line of the HIBP files, the count is 1 when missing.
+func ParseHashLine(line string) (string, int, error) {
+	hash, count, found := strings.Cut(strings.TrimSpace(line), ":")
+	if len(hash) != 40 {
+		return "", 0, fmt.Errorf("invalid line %q", line)
+	}
+	if !found {
+		return hash, 1, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid count in line %q", line)
+	}
+	return hash, n, nil
+}
@@ -0,0 +1,165 @@
+package password_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+)
+
+var breached = []string{"Password.777", "hunter2", "correct horse battery staple", "pässwört"}
+
+func hashOf(pw string) string {
+	sum := sha1.Sum([]byte(pw))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeSortedHashes writes the breached passwords among filler hashes, sorted like the HIBP download.
+func writeSortedHashes(t *testing.T) string {
+	t.Helper()
+
+	lines := make([]string, 0, 500)
+	for _, pw := range breached {
+		lines = append(lines, hashOf(pw)+":42")
+	}
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("%s:%d", hashOf(fmt.Sprintf("filler-%d", i)), i+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600); err != nil {
+		t.Fatalf("failed to write hashes, err: %v", err)
+	}
+	return path
+}
+
+func expectCorpus(t *testing.T, corpus password.BreachedPasswords) {
+	t.Helper()
+
+	for _, pw := range append(breached, "filler-0", "filler-499") {
+		found, err := corpus.Contains(pw)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !found {
+			t.Fatalf("expected %q to be found", pw)
+		}
+	}
+	for _, pw := range []string{"Password.778", "not breached at all", ""} {
+		found, err := corpus.Contains(pw)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if found {
+			t.Fatalf("expected %q not to be found", pw)
+		}
+	}
+}
+
+func TestSortedHashFile(t *testing.T) {
+	corpus, err := password.OpenBreachedPasswords(writeSortedHashes(t))
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectCorpus(t, corpus)
+}
+
+func TestRangeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	ranges := map[string][]string{}
+	for _, pw := range append(breached, "filler-0", "filler-499") {
+		hash := hashOf(pw)
+		ranges[hash[:5]] = append(ranges[hash[:5]], hash[5:]+":3")
+	}
+	for prefix, lines := range ranges {
+		if err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+			t.Fatalf("failed to write range, err: %v", err)
+		}
+	}
+
+	corpus, err := password.OpenBreachedPasswords(dir)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectCorpus(t, corpus)
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter, err := password.NewBloomFilter(502, 0.0001)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	for _, pw := range append(breached, "filler-0", "filler-499") {
+		if err := filter.AddHash(hashOf(pw)); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	}
+	if err := filter.AddHash("not-hex"); err == nil {
+		t.Fatalf("expected an error for an invalid hash")
+	}
+
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("failed to write filter, err: %v", err)
+	}
+
+	corpus, err := password.OpenBreachedPasswords(path)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if _, ok := corpus.(*password.BloomFilter); !ok {
+		t.Fatalf("expected a Bloom filter, got %T", corpus)
+	}
+	expectCorpus(t, corpus)
+
+	if _, err := password.ReadBloomFilter(bytes.NewReader(buf.Bytes()[:20])); err == nil {
+		t.Fatalf("expected an error for a truncated filter")
+	}
+}
+
+func TestParseHashLine(t *testing.T) {
+	hash, count, err := password.ParseHashLine(hashOf("hunter2") + ":17\r")
+	if err != nil || hash != hashOf("hunter2") || count != 17 {
+		t.Fatalf("unexpected result %q %d, err: %v", hash, count, err)
+	}
+	if _, count, err := password.ParseHashLine(hashOf("hunter2")); err != nil || count != 1 {
+		t.Fatalf("expected a count of 1, got %d, err: %v", count, err)
+	}
+	for _, line := range []string{"ABC:1", hashOf("hunter2") + ":many"} {
+		if _, _, err := password.ParseHashLine(line); err == nil {
+			t.Fatalf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	corpus, err := password.LoadBreachedPasswords(&config.Config{BreachedPasswordsFile: "ignored"})
+	if err != nil || corpus != nil {
+		t.Fatalf("expected no corpus when the check is off, got %v, err: %v", corpus, err)
+	}
+
+	if _, err := password.LoadBreachedPasswords(&config.Config{BreachedPasswordCheck: true}); err == nil {
+		t.Fatalf("expected an error without a file")
+	}
+	if _, err := password.LoadBreachedPasswords(&config.Config{BreachedPasswordCheck: true, BreachedPasswordsFile: "/nonexistent"}); err == nil {
+		t.Fatalf("expected an error for a missing file")
+	}
+
+	corpus, err = password.LoadBreachedPasswords(&config.Config{BreachedPasswordCheck: true, BreachedPasswordsFile: writeSortedHashes(t)})
+	if err != nil || corpus == nil {
+		t.Fatalf("expected a corpus, got %v, err: %v", corpus, err)
+	}
+}
@@ -0,0 +1,314 @@
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// ErrMismatchedPassword is returned by Verify when the password does not match the hash.
+var ErrMismatchedPassword = errors.New("password does not match the hash")
+
+// ErrUnknownPepper is returned by Verify when the hash uses a pepper that is neither the current nor a previous one.
+// The password cannot be checked, the user has to reset it.
+var ErrUnknownPepper = errors.New("password hash uses a pepper that is not configured")
+
+// Hasher hashes passwords and checks them against stored hashes, the algorithm is picked by PASSWORD_HASH_ALGORITHM.
+type Hasher interface {
+	// Hash returns the hash of the password in PHC string format.
+	Hash(password string) (string, error)
+	// Verify checks the password against a hash of any supported algorithm, a mismatch is ErrMismatchedPassword.
+	Verify(hash string, password string) error
+	// NeedsRehash tells whether the hash was made with another algorithm, other parameters or another pepper than Hash uses now.
+	NeedsRehash(hash string) bool
+}
+
+type Argon2idParams struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// Options configures the Hasher. Pepper, when set, is mixed into every argon2id hash and kept out of the database.
+// PreviousPeppers still verify the hashes made with them, which are then rehashed with Pepper.
+type Options struct {
+	Algorithm       string
+	Argon2id        Argon2idParams
+	BcryptCost      int
+	Pepper          string
+	PreviousPeppers []string
+}
+
+// DefaultOptions follow the OWASP recommendation for argon2id.
+func DefaultOptions() Options {
+	return Options{
+		Algorithm: AlgorithmArgon2id,
+		Argon2id: Argon2idParams{
+			Memory:      19 * 1024,
+			Iterations:  2,
+			Parallelism: 1,
+		},
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+type hasher struct {
+	opts Options
+	// keyID names the pepper in the hashes, so a changed pepper is noticed instead of failing every login.
+	keyID string
+	// peppers holds the current and previous peppers by key ID.
+	peppers map[string]string
+}
+
+// New creates the hasher configured by cfg.
+func New(cfg *config.Config) (Hasher, error) {
+	return NewHasher(Options{
+		Algorithm: cfg.PasswordHashAlgorithm,
+		Argon2id: Argon2idParams{
+			Memory:      uint32(cfg.Argon2MemoryKiB),
+			Iterations:  uint32(cfg.Argon2Iterations),
+			Parallelism: uint8(cfg.Argon2Parallelism),
+		},
+		BcryptCost:      cfg.BcryptCost,
+		Pepper:          cfg.PasswordPepper,
+		PreviousPeppers: cfg.PasswordPreviousPeppers,
+	})
+}
+
+// NewHasher creates a hasher, an error names the invalid option.
+func NewHasher(opts Options) (Hasher, error) {
+	switch opts.Algorithm {
+	case AlgorithmArgon2id:
+		if opts.Argon2id.Iterations < 1 {
+			return nil, fmt.Errorf("argon2id iterations must be at least 1, got %d", opts.Argon2id.Iterations)
+		}
+		if opts.Argon2id.Parallelism < 1 {
+			return nil, fmt.Errorf("argon2id parallelism must be between 1 and 255, got %d", opts.Argon2id.Parallelism)
+		}
+		if opts.Argon2id.Memory < 8*uint32(opts.Argon2id.Parallelism) {
+			return nil, fmt.Errorf("argon2id memory must be at least 8 KiB per lane, got %d KiB", opts.Argon2id.Memory)
+		}
+	case AlgorithmBcrypt:
+		if opts.BcryptCost < bcrypt.MinCost || opts.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, opts.BcryptCost)
+		}
+		// The bcrypt format has no room to record the pepper.
+		if opts.Pepper != "" {
+			return nil, fmt.Errorf("a password pepper needs the %s algorithm", AlgorithmArgon2id)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", opts.Algorithm)
+	}
+
+	h := &hasher{opts: opts, peppers: map[string]string{}}
+	for _, pepper := range opts.PreviousPeppers {
+		h.peppers[pepperKeyID(pepper)] = pepper
+	}
+	if opts.Pepper != "" {
+		h.keyID = pepperKeyID(opts.Pepper)
+		h.peppers[h.keyID] = opts.Pepper
+	}
+
+	return h, nil
+}
+
+func pepperKeyID(pepper string) string {
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte("keyid"))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// NewDefaultHasher creates a hasher with DefaultOptions.
+func NewDefaultHasher() Hasher {
+	return &hasher{opts: DefaultOptions()}
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	password = Normalize(password)
+	if h.opts.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.opts.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := phcArgon2id{
+		version:        argon2.Version,
+		Argon2idParams: h.opts.Argon2id,
+		keyID:          h.keyID,
+		salt:           salt,
+	}
+	p.key = p.derive(peppered(h.opts.Pepper, password))
+
+	return p.String(), nil
+}
+
+func (h *hasher) Verify(hash string, password string) error {
+	password = Normalize(password)
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrMismatchedPassword
+		}
+		return err
+	}
+
+	p, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	input := []byte(password)
+	if p.keyID != "" {
+		pepper, ok := h.peppers[p.keyID]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownPepper, p.keyID)
+		}
+		input = peppered(pepper, password)
+	}
+
+	if subtle.ConstantTimeCompare(p.derive(input), p.key) != 1 {
+		return ErrMismatchedPassword
+	}
+
+	return nil
+}
+
+func (h *hasher) NeedsRehash(hash string) bool {
+	if isBcrypt(hash) {
+		if h.opts.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.opts.BcryptCost
+	}
+
+	p, err := parseArgon2id(hash)
+	if err != nil || h.opts.Algorithm != AlgorithmArgon2id {
+		return true
+	}
+
+	return p.Argon2idParams != h.opts.Argon2id || p.keyID != h.keyID || len(p.key) != argon2idKeyLength
+}
+
+// peppered replaces the password by its HMAC with the pepper.
+func peppered(pepper string, password string) []byte {
+	if pepper == "" {
+		return []byte(password)
+	}
+
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// phcArgon2id is an argon2id hash in PHC string format:
+// $argon2id$v=19$m=19456,t=2,p=1[,keyid=<pepper id>]$<salt>$<key>, base64 without padding.
+type phcArgon2id struct {
+	Argon2idParams
+	version int
+	keyID   string
+	salt    []byte
+	key     []byte
+}
+
+func (p *phcArgon2id) derive(password []byte) []byte {
+	keyLength := uint32(argon2idKeyLength)
+	if len(p.key) > 0 {
+		keyLength = uint32(len(p.key))
+	}
+	return argon2.IDKey(password, p.salt, p.Iterations, p.Memory, p.Parallelism, keyLength)
+}
+
+func (p *phcArgon2id) String() string {
+	params := fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Iterations, p.Parallelism)
+	if p.keyID != "" {
+		params += ",keyid=" + p.keyID
+	}
+
+	return fmt.Sprintf("$%s$v=%d$%s$%s$%s", AlgorithmArgon2id, p.version, params,
+		base64.RawStdEncoding.EncodeToString(p.salt), base64.RawStdEncoding.EncodeToString(p.key))
+}
+
+func parseArgon2id(hash string) (*phcArgon2id, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgorithmArgon2id {
+		return nil, fmt.Errorf("unsupported password hash format")
+	}
+
+	p := &phcArgon2id{}
+	version, ok := strings.CutPrefix(parts[2], "v=")
+	if !ok {
+		return nil, fmt.Errorf("invalid argon2id version %q", parts[2])
+	}
+	var err error
+	if p.version, err = strconv.Atoi(version); err != nil || p.version != argon2.Version {
+		return nil, fmt.Errorf("invalid argon2id version %q", parts[2])
+	}
+
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		var n uint64
+		switch name {
+		case "m":
+			n, err = strconv.ParseUint(value, 10, 32)
+			p.Memory = uint32(n)
+		case "t":
+			n, err = strconv.ParseUint(value, 10, 32)
+			p.Iterations = uint32(n)
+		case "p":
+			n, err = strconv.ParseUint(value, 10, 8)
+			p.Parallelism = uint8(n)
+		case "keyid":
+			p.keyID = value
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid argon2id parameter %q", param)
+		}
+	}
+	if p.Iterations < 1 || p.Parallelism < 1 {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,199 @@
+package password_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+)
+
+func newHasher(t *testing.T, opts password.Options) password.Hasher {
+	t.Helper()
+
+	h, err := password.NewHasher(opts)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	return h
+}
+
+func cheapOptions() password.Options {
+	opts := password.DefaultOptions()
+	opts.Argon2id = password.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1}
+	opts.BcryptCost = bcrypt.MinCost
+	return opts
+}
+
+func expectMismatch(t *testing.T, err error) {
+	t.Helper()
+
+	if !errors.Is(err, password.ErrMismatchedPassword) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	h := newHasher(t, cheapOptions())
+
+	hash, err := h.Hash("Password.777")
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("expected a PHC string, got %q", hash)
+	}
+
+	if err := h.Verify(hash, "Password.777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectMismatch(t, h.Verify(hash, "Password.778"))
+	if h.NeedsRehash(hash) {
+		t.Fatalf("expected a current hash")
+	}
+
+	other, _ := h.Hash("Password.777")
+	if other == hash {
+		t.Fatalf("expected a new salt for every hash")
+	}
+
+	// Stronger parameters make the old hashes outdated, they still verify.
+	opts := cheapOptions()
+	opts.Argon2id.Iterations = 2
+	stronger := newHasher(t, opts)
+	if err := stronger.Verify(hash, "Password.777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if !stronger.NeedsRehash(hash) {
+		t.Fatalf("expected the hash to need a rehash")
+	}
+
+	if err := h.Verify("$argon2id$v=19$m=1024,t=1$c2FsdA$a2V5", "Password.777"); err == nil {
+		t.Fatalf("expected an error for a malformed hash")
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("Password.777"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password, err: %v", err)
+	}
+
+	t.Run("legacy hashes verify and need a rehash", func(t *testing.T) {
+		h := newHasher(t, cheapOptions())
+		if err := h.Verify(string(legacy), "Password.777"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectMismatch(t, h.Verify(string(legacy), "Password.778"))
+		if !h.NeedsRehash(string(legacy)) {
+			t.Fatalf("expected the hash to need a rehash")
+		}
+	})
+
+	t.Run("configured algorithm", func(t *testing.T) {
+		opts := cheapOptions()
+		opts.Algorithm = password.AlgorithmBcrypt
+		h := newHasher(t, opts)
+
+		hash, err := h.Hash("Password.777")
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !strings.HasPrefix(hash, "$2a$04$") {
+			t.Fatalf("expected a bcrypt hash, got %q", hash)
+		}
+		if h.NeedsRehash(hash) {
+			t.Fatalf("expected a current hash")
+		}
+
+		opts.BcryptCost = bcrypt.MinCost + 1
+		if !newHasher(t, opts).NeedsRehash(hash) {
+			t.Fatalf("expected another cost to need a rehash")
+		}
+	})
+}
+
+func TestPepper(t *testing.T) {
+	opts := cheapOptions()
+	opts.Pepper = "pepper-1"
+	h := newHasher(t, opts)
+
+	hash, err := h.Hash("Password.777")
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if !strings.Contains(hash, ",keyid=") {
+		t.Fatalf("expected the pepper to be named in the hash, got %q", hash)
+	}
+	if strings.Contains(hash, "pepper-1") {
+		t.Fatalf("expected the pepper to stay out of the hash, got %q", hash)
+	}
+	if err := h.Verify(hash, "Password.777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectMismatch(t, h.Verify(hash, "Password.778"))
+
+	// Hashes made before the pepper was set still verify, and get upgraded.
+	unpeppered, _ := newHasher(t, cheapOptions()).Hash("Password.777")
+	if err := h.Verify(unpeppered, "Password.777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if !h.NeedsRehash(unpeppered) {
+		t.Fatalf("expected the hash to need a rehash")
+	}
+
+	// Another pepper is a configuration error, not a wrong password.
+	opts.Pepper = "pepper-2"
+	err = newHasher(t, opts).Verify(hash, "Password.777")
+	if !errors.Is(err, password.ErrUnknownPepper) {
+		t.Fatalf("expected an unknown pepper, got %v", err)
+	}
+
+	// The previous pepper still verifies its hashes, which get upgraded.
+	opts.PreviousPeppers = []string{"pepper-1"}
+	rotated := newHasher(t, opts)
+	if err := rotated.Verify(hash, "Password.777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectMismatch(t, rotated.Verify(hash, "Password.778"))
+	if !rotated.NeedsRehash(hash) {
+		t.Fatalf("expected the hash to need a rehash")
+	}
+}
+
+func TestNew(t *testing.T) {
+	valid := config.Config{
+		PasswordHashAlgorithm: password.AlgorithmArgon2id,
+		Argon2MemoryKiB:       1024,
+		Argon2Iterations:      1,
+		Argon2Parallelism:     1,
+		BcryptCost:            10,
+	}
+	if _, err := password.New(&valid); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+
+	cases := map[string]func(cfg *config.Config){
+		"unknown algorithm":   func(cfg *config.Config) { cfg.PasswordHashAlgorithm = "md5" },
+		"no iterations":       func(cfg *config.Config) { cfg.Argon2Iterations = 0 },
+		"too little memory":   func(cfg *config.Config) { cfg.Argon2MemoryKiB = 4 },
+		"no parallelism":      func(cfg *config.Config) { cfg.Argon2Parallelism = 0 },
+		"bcrypt cost too low": func(cfg *config.Config) { cfg.PasswordHashAlgorithm = password.AlgorithmBcrypt; cfg.BcryptCost = 2 },
+		"bcrypt with pepper": func(cfg *config.Config) {
+			cfg.PasswordHashAlgorithm = password.AlgorithmBcrypt
+			cfg.PasswordPepper = "pepper"
+		},
+	}
+	for name, change := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			change(&cfg)
+			if _, err := password.New(&cfg); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
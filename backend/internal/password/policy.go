@@ -0,0 +1,206 @@
+package password
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+)
+
+// MaxLength is the most PASSWORD_MAX_LENGTH allows, in characters.
+const MaxLength = 128
+
+// Rules a password can break, sent as "rule" in the violations of a rejected password.
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleCommon           = "common"
+	RuleContainsUsername = "contains_username"
+	RuleContainsEmail    = "contains_email"
+	RuleTooWeak          = "too_weak"
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// Violation is one rule of the policy a password breaks.
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+// Policy decides which new passwords are accepted. Lengths count characters, so any Unicode is allowed.
+type Policy struct {
+	MinLength   int
+	MaxLength   int
+	MinStrength int // 0 to 4, 0 turns the strength estimate off
+	blocklist   map[string]struct{}
+}
+
+// NewDefaultPolicy accepts 8 to 128 characters that are not among the built-in common passwords.
+func NewDefaultPolicy() *Policy {
+	p := &Policy{MinLength: 8, MaxLength: MaxLength, blocklist: map[string]struct{}{}}
+	_ = p.loadBlocklist(strings.NewReader(commonPasswords))
+	return p
+}
+
+// NewPolicy creates the policy configured by cfg, an error names the invalid setting.
+// The blocklist is read from PASSWORD_BLOCKLIST_FILE, or is the built-in one when it is not set.
+func NewPolicy(cfg *config.Config) (*Policy, error) {
+	if cfg.PasswordMinLength < 1 {
+		return nil, fmt.Errorf("password min length must be at least 1, got %d", cfg.PasswordMinLength)
+	}
+	if cfg.PasswordMaxLength < cfg.PasswordMinLength || cfg.PasswordMaxLength > MaxLength {
+		return nil, fmt.Errorf("password max length must be between the min length and %d, got %d", MaxLength, cfg.PasswordMaxLength)
+	}
+	if cfg.PasswordMinStrength < 0 || cfg.PasswordMinStrength > 4 {
+		return nil, fmt.Errorf("password min strength must be between 0 and 4, got %d", cfg.PasswordMinStrength)
+	}
+
+	p := &Policy{
+		MinLength:   cfg.PasswordMinLength,
+		MaxLength:   cfg.PasswordMaxLength,
+		MinStrength: cfg.PasswordMinStrength,
+		blocklist:   map[string]struct{}{},
+	}
+
+	if cfg.PasswordBlocklistFile == "" {
+		_ = p.loadBlocklist(strings.NewReader(commonPasswords))
+		return p, nil
+	}
+
+	file, err := os.Open(cfg.PasswordBlocklistFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open password blocklist: %w", err)
+	}
+	defer file.Close()
+
+	if err := p.loadBlocklist(file); err != nil {
+		return nil, fmt.Errorf("failed to read password blocklist: %w", err)
+	}
+
+	return p, nil
+}
+
+// loadBlocklist reads one password per line, lines starting with # are comments.
+func (p *Policy) loadBlocklist(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.blocklist[strings.ToLower(Normalize(line))] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+// Normalize applies the NFKC normalization, so a password typed with another keyboard or input method still matches.
+func Normalize(password string) string {
+	return norm.NFKC.String(password)
+}
+
+// Check returns every rule the password breaks, none when it is accepted.
+// The username and email of the account are not allowed in the password.
+func (p *Policy) Check(password string, username string, email string) []Violation {
+	password = Normalize(password)
+	lower := strings.ToLower(password)
+	var violations []Violation
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		violations = append(violations, Violation{RuleMinLength, fmt.Sprintf("password must be at least %d characters long", p.MinLength)})
+	}
+	if length > p.MaxLength {
+		violations = append(violations, Violation{RuleMaxLength, fmt.Sprintf("password must be at most %d characters long", p.MaxLength)})
+	}
+
+	if _, ok := p.blocklist[lower]; ok {
+		violations = append(violations, Violation{RuleCommon, "password is too common"})
+	}
+
+	if containsFold(lower, username) {
+		violations = append(violations, Violation{RuleContainsUsername, "password must not contain the username"})
+	}
+	localPart, _, _ := strings.Cut(email, "@")
+	if containsFold(lower, localPart) {
+		violations = append(violations, Violation{RuleContainsEmail, "password must not contain the email address"})
+	}
+
+	if p.MinStrength > 0 && EstimateStrength(password) < p.MinStrength {
+		violations = append(violations, Violation{RuleTooWeak, "password is too easy to guess, make it longer or less predictable"})
+	}
+
+	return violations
+}
+
+// containsFold tells whether the lowercase password contains part, parts under 3 characters are ignored.
+func containsFold(lower string, part string) bool {
+	part = strings.ToLower(Normalize(part))
+	return utf8.RuneCountInString(part) >= 3 && strings.Contains(lower, part)
+}
+
+// EstimateStrength scores from 0 to 4 how hard the password is to guess, like zxcvbn but much rougher:
+// the entropy of its character classes, without the characters that repeat or continue a sequence.
+func EstimateStrength(password string) int {
+	var lower, upper, digit, symbol, other bool
+	effective := 0
+	prev := rune(-1)
+	for _, r := range Normalize(password) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+
+		// aaa, abc and cba add little over their first character
+		if prev < 0 || r-prev > 1 || r-prev < -1 {
+			effective++
+		}
+		prev = r
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bits := float64(effective) * math.Log2(float64(pool))
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	default:
+		return 4
+	}
+}
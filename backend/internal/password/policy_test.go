@@ -0,0 +1,145 @@
+package password_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+)
+
+func rules(violations []password.Violation) []string {
+	names := make([]string, 0, len(violations))
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := password.NewDefaultPolicy()
+
+	cases := []struct {
+		name     string
+		password string
+		expected []string
+	}{
+		{name: "accepted", password: "Password.777"},
+		{name: "passphrase", password: "correct horse battery staple"},
+		{name: "unicode", password: "pässwört-密码"},
+		{name: "unicode counts characters", password: "密码密码密码密码"},
+		{name: "too short", password: "Pw.7", expected: []string{password.RuleMinLength}},
+		{name: "too long", password: strings.Repeat("x", 129), expected: []string{password.RuleMaxLength}},
+		{name: "common", password: "Qwerty123", expected: []string{password.RuleCommon}},
+		{name: "contains username", password: "my-Alice-2024", expected: []string{password.RuleContainsUsername}},
+		{name: "contains email", password: "wonderland.rabbit", expected: []string{password.RuleContainsEmail}},
+		{name: "several", password: "alice", expected: []string{password.RuleMinLength, password.RuleContainsUsername}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := rules(policy.Check(tc.password, "alice", "wonderland.rabbit@example.com"))
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestPolicyNormalizes(t *testing.T) {
+	// The fullwidth form is the same password once normalized.
+	if password.Normalize("ｐａｓｓｗｏｒｄ") != "password" {
+		t.Fatalf("expected NFKC normalization, got %q", password.Normalize("ｐａｓｓｗｏｒｄ"))
+	}
+	got := rules(password.NewDefaultPolicy().Check("ＰＡＳＳＷＯＲＤ", "", ""))
+	if len(got) != 1 || got[0] != password.RuleCommon {
+		t.Fatalf("expected the common rule, got %v", got)
+	}
+
+	h := newHasher(t, cheapOptions())
+	hash, _ := h.Hash("ｐａｓｓ-ｗｏｒｄ-７７７")
+	if err := h.Verify(hash, "pass-word-777"); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+}
+
+func TestEstimateStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		min      int
+		max      int
+	}{
+		{password: "aaaaaaaaaaaa", min: 0, max: 0},
+		{password: "abcdefgh", min: 0, max: 0},
+		{password: "12345678", min: 0, max: 0},
+		{password: "Password.777", min: 2, max: 2},
+		{password: "correct horse battery staple", min: 4, max: 4},
+		{password: "k7#Qz!9w@Lp2", min: 3, max: 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.password, func(t *testing.T) {
+			got := password.EstimateStrength(tc.password)
+			if got < tc.min || got > tc.max {
+				t.Fatalf("expected a score between %d and %d, got %d", tc.min, tc.max, got)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	valid := config.Config{PasswordMinLength: 8, PasswordMaxLength: 128, PasswordMinStrength: 3}
+
+	t.Run("built-in blocklist", func(t *testing.T) {
+		policy, err := password.NewPolicy(&valid)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		got := rules(policy.Check("password123", "", ""))
+		if len(got) != 2 || got[0] != password.RuleCommon || got[1] != password.RuleTooWeak {
+			t.Fatalf("expected the common and too weak rules, got %v", got)
+		}
+	})
+
+	t.Run("blocklist file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "blocklist.txt")
+		if err := os.WriteFile(path, []byte("# comment\n\nTrustNo1-Ever\n"), 0o600); err != nil {
+			t.Fatalf("failed to write blocklist, err: %v", err)
+		}
+		cfg := valid
+		cfg.PasswordBlocklistFile = path
+		cfg.PasswordMinStrength = 0
+
+		policy, err := password.NewPolicy(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if got := rules(policy.Check("trustno1-ever", "", "")); len(got) != 1 || got[0] != password.RuleCommon {
+			t.Fatalf("expected the common rule, got %v", got)
+		}
+		// The file replaces the built-in list.
+		if got := policy.Check("password123", "", ""); len(got) != 0 {
+			t.Fatalf("expected no violation, got %v", got)
+		}
+	})
+
+	cases := map[string]func(cfg *config.Config){
+		"min length zero":       func(cfg *config.Config) { cfg.PasswordMinLength = 0 },
+		"max under min":         func(cfg *config.Config) { cfg.PasswordMaxLength = 6 },
+		"max over 128":          func(cfg *config.Config) { cfg.PasswordMaxLength = 129 },
+		"strength over 4":       func(cfg *config.Config) { cfg.PasswordMinStrength = 5 },
+		"missing blocklist":     func(cfg *config.Config) { cfg.PasswordBlocklistFile = "/nonexistent/blocklist.txt" },
+		"negative min strength": func(cfg *config.Config) { cfg.PasswordMinStrength = -1 },
+	}
+	for name, change := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			change(&cfg)
+			if _, err := password.NewPolicy(&cfg); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
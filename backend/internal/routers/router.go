@@ -46,6 +46,7 @@ func SetupRouter(dep *dependency.Dependency) *gin.Engine {
 	r.Use(rateLimiter.RateLimit())
 
 	r.Use(sloggin.NewWithConfig(dep.Logger, logConfig))
+	r.Use(middleware.ClientInfo())
 	r.Use(middleware.ErrorHandler())
 
 	return r
@@ -1,14 +1,17 @@
 package routers_test
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/auth/credentials/idtoken"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/pquerna/otp/totp"
 	"github.com/redis/go-redis/v9"
@@ -16,15 +19,26 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
 	"github.com/paularynty/transcendence/auth-service-go/internal/routers"
 	"github.com/paularynty/transcendence/auth-service-go/internal/service"
 	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
 )
 
 func testRouterFactory(t *testing.T, testCfg *config.Config, setDBDown bool) *gin.Engine {
 	t.Helper()
 
+	r, _ := testRouterWithDependency(t, testCfg, setDBDown)
+	return r
+}
+
+// testRouterWithDependency also returns the dependency, for tests that need to look behind the API, like at sent emails.
+func testRouterWithDependency(t *testing.T, testCfg *config.Config, setDBDown bool) (*gin.Engine, *dependency.Dependency) {
+	t.Helper()
+
 	dto.InitValidator()
 
 	testLogger := testutil.NewTestLogger()
@@ -72,8 +86,10 @@ func testRouterFactory(t *testing.T, testCfg *config.Config, setDBDown bool) *gi
 
 	r := routers.SetupRouter(dep)
 	routers.UsersRouter(r.Group("/"), userService)
+	routers.OidcRouter(r.Group("/oidc"), userService)
+	routers.WellKnownRouter(r.Group("/.well-known"), userService)
 
-	return r
+	return r, dep
 }
 
 func toJSON(t *testing.T, v any) *strings.Reader {
@@ -86,6 +102,19 @@ func toJSON(t *testing.T, v any) *strings.Reader {
 	return strings.NewReader(string(b))
 }
 
+// reauthenticate passes POST /reauth with the password, so the session can do sensitive actions.
+func reauthenticate(t *testing.T, r *gin.Engine, token string) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/reauth", toJSON(t, map[string]string{"password": testPwd}))
+	req.Header.Add("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("reauth, expected: 200, got %d", w.Code)
+	}
+}
+
 var testUsername1 = "test1"
 var testEmail1 = "test1@test.com"
 var testUsername2 = "test2"
@@ -504,11 +533,30 @@ func TestUpdateProfileEndpoint(t *testing.T) {
 			name: "duplicate",
 			body: map[string]string{
 				"username": testUsername2,
-				"email":    testEmail2,
+				"email":    testEmail1,
 				"avatar":   testAvatar,
 			},
 			want: 409,
 		},
+		{
+			name: "email change without reauth",
+			body: map[string]string{
+				"username": testUsername1,
+				"email":    "new@test.com",
+			},
+			want: 401,
+			check: func(t *testing.T, body []byte) {
+				var resp struct {
+					Code string `json:"code"`
+				}
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatalf("failed to unmarshal error response: %v", err)
+				}
+				if resp.Code != "reauth_required" {
+					t.Fatalf("expected code reauth_required, got %q", resp.Code)
+				}
+			},
+		},
 		{name: "missing body", body: nil, want: 400},
 	}
 
@@ -779,6 +827,291 @@ func TestGoogleOAuthEndpoints(t *testing.T) {
 			t.Fatalf("expected: 400, got %d", w.Code)
 		}
 	})
+
+	t.Run("link and unlink", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+		r.ServeHTTP(w, req)
+		if w.Code != 201 {
+			t.Fatalf("setup register failed, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByUsernameRequest))
+		r.ServeHTTP(w, req)
+		var loggedIn dto.UserWithTokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &loggedIn); err != nil {
+			t.Fatalf("failed to decode login response, err: %v", err)
+		}
+
+		// Linking needs a recent re-authentication, like the other sensitive actions.
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/google/link", nil)
+		req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+		r.ServeHTTP(w, req)
+		if w.Code != 401 || !strings.Contains(w.Body.String(), "reauth_required") {
+			t.Fatalf("link without a re-authentication, expected: 401 reauth_required, got %d %s", w.Code, w.Body.String())
+		}
+
+		reauthenticate(t, r, loggedIn.Token)
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/google/link", nil)
+		req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+		r.ServeHTTP(w, req)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "accounts.google.com") {
+			t.Fatalf("link, expected: 200 with the google url, got %d %s", w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("DELETE", "/google/link", nil)
+		req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Fatalf("unlink without a linked account, expected: 400, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/google/link/confirm", toJSON(t, map[string]string{"linkToken": "nope", "password": testPwd}))
+		r.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Fatalf("confirm with an invalid link token, expected: 401, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/google/reauth", nil)
+		req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Fatalf("reauth without a linked account, expected: 400, got %d", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/password", toJSON(t, map[string]string{"newPassword": "Password.888"}))
+		req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Fatalf("set password with a password, expected: 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestGoogleOAuthBindingCookie(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/google/login", nil)
+			r.ServeHTTP(w, req)
+			if w.Code != 302 {
+				t.Fatalf("expected: 302, got %d", w.Code)
+			}
+			var binding *http.Cookie
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == "oauth_binding" {
+					binding = cookie
+				}
+			}
+			if binding == nil || binding.Value == "" || !binding.HttpOnly {
+				t.Fatalf("expected an http only binding cookie, got %v", w.Result().Cookies())
+			}
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("failed to parse location, err: %v", err)
+			}
+			state := location.Query().Get("state")
+
+			// A callback without the cookie is someone else's round trip
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/google/callback?code=abc&state="+url.QueryEscape(state), nil)
+			r.ServeHTTP(w, req)
+			if w.Code != 302 || !strings.Contains(w.Header().Get("Location"), "error=") {
+				t.Fatalf("expected a redirect with an error, got %d %s", w.Code, w.Header().Get("Location"))
+			}
+
+			// and the state cannot be used again, even with the cookie
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/google/callback?code=abc&state="+url.QueryEscape(state), nil)
+			req.AddCookie(binding)
+			r.ServeHTTP(w, req)
+			if w.Code != 302 || !strings.Contains(w.Header().Get("Location"), "error=") {
+				t.Fatalf("expected a redirect with an error, got %d %s", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestLoginByCode(t *testing.T) {
+	origExchange := service.ExchangeCodeForTokens
+	t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
+	service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{Subject: "gid-router", Claims: map[string]any{"email": "router@example.com", "email_verified": true}}, nil
+	}
+
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/google/login", nil)
+			r.ServeHTTP(w, req)
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("failed to parse location, err: %v", err)
+			}
+			cookies := w.Result().Cookies()
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/google/callback?code=abc&state="+url.QueryEscape(location.Query().Get("state")), nil)
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			r.ServeHTTP(w, req)
+			callback, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("failed to parse callback location, err: %v", err)
+			}
+			code := callback.Query().Get("code")
+			if w.Code != 302 || code == "" || callback.Query().Get("token") != "" {
+				t.Fatalf("expected a redirect with a login code only, got %d %s", w.Code, callback)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByCode", toJSON(t, map[string]string{"code": code}))
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("expected: 200, got %d %s", w.Code, w.Body.String())
+			}
+			var login dto.UserWithTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/me", nil)
+			req.Header.Set("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("profile, expected: 200, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByCode", toJSON(t, map[string]string{"code": code}))
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("reused code, expected: 401, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByCode", toJSON(t, map[string]string{}))
+			r.ServeHTTP(w, req)
+			if w.Code != 400 {
+				t.Fatalf("missing code, expected: 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestOauthProviderEndpoints(t *testing.T) {
+	testCfg := testutil.NewTestConfig()
+	testCfg.RateLimiterRequestLimit = 1000
+	r, dep := testRouterWithDependency(t, testCfg, false)
+	dep.OauthProviders["github"] = &oauth.Provider{
+		Name:         "github",
+		ClientID:     "github-client",
+		AuthorizeURL: "https://github.example.com/login/oauth/authorize",
+		RedirectURI:  "http://localhost:3003/api/users/oauth/github/callback",
+	}
+
+	t.Run("list providers", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth/providers", nil)
+		r.ServeHTTP(w, req)
+		var resp dto.OauthProvidersResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode providers response, err: %v", err)
+		}
+		if w.Code != 200 || len(resp.Providers) != 1 || resp.Providers[0] != "github" {
+			t.Fatalf("expected: 200 with github, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("login redirect", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth/github/login", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 302 {
+			t.Fatalf("expected: 302, got %d", w.Code)
+		}
+		if !strings.HasPrefix(w.Header().Get("Location"), "https://github.example.com/login/oauth/authorize?") {
+			t.Fatalf("expected redirect to the provider, got %s", w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth/gitlab/login", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 404 {
+			t.Fatalf("expected: 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("callback missing code", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth/github/callback?state=abc", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Fatalf("expected: 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("callback with invalid state", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth/github/callback?code=abc&state=abc", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 302 || !strings.Contains(w.Header().Get("Location"), "error=") {
+			t.Fatalf("expected: 302 with an error, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("link requires login", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oauth/github/link", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Fatalf("expected: 401, got %d", w.Code)
+		}
+	})
 }
 
 func TestLogoutEndpoint(t *testing.T) {
@@ -833,12 +1166,13 @@ func TestLogoutEndpoint(t *testing.T) {
 		t.Fatalf("expected token to be invalid after logout, got %d", w.Code)
 	}
 
+	// Logout only ends the current session
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/validate", nil)
 	req.Header.Add("Authorization", "Bearer "+login2.Token)
 	r.ServeHTTP(w, req)
-	if w.Code != 401 {
-		t.Fatalf("expected second token to be invalid after logout, got %d", w.Code)
+	if w.Code != 200 {
+		t.Fatalf("expected second token to stay valid after logout, got %d", w.Code)
 	}
 }
 
@@ -879,6 +1213,8 @@ func TestDeleteUserEndpoint(t *testing.T) {
 		t.Fatalf("failed to unmarshal second login response: %v", err)
 	}
 
+	reauthenticate(t, r, login.Token)
+
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("DELETE", "/me", nil)
 	req.Header.Add("Authorization", "Bearer "+login.Token)
@@ -903,6 +1239,14 @@ func TestDeleteUserEndpoint(t *testing.T) {
 	if w.Code != 401 {
 		t.Fatalf("expected second token to be invalid after deletion, got %d", w.Code)
 	}
+
+	// The account is only pending deletion, logging in restores it
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("login after deletion, expected: 200, got %d", w.Code)
+	}
 }
 
 func TestTwoFAEndpoints(t *testing.T) {
@@ -932,6 +1276,7 @@ func TestTwoFAEndpoints(t *testing.T) {
 	}
 
 	// 2FA setup
+	reauthenticate(t, r, login.Token)
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/2fa/setup", nil)
 	req.Header.Add("Authorization", "Bearer "+login.Token)
@@ -971,6 +1316,13 @@ func TestTwoFAEndpoints(t *testing.T) {
 	if w.Code != 200 {
 		t.Fatalf("2fa confirm, expected: 200, got %d", w.Code)
 	}
+	var confirmed dto.TwoFAConfirmResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmed); err != nil {
+		t.Fatalf("failed to unmarshal 2fa confirm response: %v", err)
+	}
+	if len(confirmed.RecoveryCodes) != service.RecoveryCodeCount {
+		t.Fatalf("2fa confirm, expected %d recovery codes, got %d", service.RecoveryCodeCount, len(confirmed.RecoveryCodes))
+	}
 
 	// login now returns 428
 	w = httptest.NewRecorder()
@@ -995,13 +1347,28 @@ func TestTwoFAEndpoints(t *testing.T) {
 		t.Fatalf("2fa submit invalid, expected: 400, got %d", w.Code)
 	}
 
-	// 2FA submit happy
+	// 2FA submit the code already used to confirm
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/2fa", toJSON(t, map[string]string{
 		"twoFaCode":    twoFACode,
 		"sessionToken": pending.SessionToken,
 	}))
 	r.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatalf("2fa submit replayed code, expected: 400, got %d", w.Code)
+	}
+
+	// 2FA submit happy, with the code of the next time step
+	nextTwoFACode, err := totp.GenerateCode(setup.TwoFASecret, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Fatalf("failed to generate 2fa code: %v", err)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/2fa", toJSON(t, map[string]string{
+		"twoFaCode":    nextTwoFACode,
+		"sessionToken": pending.SessionToken,
+	}))
+	r.ServeHTTP(w, req)
 	if w.Code != 200 {
 		t.Fatalf("2fa submit, expected: 200, got %d", w.Code)
 	}
@@ -1023,7 +1390,7 @@ func TestTwoFAEndpoints(t *testing.T) {
 	}
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/2fa", toJSON(t, map[string]string{
-		"twoFaCode":    twoFACode,
+		"recoveryCode": confirmed.RecoveryCodes[0],
 		"sessionToken": pending2.SessionToken,
 	}))
 	r.ServeHTTP(w, req)
@@ -1035,7 +1402,45 @@ func TestTwoFAEndpoints(t *testing.T) {
 		t.Fatalf("failed to unmarshal 2fa submit second response: %v", err)
 	}
 
+	// Regenerate recovery codes
+	reauthenticate(t, r, afterChallenge2.Token)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/2fa/recovery-codes", toJSON(t, map[string]string{
+		"password": testPwd,
+	}))
+	req.Header.Add("Authorization", "Bearer "+afterChallenge2.Token)
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("regenerate recovery codes, expected: 200, got %d", w.Code)
+	}
+	var regenerated dto.RecoveryCodesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &regenerated); err != nil {
+		t.Fatalf("failed to unmarshal recovery codes response: %v", err)
+	}
+
+	// Login with a recovery code
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByUsernameRequest))
+	r.ServeHTTP(w, req)
+	if w.Code != 428 {
+		t.Fatalf("login with 2fa enabled, expected: 428, got %d", w.Code)
+	}
+	var pending3 dto.TwoFAPendingUserResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &pending3); err != nil {
+		t.Fatalf("failed to unmarshal 2fa pending response: %v", err)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/2fa", toJSON(t, map[string]string{
+		"recoveryCode": regenerated.RecoveryCodes[0],
+		"sessionToken": pending3.SessionToken,
+	}))
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("2fa submit recovery code, expected: 200, got %d", w.Code)
+	}
+
 	// 2FA disable wrong password
+	reauthenticate(t, r, afterChallenge.Token)
 	w = httptest.NewRecorder()
 	req, _ = http.NewRequest("PUT", "/2fa/disable", toJSON(t, map[string]string{"password": "WrongPassword.123"}))
 	req.Header.Add("Authorization", "Bearer "+afterChallenge.Token)
@@ -1099,6 +1504,9 @@ func TestAuthRequiredEndpoints(t *testing.T) {
 		{name: "update profile", method: http.MethodPut, path: "/me"},
 		{name: "logout", method: http.MethodDelete, path: "/logout"},
 		{name: "delete me", method: http.MethodDelete, path: "/me"},
+		{name: "list sessions", method: http.MethodGet, path: "/me/sessions"},
+		{name: "revoke session", method: http.MethodDelete, path: "/me/sessions/1"},
+		{name: "reauth", method: http.MethodPost, path: "/reauth"},
 		{name: "2fa setup", method: http.MethodPost, path: "/2fa/setup"},
 		{name: "2fa confirm", method: http.MethodPost, path: "/2fa/confirm"},
 		{name: "2fa disable", method: http.MethodPut, path: "/2fa/disable"},
@@ -1159,6 +1567,7 @@ func TestValidationMissingBody(t *testing.T) {
 	if login.Token == "" {
 		t.Fatalf("login user, expected token to be set")
 	}
+	reauthenticate(t, r, login.Token)
 
 	type validationErrorResp struct {
 		Error []string `json:"error"`
@@ -1223,3 +1632,1284 @@ func TestValidationMissingBody(t *testing.T) {
 		})
 	}
 }
+
+func TestRefreshTokenEndpoint(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	refresh := func(t *testing.T, r *gin.Engine, refreshToken string) (int, dto.RefreshTokenResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/token/refresh", toJSON(t, map[string]string{"refreshToken": refreshToken}))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+
+		var resp dto.RefreshTokenResponse
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal refresh response: %v", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	validate := func(t *testing.T, r *gin.Engine, token string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/validate", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("setup login failed, got %d", w.Code)
+			}
+			var login dto.UserWithTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+			if login.RefreshToken == "" {
+				t.Fatalf("expected refresh token to be set")
+			}
+
+			// Rotation
+			code, rotated := refresh(t, r, login.RefreshToken)
+			if code != 200 {
+				t.Fatalf("refresh, expected: 200, got %d", code)
+			}
+			if rotated.Token == "" || rotated.Token == login.Token {
+				t.Fatalf("expected a new access token")
+			}
+			if rotated.RefreshToken == "" || rotated.RefreshToken == login.RefreshToken {
+				t.Fatalf("expected a new refresh token")
+			}
+			if code := validate(t, r, login.Token); code != 401 {
+				t.Fatalf("expected old access token to be invalid after refresh, got %d", code)
+			}
+			if code := validate(t, r, rotated.Token); code != 200 {
+				t.Fatalf("expected new access token to be valid, got %d", code)
+			}
+
+			// Reuse of the old refresh token revokes the whole family
+			if code, _ := refresh(t, r, login.RefreshToken); code != 401 {
+				t.Fatalf("refresh token reuse, expected: 401, got %d", code)
+			}
+			if code, _ := refresh(t, r, rotated.RefreshToken); code != 401 {
+				t.Fatalf("expected rotated refresh token to be revoked, got %d", code)
+			}
+			if code := validate(t, r, rotated.Token); code != 401 {
+				t.Fatalf("expected access token of the revoked family to be invalid, got %d", code)
+			}
+
+			if code, _ := refresh(t, r, "not-a-refresh-token"); code != 401 {
+				t.Fatalf("invalid refresh token, expected: 401, got %d", code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/token/refresh", strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+			if w.Code != 400 {
+				t.Fatalf("missing refresh token, expected: 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenWithoutExpiry(t *testing.T) {
+	testCfg := testutil.NewTestConfig()
+	testCfg.RateLimiterRequestLimit = 1000
+	testCfg.RedisURL = "redis"
+	testCfg.IsRedisEnabled = true
+	r, dep := testRouterWithDependency(t, testCfg, false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+	r.ServeHTTP(w, req)
+	if w.Code != 201 {
+		t.Fatalf("setup register failed, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("setup login failed, got %d", w.Code)
+	}
+	var login dto.UserWithTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+		t.Fatalf("failed to unmarshal login response: %v", err)
+	}
+
+	// A refresh token that expired between the read and the update is recreated without an expiry, it must not be usable
+	ctx := context.Background()
+	keys, err := dep.Redis.Keys(ctx, service.RefreshTokenPrefix+"*").Result()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("expected one refresh token key, got %v, err: %v", keys, err)
+	}
+	if err := dep.Redis.Persist(ctx, keys[0]).Err(); err != nil {
+		t.Fatalf("failed to drop the expiry, err: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/token/refresh", toJSON(t, map[string]string{"refreshToken": login.RefreshToken}))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	if w.Code != 401 {
+		t.Fatalf("refresh without expiry, expected: 401, got %d", w.Code)
+	}
+	if exists, _ := dep.Redis.Exists(ctx, keys[0]).Result(); exists != 0 {
+		t.Fatalf("expected the refresh token key to be removed")
+	}
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	const firefoxUA = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	const chromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"
+
+	login := func(t *testing.T, r *gin.Engine, userAgent string) dto.UserWithTokenResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "203.0.113.7:41000"
+		r.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("setup login failed, got %d", w.Code)
+		}
+		var user dto.UserWithTokenResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+			t.Fatalf("failed to unmarshal login response: %v", err)
+		}
+		return user
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+
+			laptop := login(t, r, firefoxUA)
+			desktop := login(t, r, chromeUA)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/me/sessions", nil)
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("list sessions, expected: 200, got %d", w.Code)
+			}
+			var sessions []dto.SessionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+				t.Fatalf("failed to unmarshal sessions response: %v", err)
+			}
+			if len(sessions) != 2 {
+				t.Fatalf("expected 2 sessions, got %d", len(sessions))
+			}
+
+			var desktopSessionID string
+			for _, session := range sessions {
+				switch session.DeviceLabel {
+				case "Firefox on Linux":
+					if !session.Current {
+						t.Fatalf("expected laptop session to be current")
+					}
+				case "Chrome on Windows":
+					if session.Current {
+						t.Fatalf("expected desktop session not to be current")
+					}
+					desktopSessionID = session.ID
+				default:
+					t.Fatalf("unexpected device label: %q", session.DeviceLabel)
+				}
+				if session.UserAgent == "" || session.ClientIP != "203.0.113.7" || session.CreatedAt == 0 || session.LastUsedAt == 0 {
+					t.Fatalf("expected session metadata to be set, got %+v", session)
+				}
+			}
+
+			// Revoking needs a recent re-authentication of the session
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/sessions/"+desktopSessionID, nil)
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 || !strings.Contains(w.Body.String(), `"code":"reauth_required"`) {
+				t.Fatalf("revoke session without reauth, expected: 401 reauth_required, got %d %s", w.Code, w.Body.String())
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/reauth", toJSON(t, map[string]string{"password": "WrongPassword.123"}))
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("reauth wrong password, expected: 401, got %d", w.Code)
+			}
+
+			reauthenticate(t, r, laptop.Token)
+
+			// The claim belongs to the laptop session only
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/trusted-devices", nil)
+			req.Header.Add("Authorization", "Bearer "+desktop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("revoke devices from another session, expected: 401, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/sessions/"+desktopSessionID, nil)
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 204 {
+				t.Fatalf("revoke session, expected: 204, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/validate", nil)
+			req.Header.Add("Authorization", "Bearer "+desktop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("expected revoked session token to be invalid, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/token/refresh", toJSON(t, map[string]string{"refreshToken": desktop.RefreshToken}))
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("expected revoked session refresh token to be invalid, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/sessions/"+desktopSessionID, nil)
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 404 {
+				t.Fatalf("revoke missing session, expected: 404, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/validate", nil)
+			req.Header.Add("Authorization", "Bearer "+laptop.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("expected current session to stay valid, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestJwksEndpoint(t *testing.T) {
+	testCfg := testutil.NewTestConfig()
+	r := testRouterFactory(t, testCfg, false)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected: 200, got %d", w.Code)
+	}
+
+	var resp dto.JWKSResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal jwks response: %v", err)
+	}
+	if resp.Keys == nil {
+		t.Fatalf("expected keys to be an array")
+	}
+}
+
+func TestOidcEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	// RFC 7636 appendix B
+	const codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const codeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	authorizeRequest := dto.OidcAuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "test-client",
+		RedirectURI:         "http://localhost:4000/callback",
+		Scope:               "openid profile",
+		State:               "xyz",
+		Nonce:               "n-0S6_WzA2Mj",
+		CodeChallenge:       codeChallenge,
+		CodeChallengeMethod: "S256",
+	}
+
+	exchange := func(t *testing.T, r *gin.Engine, code string) *httptest.ResponseRecorder {
+		t.Helper()
+		form := url.Values{}
+		form.Set("grant_type", "authorization_code")
+		form.Set("code", code)
+		form.Set("redirect_uri", authorizeRequest.RedirectURI)
+		form.Set("client_id", authorizeRequest.ClientID)
+		form.Set("code_verifier", codeVerifier)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oidc/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			// Discovery
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("discovery, expected: 200, got %d", w.Code)
+			}
+			var discovery dto.OidcDiscoveryResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+				t.Fatalf("failed to unmarshal discovery response: %v", err)
+			}
+			if discovery.Issuer != testCfg.OidcIssuer || discovery.TokenEndpoint != testCfg.OidcIssuer+"/api/oidc/token" {
+				t.Fatalf("unexpected discovery document: %+v", discovery)
+			}
+
+			// The authorization endpoint sends the user to the frontend
+			query := url.Values{}
+			query.Set("response_type", authorizeRequest.ResponseType)
+			query.Set("client_id", authorizeRequest.ClientID)
+			query.Set("redirect_uri", authorizeRequest.RedirectURI)
+			query.Set("scope", authorizeRequest.Scope)
+			query.Set("state", authorizeRequest.State)
+			query.Set("code_challenge", authorizeRequest.CodeChallenge)
+			query.Set("code_challenge_method", authorizeRequest.CodeChallengeMethod)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/oidc/authorize?"+query.Encode(), nil)
+			r.ServeHTTP(w, req)
+			if w.Code != 302 {
+				t.Fatalf("authorize, expected: 302, got %d", w.Code)
+			}
+			if !strings.HasPrefix(w.Header().Get("Location"), testCfg.FrontendUrl+"/oidc/authorize?") {
+				t.Fatalf("expected redirect to the frontend, got %s", w.Header().Get("Location"))
+			}
+
+			query.Set("redirect_uri", "http://evil.example.com/callback")
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/oidc/authorize?"+query.Encode(), nil)
+			r.ServeHTTP(w, req)
+			if w.Code != 400 {
+				t.Fatalf("unregistered redirect uri, expected: 400, got %d", w.Code)
+			}
+
+			// Issuing a code requires a logged in user
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/oidc/authorize", toJSON(t, authorizeRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("authorize without login, expected: 401, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("setup login failed, got %d", w.Code)
+			}
+			var login dto.UserWithTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/oidc/authorize", toJSON(t, authorizeRequest))
+			req.Header.Add("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("authorize, expected: 200, got %d", w.Code)
+			}
+			var authorized dto.OidcAuthorizeResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &authorized); err != nil {
+				t.Fatalf("failed to unmarshal authorize response: %v", err)
+			}
+			redirectURL, err := url.Parse(authorized.RedirectURL)
+			if err != nil {
+				t.Fatalf("failed to parse redirect url: %v", err)
+			}
+			code := redirectURL.Query().Get("code")
+			if code == "" || redirectURL.Query().Get("state") != authorizeRequest.State {
+				t.Fatalf("unexpected redirect url: %s", authorized.RedirectURL)
+			}
+
+			// Token
+			w = exchange(t, r, code)
+			if w.Code != 200 {
+				t.Fatalf("token, expected: 200, got %d", w.Code)
+			}
+			var tokens dto.OidcTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+				t.Fatalf("failed to unmarshal token response: %v", err)
+			}
+			if tokens.AccessToken == "" || tokens.IDToken == "" || tokens.TokenType != "Bearer" {
+				t.Fatalf("unexpected token response: %+v", tokens)
+			}
+
+			// The code is single-use
+			w = exchange(t, r, code)
+			if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_grant") {
+				t.Fatalf("code reuse, expected: 400 invalid_grant, got %d %s", w.Code, w.Body.String())
+			}
+
+			// Userinfo
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/oidc/userinfo", nil)
+			req.Header.Add("Authorization", "Bearer "+tokens.AccessToken)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("userinfo, expected: 200, got %d", w.Code)
+			}
+			var userInfo dto.OidcUserInfoResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &userInfo); err != nil {
+				t.Fatalf("failed to unmarshal userinfo response: %v", err)
+			}
+			if userInfo.PreferredUsername != testUsername1 {
+				t.Fatalf("expected username %s, got %s", testUsername1, userInfo.PreferredUsername)
+			}
+
+			// Our own user tokens are not OIDC access tokens
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/oidc/userinfo", nil)
+			req.Header.Add("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("userinfo with user token, expected: 401, got %d", w.Code)
+			}
+		})
+	}
+}
+
+// createTestServiceClient registers a service client in the db of the test router.
+func createTestServiceClient(t *testing.T, testCfg *config.Config, clientID string) string {
+	t.Helper()
+
+	testLogger := testutil.NewTestLogger()
+	myDB, err := db.GetDB(testCfg.DbAddress, testLogger)
+	if err != nil {
+		t.Fatalf("failed to open the test db, err: %v", err)
+	}
+	t.Cleanup(func() {
+		db.CloseDB(myDB, testLogger)
+	})
+
+	cfg := *testCfg
+	cfg.IsRedisEnabled = false
+	userService, err := service.NewUserService(testutil.NewTestDependency(&cfg, myDB, nil, testLogger))
+	if err != nil {
+		t.Fatalf("failed to create user service, err: %v", err)
+	}
+
+	secret, err := userService.CreateServiceClient(context.Background(), clientID, clientID)
+	if err != nil {
+		t.Fatalf("failed to create service client, err: %v", err)
+	}
+
+	return secret
+}
+
+func TestServiceClientEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	introspect := func(t *testing.T, r *gin.Engine, token string, authorize func(req *http.Request)) (int, dto.IntrospectResponse) {
+		t.Helper()
+		form := url.Values{}
+		form.Set("token", token)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/oidc/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		authorize(req)
+		r.ServeHTTP(w, req)
+
+		var resp dto.IntrospectResponse
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal introspection response: %v", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+			secret := createTestServiceClient(t, testCfg, "game")
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByEmailRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("setup login failed, got %d", w.Code)
+			}
+			var login dto.UserWithTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			// client_credentials grant
+			form := url.Values{}
+			form.Set("grant_type", "client_credentials")
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/oidc/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("game", secret)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("client_credentials, expected: 200, got %d", w.Code)
+			}
+			var serviceToken dto.OidcTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &serviceToken); err != nil {
+				t.Fatalf("failed to unmarshal token response: %v", err)
+			}
+
+			form.Set("client_id", "game")
+			form.Set("client_secret", "nope")
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/oidc/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("client_credentials with wrong secret, expected: 401, got %d", w.Code)
+			}
+
+			// A service token is not accepted where a user is required
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/me", nil)
+			req.Header.Add("Authorization", "Bearer "+serviceToken.AccessToken)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("service token on a user route, expected: 401, got %d", w.Code)
+			}
+
+			// and a user token is not accepted where a service is required
+			if code, _ := introspect(t, r, login.Token, bearer(login.Token)); code != 401 {
+				t.Fatalf("introspect with user token, expected: 401, got %d", code)
+			}
+			if code, _ := introspect(t, r, login.Token, func(req *http.Request) {}); code != 401 {
+				t.Fatalf("introspect without credentials, expected: 401, got %d", code)
+			}
+
+			code, resp := introspect(t, r, login.Token, bearer(serviceToken.AccessToken))
+			if code != 200 {
+				t.Fatalf("introspect, expected: 200, got %d", code)
+			}
+			if !resp.Active || resp.Username != testUsername1 || resp.TokenType != "USER" {
+				t.Fatalf("unexpected introspection response: %+v", resp)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/logout", nil)
+			req.Header.Add("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 204 {
+				t.Fatalf("logout, expected: 204, got %d", w.Code)
+			}
+
+			code, resp = introspect(t, r, login.Token, func(req *http.Request) { req.SetBasicAuth("game", secret) })
+			if code != 200 {
+				t.Fatalf("introspect, expected: 200, got %d", code)
+			}
+			if resp.Active {
+				t.Fatalf("expected logged out token to be inactive")
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	login := func(t *testing.T, r *gin.Engine, identifier string, password string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/loginByIdentifier", toJSON(t, map[string]string{"identifier": identifier, "password": password}))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			testCfg.LoginBackoffBaseInSec = 0
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+
+			for i := 0; i < testCfg.LoginMaxAttempts; i++ {
+				if w := login(t, r, testUsername1, "Wrong.777"); w.Code != 401 {
+					t.Fatalf("wrong password, expected: 401, got %d", w.Code)
+				}
+				if w := login(t, r, "nobody", "Wrong.777"); w.Code != 401 {
+					t.Fatalf("unknown account, expected: 401, got %d", w.Code)
+				}
+			}
+
+			locked := login(t, r, testUsername1, testPwd)
+			if locked.Code != 429 || locked.Header().Get("Retry-After") == "" {
+				t.Fatalf("expected 429 with Retry-After, got %d %q", locked.Code, locked.Header().Get("Retry-After"))
+			}
+
+			// A lockout does not tell whether the account exists
+			unknown := login(t, r, "nobody", testPwd)
+			if unknown.Code != locked.Code || unknown.Body.String() != locked.Body.String() {
+				t.Fatalf("expected the same lockout response, got %d %s and %d %s", locked.Code, locked.Body.String(), unknown.Code, unknown.Body.String())
+			}
+		})
+	}
+}
+
+func TestTwoFAAttemptLimits(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	pendingLogin := func(t *testing.T, r *gin.Engine) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByUsernameRequest))
+		r.ServeHTTP(w, req)
+		if w.Code != 428 {
+			t.Fatalf("login with 2fa enabled, expected: 428, got %d", w.Code)
+		}
+		var pending dto.TwoFAPendingUserResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil {
+			t.Fatalf("failed to unmarshal 2fa pending response: %v", err)
+		}
+		return pending.SessionToken
+	}
+
+	submit := func(t *testing.T, r *gin.Engine, sessionToken string, code string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/2fa", toJSON(t, map[string]string{"twoFaCode": code, "sessionToken": sessionToken}))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			testCfg.LoginBackoffBaseInSec = 0
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByUsernameRequest))
+			r.ServeHTTP(w, req)
+			var login dto.UserWithTokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			reauthenticate(t, r, login.Token)
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/2fa/setup", nil)
+			req.Header.Add("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			var setup dto.TwoFASetupResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &setup); err != nil {
+				t.Fatalf("failed to unmarshal 2fa setup response: %v", err)
+			}
+			code, err := totp.GenerateCode(setup.TwoFASecret, time.Now())
+			if err != nil {
+				t.Fatalf("failed to generate 2fa code: %v", err)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/2fa/confirm", toJSON(t, map[string]string{"twoFaCode": code, "setupToken": setup.SetupToken}))
+			req.Header.Add("Authorization", "Bearer "+login.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("2fa confirm, expected: 200, got %d", w.Code)
+			}
+			nextCode, err := totp.GenerateCode(setup.TwoFASecret, time.Now().Add(30*time.Second))
+			if err != nil {
+				t.Fatalf("failed to generate 2fa code: %v", err)
+			}
+
+			// A session token stops working after too many wrong codes, even with the right one
+			sessionToken := pendingLogin(t, r)
+			for i := 0; i < testCfg.TwoFaMaxAttempts; i++ {
+				if status := submit(t, r, sessionToken, "000000"); status != 400 {
+					t.Fatalf("wrong code, expected: 400, got %d", status)
+				}
+			}
+			if status := submit(t, r, sessionToken, nextCode); status != 400 {
+				t.Fatalf("exhausted session token, expected: 400, got %d", status)
+			}
+
+			if status := submit(t, r, pendingLogin(t, r), nextCode); status != 200 {
+				t.Fatalf("new session token, expected: 200, got %d", status)
+			}
+
+			// A code works once, in any session
+			if status := submit(t, r, pendingLogin(t, r), nextCode); status != 400 {
+				t.Fatalf("replayed code, expected: 400, got %d", status)
+			}
+			if status := submit(t, r, pendingLogin(t, r), code); status != 400 {
+				t.Fatalf("code used to confirm, expected: 400, got %d", status)
+			}
+		})
+	}
+}
+
+func TestTrustedDeviceEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	login := func(t *testing.T, r *gin.Engine, cookie *http.Cookie) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/loginByIdentifier", toJSON(t, mockLoginUserByUsernameRequest))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r := testRouterFactory(t, testCfg, false)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/", toJSON(t, mockRegisterRequest))
+			r.ServeHTTP(w, req)
+			if w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			var loginResp dto.UserWithTokenResponse
+			if err := json.Unmarshal(login(t, r, nil).Body.Bytes(), &loginResp); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			reauthenticate(t, r, loginResp.Token)
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/2fa/setup", nil)
+			req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+			r.ServeHTTP(w, req)
+			var setup dto.TwoFASetupResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &setup); err != nil {
+				t.Fatalf("failed to unmarshal 2fa setup response: %v", err)
+			}
+			code, err := totp.GenerateCode(setup.TwoFASecret, time.Now())
+			if err != nil {
+				t.Fatalf("failed to generate 2fa code: %v", err)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/2fa/confirm", toJSON(t, map[string]string{"twoFaCode": code, "setupToken": setup.SetupToken}))
+			req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("2fa confirm, expected: 200, got %d", w.Code)
+			}
+			var confirm dto.TwoFAConfirmResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &confirm); err != nil {
+				t.Fatalf("failed to unmarshal 2fa confirm response: %v", err)
+			}
+
+			// Passing 2FA with rememberDevice sets the cookie
+			w = login(t, r, nil)
+			if w.Code != 428 {
+				t.Fatalf("login with 2fa enabled, expected: 428, got %d", w.Code)
+			}
+			var pending dto.TwoFAPendingUserResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil {
+				t.Fatalf("failed to unmarshal 2fa pending response: %v", err)
+			}
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", "/2fa", toJSON(t, map[string]any{
+				"recoveryCode":   confirm.RecoveryCodes[0],
+				"sessionToken":   pending.SessionToken,
+				"rememberDevice": true,
+			}))
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("2fa submit, expected: 200, got %d", w.Code)
+			}
+			var deviceCookie *http.Cookie
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == "trusted_device" {
+					deviceCookie = cookie
+				}
+			}
+			if deviceCookie == nil || deviceCookie.Value == "" || !deviceCookie.HttpOnly {
+				t.Fatalf("expected an http-only trusted_device cookie, got %+v", deviceCookie)
+			}
+			if strings.Contains(w.Body.String(), deviceCookie.Value) {
+				t.Fatalf("expected the device token to stay out of the body")
+			}
+
+			// The cookie skips the 2FA step
+			w = login(t, r, deviceCookie)
+			if w.Code != 200 {
+				t.Fatalf("login on trusted device, expected: 200, got %d", w.Code)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &loginResp); err != nil {
+				t.Fatalf("failed to unmarshal login response: %v", err)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/me/trusted-devices", nil)
+			req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+			req.AddCookie(deviceCookie)
+			r.ServeHTTP(w, req)
+			if w.Code != 200 {
+				t.Fatalf("list trusted devices, expected: 200, got %d", w.Code)
+			}
+			var devices []dto.TrustedDeviceResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &devices); err != nil {
+				t.Fatalf("failed to unmarshal trusted devices response: %v", err)
+			}
+			if len(devices) != 1 || !devices[0].Current {
+				t.Fatalf("unexpected trusted devices %+v", devices)
+			}
+
+			reauthenticate(t, r, loginResp.Token)
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/trusted-devices/unknown", nil)
+			req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 404 {
+				t.Fatalf("revoke unknown device, expected: 404, got %d", w.Code)
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/me/trusted-devices", nil)
+			req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 204 {
+				t.Fatalf("forget trusted devices, expected: 204, got %d", w.Code)
+			}
+
+			if w = login(t, r, deviceCookie); w.Code != 428 {
+				t.Fatalf("login after forgetting devices, expected: 428, got %d", w.Code)
+			}
+		})
+	}
+}
+
+// waitForLoginCode waits for the nth login code emailed to the address, and returns the code.
+func waitForLoginCode(t *testing.T, memoryMailer *mailer.MemoryMailer, to string, n int) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var codes []string
+		for _, msg := range memoryMailer.Messages() {
+			if msg.To == to && msg.Subject == "Your login code" {
+				codes = append(codes, strings.TrimSuffix(strings.Fields(msg.Body[strings.Index(msg.Body, "code is "):])[2], "."))
+			}
+		}
+		if len(codes) >= n {
+			return codes[n-1]
+		}
+	}
+
+	t.Fatalf("expected %d login codes to %s", n, to)
+	return ""
+}
+
+func TestEmailTwoFAEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	send := func(t *testing.T, r *gin.Engine, method string, path string, token string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, toJSON(t, body))
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			// The code is resent right away below
+			testCfg.TwoFaEmailResendCooldown = 0
+			r, dep := testRouterWithDependency(t, testCfg, false)
+			memoryMailer := dep.Mailer.(*mailer.MemoryMailer)
+
+			if w := send(t, r, "POST", "/", "", mockRegisterRequest); w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			var loggedIn dto.UserWithTokenResponse
+			if err := json.Unmarshal(send(t, r, "POST", "/loginByIdentifier", "", mockLoginUserByUsernameRequest).Body.Bytes(), &loggedIn); err != nil {
+				t.Fatalf("failed to decode login response, err: %v", err)
+			}
+
+			// Only a verified email can receive the codes
+			reauthenticate(t, r, loggedIn.Token)
+			if w := send(t, r, "POST", "/2fa/email/enable", loggedIn.Token, map[string]string{"password": testPwd}); w.Code != 400 {
+				t.Fatalf("unverified email, expected: 400, got %d", w.Code)
+			}
+			if err := dep.DB.Model(&db.User{}).Where("email = ?", testEmail1).Update("email_verified_at", time.Now()).Error; err != nil {
+				t.Fatalf("failed to verify email, err: %v", err)
+			}
+			w := send(t, r, "POST", "/2fa/email/enable", loggedIn.Token, map[string]string{"password": testPwd})
+			if w.Code != 200 {
+				t.Fatalf("enable email 2fa, expected: 200, got %d", w.Code)
+			}
+			var enabled dto.TwoFAConfirmResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &enabled); err != nil {
+				t.Fatalf("failed to decode enable response, err: %v", err)
+			}
+			if !enabled.TwoFA || len(enabled.RecoveryCodes) != service.RecoveryCodeCount {
+				t.Fatalf("unexpected enable response %+v", enabled)
+			}
+
+			// The login emails a code and hints at the method
+			w = send(t, r, "POST", "/loginByIdentifier", "", mockLoginUserByUsernameRequest)
+			if w.Code != 428 {
+				t.Fatalf("login with email 2fa, expected: 428, got %d", w.Code)
+			}
+			var pending dto.TwoFAPendingUserResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &pending); err != nil {
+				t.Fatalf("failed to decode pending response, err: %v", err)
+			}
+			if pending.Method != "email" {
+				t.Fatalf("expected the email method hint, got %+v", pending)
+			}
+			code := waitForLoginCode(t, memoryMailer, testEmail1, 1)
+
+			// A new code replaces the previous one
+			if w := send(t, r, "POST", "/2fa/email/send", "", map[string]string{"sessionToken": pending.SessionToken}); w.Code != 202 {
+				t.Fatalf("resend code, expected: 202, got %d", w.Code)
+			}
+			newCode := waitForLoginCode(t, memoryMailer, testEmail1, 2)
+			if code != newCode {
+				if w := send(t, r, "POST", "/2fa", "", map[string]string{"emailCode": code, "sessionToken": pending.SessionToken}); w.Code != 400 {
+					t.Fatalf("replaced code, expected: 400, got %d", w.Code)
+				}
+			}
+			w = send(t, r, "POST", "/2fa", "", map[string]string{"emailCode": newCode, "sessionToken": pending.SessionToken})
+			if w.Code != 200 {
+				t.Fatalf("email code, expected: 200, got %d", w.Code)
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &loggedIn); err != nil {
+				t.Fatalf("failed to decode 2fa response, err: %v", err)
+			}
+
+			reauthenticate(t, r, loggedIn.Token)
+			if w := send(t, r, "PUT", "/2fa/email/disable", loggedIn.Token, map[string]string{"password": testPwd}); w.Code != 200 {
+				t.Fatalf("disable email 2fa, expected: 200, got %d", w.Code)
+			}
+			if w := send(t, r, "POST", "/loginByIdentifier", "", mockLoginUserByUsernameRequest); w.Code != 200 {
+				t.Fatalf("login without 2fa, expected: 200, got %d", w.Code)
+			}
+		})
+	}
+}
+
+// waitForMailToken waits for the background sender, and returns the token of the link in the email.
+func waitForMailToken(t *testing.T, memoryMailer *mailer.MemoryMailer, to string, subject string) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, msg := range memoryMailer.Messages() {
+			if msg.To != to || msg.Subject != subject {
+				continue
+			}
+
+			start := strings.Index(msg.Body, "token=")
+			if start == -1 {
+				t.Fatalf("expected a link with a token in the email: %s", msg.Body)
+			}
+			return strings.Fields(msg.Body[start+len("token="):])[0]
+		}
+	}
+
+	t.Fatalf("expected an email %q to %s", subject, to)
+	return ""
+}
+
+func TestPasswordResetEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	post := func(t *testing.T, r *gin.Engine, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, toJSON(t, body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r, dep := testRouterWithDependency(t, testCfg, false)
+			memoryMailer := dep.Mailer.(*mailer.MemoryMailer)
+
+			if w := post(t, r, "/", mockRegisterRequest); w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			login := post(t, r, "/loginByIdentifier", mockLoginUserByUsernameRequest)
+			if login.Code != 200 {
+				t.Fatalf("setup login failed, got %d", login.Code)
+			}
+			var loggedIn dto.UserWithTokenResponse
+			if err := json.Unmarshal(login.Body.Bytes(), &loggedIn); err != nil {
+				t.Fatalf("failed to decode login response, err: %v", err)
+			}
+
+			// The same response whether the email is registered or not
+			if w := post(t, r, "/password/forgot", map[string]string{"email": "nobody@test.com"}); w.Code != 202 {
+				t.Fatalf("unknown email, expected: 202, got %d", w.Code)
+			}
+			if w := post(t, r, "/password/forgot", map[string]string{"email": testEmail1}); w.Code != 202 {
+				t.Fatalf("known email, expected: 202, got %d", w.Code)
+			}
+
+			token := waitForMailToken(t, memoryMailer, testEmail1, "Reset your password")
+
+			resetRequest := map[string]string{"token": token, "newPassword": testNewPassword}
+			if w := post(t, r, "/password/reset", resetRequest); w.Code != 200 {
+				t.Fatalf("reset, expected: 200, got %d %s", w.Code, w.Body.String())
+			}
+			if w := post(t, r, "/password/reset", resetRequest); w.Code != 400 {
+				t.Fatalf("reused token, expected: 400, got %d", w.Code)
+			}
+
+			// The sessions from before the reset are revoked
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/me", nil)
+			req.Header.Set("Authorization", "Bearer "+loggedIn.Token)
+			r.ServeHTTP(w, req)
+			if w.Code != 401 {
+				t.Fatalf("old session, expected: 401, got %d", w.Code)
+			}
+
+			if w := post(t, r, "/loginByIdentifier", map[string]string{"identifier": testUsername1, "password": testNewPassword}); w.Code != 200 {
+				t.Fatalf("login with new password, expected: 200, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestEmailVerificationEndpoints(t *testing.T) {
+	testCases := []struct {
+		name           string
+		isRedisEnabled bool
+	}{
+		{name: "db", isRedisEnabled: false},
+		{name: "redis", isRedisEnabled: true},
+	}
+
+	post := func(t *testing.T, r *gin.Engine, path string, body any, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, toJSON(t, body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testCfg := testutil.NewTestConfig()
+			testCfg.RateLimiterRequestLimit = 1000
+			testCfg.EmailVerificationPolicy = config.EmailVerificationPolicyActions
+			if tc.isRedisEnabled {
+				testCfg.RedisURL = "redis"
+				testCfg.IsRedisEnabled = true
+			}
+			r, dep := testRouterWithDependency(t, testCfg, false)
+			memoryMailer := dep.Mailer.(*mailer.MemoryMailer)
+
+			if w := post(t, r, "/", mockRegisterRequest, ""); w.Code != 201 {
+				t.Fatalf("setup register failed, got %d", w.Code)
+			}
+			login := post(t, r, "/loginByIdentifier", mockLoginUserByUsernameRequest, "")
+			if login.Code != 200 {
+				t.Fatalf("unverified login with the actions policy, expected: 200, got %d", login.Code)
+			}
+			var loggedIn dto.UserWithTokenResponse
+			if err := json.Unmarshal(login.Body.Bytes(), &loggedIn); err != nil {
+				t.Fatalf("failed to decode login response, err: %v", err)
+			}
+			if loggedIn.EmailVerified {
+				t.Fatalf("expected unverified email")
+			}
+
+			if w := post(t, r, "/2fa/setup", nil, loggedIn.Token); w.Code != 403 {
+				t.Fatalf("2fa setup with an unverified email, expected: 403, got %d", w.Code)
+			}
+
+			if w := post(t, r, "/email/verify/resend", map[string]string{"email": "nobody@test.com"}, ""); w.Code != 202 {
+				t.Fatalf("resend to unknown email, expected: 202, got %d", w.Code)
+			}
+
+			token := waitForMailToken(t, memoryMailer, testEmail1, "Verify your email")
+			verify := post(t, r, "/email/verify", map[string]string{"token": token}, "")
+			if verify.Code != 200 || !strings.Contains(verify.Body.String(), `"emailVerified":true`) {
+				t.Fatalf("verify, expected: 200 with a verified email, got %d %s", verify.Code, verify.Body.String())
+			}
+			if w := post(t, r, "/email/verify", map[string]string{"token": token}, ""); w.Code != 400 {
+				t.Fatalf("reused token, expected: 400, got %d", w.Code)
+			}
+
+			reauthenticate(t, r, loggedIn.Token)
+			if w := post(t, r, "/2fa/setup", nil, loggedIn.Token); w.Code != 200 {
+				t.Fatalf("2fa setup with a verified email, expected: 200, got %d", w.Code)
+			}
+		})
+	}
+}
@@ -15,27 +15,84 @@ func UsersRouter(r *gin.RouterGroup, userService *service.UserService) {
 	// Public endpoints
 	r.POST("/", middleware.ValidateBody[dto.CreateUserRequest](), h.CreateUserHandler)
 	r.POST("/loginByIdentifier", middleware.ValidateBody[dto.LoginUserRequest](), h.LoginUserHandler)
+	r.POST("/loginByCode", middleware.ValidateBody[dto.LoginCodeRequest](), h.LoginByCodeHandler)
 	r.POST("/2fa", middleware.ValidateBody[dto.TwoFAChallengeRequest](), h.TwoFaSubmitHandler)
+	r.POST("/2fa/email/send", middleware.ValidateBody[dto.TwoFAEmailCodeRequest](), h.SendTwoFaEmailCodeHandler)
+	r.POST("/token/refresh", middleware.ValidateBody[dto.RefreshTokenRequest](), h.RefreshTokenHandler)
+	r.POST("/password/forgot", middleware.ValidateBody[dto.ForgotPasswordRequest](), h.ForgotPasswordHandler)
+	r.POST("/password/reset", middleware.ValidateBody[dto.ResetPasswordRequest](), h.ResetPasswordHandler)
+	r.POST("/email/verify", middleware.ValidateBody[dto.VerifyEmailRequest](), h.VerifyEmailHandler)
+	r.POST("/email/verify/resend", middleware.ValidateBody[dto.ResendVerificationEmailRequest](), h.ResendVerificationEmailHandler)
 	r.GET("/google/login", h.GoogleLoginHandler)
 	r.GET("/google/callback", h.GoogleCallbackHandler)
+	r.POST("/google/link/confirm", middleware.ValidateBody[dto.GoogleLinkConfirmRequest](), h.GoogleLinkConfirmHandler)
+	r.GET("/oauth/providers", h.OauthProvidersHandler)
+	r.GET("/oauth/:provider/login", h.OauthLoginHandler)
+	r.GET("/oauth/:provider/callback", h.OauthCallbackHandler)
 
 	// Authenticated endpoints
 	auth := r.Group("")
 	auth.Use(middleware.Auth(userService))
 
+	// Sensitive actions, the session must have passed POST /reauth within REAUTH_MAX_AGE
+	recent := auth.Group("")
+	recent.Use(middleware.RequireRecentAuth(userService))
+
+	auth.POST("/reauth", middleware.ValidateBody[dto.ReauthRequest](), h.ReauthHandler)
 	auth.GET("/me", h.GetLoggedUserProfileHandler)
 	auth.PUT("/password", middleware.ValidateBody[dto.UpdateUserPasswordRequest](), h.UpdateLoggedUserPasswordHandler)
+	auth.POST("/password", middleware.ValidateBody[dto.SetUserPasswordRequest](), h.SetLoggedUserPasswordHandler)
 	auth.PUT("/me", middleware.ValidateBody[dto.UpdateUserRequest](), h.UpdateLoggedUserProfileHandler)
 	auth.DELETE("/logout", h.LogoutUserHandler)
-	auth.DELETE("/me", h.DeleteLoggedUserHandler)
+	recent.DELETE("/me", h.DeleteLoggedUserHandler)
+	auth.GET("/me/sessions", h.GetLoggedUserSessionsHandler)
+	recent.DELETE("/me/sessions/:id", h.RevokeLoggedUserSessionHandler)
+	auth.GET("/me/trusted-devices", h.GetLoggedUserTrustedDevicesHandler)
+	recent.DELETE("/me/trusted-devices", h.RevokeLoggedUserTrustedDevicesHandler)
+	recent.DELETE("/me/trusted-devices/:id", h.RevokeLoggedUserTrustedDeviceHandler)
+	recent.POST("/google/link", h.GoogleLinkHandler)
+	recent.DELETE("/google/link", h.GoogleUnlinkHandler)
+	auth.POST("/google/reauth", h.GoogleReauthHandler)
+	recent.POST("/oauth/:provider/link", h.OauthLinkHandler)
+	recent.DELETE("/oauth/:provider/link", h.OauthUnlinkHandler)
+	auth.POST("/oauth/:provider/reauth", h.OauthReauthHandler)
+
+	// Blocked for unverified emails, unless EMAIL_VERIFICATION_POLICY is "none"
+	verified := auth.Group("")
+	verified.Use(middleware.RequireVerifiedEmail(userService))
 
-	auth.POST("/2fa/setup", h.StartTwoFaSetupHandler)
-	auth.POST("/2fa/confirm", middleware.ValidateBody[dto.TwoFAConfirmRequest](), h.ConfirmTwoFaSetupHandler)
-	auth.PUT("/2fa/disable", middleware.ValidateBody[dto.DisableTwoFARequest](), h.DisableTwoFaHandler)
+	// The setup token of /2fa/setup proves the re-authentication to /2fa/confirm
+	verified.POST("/2fa/setup", middleware.RequireRecentAuth(userService), h.StartTwoFaSetupHandler)
+	verified.POST("/2fa/confirm", middleware.ValidateBody[dto.TwoFAConfirmRequest](), h.ConfirmTwoFaSetupHandler)
+	recent.PUT("/2fa/disable", middleware.ValidateBody[dto.DisableTwoFARequest](), h.DisableTwoFaHandler)
+	recent.POST("/2fa/recovery-codes", middleware.ValidateBody[dto.RegenerateRecoveryCodesRequest](), h.RegenerateRecoveryCodesHandler)
+	recent.POST("/2fa/email/enable", middleware.ValidateBody[dto.EnableEmailTwoFARequest](), h.EnableEmailTwoFaHandler)
+	recent.PUT("/2fa/email/disable", middleware.ValidateBody[dto.DisableEmailTwoFARequest](), h.DisableEmailTwoFaHandler)
 
 	auth.GET("/friends", h.GetLoggedUsersFriendsHandler)
-	auth.POST("/friends", middleware.ValidateBody[dto.AddNewFriendRequest](), h.AddFriendHandler)
+	verified.POST("/friends", middleware.ValidateBody[dto.AddNewFriendRequest](), h.AddFriendHandler)
 
 	auth.POST("/validate", h.ValidateUserHandler)
 	auth.GET("/", h.GetUsersWithLimitedInfoHandler)
 }
+
+func WellKnownRouter(r *gin.RouterGroup, userService *service.UserService) {
+	h := &handler.UserHandler{Service: userService}
+
+	r.GET("/jwks.json", h.JwksHandler)
+	r.GET("/openid-configuration", h.OidcDiscoveryHandler)
+}
+
+func OidcRouter(r *gin.RouterGroup, userService *service.UserService) {
+	h := &handler.UserHandler{Service: userService}
+
+	r.GET("/authorize", middleware.ValidateQuery[dto.OidcAuthorizeRequest](), h.OidcAuthorizeHandler)
+	r.POST("/token", h.OidcTokenHandler)
+	r.GET("/userinfo", h.OidcUserInfoHandler)
+	r.POST("/introspect", middleware.ServiceAuth(userService), h.IntrospectTokenHandler)
+
+	auth := r.Group("")
+	auth.Use(middleware.Auth(userService))
+
+	auth.POST("/authorize", middleware.RequireVerifiedEmail(userService), middleware.ValidateBody[dto.OidcAuthorizeRequest](), h.OidcAuthorizeConfirmHandler)
+}
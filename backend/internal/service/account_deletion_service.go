@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"gorm.io/gorm"
+)
+
+// deletionCutoff returns the time before which a deleted account can no longer be restored.
+func (s *UserService) deletionCutoff() time.Time {
+	return time.Now().Add(-time.Duration(s.Dep.Cfg.AccountDeletionGracePeriodInSec) * time.Second)
+}
+
+// The queries below use the classic API, gorm.G starts a new session that drops Unscoped.
+
+// restoreDeletedUser cancels the pending deletion of the user, when it is still within the grace period.
+func (s *UserService) restoreDeletedUser(ctx context.Context, userID uint) error {
+	return s.Dep.DB.WithContext(ctx).Unscoped().Model(&model.User{}).
+		Where("id = ? AND deleted_at > ?", userID, s.deletionCutoff()).
+		Update("deleted_at", nil).Error
+}
+
+// findLoginUser loads the user of a login step, an account pending deletion included, so it can finish the login.
+func (s *UserService) findLoginUser(ctx context.Context, userID uint) (model.User, error) {
+	var modelUser model.User
+	err := s.Dep.DB.WithContext(ctx).Unscoped().Preload("Identities").
+		Where("id = ? AND (deleted_at IS NULL OR deleted_at > ?)", userID, s.deletionCutoff()).
+		First(&modelUser).Error
+	return modelUser, err
+}
+
+// restoreOnLogin restores an account pending deletion once its login has succeeded, the 2FA step included.
+func (s *UserService) restoreOnLogin(ctx context.Context, modelUser *model.User) error {
+	if !modelUser.DeletedAt.Valid {
+		return nil
+	}
+
+	if err := s.restoreDeletedUser(ctx, modelUser.ID); err != nil {
+		return err
+	}
+	modelUser.DeletedAt = gorm.DeletedAt{}
+	return nil
+}
+
+// PurgeDeletedUsers deletes for good the accounts whose grace period is over, their data goes with them, and returns how many it deleted.
+func (s *UserService) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	res := s.Dep.DB.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at <= ?", s.deletionCutoff()).
+		Delete(&model.User{})
+	return res.RowsAffected, res.Error
+}
+
+// RunAccountPurge calls PurgeDeletedUsers every ACCOUNT_PURGE_INTERVAL_IN_SECONDS until ctx is done.
+func (s *UserService) RunAccountPurge(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.Dep.Cfg.AccountPurgeIntervalInSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.PurgeDeletedUsers(ctx)
+		if err != nil {
+			s.Dep.Logger.Warn("failed to purge deleted accounts", "err", err)
+		} else if purged > 0 {
+			s.Dep.Logger.Info("purged deleted accounts", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
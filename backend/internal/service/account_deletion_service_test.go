@@ -0,0 +1,213 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"gorm.io/gorm"
+)
+
+// deleteAlice creates alice with a session and bob as her friend, then deletes alice.
+func deleteAlice(t *testing.T, userService *service.UserService, myDB *gorm.DB) (model.User, *dto.UserWithoutTokenResponse) {
+	t.Helper()
+
+	alice := createPasswordUser(t, myDB)
+	bob := registerUser(t, userService)
+	if err := userService.AddNewFriend(context.Background(), bob.ID, &dto.AddNewFriendRequest{UserID: alice.ID}); err != nil {
+		t.Fatalf("failed to add friend, err: %v", err)
+	}
+	loginAlice(t, userService, "")
+
+	if err := userService.DeleteUser(context.Background(), alice.ID); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+
+	return alice, bob
+}
+
+func TestAccountDeletion(t *testing.T) {
+	t.Run("pending deletion hides the account", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice, bob := deleteAlice(t, userService, myDB)
+
+		var deleted model.User
+		if err := myDB.Unscoped().First(&deleted, alice.ID).Error; err != nil {
+			t.Fatalf("expected the account to be kept, err: %v", err)
+		}
+		if !deleted.DeletedAt.Valid {
+			t.Fatalf("expected the account to be pending deletion")
+		}
+
+		count, err := gorm.G[model.Token](myDB).Where("user_id = ?", alice.ID).Count(context.Background(), "id")
+		if err != nil || count != 0 {
+			t.Fatalf("expected no sessions left, got %d, err: %v", count, err)
+		}
+
+		users, err := userService.GetAllUsersLimitedInfo(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(users) != 1 || users[0].ID != bob.ID {
+			t.Fatalf("expected only bob to be listed, got %+v", users)
+		}
+
+		friends, err := userService.GetUserFriends(context.Background(), bob.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(friends) != 0 {
+			t.Fatalf("expected no friends listed, got %+v", friends)
+		}
+
+		err = userService.AddNewFriend(context.Background(), bob.ID, &dto.AddNewFriendRequest{UserID: alice.ID})
+		expectAuthErrorStatus(t, err, 404)
+	})
+
+	t.Run("login restores the account", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice, bob := deleteAlice(t, userService, myDB)
+
+		if result := loginAlice(t, userService, ""); result.User == nil || result.User.ID != alice.ID {
+			t.Fatalf("expected the login to succeed, got %+v", result)
+		}
+
+		if _, err := gorm.G[model.User](myDB).Where("id = ?", alice.ID).First(context.Background()); err != nil {
+			t.Fatalf("expected the account to be restored, err: %v", err)
+		}
+		friends, err := userService.GetUserFriends(context.Background(), bob.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(friends) != 1 {
+			t.Fatalf("expected the friendship to be restored, got %+v", friends)
+		}
+	})
+
+	t.Run("restored only once the 2FA step passes", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, alice.ID)
+		if err := userService.DeleteUser(context.Background(), alice.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectDeleted := func() {
+			t.Helper()
+			if _, err := gorm.G[model.User](myDB).Where("id = ?", alice.ID).First(context.Background()); err == nil {
+				t.Fatalf("expected the account to stay pending deletion")
+			}
+		}
+
+		if result := loginAlice(t, userService, ""); result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step, got %+v", result)
+		}
+		expectDeleted()
+
+		_, err := submitRecoveryCode(t, userService, alice.ID, "WRONG-CODE")
+		expectAuthErrorStatus(t, err, 400)
+		expectDeleted()
+
+		if _, err := submitRecoveryCode(t, userService, alice.ID, codes[0]); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if _, err := gorm.G[model.User](myDB).Where("id = ?", alice.ID).First(context.Background()); err != nil {
+			t.Fatalf("expected the account to be restored, err: %v", err)
+		}
+	})
+
+	t.Run("google login restores only once the 2FA step passes", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, alice.ID)
+		err := gorm.G[model.UserIdentity](myDB).Create(context.Background(), &model.UserIdentity{
+			UserID:   alice.ID,
+			Provider: service.GoogleProvider,
+			Subject:  "gid-alice",
+			Email:    "alice@example.com",
+			LinkedAt: time.Now(),
+			Profile:  "{}",
+		})
+		if err != nil {
+			t.Fatalf("failed to link google, err: %v", err)
+		}
+		if err := userService.DeleteUser(context.Background(), alice.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		mockGoogleAccount(t, "gid-alice", "alice@example.com", true)
+
+		state, binding := startGoogleLogin(t, userService)
+		code := googleCallbackQuery(t, userService, state, binding).Get("code")
+		if code == "" {
+			t.Fatalf("expected a login code")
+		}
+		result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: code})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step, got %+v", result)
+		}
+		if _, err := gorm.G[model.User](myDB).Where("id = ?", alice.ID).First(context.Background()); err == nil {
+			t.Fatalf("expected the account to stay pending deletion")
+		}
+	})
+
+	t.Run("google sign-in with the email of a deleted account", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice := createPasswordUser(t, myDB)
+		if err := userService.DeleteUser(context.Background(), alice.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		mockGoogleAccount(t, "gid-alice", "alice@example.com", true)
+
+		state, binding := startGoogleLogin(t, userService)
+		q := googleCallbackQuery(t, userService, state, binding)
+		if q.Get("error") == "" || q.Get("code") != "" || q.Get("linkToken") != "" {
+			t.Fatalf("expected an error, got %v", q)
+		}
+		var count int64
+		if err := myDB.Unscoped().Model(&model.User{}).Count(&count).Error; err != nil || count != 1 {
+			t.Fatalf("expected no new user, got %d, err: %v", count, err)
+		}
+	})
+
+	t.Run("purged after the grace period", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice, bob := deleteAlice(t, userService, myDB)
+
+		// Still within the grace period, nothing to purge.
+		purged, err := userService.PurgeDeletedUsers(context.Background())
+		if err != nil || purged != 0 {
+			t.Fatalf("expected nothing purged, got %d, err: %v", purged, err)
+		}
+
+		old := time.Now().Add(-time.Duration(userService.Dep.Cfg.AccountDeletionGracePeriodInSec+1) * time.Second)
+		err = myDB.Unscoped().Model(&model.User{}).Where("id = ?", alice.ID).Update("deleted_at", old).Error
+		if err != nil {
+			t.Fatalf("failed to age the deletion, err: %v", err)
+		}
+
+		_, err = userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "alice"},
+			Password:   dto.Password{Password: "Password.777"},
+		})
+		expectAuthErrorStatus(t, err, 401)
+
+		purged, err = userService.PurgeDeletedUsers(context.Background())
+		if err != nil || purged != 1 {
+			t.Fatalf("expected one account purged, got %d, err: %v", purged, err)
+		}
+		var count int64
+		err = myDB.Unscoped().Model(&model.User{}).Where("id = ?", alice.ID).Count(&count).Error
+		if err != nil || count != 0 {
+			t.Fatalf("expected the account to be gone, got %d, err: %v", count, err)
+		}
+		if _, err := gorm.G[model.User](myDB).Where("id = ?", bob.ID).First(context.Background()); err != nil {
+			t.Fatalf("expected bob to be kept, err: %v", err)
+		}
+	})
+}
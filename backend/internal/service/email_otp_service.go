@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const EmailOtpPrefix = "email_otp:"
+
+func buildEmailOtpKey(sessionHash string) string {
+	return EmailOtpPrefix + sessionHash
+}
+
+// generateEmailOtp returns a random 6-digit code.
+func generateEmailOtp() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func (s *UserService) createEmailOtpByDB(ctx context.Context, otp *model.EmailOtp) error {
+	_, err := gorm.G[model.EmailOtp](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A new code for the same session replaces the previous one.
+	return s.Dep.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"code_hash", "expires_at", "updated_at"}),
+	}).Create(otp).Error
+}
+
+func (s *UserService) createEmailOtpByRedis(ctx context.Context, otp *model.EmailOtp) error {
+	return s.Dep.Redis.Set(ctx, buildEmailOtpKey(otp.SessionHash), otp.CodeHash, time.Until(otp.ExpiresAt)).Err()
+}
+
+// emailOtpSendCounters counts the codes emailed for a session token, so the endpoint cannot be used to flood the inbox.
+func (s *UserService) emailOtpSendCounters(sessionToken string) []attemptCounter {
+	return []attemptCounter{{
+		key:          buildLoginAttemptKey("2fa_email_send", hashOpaqueToken(sessionToken)),
+		freeAttempts: s.Dep.Cfg.TwoFaEmailMaxSends,
+		maxAttempts:  s.Dep.Cfg.TwoFaEmailMaxSends,
+		cooldown:     time.Duration(s.Dep.Cfg.TwoFaEmailResendCooldown) * time.Second,
+	}}
+}
+
+// sendEmailOtp emails a code for the 2FA step of the login of sessionToken, the code lives as long as the session token.
+// Every send waits out the cooldown of the previous one, and a session token gets at most TwoFaEmailMaxSends codes.
+func (s *UserService) sendEmailOtp(ctx context.Context, modelUser *model.User, sessionToken string) error {
+	counters := s.emailOtpSendCounters(sessionToken)
+	if err := s.checkAttemptCounters(ctx, counters); err != nil {
+		return err
+	}
+	if err := s.recordFailedAttempt(ctx, counters); err != nil {
+		return err
+	}
+
+	code, err := generateEmailOtp()
+	if err != nil {
+		return err
+	}
+
+	otp := &model.EmailOtp{
+		UserID:      modelUser.ID,
+		SessionHash: hashOpaqueToken(sessionToken),
+		CodeHash:    hashOpaqueToken(code),
+		ExpiresAt:   time.Now().Add(time.Duration(s.Dep.Cfg.TwoFaTokenExpiry) * time.Second),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createEmailOtpByRedis(ctx, otp)
+	} else {
+		err = s.createEmailOtpByDB(ctx, otp)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(mailer.Message{
+		To:      modelUser.Email,
+		Subject: "Your login code",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nYour login code is %s. It expires in %d minutes.\n\nIf you did not try to log in, change your password.\n",
+			modelUser.Username, code, max(s.Dep.Cfg.TwoFaTokenExpiry/60, 1),
+		),
+	})
+
+	return nil
+}
+
+func (s *UserService) consumeEmailOtpByDB(ctx context.Context, userID uint, sessionHash string, codeHash string) (bool, error) {
+	rows, err := gorm.G[model.EmailOtp](s.Dep.DB.Unscoped()).
+		Where("user_id = ? AND session_hash = ? AND code_hash = ? AND expires_at > ?", userID, sessionHash, codeHash, time.Now()).
+		Delete(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+func (s *UserService) consumeEmailOtpByRedis(ctx context.Context, sessionHash string, codeHash string) (bool, error) {
+	key := buildEmailOtpKey(sessionHash)
+	stored, err := s.Dep.Redis.Get(ctx, key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	if stored != codeHash {
+		return false, nil
+	}
+
+	// Only one of two concurrent uses deletes the key.
+	deleted, err := s.Dep.Redis.Del(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return deleted == 1, nil
+}
+
+// consumeEmailOtp deletes the code emailed for the session token when it matches, and tells whether it did.
+func (s *UserService) consumeEmailOtp(ctx context.Context, userID uint, sessionToken string, code string) (bool, error) {
+	sessionHash := hashOpaqueToken(sessionToken)
+	codeHash := hashOpaqueToken(code)
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.consumeEmailOtpByRedis(ctx, sessionHash, codeHash)
+	}
+	return s.consumeEmailOtpByDB(ctx, userID, sessionHash, codeHash)
+}
+
+// SendTwoFAEmailCode emails a new code for a pending login, for users who also have an authenticator.
+func (s *UserService) SendTwoFAEmailCode(ctx context.Context, request *dto.TwoFAEmailCodeRequest) error {
+	claims, err := jwt.ValidateTwoFAToken(s.Dep, request.SessionToken)
+	if err != nil || claims.Type != jwt.TwoFATokenType {
+		return authError.NewAuthError(400, "invalid session token")
+	}
+
+	if err := s.checkTwoFASession(ctx, claims.ID); err != nil {
+		return err
+	}
+
+	modelUser, err := s.findLoginUser(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return authError.NewAuthError(404, "user not found")
+		}
+		return err
+	}
+
+	if !modelUser.EmailOtpEnabled {
+		return authError.NewAuthError(400, "email 2FA is not enabled for this user")
+	}
+
+	return s.sendEmailOtp(ctx, &modelUser, request.SessionToken)
+}
+
+// EnableEmailTwoFA turns on emailed codes as a second factor. When it is the first 2FA method of the user, it returns the recovery codes.
+func (s *UserService) EnableEmailTwoFA(ctx context.Context, userID uint, request *dto.EnableEmailTwoFARequest) (*dto.TwoFAConfirmResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	if modelUser.EmailOtpEnabled {
+		return nil, authError.NewAuthError(400, "email 2FA is already enabled")
+	}
+
+	if modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(400, "set a password before enabling 2FA")
+	}
+
+	// The codes would go to whoever owns an unverified email.
+	if modelUser.EmailVerifiedAt == nil {
+		return nil, authError.NewAuthError(400, "verify your email before enabling email 2FA")
+	}
+
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
+	if err != nil {
+		if errors.Is(err, password.ErrMismatchedPassword) {
+			return nil, authError.NewAuthError(401, "invalid credentials")
+		}
+		return nil, err
+	}
+
+	firstMethod := !isTwoFAEnabled(&modelUser)
+
+	var recoveryCodes []string
+	err = s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		_, err := gorm.G[model.User](tx).Where("id = ?", userID).Update(ctx, "email_otp_enabled", true)
+		if err != nil || !firstMethod {
+			return err
+		}
+
+		recoveryCodes, err = s.replaceRecoveryCodes(ctx, tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	modelUser.EmailOtpEnabled = true
+
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.TwoFAConfirmResponse{
+		UserWithTokenResponse: *userToUserWithTokenResponse(&modelUser, userTokens),
+		RecoveryCodes:         recoveryCodes,
+	}, nil
+}
+
+// DisableEmailTwoFA turns off emailed codes, and keeps the authenticator when the user has one.
+func (s *UserService) DisableEmailTwoFA(ctx context.Context, userID uint, request *dto.DisableEmailTwoFARequest) (*dto.UserWithTokenResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	if !modelUser.EmailOtpEnabled || modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(400, "email 2FA is not enabled")
+	}
+
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
+	if err != nil {
+		if errors.Is(err, password.ErrMismatchedPassword) {
+			return nil, authError.NewAuthError(401, "invalid credentials")
+		}
+		return nil, err
+	}
+
+	if err := s.turnOffTwoFAMethods(ctx, &modelUser, false, true); err != nil {
+		return nil, err
+	}
+
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return userToUserWithTokenResponse(&modelUser, userTokens), nil
+}
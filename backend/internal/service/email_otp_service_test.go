@@ -0,0 +1,300 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"gorm.io/gorm"
+)
+
+var emailOtpRegexp = regexp.MustCompile(`\b\d{6}\b`)
+
+// enableEmailTwoFA verifies the email of the user, turns on email 2FA and returns the response.
+func enableEmailTwoFA(t *testing.T, userService *service.UserService, myDB *gorm.DB, userID uint) *dto.TwoFAConfirmResponse {
+	t.Helper()
+
+	_, err := gorm.G[model.User](myDB).Where("id = ?", userID).Update(context.Background(), "email_verified_at", time.Now())
+	if err != nil {
+		t.Fatalf("failed to verify email, err: %v", err)
+	}
+
+	resp, err := userService.EnableEmailTwoFA(context.Background(), userID, &dto.EnableEmailTwoFARequest{
+		Password: dto.Password{Password: "Password.777"},
+	})
+	if err != nil {
+		t.Fatalf("failed to enable email 2FA, err: %v", err)
+	}
+
+	return resp
+}
+
+// pendingLogin logs alice in up to the 2FA step.
+func pendingLogin(t *testing.T, userService *service.UserService) *dto.TwoFAPendingUserResponse {
+	t.Helper()
+
+	result := loginAlice(t, userService, "")
+	if result.TwoFAPending == nil {
+		t.Fatalf("expected the 2FA step")
+	}
+
+	return result.TwoFAPending
+}
+
+func emailOtpFromMail(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+
+	code := emailOtpRegexp.FindString(msg.Body)
+	if code == "" {
+		t.Fatalf("expected a code in the email: %s", msg.Body)
+	}
+	return code
+}
+
+func submitEmailCode(userService *service.UserService, sessionToken string, code string) error {
+	_, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+		EmailCode:    code,
+		SessionToken: sessionToken,
+	})
+	return err
+}
+
+func TestEmailTwoFA(t *testing.T) {
+	t.Run("enable needs a verified email and the password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		_, err := userService.EnableEmailTwoFA(context.Background(), user.ID, &dto.EnableEmailTwoFARequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		expectAuthErrorStatus(t, err, 400)
+
+		_, err = gorm.G[model.User](myDB).Where("id = ?", user.ID).Update(context.Background(), "email_verified_at", time.Now())
+		if err != nil {
+			t.Fatalf("failed to verify email, err: %v", err)
+		}
+		_, err = userService.EnableEmailTwoFA(context.Background(), user.ID, &dto.EnableEmailTwoFARequest{
+			Password: dto.Password{Password: "Wrong.777"},
+		})
+		expectAuthErrorStatus(t, err, 401)
+
+		resp := enableEmailTwoFA(t, userService, myDB, user.ID)
+		if !resp.TwoFA || !slices.Equal(resp.TwoFAMethods, []string{service.TwoFAMethodEmail}) {
+			t.Fatalf("unexpected methods %v", resp.TwoFAMethods)
+		}
+		if len(resp.RecoveryCodes) != service.RecoveryCodeCount {
+			t.Fatalf("expected %d recovery codes, got %d", service.RecoveryCodeCount, len(resp.RecoveryCodes))
+		}
+
+		_, err = userService.EnableEmailTwoFA(context.Background(), user.ID, &dto.EnableEmailTwoFARequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("login emails the code", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		pending := pendingLogin(t, userService)
+		if pending.Method != service.TwoFAMethodEmail || !slices.Equal(pending.Methods, []string{service.TwoFAMethodEmail}) {
+			t.Fatalf("unexpected method hint %+v", pending)
+		}
+
+		messages := waitForMails(t, userService, 1)
+		if messages[0].To != "alice@example.com" {
+			t.Fatalf("expected email to alice, got %s", messages[0].To)
+		}
+		code := emailOtpFromMail(t, messages[0])
+
+		wrong := "000000"
+		if code == wrong {
+			wrong = "111111"
+		}
+		expectAuthErrorStatus(t, submitEmailCode(userService, pending.SessionToken, wrong), 400)
+		if err := submitEmailCode(userService, pending.SessionToken, code); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectAuthErrorStatus(t, submitEmailCode(userService, pending.SessionToken, code), 400)
+	})
+
+	t.Run("code belongs to its login", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		first := pendingLogin(t, userService)
+		code := emailOtpFromMail(t, waitForMails(t, userService, 1)[0])
+		second := pendingLogin(t, userService)
+		waitForMails(t, userService, 2)
+
+		expectAuthErrorStatus(t, submitEmailCode(userService, second.SessionToken, code), 400)
+		if err := submitEmailCode(userService, first.SessionToken, code); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("with an authenticator", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+
+		resp := enableEmailTwoFA(t, userService, myDB, user.ID)
+		if len(resp.RecoveryCodes) != 0 {
+			t.Fatalf("expected the recovery codes of the authenticator to be kept")
+		}
+		if !slices.Equal(resp.TwoFAMethods, []string{service.TwoFAMethodTotp, service.TwoFAMethodEmail}) {
+			t.Fatalf("unexpected methods %v", resp.TwoFAMethods)
+		}
+
+		// The authenticator is asked first, the code is only emailed on request.
+		pending := pendingLogin(t, userService)
+		if pending.Method != service.TwoFAMethodTotp || len(pending.Methods) != 2 {
+			t.Fatalf("unexpected method hint %+v", pending)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := len(userService.Dep.Mailer.(*mailer.MemoryMailer).Messages()); n != 0 {
+			t.Fatalf("expected no email before the request, got %d", n)
+		}
+
+		err := userService.SendTwoFAEmailCode(context.Background(), &dto.TwoFAEmailCodeRequest{SessionToken: pending.SessionToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		code := emailOtpFromMail(t, waitForMails(t, userService, 1)[0])
+		if err := submitEmailCode(userService, pending.SessionToken, code); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		// Turning email off keeps the authenticator and its recovery codes.
+		updated, err := userService.DisableEmailTwoFA(context.Background(), user.ID, &dto.DisableEmailTwoFARequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !slices.Equal(updated.TwoFAMethods, []string{service.TwoFAMethodTotp}) {
+			t.Fatalf("unexpected methods %v", updated.TwoFAMethods)
+		}
+		count, err := gorm.G[model.RecoveryCode](myDB).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil || count != int64(service.RecoveryCodeCount) {
+			t.Fatalf("expected the recovery codes to be kept, got %d, err: %v", count, err)
+		}
+
+		err = userService.SendTwoFAEmailCode(context.Background(), &dto.TwoFAEmailCodeRequest{SessionToken: pending.SessionToken})
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("resending waits for the cooldown", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		pending := pendingLogin(t, userService)
+		waitForMails(t, userService, 1)
+
+		err := userService.SendTwoFAEmailCode(context.Background(), &dto.TwoFAEmailCodeRequest{SessionToken: pending.SessionToken})
+		var authErr *authError.AuthError
+		if !errors.As(err, &authErr) || authErr.Status != 429 || authErr.RetryAfter < userService.Dep.Cfg.TwoFaEmailResendCooldown-1 {
+			t.Fatalf("expected 429 with the cooldown, got %v", err)
+		}
+
+		// Another login has its own session token.
+		other := pendingLogin(t, userService)
+		waitForMails(t, userService, 2)
+		if other.SessionToken == pending.SessionToken {
+			t.Fatalf("expected a new session token")
+		}
+	})
+
+	t.Run("resends are limited", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.TwoFaEmailResendCooldown = 0
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		// The code of the login counts as the first one.
+		pending := pendingLogin(t, userService)
+		request := &dto.TwoFAEmailCodeRequest{SessionToken: pending.SessionToken}
+		for i := 1; i < userService.Dep.Cfg.TwoFaEmailMaxSends; i++ {
+			if err := userService.SendTwoFAEmailCode(context.Background(), request); err != nil {
+				t.Fatalf("unexpected error, err: %v", err)
+			}
+		}
+		waitForMails(t, userService, userService.Dep.Cfg.TwoFaEmailMaxSends)
+
+		expectAuthErrorStatus(t, userService.SendTwoFAEmailCode(context.Background(), request), 429)
+	})
+
+	t.Run("disabling the last method", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		resp, err := userService.DisableEmailTwoFA(context.Background(), user.ID, &dto.DisableEmailTwoFARequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.TwoFA || len(resp.TwoFAMethods) != 0 {
+			t.Fatalf("expected 2FA to be off, got %v", resp.TwoFAMethods)
+		}
+
+		count, err := gorm.G[model.RecoveryCode](myDB.Unscoped()).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil || count != 0 {
+			t.Fatalf("expected no recovery codes left, got %d, err: %v", count, err)
+		}
+		if result := loginAlice(t, userService, ""); result.User == nil {
+			t.Fatalf("expected a login without 2FA")
+		}
+	})
+
+	changeEmail := func(userService *service.UserService, userID uint, token string) (*dto.UserWithoutTokenResponse, error) {
+		return userService.UpdateUserProfile(context.Background(), userID, token, &dto.UpdateUserRequest{
+			User: dto.User{
+				UserName: dto.UserName{Username: "alice"},
+				Email:    "alice.new@example.com",
+			},
+		})
+	}
+
+	t.Run("email change is refused when it is the only method", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		// The only second factor would go to an unverified address.
+		_, err := changeEmail(userService, user.ID, recentSession(t, myDB, user.ID))
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("email change turns email codes off next to an authenticator", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+		enableEmailTwoFA(t, userService, myDB, user.ID)
+
+		resp, err := changeEmail(userService, user.ID, recentSession(t, myDB, user.ID))
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.EmailVerified || !slices.Equal(resp.TwoFAMethods, []string{service.TwoFAMethodTotp}) {
+			t.Fatalf("expected an unverified email and only the authenticator, got %+v", resp)
+		}
+
+		pending := pendingLogin(t, userService)
+		err = userService.SendTwoFAEmailCode(context.Background(), &dto.TwoFAEmailCodeRequest{SessionToken: pending.SessionToken})
+		expectAuthErrorStatus(t, err, 400)
+	})
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const EmailVerificationPrefix = "email_verification:"
+
+func buildEmailVerificationKey(tokenHash string) string {
+	return EmailVerificationPrefix + tokenHash
+}
+
+func buildEmailVerificationUserKey(userID uint) string {
+	return fmt.Sprintf("%suser:%d", EmailVerificationPrefix, userID)
+}
+
+// createEmailVerificationTokenByDB stores a new token, the older tokens of the user stop working.
+func (s *UserService) createEmailVerificationTokenByDB(ctx context.Context, verificationToken *model.EmailVerificationToken) error {
+	_, err := gorm.G[model.EmailVerificationToken](s.Dep.DB.Unscoped()).Where("user_id = ? OR expires_at < ?", verificationToken.UserID, time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.EmailVerificationToken](s.Dep.DB).Create(ctx, verificationToken)
+}
+
+func (s *UserService) createEmailVerificationTokenByRedis(ctx context.Context, verificationToken *model.EmailVerificationToken) error {
+	userKey := buildEmailVerificationUserKey(verificationToken.UserID)
+
+	oldTokenHash, err := s.Dep.Redis.Get(ctx, userKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	key := buildEmailVerificationKey(verificationToken.TokenHash)
+	ttl := time.Until(verificationToken.ExpiresAt)
+	_, err = s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if oldTokenHash != "" {
+			pipe.Del(ctx, buildEmailVerificationKey(oldTokenHash))
+		}
+		pipe.HSet(ctx, key, "userId", verificationToken.UserID, "email", verificationToken.Email)
+		pipe.Expire(ctx, key, ttl)
+		pipe.Set(ctx, userKey, verificationToken.TokenHash, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// consumeEmailVerificationTokenByDB returns the token and deletes it, a token can only be used once.
+func (s *UserService) consumeEmailVerificationTokenByDB(ctx context.Context, tokenHash string) (*model.EmailVerificationToken, error) {
+	verificationToken, err := gorm.G[model.EmailVerificationToken](s.Dep.DB).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, "invalid or expired verification token")
+		}
+		return nil, err
+	}
+
+	rows, err := gorm.G[model.EmailVerificationToken](s.Dep.DB.Unscoped()).Where("id = ?", verificationToken.ID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 || time.Now().After(verificationToken.ExpiresAt) {
+		return nil, authError.NewAuthError(400, "invalid or expired verification token")
+	}
+
+	return &verificationToken, nil
+}
+
+func (s *UserService) consumeEmailVerificationTokenByRedis(ctx context.Context, tokenHash string) (*model.EmailVerificationToken, error) {
+	key := buildEmailVerificationKey(tokenHash)
+
+	var getCmd *redis.MapStringStringCmd
+	_, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := getCmd.Val()
+	if len(values) == 0 {
+		return nil, authError.NewAuthError(400, "invalid or expired verification token")
+	}
+
+	userID, err := strconv.ParseUint(values["userId"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Dep.Redis.Del(ctx, buildEmailVerificationUserKey(uint(userID))).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.EmailVerificationToken{
+		UserID:    uint(userID),
+		Email:     values["email"],
+		TokenHash: tokenHash,
+	}, nil
+}
+
+// sendVerificationEmail issues a verification token for the current email of the user and emails the link.
+func (s *UserService) sendVerificationEmail(ctx context.Context, modelUser *model.User) error {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	verificationToken := &model.EmailVerificationToken{
+		UserID:    modelUser.ID,
+		Email:     modelUser.Email,
+		TokenHash: hashOpaqueToken(token),
+		ExpiresAt: time.Now().Add(time.Duration(s.Dep.Cfg.EmailVerificationTokenExpiry) * time.Second),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createEmailVerificationTokenByRedis(ctx, verificationToken)
+	} else {
+		err = s.createEmailVerificationTokenByDB(ctx, verificationToken)
+	}
+	if err != nil {
+		return err
+	}
+
+	verifyURL := fmt.Sprintf("%s/user/verify-email?token=%s", s.Dep.Cfg.FrontendUrl, token)
+	s.sendMail(mailer.Message{
+		To:      modelUser.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nOpen the link below to confirm that this is your email:\n\n%s\n\nThe link expires in %d hours. If you did not sign up, you can ignore this email.\n",
+			modelUser.Username, verifyURL, s.Dep.Cfg.EmailVerificationTokenExpiry/3600,
+		),
+	})
+
+	return nil
+}
+
+// VerifyEmail marks the email of the token as verified, if it is still the email of the user.
+func (s *UserService) VerifyEmail(ctx context.Context, request *dto.VerifyEmailRequest) (*dto.UserWithoutTokenResponse, error) {
+	var verificationToken *model.EmailVerificationToken
+	var err error
+
+	tokenHash := hashOpaqueToken(request.Token)
+	if s.Dep.Cfg.IsRedisEnabled {
+		verificationToken, err = s.consumeEmailVerificationTokenByRedis(ctx, tokenHash)
+	} else {
+		verificationToken, err = s.consumeEmailVerificationTokenByDB(ctx, tokenHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", verificationToken.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, "invalid or expired verification token")
+		}
+		return nil, err
+	}
+
+	if modelUser.Email != verificationToken.Email {
+		return nil, authError.NewAuthError(400, "invalid or expired verification token")
+	}
+
+	if modelUser.EmailVerifiedAt == nil {
+		now := time.Now()
+		_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", modelUser.ID).Update(ctx, "email_verified_at", now)
+		if err != nil {
+			return nil, err
+		}
+		modelUser.EmailVerifiedAt = &now
+	}
+
+	return userToUserWithoutTokenResponse(&modelUser), nil
+}
+
+// ResendVerificationEmail sends a new link to an unverified email.
+// It succeeds either way, so it cannot be used to find out which emails are registered.
+func (s *UserService) ResendVerificationEmail(ctx context.Context, request *dto.ResendVerificationEmailRequest) error {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("email = ?", request.Email).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if modelUser.EmailVerifiedAt != nil {
+		return nil
+	}
+
+	return s.sendVerificationEmail(ctx, &modelUser)
+}
+
+// IsEmailVerified tells whether the user has verified their current email.
+func (s *UserService) IsEmailVerified(ctx context.Context, userID uint) (bool, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, authError.NewAuthError(404, "user not found")
+		}
+		return false, err
+	}
+
+	return modelUser.EmailVerifiedAt != nil, nil
+}
@@ -0,0 +1,129 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+)
+
+func registerUser(t *testing.T, userService *service.UserService) *dto.UserWithoutTokenResponse {
+	t.Helper()
+
+	user, err := userService.CreateUser(context.Background(), &dto.CreateUserRequest{
+		User: dto.User{
+			UserName: dto.UserName{Username: "bob"},
+			Email:    "bob@example.com",
+		},
+		Password: dto.Password{Password: "Password.777"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	return user
+}
+
+func TestEmailVerification(t *testing.T) {
+	t.Run("verify on signup", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		user := registerUser(t, userService)
+		if user.EmailVerified {
+			t.Fatalf("expected unverified email after signup")
+		}
+
+		messages := waitForMails(t, userService, 1)
+		token := tokenFromMail(t, messages[0])
+
+		verified, err := userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: token})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !verified.EmailVerified {
+			t.Fatalf("expected verified email")
+		}
+
+		_, err = userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: token})
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("email change needs a new verification", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := registerUser(t, userService)
+		oldToken := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+
+		updated, err := userService.UpdateUserProfile(context.Background(), user.ID, recentSession(t, myDB, user.ID), &dto.UpdateUserRequest{
+			User: dto.User{
+				UserName: dto.UserName{Username: "bob"},
+				Email:    "bob2@example.com",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if updated.EmailVerified {
+			t.Fatalf("expected unverified email after the change")
+		}
+
+		messages := waitForMails(t, userService, 2)
+		if messages[1].To != "bob2@example.com" {
+			t.Fatalf("expected email to the new address, got %s", messages[1].To)
+		}
+
+		// The link sent to the old email does not verify the new one
+		_, err = userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: oldToken})
+		expectAuthErrorStatus(t, err, 400)
+
+		_, err = userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: tokenFromMail(t, messages[1])})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("resend", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		registerUser(t, userService)
+		waitForMails(t, userService, 1)
+
+		err := userService.ResendVerificationEmail(context.Background(), &dto.ResendVerificationEmailRequest{Email: "bob@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		err = userService.ResendVerificationEmail(context.Background(), &dto.ResendVerificationEmailRequest{Email: "nobody@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		messages := waitForMails(t, userService, 2)
+		if _, err := userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: tokenFromMail(t, messages[1])}); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("login policy refuses unverified users", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.EmailVerificationPolicy = config.EmailVerificationPolicyLogin
+		registerUser(t, userService)
+
+		login := func() error {
+			_, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+				Identifier: dto.Identifier{Identifier: "bob"},
+				Password:   dto.Password{Password: "Password.777"},
+			})
+			return err
+		}
+
+		expectAuthErrorStatus(t, login(), 403)
+
+		token := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+		if _, err := userService.VerifyEmail(context.Background(), &dto.VerifyEmailRequest{Token: token}); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		if err := login(); err != nil {
+			t.Fatalf("expected login after verification, err: %v", err)
+		}
+	})
+}
@@ -25,7 +25,9 @@ func (s *UserService) GetAllUsersLimitedInfo(ctx context.Context) ([]dto.SimpleU
 }
 
 func (s *UserService) GetUserFriends(ctx context.Context, userID uint) ([]dto.FriendResponse, error) {
-	friends, err := gorm.G[model.Friend](s.Dep.DB).Preload("Friend", nil).Where("user_id = ?", userID).Find(ctx)
+	// Friends pending deletion are left out.
+	activeUsers := s.Dep.DB.Model(&model.User{}).Select("id")
+	friends, err := gorm.G[model.Friend](s.Dep.DB).Preload("Friend", nil).Where("user_id = ? AND friend_id IN (?)", userID, activeUsers).Find(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -54,12 +56,21 @@ func (s *UserService) AddNewFriend(ctx context.Context, userID uint, request *dt
 		return authError.NewAuthError(400, "cannot add yourself as a friend")
 	}
 
+	// The foreign key does not see accounts pending deletion.
+	_, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", request.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return authError.NewAuthError(404, "user not found")
+		}
+		return err
+	}
+
 	newFriend := model.Friend{
 		UserID:   userID,
 		FriendID: request.UserID,
 	}
 
-	err := gorm.G[model.Friend](s.Dep.DB).Create(ctx, &newFriend)
+	err = gorm.G[model.Friend](s.Dep.DB).Create(ctx, &newFriend)
 	if err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
 			return authError.NewAuthError(409, "friend already added")
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -15,17 +16,101 @@ import (
 	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
 	"gorm.io/gorm"
 )
 
-func (s *UserService) GetGoogleOAuthURL(ctx context.Context) (string, error) {
+// GetGoogleOAuthURL starts a Google login. It returns the Google URL, and the binding the handler stores in a cookie.
+func (s *UserService) GetGoogleOAuthURL(ctx context.Context) (string, string, error) {
 	state, err := jwt.SignOauthStateToken(s.Dep)
 	if err != nil {
 		s.Dep.Logger.Error("failed to sign oauth state token:", "err", err)
-		return "", err
+		return "", "", err
+	}
+
+	return s.startGoogleOauthFlow(ctx, state)
+}
+
+// GetGoogleLinkURL starts a Google round trip that links the Google account to the logged in user.
+// Like GetGoogleOAuthURL, it also returns the binding for the cookie.
+func (s *UserService) GetGoogleLinkURL(ctx context.Context, userID uint) (*dto.GoogleLinkURLResponse, string, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", authError.NewAuthError(404, "user not found")
+		}
+		return nil, "", err
+	}
+
+	if findIdentity(&modelUser, GoogleProvider) != nil {
+		return nil, "", authError.NewAuthError(409, "google account already linked")
+	}
+
+	state, err := jwt.SignOauthLinkStateToken(s.Dep, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	googleURL, binding, err := s.startGoogleOauthFlow(ctx, state)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &dto.GoogleLinkURLResponse{URL: googleURL}, binding, nil
+}
+
+// GetGoogleReauthURL starts a Google round trip where the logged in user proves they still own their linked Google account,
+// in place of a password they do not have. It re-authenticates the session of the access token only.
+// Like GetGoogleOAuthURL, it also returns the binding for the cookie.
+func (s *UserService) GetGoogleReauthURL(ctx context.Context, userID uint, token string) (*dto.GoogleLinkURLResponse, string, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", authError.NewAuthError(404, "user not found")
+		}
+		return nil, "", err
+	}
+
+	if findIdentity(&modelUser, GoogleProvider) == nil {
+		return nil, "", authError.NewAuthError(400, "no google account linked")
+	}
+
+	session, err := s.getSession(ctx, userID, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state, err := jwt.SignOauthReauthStateToken(s.Dep, "", userID, session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	googleURL, binding, err := s.startGoogleOauthFlow(ctx, state)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &dto.GoogleLinkURLResponse{URL: googleURL}, binding, nil
+}
+
+// startGoogleOauthFlow starts the round trip of the state, and returns the Google URL and the binding for the cookie.
+func (s *UserService) startGoogleOauthFlow(ctx context.Context, state string) (string, string, error) {
+	flow, binding, err := s.startOauthFlow(ctx, state)
+	if err != nil {
+		return "", "", err
 	}
 
+	googleURL, err := s.buildGoogleOAuthURL(state, flow.CodeVerifier, flow.Nonce)
+	if err != nil {
+		return "", "", err
+	}
+
+	return googleURL, binding, nil
+}
+
+func (s *UserService) buildGoogleOAuthURL(state string, codeVerifier string, nonce string) (string, error) {
 	u, err := url.Parse(BaseGoogleOAuthURL)
 	if err != nil {
 		s.Dep.Logger.Error("failed to parse google oauth base url:", "err", err)
@@ -38,34 +123,56 @@ func (s *UserService) GetGoogleOAuthURL(ctx context.Context) (string, error) {
 	q.Set("response_type", "code")
 	q.Set("scope", "openid email profile")
 	q.Set("state", state)
+	q.Set("code_challenge", oauth.CodeChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+	q.Set("nonce", nonce)
 
 	u.RawQuery = q.Encode()
 
 	return u.String(), nil
 }
 
-func assembleFrontendRedirectURL(dep *dependency.Dependency, token *string, errMsg *string) string {
+func assembleFrontendRedirectURL(dep *dependency.Dependency, loginCode *string, errMsg *string) string {
+	q := url.Values{}
+	if loginCode != nil {
+		q.Set("code", *loginCode)
+	}
+	if errMsg != nil {
+		q.Set("error", *errMsg)
+	}
+
+	return assembleFrontendRedirectURLWithQuery(dep, q)
+}
+
+// assembleFrontendRedirectURLWithQuery sends the browser back to the frontend Google callback page with q.
+func assembleFrontendRedirectURLWithQuery(dep *dependency.Dependency, q url.Values) string {
 	u, err := url.Parse(dep.Cfg.FrontendUrl + "/user/oauth-callback-google")
 	if err != nil {
 		dep.Logger.Error("failed to parse frontend redirect url:", "err", err)
 		return "/unrecovered-error"
 	}
 
-	q := u.Query()
-	if token != nil {
-		q.Set("token", *token)
-	}
-	if errMsg != nil {
-		q.Set("error", *errMsg)
-	}
-
 	u.RawQuery = q.Encode()
 	return u.String()
 }
 
-var ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+// assembleFrontendRedirectURLWithFragment is assembleFrontendRedirectURLWithQuery with q in the fragment,
+// which the browser keeps out of requests, Referer headers and server logs.
+func assembleFrontendRedirectURLWithFragment(dep *dependency.Dependency, q url.Values) string {
+	u, err := url.Parse(dep.Cfg.FrontendUrl + "/user/oauth-callback-google")
+	if err != nil {
+		dep.Logger.Error("failed to parse frontend redirect url:", "err", err)
+		return "/unrecovered-error"
+	}
+
+	return u.String() + "#" + q.Encode()
+}
+
+// ExchangeCodeForTokens redeems the code with the PKCE verifier, and checks that the ID token carries the nonce of the round trip.
+var ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 	data := url.Values{}
 	data.Set("code", code)
+	data.Set("code_verifier", codeVerifier)
 	data.Set("client_id", dep.Cfg.GoogleClientId)
 	data.Set("client_secret", dep.Cfg.GoogleClientSecret)
 	data.Set("redirect_uri", dep.Cfg.GoogleRedirectUri)
@@ -103,6 +210,11 @@ var ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context
 		return nil, err
 	}
 
+	tokenNonce, _ := payload.Claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce does not match")
+	}
+
 	return payload, nil
 }
 
@@ -124,9 +236,10 @@ var FetchGoogleUserInfo = func(payload *idtoken.Payload) (*dto.GoogleUserData, e
 	}
 
 	googleUserInfo := &dto.GoogleUserData{
-		ID:    sub,
-		Email: claims.Email,
-		Name:  claims.Name,
+		ID:            sub,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
 	}
 
 	if claims.Picture != "" {
@@ -136,40 +249,45 @@ var FetchGoogleUserInfo = func(payload *idtoken.Payload) (*dto.GoogleUserData, e
 	return googleUserInfo, nil
 }
 
-// This feature does not work unless we can verify the user's password/email ownership.
-func (s *UserService) linkGoogleAccountToExistingUser(ctx context.Context, modelUser *model.User, googleUserInfo *dto.GoogleUserData) error {
-	return authError.NewAuthError(409, "same email exists")
-
-	/**
-
-	// Should not be here.
-	if modelUser.Email != googleUserInfo.Email {
-		return middleware.NewAuthError(500, "email mismatch between existing account and Google account")
+// linkGoogleAccountToExistingUser links the Google account to a user who has proven they own the account.
+// A verified Google email that matches the email of the user also verifies it. The identities of modelUser must be preloaded.
+func (s *UserService) linkGoogleAccountToExistingUser(ctx context.Context, modelUser *model.User, googleUserInfo *dto.GoogleUserData, profile map[string]any) error {
+	if findIdentity(modelUser, GoogleProvider) != nil {
+		return authError.NewAuthError(409, "google account already linked")
 	}
 
-	if modelUser.GoogleOauthID != nil {
-		return middleware.NewAuthError(400, "user already has a linked Google account")
-	}
+	identity := newUserIdentity(modelUser.ID, GoogleProvider, googleUserInfo.ID, googleUserInfo.Email, profile)
 
-	if isTwoFAEnabled(modelUser.TwoFAToken) {
-		return middleware.NewAuthError(400, "cannot link Google account when 2FA is enabled")
+	updates := map[string]any{}
+	if modelUser.Avatar == nil && googleUserInfo.Picture != nil {
+		updates["avatar"] = *googleUserInfo.Picture
 	}
-
-	modelUser.GoogleOauthID = &googleUserInfo.ID
-	if googleUserInfo.Picture != nil {
-		modelUser.Avatar = googleUserInfo.Picture
+	if modelUser.EmailVerifiedAt == nil && googleUserInfo.EmailVerified && strings.EqualFold(modelUser.Email, googleUserInfo.Email) {
+		updates["email_verified_at"] = time.Now()
 	}
 
-	err := s.DB.WithContext(ctx).Save(modelUser).Error
+	err := s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := gorm.G[model.UserIdentity](tx).Create(ctx, identity); err != nil {
+			return err
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(modelUser).Updates(updates).Error
+	})
 	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return authError.NewAuthError(409, "google account already linked to another user")
+		}
 		return err
 	}
+	modelUser.Identities = append(modelUser.Identities, *identity)
 
 	return nil
-	*/
 }
 
-func (s *UserService) createNewUserFromGoogleInfo(ctx context.Context, googleUserInfo *dto.GoogleUserData, isRetry bool) (*model.User, error) {
+func (s *UserService) createNewUserFromGoogleInfo(ctx context.Context, googleUserInfo *dto.GoogleUserData, profile map[string]any, isRetry bool) (*model.User, error) {
 
 	username := ""
 
@@ -188,19 +306,29 @@ func (s *UserService) createNewUserFromGoogleInfo(ctx context.Context, googleUse
 	}
 
 	modelUser := model.User{
-		Username:      username,
-		Email:         googleUserInfo.Email,
-		PasswordHash:  nil,
-		Avatar:        googleUserInfo.Picture,
-		GoogleOauthID: &googleUserInfo.ID,
-		TwoFAToken:    nil,
+		Username:     username,
+		Email:        googleUserInfo.Email,
+		PasswordHash: nil,
+		Avatar:       googleUserInfo.Picture,
+	}
+
+	// Google has already verified the email.
+	if googleUserInfo.EmailVerified {
+		now := time.Now()
+		modelUser.EmailVerifiedAt = &now
 	}
 
-	err := gorm.G[model.User](s.Dep.DB).Create(ctx, &modelUser)
+	err := s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := gorm.G[model.User](tx).Create(ctx, &modelUser); err != nil {
+			return err
+		}
+
+		return gorm.G[model.UserIdentity](tx).Create(ctx, newUserIdentity(modelUser.ID, GoogleProvider, googleUserInfo.ID, googleUserInfo.Email, profile))
+	})
 	if err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
 			if !isRetry {
-				return s.createNewUserFromGoogleInfo(ctx, googleUserInfo, true)
+				return s.createNewUserFromGoogleInfo(ctx, googleUserInfo, profile, true)
 			}
 			return nil, authError.NewAuthError(409, "username or email already in use")
 		}
@@ -216,15 +344,21 @@ func HandleGoogleOAuthCallbackError(dep *dependency.Dependency, err error, errMs
 	return assembleFrontendRedirectURL(dep, nil, &publicMsg)
 }
 
-func (s *UserService) HandleGoogleOAuthCallback(ctx context.Context, code string, state string) string {
+// HandleGoogleOAuthCallback finishes a Google round trip, binding is the cookie set when it started.
+func (s *UserService) HandleGoogleOAuthCallback(ctx context.Context, code string, state string, binding string) string {
 	var finalUserID uint
 
 	claims, err := jwt.ValidateOauthStateToken(s.Dep, state)
-	if err != nil || claims.Type != jwt.GoogleOAuthStateType {
+	if err != nil || claims.Type != jwt.GoogleOAuthStateType || claims.Provider != "" {
 		return HandleGoogleOAuthCallbackError(s.Dep, err, "invalid oauth state token")
 	}
 
-	googlePayload, err := ExchangeCodeForTokens(s.Dep, ctx, code)
+	flow, err := s.consumeOauthFlow(ctx, state, binding)
+	if err != nil {
+		return HandleGoogleOAuthCallbackError(s.Dep, err, "invalid oauth round trip")
+	}
+
+	googlePayload, err := ExchangeCodeForTokens(s.Dep, ctx, code, flow.CodeVerifier, flow.Nonce)
 	if err != nil {
 		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to exchange code for tokens")
 	}
@@ -234,29 +368,76 @@ func (s *UserService) HandleGoogleOAuthCallback(ctx context.Context, code string
 		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to fetch google user info from id token")
 	}
 
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("google_oauth_id = ?", googleUserInfo.ID).First(ctx)
-	if err == nil { // User with this Google OAuth ID exists, log them in
-		finalUserID = modelUser.ID
+	// A logged in user re-authenticating their session, only the Google account they linked will do.
+	if claims.Reauth {
+		modelIdentity, err := gorm.G[model.UserIdentity](s.Dep.DB).Where("user_id = ? AND provider = ?", claims.UserID, GoogleProvider).First(ctx)
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to query google identity to re-authenticate")
+		}
+		if modelIdentity.Subject != googleUserInfo.ID {
+			return HandleGoogleOAuthCallbackError(s.Dep, authError.NewAuthError(403, "other google account"), "re-authenticated with another google account")
+		}
+
+		err = s.refreshIdentitySnapshot(ctx, modelIdentity.ID, googleUserInfo.Email, googlePayload.Claims)
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to refresh google identity")
+		}
+
+		err = s.markSessionReauthenticated(ctx, claims.UserID, claims.Session, time.Now())
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to re-authenticate session")
+		}
+
+		return assembleFrontendRedirectURLWithQuery(s.Dep, url.Values{"reauthenticated": {"google"}})
+	}
+
+	// A logged in user linking their Google account, they are not logged in again.
+	if claims.UserID != 0 {
+		modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", claims.UserID).First(ctx)
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to query user to link google account")
+		}
+
+		err = s.linkGoogleAccountToExistingUser(ctx, &modelUser, googleUserInfo, googlePayload.Claims)
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to link google account to logged in user")
+		}
+
+		return assembleFrontendRedirectURLWithQuery(s.Dep, url.Values{"linked": {"google"}})
+	}
+
+	modelIdentity, err := gorm.G[model.UserIdentity](s.Dep.DB).Where("provider = ? AND subject = ?", GoogleProvider, googleUserInfo.ID).First(ctx)
+	if err == nil { // User with this Google account exists, log them in
+		finalUserID = modelIdentity.UserID
+
+		err = s.refreshIdentitySnapshot(ctx, modelIdentity.ID, googleUserInfo.Email, googlePayload.Claims)
+		if err != nil {
+			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to refresh google identity")
+		}
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to query user by google oauth id")
+		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to query user identity by google oauth id")
 	} else {
-		// No user with this Google OAuth ID, check if a user with this email exists
-		modelUser, err = gorm.G[model.User](s.Dep.DB).Where("email = ?", googleUserInfo.Email).First(ctx)
+		// No user with this Google account, check if a user with this email exists, accounts pending deletion included
+		var modelUser model.User
+		err := s.Dep.DB.WithContext(ctx).Unscoped().Preload("Identities").Where("email = ?", googleUserInfo.Email).First(&modelUser).Error
 		if err == nil { // User with this email exists, link Google account
+			// Only with a verified Google email, and only once the user has proven their password.
+			// Users without a password link from their profile instead, a deleted account logs in with its password first.
+			if !googleUserInfo.EmailVerified || modelUser.PasswordHash == nil || modelUser.DeletedAt.Valid || findIdentity(&modelUser, GoogleProvider) != nil {
+				return HandleGoogleOAuthCallbackError(s.Dep, authError.NewAuthError(409, "same email exists"), "failed to link google account to existing user")
+			}
 
-			// Autolinking is disabled and always returns 409 for now, as we cannot verify ownership of the email/password here.
-			err = s.linkGoogleAccountToExistingUser(ctx, &modelUser, googleUserInfo)
-			if err != nil { // Failed to link Google account
-				return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to link google account to existing user")
+			linkToken, err := jwt.SignGoogleLinkToken(s.Dep, modelUser.ID, googleUserInfo.ID, googleUserInfo.Email)
+			if err != nil {
+				return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to sign google link token")
 			}
 
-			// Successfully linked Google account
-			finalUserID = modelUser.ID
+			return assembleFrontendRedirectURLWithFragment(s.Dep, url.Values{"linkToken": {linkToken}})
 		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 			return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to query user by email")
 		} else {
 			// No user with this email exists, create a new user
-			newUser, err := s.createNewUserFromGoogleInfo(ctx, googleUserInfo, false)
+			newUser, err := s.createNewUserFromGoogleInfo(ctx, googleUserInfo, googlePayload.Claims, false)
 			if err != nil {
 				return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to create new user from google info")
 			}
@@ -269,10 +450,69 @@ func (s *UserService) HandleGoogleOAuthCallback(ctx context.Context, code string
 		return HandleGoogleOAuthCallbackError(s.Dep, errors.New("finalUserID is zero"), "internal error determining final user ID")
 	}
 
-	userToken, err := s.issueNewTokenForUser(ctx, finalUserID, false)
+	loginCode, err := s.issueLoginCode(ctx, finalUserID)
+	if err != nil {
+		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to issue login code for user")
+	}
+
+	return assembleFrontendRedirectURL(s.Dep, &loginCode, nil)
+}
+
+// ConfirmGoogleLink links the Google account of a link token once the user proves their password, then logs them in.
+func (s *UserService) ConfirmGoogleLink(ctx context.Context, request *dto.GoogleLinkConfirmRequest) (*LoginResult, error) {
+	claims, err := jwt.ValidateGoogleLinkToken(s.Dep, request.LinkToken)
 	if err != nil {
-		return HandleGoogleOAuthCallbackError(s.Dep, err, "failed to issue new token for user")
+		return nil, authError.NewAuthError(401, "invalid or expired link token")
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", claims.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, "invalid or expired link token")
+		}
+		return nil, err
+	}
+
+	// A password check like a login, so it shares the counters of both identifiers of the login.
+	// The IP counter comes with the first one only, so a failure counts once against it.
+	counters := append(
+		s.loginAttemptCounters(ctx, "identifier", modelUser.Username),
+		s.loginAttemptCounters(context.Background(), "identifier", modelUser.Email)...,
+	)
+	if err := s.checkAttemptCounters(ctx, counters); err != nil {
+		return nil, err
 	}
 
-	return assembleFrontendRedirectURL(s.Dep, &userToken, nil)
+	if modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(401, "invalid credentials")
+	}
+
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
+	if err != nil {
+		if errors.Is(err, password.ErrMismatchedPassword) {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(401, "invalid credentials"))
+		}
+		return nil, err
+	}
+
+	if err := s.resetAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	// The link token is only issued for a verified Google email.
+	err = s.linkGoogleAccountToExistingUser(ctx, &modelUser, &dto.GoogleUserData{
+		ID:            claims.GoogleID,
+		Email:         claims.Email,
+		EmailVerified: true,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.completeLogin(ctx, &modelUser, "")
+}
+
+// UnlinkGoogleAccount removes the Google account of the user, as long as they can still log in another way.
+func (s *UserService) UnlinkGoogleAccount(ctx context.Context, userID uint) (*dto.UserWithoutTokenResponse, error) {
+	return s.unlinkIdentity(ctx, GoogleProvider, userID)
 }
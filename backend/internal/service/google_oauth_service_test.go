@@ -2,9 +2,12 @@ package service_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"net/url"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/auth/credentials/idtoken"
 	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
@@ -14,6 +17,7 @@ import (
 	"github.com/paularynty/transcendence/auth-service-go/internal/service"
 	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/pquerna/otp/totp"
 	"gorm.io/gorm"
 )
 
@@ -21,7 +25,7 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 	t.Run("invalid state token", func(t *testing.T) {
 		userService, _ := testutil.NewTestUserService(t)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", "bad-state")
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", "bad-state", "")
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
@@ -29,8 +33,8 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 		if u.Query().Get("error") == "" {
 			t.Fatalf("expected error query param")
 		}
-		if u.Query().Get("token") != "" {
-			t.Fatalf("did not expect token query param")
+		if u.Query().Get("code") != "" {
+			t.Fatalf("did not expect code query param")
 		}
 	})
 
@@ -39,16 +43,13 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 
 		origExchange := service.ExchangeCodeForTokens
 		t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
-		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 			return nil, errors.New("exchange failed")
 		}
 
-		state, err := jwt.SignOauthStateToken(userService.Dep)
-		if err != nil {
-			t.Fatalf("failed to sign state token, err: %v", err)
-		}
+		state, binding := startGoogleLogin(t, userService)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state)
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
@@ -68,19 +69,16 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 			service.FetchGoogleUserInfo = origFetch
 		})
 
-		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 			return &idtoken.Payload{Subject: "gid", Claims: map[string]any{}}, nil
 		}
 		service.FetchGoogleUserInfo = func(payload *idtoken.Payload) (*dto.GoogleUserData, error) {
 			return nil, authError.NewAuthError(400, "bad token")
 		}
 
-		state, err := jwt.SignOauthStateToken(userService.Dep)
-		if err != nil {
-			t.Fatalf("failed to sign state token, err: %v", err)
-		}
+		state, binding := startGoogleLogin(t, userService)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state)
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
@@ -95,7 +93,7 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 
 		origExchange := service.ExchangeCodeForTokens
 		t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
-		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 			return &idtoken.Payload{
 				Subject: "gid-1",
 				Claims: map[string]any{
@@ -105,28 +103,24 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 			}, nil
 		}
 
-		googleID := "gid-1"
 		user := db.User{
-			Username:      "giduser",
-			Email:         "gid@example.com",
-			GoogleOauthID: &googleID,
+			Username:   "giduser",
+			Email:      "gid@example.com",
+			Identities: googleIdentities("gid-1"),
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
 		}
 
-		state, err := jwt.SignOauthStateToken(userService.Dep)
-		if err != nil {
-			t.Fatalf("failed to sign state token, err: %v", err)
-		}
+		state, binding := startGoogleLogin(t, userService)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state)
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
 		}
-		if u.Query().Get("token") == "" {
-			t.Fatalf("expected token query param")
+		if u.Query().Get("code") == "" {
+			t.Fatalf("expected code query param")
 		}
 		if u.Query().Get("error") != "" {
 			t.Fatalf("did not expect error query param")
@@ -138,7 +132,7 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 
 		origExchange := service.ExchangeCodeForTokens
 		t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
-		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 			return &idtoken.Payload{
 				Subject: "gid-2",
 				Claims: map[string]any{
@@ -156,12 +150,9 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 			t.Fatalf("failed to create user, err: %v", err)
 		}
 
-		state, err := jwt.SignOauthStateToken(userService.Dep)
-		if err != nil {
-			t.Fatalf("failed to sign state token, err: %v", err)
-		}
+		state, binding := startGoogleLogin(t, userService)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state)
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
@@ -176,7 +167,7 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 
 		origExchange := service.ExchangeCodeForTokens
 		t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
-		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string) (*idtoken.Payload, error) {
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
 			return &idtoken.Payload{
 				Subject: "gid-3",
 				Claims: map[string]any{
@@ -187,29 +178,462 @@ func TestHandleGoogleOAuthCallback(t *testing.T) {
 			}, nil
 		}
 
-		state, err := jwt.SignOauthStateToken(userService.Dep)
-		if err != nil {
-			t.Fatalf("failed to sign state token, err: %v", err)
-		}
+		state, binding := startGoogleLogin(t, userService)
 
-		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state)
+		redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
 		u, err := url.Parse(redirect)
 		if err != nil {
 			t.Fatalf("failed to parse redirect url, err: %v", err)
 		}
-		if u.Query().Get("token") == "" {
-			t.Fatalf("expected token query param")
+		if u.Query().Get("code") == "" {
+			t.Fatalf("expected code query param")
 		}
 		if u.Query().Get("error") != "" {
 			t.Fatalf("did not expect error query param")
 		}
 
-		modelUser, err := gorm.G[db.User](myDB).Where("email = ?", "new@example.com").First(context.Background())
+		modelUser, err := gorm.G[db.User](myDB).Preload("Identities", nil).Where("email = ?", "new@example.com").First(context.Background())
 		if err != nil {
 			t.Fatalf("expected user to be created, err: %v", err)
 		}
-		if modelUser.GoogleOauthID == nil || *modelUser.GoogleOauthID != "gid-3" {
-			t.Fatalf("expected google oauth id to be set")
+		if len(modelUser.Identities) != 1 || modelUser.Identities[0].Provider != "google" || modelUser.Identities[0].Subject != "gid-3" {
+			t.Fatalf("expected a google identity, got %+v", modelUser.Identities)
+		}
+	})
+}
+
+func googleIdentities(googleID string) []db.UserIdentity {
+	return []db.UserIdentity{{Provider: "google", Subject: googleID, Email: googleID + "@gmail.com", LinkedAt: time.Now(), Profile: "{}"}}
+}
+
+// mockGoogleAccount makes the Google code exchange return the given account.
+func mockGoogleAccount(t *testing.T, googleID string, email string, emailVerified bool) {
+	t.Helper()
+
+	origExchange := service.ExchangeCodeForTokens
+	t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
+	service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
+		return &idtoken.Payload{
+			Subject: googleID,
+			Claims: map[string]any{
+				"email":          email,
+				"email_verified": emailVerified,
+				"name":           "Alice",
+			},
+		}, nil
+	}
+}
+
+// startGoogleLogin starts a Google login like GoogleLoginHandler, and returns the state and the cookie binding.
+func startGoogleLogin(t *testing.T, userService *service.UserService) (string, string) {
+	t.Helper()
+
+	googleURL, binding, err := userService.GetGoogleOAuthURL(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start google login, err: %v", err)
+	}
+	u, err := url.Parse(googleURL)
+	if err != nil {
+		t.Fatalf("failed to parse google url, err: %v", err)
+	}
+	return u.Query().Get("state"), binding
+}
+
+func googleCallbackQuery(t *testing.T, userService *service.UserService, state string, binding string) url.Values {
+	t.Helper()
+
+	redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatalf("failed to parse redirect url, err: %v", err)
+	}
+	return u.Query()
+}
+
+// googleCallbackLinkToken finishes a Google round trip that asks for the password, and returns the link token of the fragment.
+func googleCallbackLinkToken(t *testing.T, userService *service.UserService, state string, binding string) string {
+	t.Helper()
+
+	redirect := userService.HandleGoogleOAuthCallback(context.Background(), "code", state, binding)
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatalf("failed to parse redirect url, err: %v", err)
+	}
+	if u.RawQuery != "" {
+		t.Fatalf("expected nothing in the query, got %v", u.RawQuery)
+	}
+	fragment, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		t.Fatalf("failed to parse fragment, err: %v", err)
+	}
+	return fragment.Get("linkToken")
+}
+
+func TestGoogleAccountLinking(t *testing.T) {
+	t.Run("existing email links after the password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+		mockGoogleAccount(t, "gid-alice", "alice@example.com", true)
+
+		state, binding := startGoogleLogin(t, userService)
+
+		linkToken := googleCallbackLinkToken(t, userService, state, binding)
+		if linkToken == "" {
+			t.Fatalf("expected a link token")
+		}
+
+		_, err := userService.ConfirmGoogleLink(context.Background(), &dto.GoogleLinkConfirmRequest{
+			LinkToken: linkToken,
+			Password:  dto.Password{Password: "Wrong.777"},
+		})
+		expectAuthErrorStatus(t, err, 401)
+
+		result, err := userService.ConfirmGoogleLink(context.Background(), &dto.GoogleLinkConfirmRequest{
+			LinkToken: linkToken,
+			Password:  dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if result.User == nil || result.User.Token == "" {
+			t.Fatalf("expected to be logged in")
+		}
+		if result.User.GoogleOauthId == nil || *result.User.GoogleOauthId != "gid-alice" || !result.User.EmailVerified {
+			t.Fatalf("expected the google account linked and the email verified, got %+v", result.User)
+		}
+
+		// Google sign-in now logs straight in
+		state, binding = startGoogleLogin(t, userService)
+		q := googleCallbackQuery(t, userService, state, binding)
+		if q.Get("code") == "" {
+			t.Fatalf("expected code query param, got %v", q)
+		}
+	})
+
+	t.Run("password check shares the lockout of the email login", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		createAndLoginUser(t, userService, myDB)
+		mockGoogleAccount(t, "gid-alice", "alice@example.com", true)
+
+		for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "alice@example.com", "Wrong.777"), 401)
+		}
+
+		state, binding := startGoogleLogin(t, userService)
+		linkToken := googleCallbackLinkToken(t, userService, state, binding)
+
+		_, err := userService.ConfirmGoogleLink(context.Background(), &dto.GoogleLinkConfirmRequest{
+			LinkToken: linkToken,
+			Password:  dto.Password{Password: "Password.777"},
+		})
+		expectAuthErrorStatus(t, err, 429)
+	})
+
+	t.Run("unverified google email does not link", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+		mockGoogleAccount(t, "gid-alice", "alice@example.com", false)
+
+		state, binding := startGoogleLogin(t, userService)
+
+		q := googleCallbackQuery(t, userService, state, binding)
+		if q.Get("error") == "" || q.Get("linkToken") != "" {
+			t.Fatalf("expected an error and no link token, got %v", q)
+		}
+	})
+
+	t.Run("logged in user links", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+		mockGoogleAccount(t, "gid-other", "alice.other@example.com", true)
+
+		resp, binding, err := userService.GetGoogleLinkURL(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		linkURL, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatalf("failed to parse link url, err: %v", err)
+		}
+
+		q := googleCallbackQuery(t, userService, linkURL.Query().Get("state"), binding)
+		if q.Get("linked") != "google" || q.Get("code") != "" {
+			t.Fatalf("expected linked without a new session, got %v", q)
+		}
+
+		modelUser, err := gorm.G[db.User](myDB).Preload("Identities", nil).Where("id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to load user, err: %v", err)
+		}
+		if len(modelUser.Identities) != 1 || modelUser.Identities[0].Subject != "gid-other" || modelUser.Identities[0].Email != "alice.other@example.com" {
+			t.Fatalf("expected a google identity, got %+v", modelUser.Identities)
+		}
+		if modelUser.EmailVerifiedAt != nil {
+			t.Fatalf("a different google email must not verify the email of the user")
+		}
+
+		_, _, err = userService.GetGoogleLinkURL(context.Background(), user.ID)
+		expectAuthErrorStatus(t, err, 409)
+	})
+
+	t.Run("unlink", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		_, err := userService.UnlinkGoogleAccount(context.Background(), user.ID)
+		expectAuthErrorStatus(t, err, 400)
+
+		identity := googleIdentities("gid-alice")[0]
+		identity.UserID = user.ID
+		if err := gorm.G[db.UserIdentity](myDB).Create(context.Background(), &identity); err != nil {
+			t.Fatalf("failed to link google account, err: %v", err)
+		}
+
+		unlinked, err := userService.UnlinkGoogleAccount(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if unlinked.GoogleOauthId != nil || len(unlinked.LinkedProviders) != 0 {
+			t.Fatalf("expected google account unlinked, got %+v", unlinked)
+		}
+	})
+
+	t.Run("unlink refuses the only login method", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+
+		user := db.User{Username: "googleonly", Email: "googleonly@example.com", Identities: googleIdentities("gid-only")}
+		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
+			t.Fatalf("failed to create user, err: %v", err)
+		}
+
+		_, err := userService.UnlinkGoogleAccount(context.Background(), user.ID)
+		expectAuthErrorStatus(t, err, 400)
+	})
+}
+
+func TestGoogleOauthFlowBinding(t *testing.T) {
+	t.Run("pkce and nonce are sent to the code exchange", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		var gotVerifier, gotNonce string
+		origExchange := service.ExchangeCodeForTokens
+		t.Cleanup(func() { service.ExchangeCodeForTokens = origExchange })
+		service.ExchangeCodeForTokens = func(dep *dependency.Dependency, ctx context.Context, code string, codeVerifier string, nonce string) (*idtoken.Payload, error) {
+			gotVerifier, gotNonce = codeVerifier, nonce
+			return &idtoken.Payload{Subject: "gid-pkce", Claims: map[string]any{"email": "pkce@example.com"}}, nil
+		}
+
+		googleURL, binding, err := userService.GetGoogleOAuthURL(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		u, err := url.Parse(googleURL)
+		if err != nil {
+			t.Fatalf("failed to parse google url, err: %v", err)
+		}
+		q := u.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("nonce") == "" {
+			t.Fatalf("expected pkce and nonce params, got %v", q)
+		}
+
+		callback := googleCallbackQuery(t, userService, q.Get("state"), binding)
+		if callback.Get("code") == "" {
+			t.Fatalf("expected code query param, got %v", callback)
+		}
+
+		sum := sha256.Sum256([]byte(gotVerifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != q.Get("code_challenge") {
+			t.Fatalf("code verifier does not match the code challenge")
+		}
+		if gotNonce != q.Get("nonce") {
+			t.Fatalf("expected nonce %q, got %q", q.Get("nonce"), gotNonce)
+		}
+	})
+
+	t.Run("replayed state is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-replay", "replay@example.com", true)
+
+		state, binding := startGoogleLogin(t, userService)
+
+		if q := googleCallbackQuery(t, userService, state, binding); q.Get("code") == "" {
+			t.Fatalf("expected code query param, got %v", q)
 		}
+		if q := googleCallbackQuery(t, userService, state, binding); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected the replay to fail, got %v", q)
+		}
+	})
+
+	t.Run("state from another browser is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-csrf", "csrf@example.com", true)
+
+		state, _ := startGoogleLogin(t, userService)
+		_, otherBinding := startGoogleLogin(t, userService)
+
+		if q := googleCallbackQuery(t, userService, state, otherBinding); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+		if q := googleCallbackQuery(t, userService, state, ""); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+
+	t.Run("signed state without a round trip is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-forged", "forged@example.com", true)
+
+		state, err := jwt.SignOauthStateToken(userService.Dep)
+		if err != nil {
+			t.Fatalf("failed to sign state token, err: %v", err)
+		}
+
+		if q := googleCallbackQuery(t, userService, state, "binding"); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+}
+
+// googleLogin logs in with the mocked Google account, and returns the user without 2FA.
+func googleLogin(t *testing.T, userService *service.UserService) *dto.UserWithTokenResponse {
+	t.Helper()
+
+	result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: googleLoginCode(t, userService)})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if result.User == nil {
+		t.Fatalf("expected a logged in user, got %+v", result)
+	}
+	return result.User
+}
+
+// googleReauth re-authenticates the session of the user with a Google round trip.
+func googleReauth(t *testing.T, userService *service.UserService, user *dto.UserWithTokenResponse) url.Values {
+	t.Helper()
+
+	resp, binding, err := userService.GetGoogleReauthURL(context.Background(), user.ID, user.Token)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	reauthURL, err := url.Parse(resp.URL)
+	if err != nil {
+		t.Fatalf("failed to parse reauth url, err: %v", err)
+	}
+
+	return googleCallbackQuery(t, userService, reauthURL.Query().Get("state"), binding)
+}
+
+func TestGoogleUserPassword(t *testing.T) {
+	newPassword := &dto.SetUserPasswordRequest{NewPassword: dto.NewPassword{NewPassword: "Password.888"}}
+
+	t.Run("fresh google login sets a password then enables 2FA", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-pw", "pw@example.com", true)
+		user := googleLogin(t, userService)
+
+		_, err := userService.StartTwoFaSetup(context.Background(), user.ID)
+		expectAuthErrorStatus(t, err, 400)
+
+		// The Google login itself does not replace the old password.
+		_, err = userService.SetUserPassword(context.Background(), user.ID, user.Token, newPassword)
+		expectAuthErrorStatus(t, err, 401)
+
+		if q := googleReauth(t, userService, user); q.Get("reauthenticated") != "google" {
+			t.Fatalf("expected a re-authentication, got %v", q)
+		}
+
+		resp, err := userService.SetUserPassword(context.Background(), user.ID, user.Token, newPassword)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.Token == "" {
+			t.Fatalf("expected token in response")
+		}
+
+		_, err = userService.SetUserPassword(context.Background(), user.ID, resp.Token, newPassword)
+		expectAuthErrorStatus(t, err, 400)
+
+		loggedIn, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "pw@example.com"},
+			Password:   dto.Password{Password: "Password.888"},
+		})
+		if err != nil || loggedIn.User == nil {
+			t.Fatalf("expected a password login, got %+v, err: %v", loggedIn, err)
+		}
+
+		setup, err := userService.StartTwoFaSetup(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		code, err := totp.GenerateCode(setup.TwoFASecret, time.Now())
+		if err != nil {
+			t.Fatalf("failed to generate code, err: %v", err)
+		}
+		_, err = userService.ConfirmTwoFaSetup(context.Background(), user.ID, &dto.TwoFAConfirmRequest{TwoFACode: code, SetupToken: setup.SetupToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		// The next Google login asks for the 2FA code instead of logging in
+		result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: googleLoginCode(t, userService)})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if result.User != nil || result.TwoFAPending == nil || result.TwoFAPending.SessionToken == "" {
+			t.Fatalf("expected a 2FA challenge, got %+v", result)
+		}
+	})
+
+	t.Run("google re-authentication is bound to the session", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-stale", "stale@example.com", true)
+		user := googleLogin(t, userService)
+		other := googleLogin(t, userService)
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+
+		q := googleReauth(t, userService, user)
+		if q.Get("reauthenticated") != "google" || q.Get("code") != "" {
+			t.Fatalf("expected a re-authentication without a new session, got %v", q)
+		}
+
+		expectRecentAuth(t, userService, user.ID, user.Token, true)
+		expectRecentAuth(t, userService, other.ID, other.Token, false)
+
+		// Nor does it re-authenticate the other session.
+		_, err := userService.Reauthenticate(context.Background(), other.ID, other.Token, &dto.ReauthRequest{})
+		expectAuthErrorStatus(t, err, 400)
+		expectRecentAuth(t, userService, other.ID, other.Token, false)
+	})
+
+	t.Run("re-authentication with another google account", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-owner", "owner@example.com", true)
+		user := googleLogin(t, userService)
+
+		resp, binding, err := userService.GetGoogleReauthURL(context.Background(), user.ID, user.Token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		reauthURL, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatalf("failed to parse reauth url, err: %v", err)
+		}
+
+		mockGoogleAccount(t, "gid-other", "other@example.com", true)
+		q := googleCallbackQuery(t, userService, reauthURL.Query().Get("state"), binding)
+		if q.Get("error") == "" || q.Get("reauthenticated") != "" {
+			t.Fatalf("expected an error, got %v", q)
+		}
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+	})
+
+	t.Run("re-authentication needs a linked google account", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		_, _, err := userService.GetGoogleReauthURL(context.Background(), user.ID, user.Token)
+		expectAuthErrorStatus(t, err, 400)
 	})
 }
@@ -2,13 +2,17 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
@@ -17,39 +21,122 @@ import (
 
 const HeartBeatPrefix = "heartbeat:"
 
-func isTwoFAEnabled(twoFAToken *string) bool {
-	return twoFAToken != nil && *twoFAToken != "" && !strings.HasPrefix(*twoFAToken, TwoFAPrePrefix)
+// twoFAMethods lists the second factors the user has turned on, the authenticator first.
+func twoFAMethods(user *model.User) []string {
+	methods := []string{}
+	if user.TotpSecret != nil {
+		methods = append(methods, TwoFAMethodTotp)
+	}
+	if user.EmailOtpEnabled {
+		methods = append(methods, TwoFAMethodEmail)
+	}
+	return methods
+}
+
+func isTwoFAEnabled(user *model.User) bool {
+	return len(twoFAMethods(user)) > 0
+}
+
+// findIdentity returns the account of the user at the provider, the identities must be preloaded.
+func findIdentity(user *model.User, provider string) *model.UserIdentity {
+	for i := range user.Identities {
+		if user.Identities[i].Provider == provider {
+			return &user.Identities[i]
+		}
+	}
+	return nil
+}
+
+func linkedProviders(user *model.User) []string {
+	providers := make([]string, 0, len(user.Identities))
+	for _, identity := range user.Identities {
+		providers = append(providers, identity.Provider)
+	}
+	slices.Sort(providers)
+	return providers
+}
+
+// googleOauthID is still sent to the frontend, which tells Google users apart with it.
+func googleOauthID(user *model.User) *string {
+	if identity := findIdentity(user, GoogleProvider); identity != nil {
+		return &identity.Subject
+	}
+	return nil
 }
 
 func userToUserWithoutTokenResponse(user *model.User) *dto.UserWithoutTokenResponse {
-	isTwoFAEnabled := isTwoFAEnabled(user.TwoFAToken)
+	methods := twoFAMethods(user)
 
 	return &dto.UserWithoutTokenResponse{
-		ID:            user.ID,
-		Username:      user.Username,
-		Email:         user.Email,
-		Avatar:        user.Avatar,
-		TwoFA:         isTwoFAEnabled,
-		GoogleOauthId: user.GoogleOauthID,
-		CreatedAt:     user.CreatedAt.Unix(),
+		ID:              user.ID,
+		Username:        user.Username,
+		Email:           user.Email,
+		Avatar:          user.Avatar,
+		TwoFA:           len(methods) > 0,
+		TwoFAMethods:    methods,
+		GoogleOauthId:   googleOauthID(user),
+		LinkedProviders: linkedProviders(user),
+		EmailVerified:   user.EmailVerifiedAt != nil,
+		CreatedAt:       user.CreatedAt.Unix(),
 	}
 }
 
-func userToUserWithTokenResponse(user *model.User, token string) *dto.UserWithTokenResponse {
-	isTwoFAEnabled := isTwoFAEnabled(user.TwoFAToken)
+func userToUserWithTokenResponse(user *model.User, tokens *userTokens) *dto.UserWithTokenResponse {
+	methods := twoFAMethods(user)
 
 	return &dto.UserWithTokenResponse{
-		ID:            user.ID,
-		Username:      user.Username,
-		Email:         user.Email,
-		Avatar:        user.Avatar,
-		TwoFA:         isTwoFAEnabled,
-		GoogleOauthId: user.GoogleOauthID,
-		CreatedAt:     user.CreatedAt.Unix(),
-		Token:         token,
+		ID:              user.ID,
+		Username:        user.Username,
+		Email:           user.Email,
+		Avatar:          user.Avatar,
+		TwoFA:           len(methods) > 0,
+		TwoFAMethods:    methods,
+		GoogleOauthId:   googleOauthID(user),
+		LinkedProviders: linkedProviders(user),
+		EmailVerified:   user.EmailVerifiedAt != nil,
+		CreatedAt:       user.CreatedAt.Unix(),
+		Token:           tokens.AccessToken,
+		RefreshToken:    tokens.RefreshToken,
 	}
 }
 
+// profileSnapshot serializes the provider profile for UserIdentity.Profile.
+func profileSnapshot(profile map[string]any) string {
+	if profile == nil {
+		return "{}"
+	}
+
+	snapshot, err := json.Marshal(profile)
+	if err != nil {
+		return "{}"
+	}
+	return string(snapshot)
+}
+
+func newUserIdentity(userID uint, provider string, subject string, email string, profile map[string]any) *model.UserIdentity {
+	now := time.Now()
+	return &model.UserIdentity{
+		UserID:          userID,
+		Provider:        provider,
+		Subject:         subject,
+		Email:           email,
+		LinkedAt:        now,
+		Profile:         profileSnapshot(profile),
+		AuthenticatedAt: &now,
+	}
+}
+
+// refreshIdentitySnapshot stores what the provider says about the user at this login.
+func (s *UserService) refreshIdentitySnapshot(ctx context.Context, identityID uint, email string, profile map[string]any) error {
+	now := time.Now()
+	_, err := gorm.G[model.UserIdentity](s.Dep.DB).Where("id = ?", identityID).Updates(ctx, model.UserIdentity{
+		Email:           email,
+		Profile:         profileSnapshot(profile),
+		AuthenticatedAt: &now,
+	})
+	return err
+}
+
 func userToSimpleUser(user *model.User) *dto.SimpleUser {
 	return &dto.SimpleUser{
 		ID:       user.ID,
@@ -185,68 +272,117 @@ func buildTokenKey(userID uint, token string) string {
 	return fmt.Sprintf("user_token:%d:%s", userID, token)
 }
 
-func (s *UserService) issueNewTokenForUserByDB(ctx context.Context, userID uint, revokeAllTokens bool) (string, error) {
+// userTokens is the access/refresh token pair handed out on every login.
+type userTokens struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+func (s *UserService) issueNewTokenForUserByDB(ctx context.Context, userID uint, revokeAllTokens bool) (*userTokens, error) {
 
 	if revokeAllTokens {
-		res := s.Dep.DB.WithContext(ctx).Exec("DELETE FROM tokens WHERE user_id = ?", userID)
-		if res.Error != nil {
-			return "", res.Error
+		err := logoutUserByDB(ctx, s.Dep.DB, userID)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	token, err := jwt.SignUserToken(s.Dep, userID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	clientInfo := util.ClientInfoFromContext(ctx)
+	modelToken := model.Token{
+		UserID:      userID,
+		Token:       token,
+		LastUsedAt:  time.Now(),
+		ClientIP:    clientInfo.IP,
+		UserAgent:   clientInfo.UserAgent,
+		DeviceLabel: util.DeviceLabelFromUserAgent(clientInfo.UserAgent),
+	}
+	err = gorm.G[model.Token](s.Dep.DB).Create(ctx, &modelToken)
+	if err != nil {
+		return nil, err
 	}
 
-	err = gorm.G[model.Token](s.Dep.DB).Create(ctx, &model.Token{
-		UserID: userID,
-		Token:  token,
-	})
+	refreshToken, err := s.createRefreshTokenByDB(ctx, &modelToken)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	s.updateHeartBeat(userID)
 
-	return token, nil
+	return &userTokens{AccessToken: token, RefreshToken: refreshToken}, nil
 }
 
-func (s *UserService) issueNewTokenForUserByRedis(ctx context.Context, userID uint, revokeAllTokens bool) (string, error) {
+func (s *UserService) issueNewTokenForUserByRedis(ctx context.Context, userID uint, revokeAllTokens bool) (*userTokens, error) {
 
 	if revokeAllTokens {
-		// A rough way to delete all tokens for the user
-		iter := s.Dep.Redis.Scan(ctx, 0, buildTokenKey(userID, "*"), 100).Iterator()
-		for iter.Next(ctx) {
-			err := s.Dep.Redis.Del(ctx, iter.Val()).Err()
-			if err != nil {
-				return "", err
-			}
-		}
-		if err := iter.Err(); err != nil {
-			return "", err
+		err := logoutUserByRedis(ctx, s.Dep.Redis, userID)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	token, err := jwt.SignUserToken(s.Dep, userID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	err = s.Dep.Redis.Set(ctx, buildTokenKey(userID, token), "", time.Duration(s.Dep.Cfg.UserTokenExpiry)*time.Second).Err()
+	familyID := uuid.NewString()
+	familyExpiry := time.Duration(s.Dep.Cfg.UserTokenAbsoluteExpiry) * time.Second
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	clientInfo := util.ClientInfoFromContext(ctx)
+	err = s.Dep.Redis.HSet(ctx, buildTokenFamilyKey(userID, familyID),
+		"accessToken", token,
+		"createdAt", now,
+		"lastUsedAt", now,
+		"clientIp", clientInfo.IP,
+		"userAgent", clientInfo.UserAgent,
+		"deviceLabel", util.DeviceLabelFromUserAgent(clientInfo.UserAgent),
+	).Err()
+	if err != nil {
+		return nil, err
+	}
+	err = s.Dep.Redis.Expire(ctx, buildTokenFamilyKey(userID, familyID), familyExpiry).Err()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	err = s.Dep.Redis.Set(ctx, buildTokenKey(userID, token), familyID, time.Duration(s.Dep.Cfg.UserTokenExpiry)*time.Second).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := s.createRefreshTokenByRedis(ctx, userID, familyID, familyExpiry)
+	if err != nil {
+		return nil, err
 	}
 
 	s.updateHeartBeat(userID)
 
-	return token, nil
+	return &userTokens{AccessToken: token, RefreshToken: refreshToken}, nil
 }
 
-func (s *UserService) issueNewTokenForUser(ctx context.Context, userID uint, revokeAllTokens bool) (string, error) {
+func (s *UserService) issueNewTokenForUser(ctx context.Context, userID uint, revokeAllTokens bool) (*userTokens, error) {
 	if s.Dep.Cfg.IsRedisEnabled {
 		return s.issueNewTokenForUserByRedis(ctx, userID, revokeAllTokens)
 	} else {
 		return s.issueNewTokenForUserByDB(ctx, userID, revokeAllTokens)
 	}
 }
+
+// sendMail sends the email in the background, so the response time does not tell whether an email was sent.
+func (s *UserService) sendMail(msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := s.Dep.Mailer.Send(ctx, msg)
+		if err != nil {
+			s.Dep.Logger.Warn("failed to send email", "subject", msg.Subject, "err", err.Error())
+		}
+	}()
+}
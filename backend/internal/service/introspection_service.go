@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"gorm.io/gorm"
+)
+
+// IntrospectToken reports whether a token we issued is still active, and whom it belongs to.
+// Invalid, expired and revoked tokens are not errors, they are inactive.
+func (s *UserService) IntrospectToken(ctx context.Context, request *dto.IntrospectRequest) (*dto.IntrospectResponse, error) {
+	claims, err := jwt.ValidateAnyToken(s.Dep, request.Token)
+	if err != nil {
+		return &dto.IntrospectResponse{Active: false}, nil
+	}
+
+	response := &dto.IntrospectResponse{
+		Active:    true,
+		TokenType: claims.Type,
+		Jti:       claims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		response.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response.Iat = claims.IssuedAt.Unix()
+	}
+
+	switch claims.Type {
+	case jwt.GoogleOAuthStateType:
+		// Only bound to a user when it links a Google account.
+		if claims.UserID == 0 {
+			return response, nil
+		}
+	case jwt.UserTokenType:
+		// Same server side state as the Auth middleware: logged out or rotated tokens are gone.
+		// Asking about a token is not using it, the session and the heartbeat are left alone.
+		err := s.checkUserToken(ctx, request.Token, claims.UserID)
+		if err != nil {
+			var authErr *authError.AuthError
+			if errors.As(err, &authErr) && authErr.Status == 401 {
+				return &dto.IntrospectResponse{Active: false}, nil
+			}
+			return nil, err
+		}
+	case jwt.TwoFATokenType:
+		// A 2FA session that used up its codes cannot finish the login anymore.
+		err := s.checkTwoFASession(ctx, claims.ID)
+		if err != nil {
+			var authErr *authError.AuthError
+			if errors.As(err, &authErr) && authErr.Status == 400 {
+				return &dto.IntrospectResponse{Active: false}, nil
+			}
+			return nil, err
+		}
+	case jwt.OidcAccessTokenType:
+		response.ClientID = claims.ClientID
+	case jwt.ServiceTokenType:
+		// Not bound to a user, active as long as the client is registered.
+		err := s.ValidateServiceClient(ctx, claims.ClientID)
+		if err != nil {
+			var authErr *authError.AuthError
+			if errors.As(err, &authErr) && authErr.Status == 401 {
+				return &dto.IntrospectResponse{Active: false}, nil
+			}
+			return nil, err
+		}
+		response.Sub = claims.ClientID
+		response.ClientID = claims.ClientID
+		return response, nil
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", claims.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &dto.IntrospectResponse{Active: false}, nil
+		}
+		return nil, err
+	}
+
+	response.Sub = strconv.FormatUint(uint64(modelUser.ID), 10)
+	response.Username = modelUser.Username
+
+	return response, nil
+}
@@ -0,0 +1,160 @@
+package service_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"gorm.io/gorm"
+)
+
+func TestIntrospectToken(t *testing.T) {
+	introspect := func(t *testing.T, userService *service.UserService, token string) *dto.IntrospectResponse {
+		t.Helper()
+
+		resp, err := userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: token})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("user token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		resp, err := userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: user.Token})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !resp.Active || resp.TokenType != jwt.UserTokenType || resp.Username != "alice" ||
+			resp.Sub != strconv.FormatUint(uint64(user.ID), 10) || resp.Exp == 0 || resp.Iat == 0 || resp.Jti == "" {
+			t.Fatalf("unexpected introspection response: %+v", resp)
+		}
+
+		// Revocation is reflected
+		if err := userService.LogoutUser(context.Background(), user.ID, user.Token); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		resp, err = userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: user.Token})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.Active {
+			t.Fatalf("expected logged out token to be inactive")
+		}
+	})
+
+	t.Run("user token is not used by the lookup", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+		time.Sleep(50 * time.Millisecond)
+
+		lastUsedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+		_, err := gorm.G[model.Token](myDB).Where("token = ?", user.Token).Update(context.Background(), "last_used_at", lastUsedAt)
+		if err != nil {
+			t.Fatalf("failed to age the session, err: %v", err)
+		}
+		if err := myDB.Exec("DELETE FROM heart_beats").Error; err != nil {
+			t.Fatalf("failed to clear heartbeats, err: %v", err)
+		}
+
+		if resp := introspect(t, userService, user.Token); !resp.Active {
+			t.Fatalf("expected token to be active")
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		modelToken, err := gorm.G[model.Token](myDB).Where("token = ?", user.Token).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to load session, err: %v", err)
+		}
+		if !modelToken.LastUsedAt.Equal(lastUsedAt) {
+			t.Fatalf("expected the session to be left alone, last used at %v", modelToken.LastUsedAt)
+		}
+		count, err := gorm.G[model.HeartBeat](myDB).Count(context.Background(), "id")
+		if err != nil || count != 0 {
+			t.Fatalf("expected no heartbeat, got %d, err: %v", count, err)
+		}
+	})
+
+	t.Run("2fa token that used up its codes", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+		pending := pendingLogin(t, userService)
+
+		if resp := introspect(t, userService, pending.SessionToken); !resp.Active {
+			t.Fatalf("expected token to be active")
+		}
+
+		for i := 0; i < userService.Dep.Cfg.TwoFaMaxAttempts; i++ {
+			_, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+				TwoFACode:    "000000",
+				SessionToken: pending.SessionToken,
+			})
+			if err == nil {
+				t.Fatalf("expected the wrong code to fail")
+			}
+		}
+
+		if resp := introspect(t, userService, pending.SessionToken); resp.Active {
+			t.Fatalf("expected token to be inactive")
+		}
+	})
+
+	t.Run("2fa token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := testutil.CreateUser(t, myDB, "alice", "alice@example.com", nil)
+
+		token, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+		if err != nil {
+			t.Fatalf("failed to sign token, err: %v", err)
+		}
+
+		resp, err := userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: token})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !resp.Active || resp.TokenType != jwt.TwoFATokenType || resp.Username != "alice" {
+			t.Fatalf("unexpected introspection response: %+v", resp)
+		}
+	})
+
+	t.Run("oauth state token", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		token, err := jwt.SignOauthStateToken(userService.Dep)
+		if err != nil {
+			t.Fatalf("failed to sign token, err: %v", err)
+		}
+
+		resp := introspect(t, userService, token)
+		if !resp.Active || resp.TokenType != jwt.GoogleOAuthStateType || resp.Sub != "" {
+			t.Fatalf("unexpected introspection response: %+v", resp)
+		}
+	})
+
+	t.Run("token of a deleted user", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		token, err := jwt.SignTwoFAToken(userService.Dep, 999)
+		if err != nil {
+			t.Fatalf("failed to sign token, err: %v", err)
+		}
+
+		if resp := introspect(t, userService, token); resp.Active {
+			t.Fatalf("expected token to be inactive")
+		}
+	})
+
+	t.Run("garbage", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		if resp := introspect(t, userService, "not-a-token"); resp.Active {
+			t.Fatalf("expected token to be inactive")
+		}
+	})
+}
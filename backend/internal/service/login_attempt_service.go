@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const LoginAttemptPrefix = "login_attempt:"
+
+// The same message whether the account exists or not.
+const tooManyAttemptsMessage = "too many failed attempts, try again later"
+
+// attemptCounter is one failed-attempt counter, with the thresholds that apply to it.
+// After freeAttempts failures every further failure blocks the counter for an exponentially growing delay,
+// after maxAttempts failures it is locked out for the lockout duration.
+type attemptCounter struct {
+	key          string
+	freeAttempts int
+	maxAttempts  int
+	// keepOnSuccess counters are not reset by a successful attempt, they only expire.
+	keepOnSuccess bool
+	// cooldown, when set, blocks the counter that long after every attempt below maxAttempts, in place of the backoff.
+	cooldown time.Duration
+}
+
+func buildLoginAttemptKey(kind string, value string) string {
+	return fmt.Sprintf("%s%s:%s", LoginAttemptPrefix, kind, value)
+}
+
+// loginAttemptCounters returns the counters of a login: one per identifier, one per client IP.
+// An IP is shared by many users behind a NAT, so it only backs off once an identifier would be locked out.
+func (s *UserService) loginAttemptCounters(ctx context.Context, kind string, identifier string) []attemptCounter {
+	counters := []attemptCounter{{
+		key:          buildLoginAttemptKey(kind, strings.ToLower(identifier)),
+		freeAttempts: s.Dep.Cfg.LoginFreeAttempts,
+		maxAttempts:  s.Dep.Cfg.LoginMaxAttempts,
+	}}
+
+	if ip := util.ClientInfoFromContext(ctx).IP; ip != "" {
+		// Logging in to an account of one's own must not clear the failures against the others.
+		counters = append(counters, attemptCounter{
+			key:           buildLoginAttemptKey("ip", ip),
+			freeAttempts:  s.Dep.Cfg.LoginMaxAttempts,
+			maxAttempts:   s.Dep.Cfg.LoginMaxAttemptsPerIP,
+			keepOnSuccess: true,
+		})
+	}
+
+	return counters
+}
+
+// blockDuration returns how long a counter is blocked after its nth failure.
+func (s *UserService) blockDuration(counter attemptCounter, failures int) time.Duration {
+	lockout := time.Duration(s.Dep.Cfg.LoginLockoutDurationInSec) * time.Second
+
+	if failures >= counter.maxAttempts {
+		return lockout
+	}
+	if counter.cooldown > 0 {
+		return counter.cooldown
+	}
+	if failures <= counter.freeAttempts {
+		return 0
+	}
+
+	backoff := time.Duration(float64(s.Dep.Cfg.LoginBackoffBaseInSec)*math.Pow(2, float64(failures-counter.freeAttempts-1))) * time.Second
+	return min(backoff, lockout)
+}
+
+func retryAfterError(blockedUntil time.Time) error {
+	retryAfter := int(math.Ceil(time.Until(blockedUntil).Seconds()))
+	return authError.NewRetryAfterError(429, tooManyAttemptsMessage, max(retryAfter, 1))
+}
+
+func (s *UserService) getBlockedUntilByDB(ctx context.Context, key string) (time.Time, error) {
+	attempt, err := gorm.G[model.LoginAttempt](s.Dep.DB).Where("counter_key = ?", key).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	return attempt.BlockedUntil, nil
+}
+
+func (s *UserService) getBlockedUntilByRedis(ctx context.Context, key string) (time.Time, error) {
+	blockedUntil, err := s.Dep.Redis.HGet(ctx, key, "blockedUntil").Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	return time.Unix(blockedUntil, 0), nil
+}
+
+// checkAttemptCounters returns a 429 error with the retry delay when any of the counters is blocked.
+func (s *UserService) checkAttemptCounters(ctx context.Context, counters []attemptCounter) error {
+	var latest time.Time
+
+	for _, counter := range counters {
+		var blockedUntil time.Time
+		var err error
+
+		if s.Dep.Cfg.IsRedisEnabled {
+			blockedUntil, err = s.getBlockedUntilByRedis(ctx, counter.key)
+		} else {
+			blockedUntil, err = s.getBlockedUntilByDB(ctx, counter.key)
+		}
+		if err != nil {
+			return err
+		}
+
+		if blockedUntil.After(latest) {
+			latest = blockedUntil
+		}
+	}
+
+	if time.Now().Before(latest) {
+		return retryAfterError(latest)
+	}
+
+	return nil
+}
+
+func (s *UserService) recordFailedAttemptByDB(ctx context.Context, counter attemptCounter) error {
+	window := time.Duration(s.Dep.Cfg.LoginLockoutDurationInSec) * time.Second
+	now := time.Now()
+
+	// Counted in one statement, concurrent failures can not overwrite each other.
+	// Failures are forgotten once the window has passed since the last one.
+	attempt := model.LoginAttempt{
+		CounterKey:    counter.key,
+		Failures:      1,
+		LastFailureAt: now,
+		BlockedUntil:  now.Add(s.blockDuration(counter, 1)),
+	}
+	err := s.Dep.DB.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "counter_key"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"failures":        gorm.Expr("CASE WHEN last_failure_at > ? THEN failures + 1 ELSE 1 END", now.Add(-window)),
+				"last_failure_at": now,
+				"updated_at":      now,
+			}),
+		},
+		clause.Returning{Columns: []clause.Column{{Name: "failures"}}},
+	).Create(&attempt).Error
+	if err != nil {
+		return err
+	}
+
+	// A concurrent failure may have blocked the counter for longer already, the block is only extended.
+	blockedUntil := now.Add(s.blockDuration(counter, attempt.Failures))
+	_, err = gorm.G[model.LoginAttempt](s.Dep.DB).Where("counter_key = ? AND blocked_until < ?", counter.key, blockedUntil).
+		Update(ctx, "blocked_until", blockedUntil)
+	return err
+}
+
+func (s *UserService) recordFailedAttemptByRedis(ctx context.Context, counter attemptCounter) error {
+	window := time.Duration(s.Dep.Cfg.LoginLockoutDurationInSec) * time.Second
+
+	failures, err := s.Dep.Redis.HIncrBy(ctx, counter.key, "failures", 1).Result()
+	if err != nil {
+		return err
+	}
+
+	blockedUntil := time.Now().Add(s.blockDuration(counter, int(failures)))
+	err = s.Dep.Redis.HSet(ctx, counter.key, "blockedUntil", strconv.FormatInt(blockedUntil.Unix(), 10)).Err()
+	if err != nil {
+		return err
+	}
+
+	// Failures are forgotten once the window has passed since the last one.
+	return s.Dep.Redis.Expire(ctx, counter.key, window).Err()
+}
+
+func (s *UserService) recordFailedAttempt(ctx context.Context, counters []attemptCounter) error {
+	for _, counter := range counters {
+		var err error
+		if s.Dep.Cfg.IsRedisEnabled {
+			err = s.recordFailedAttemptByRedis(ctx, counter)
+		} else {
+			err = s.recordFailedAttemptByDB(ctx, counter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *UserService) resetAttemptCounters(ctx context.Context, counters []attemptCounter) error {
+	keys := make([]string, 0, len(counters))
+	for _, counter := range counters {
+		if !counter.keepOnSuccess {
+			keys = append(keys, counter.key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.Dep.Redis.Del(ctx, keys...).Err()
+	}
+
+	_, err := gorm.G[model.LoginAttempt](s.Dep.DB.Unscoped()).Where("counter_key IN ?", keys).Delete(ctx)
+	return err
+}
+
+// failAttempt records the failure and returns the error to answer it with.
+func (s *UserService) failAttempt(ctx context.Context, counters []attemptCounter, failure error) error {
+	if err := s.recordFailedAttempt(ctx, counters); err != nil {
+		return err
+	}
+
+	return failure
+}
@@ -0,0 +1,207 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"gorm.io/gorm"
+)
+
+func login(userService *service.UserService, ctx context.Context, identifier string, password string) error {
+	_, err := userService.LoginUser(ctx, &dto.LoginUserRequest{
+		Identifier: dto.Identifier{Identifier: identifier},
+		Password:   dto.Password{Password: password},
+	})
+	return err
+}
+
+func TestLoginAttempts(t *testing.T) {
+	t.Run("backoff after the free attempts", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+
+		for i := 0; i < userService.Dep.Cfg.LoginFreeAttempts; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		}
+
+		// The next failure starts the backoff, even the right password has to wait.
+		expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		err := login(userService, context.Background(), "alice", "Password.777")
+		expectAuthErrorStatus(t, err, 429)
+
+		var authErr *authError.AuthError
+		if !errors.As(err, &authErr) || authErr.RetryAfter < 1 {
+			t.Fatalf("expected retry after to be set, got %v", err)
+		}
+	})
+
+	t.Run("lockout after the max attempts", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		createAndLoginUser(t, userService, myDB)
+
+		for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		}
+
+		err := login(userService, context.Background(), "alice", "Password.777")
+		expectAuthErrorStatus(t, err, 429)
+
+		var authErr *authError.AuthError
+		if !errors.As(err, &authErr) || authErr.RetryAfter < userService.Dep.Cfg.LoginLockoutDurationInSec-1 {
+			t.Fatalf("expected a lockout, got %v", err)
+		}
+	})
+
+	t.Run("unknown account looks the same", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+
+		for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "nobody", "Wrong.777"), 401)
+		}
+
+		expectAuthErrorStatus(t, login(userService, context.Background(), "nobody", "Wrong.777"), 429)
+	})
+
+	t.Run("success resets the counters", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		createAndLoginUser(t, userService, myDB)
+
+		for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts-1; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		}
+		if err := login(userService, context.Background(), "alice", "Password.777"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		if err := login(userService, context.Background(), "alice", "Password.777"); err != nil {
+			t.Fatalf("expected counters to be reset, err: %v", err)
+		}
+	})
+
+	t.Run("failures are forgotten after the window", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		createAndLoginUser(t, userService, myDB)
+
+		for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts-1; i++ {
+			expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		}
+
+		window := time.Duration(userService.Dep.Cfg.LoginLockoutDurationInSec) * time.Second
+		_, err := gorm.G[db.LoginAttempt](myDB).Where("1 = 1").Update(context.Background(), "last_failure_at", time.Now().Add(-window))
+		if err != nil {
+			t.Fatalf("failed to age login attempts, err: %v", err)
+		}
+
+		expectAuthErrorStatus(t, login(userService, context.Background(), "alice", "Wrong.777"), 401)
+		if err := login(userService, context.Background(), "alice", "Password.777"); err != nil {
+			t.Fatalf("expected old failures to be forgotten, err: %v", err)
+		}
+	})
+
+	t.Run("per ip counter", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		userService.Dep.Cfg.LoginMaxAttemptsPerIP = 3
+		ctx := util.WithClientInfo(context.Background(), util.ClientInfo{IP: "203.0.113.7"})
+
+		// Spraying different identifiers from one IP
+		for _, identifier := range []string{"bob", "carol", "dave"} {
+			expectAuthErrorStatus(t, login(userService, ctx, identifier, "Wrong.777"), 401)
+		}
+
+		expectAuthErrorStatus(t, login(userService, ctx, "erin", "Wrong.777"), 429)
+		expectAuthErrorStatus(t, login(userService, context.Background(), "erin", "Wrong.777"), 401)
+	})
+
+	t.Run("success does not reset the per ip counter", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+		userService.Dep.Cfg.LoginMaxAttemptsPerIP = 3
+		createPasswordUser(t, myDB)
+		ctx := util.WithClientInfo(context.Background(), util.ClientInfo{IP: "203.0.113.7"})
+
+		// Logging in to an account of one's own in between does not buy more guesses on the others
+		for _, identifier := range []string{"bob", "carol"} {
+			expectAuthErrorStatus(t, login(userService, ctx, identifier, "Wrong.777"), 401)
+			if err := login(userService, ctx, "alice", "Password.777"); err != nil {
+				t.Fatalf("unexpected error, err: %v", err)
+			}
+		}
+		expectAuthErrorStatus(t, login(userService, ctx, "dave", "Wrong.777"), 401)
+
+		expectAuthErrorStatus(t, login(userService, ctx, "erin", "Wrong.777"), 429)
+	})
+
+	t.Run("concurrent failures are all counted", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginFreeAttempts = 100
+		userService.Dep.Cfg.LoginMaxAttempts = 100
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = login(userService, context.Background(), "nobody", "Wrong.777")
+			}()
+		}
+		wg.Wait()
+
+		attempt, err := gorm.G[db.LoginAttempt](myDB).Where("counter_key LIKE ?", "%nobody").First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query login attempt, err: %v", err)
+		}
+		if attempt.Failures != 10 {
+			t.Fatalf("expected 10 failures, got %d", attempt.Failures)
+		}
+	})
+}
+
+func TestTwoFAChallengeAttempts(t *testing.T) {
+	userService, myDB := testutil.NewTestUserService(t)
+	userService.Dep.Cfg.LoginBackoffBaseInSec = 0
+
+	secret := "JBSWY3DPEHPK3PXP"
+	user := db.User{
+		Username:   "alice",
+		Email:      "alice@example.com",
+		TotpSecret: &secret,
+	}
+	if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
+		t.Fatalf("failed to create user, err: %v", err)
+	}
+
+	// A new login every time, so the cap of wrong codes per session token does not kick in first.
+	submit := func() error {
+		sessionToken, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+		if err != nil {
+			t.Fatalf("failed to sign session token, err: %v", err)
+		}
+
+		_, err = userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+			TwoFACode:    "000000",
+			SessionToken: sessionToken,
+		})
+		return err
+	}
+
+	for i := 0; i < userService.Dep.Cfg.LoginMaxAttempts; i++ {
+		expectAuthErrorStatus(t, submit(), 400)
+	}
+	expectAuthErrorStatus(t, submit(), 429)
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const LoginCodePrefix = "login_code:"
+
+func buildLoginCodeKey(codeHash string) string {
+	return LoginCodePrefix + codeHash
+}
+
+func (s *UserService) createLoginCodeByDB(ctx context.Context, code *model.LoginCode) error {
+	// Codes live for seconds, expired ones are cleaned up whenever a new one is issued.
+	_, err := gorm.G[model.LoginCode](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.LoginCode](s.Dep.DB).Create(ctx, code)
+}
+
+func (s *UserService) createLoginCodeByRedis(ctx context.Context, code *model.LoginCode) error {
+	key := buildLoginCodeKey(code.CodeHash)
+	err := s.Dep.Redis.HSet(ctx, key,
+		"userId", code.UserID,
+		"expiresAt", code.ExpiresAt.Unix(),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return s.Dep.Redis.ExpireAt(ctx, key, code.ExpiresAt).Err()
+}
+
+// consumeLoginCodeByDB returns the code and deletes it, a code can only be redeemed once.
+func (s *UserService) consumeLoginCodeByDB(ctx context.Context, codeHash string) (*model.LoginCode, error) {
+	code, err := gorm.G[model.LoginCode](s.Dep.DB).Where("code_hash = ?", codeHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, "invalid or expired login code")
+		}
+		return nil, err
+	}
+
+	// The row count guards against two concurrent redemptions of the same code.
+	rows, err := gorm.G[model.LoginCode](s.Dep.DB.Unscoped()).Where("id = ?", code.ID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, authError.NewAuthError(401, "invalid or expired login code")
+	}
+
+	return &code, nil
+}
+
+func (s *UserService) consumeLoginCodeByRedis(ctx context.Context, codeHash string) (*model.LoginCode, error) {
+	key := buildLoginCodeKey(codeHash)
+
+	var getCmd *redis.MapStringStringCmd
+	_, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := getCmd.Val()
+	if len(values) == 0 {
+		return nil, authError.NewAuthError(401, "invalid or expired login code")
+	}
+
+	userID, err := strconv.ParseUint(values["userId"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := strconv.ParseInt(values["expiresAt"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.LoginCode{
+		UserID:    uint(userID),
+		CodeHash:  codeHash,
+		ExpiresAt: time.Unix(expiresAt, 0),
+	}, nil
+}
+
+// issueLoginCode returns a code for the redirect to the frontend, so the tokens never show up in a URL.
+func (s *UserService) issueLoginCode(ctx context.Context, userID uint) (string, error) {
+	code, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	modelCode := &model.LoginCode{
+		UserID:    userID,
+		CodeHash:  hashOpaqueToken(code),
+		ExpiresAt: time.Now().Add(time.Duration(s.Dep.Cfg.LoginCodeExpiry) * time.Second),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createLoginCodeByRedis(ctx, modelCode)
+	} else {
+		err = s.createLoginCodeByDB(ctx, modelCode)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// ExchangeLoginCode redeems the code of an OAuth login redirect for the tokens of the user,
+// or for the 2FA challenge when the user has 2FA enabled.
+func (s *UserService) ExchangeLoginCode(ctx context.Context, request *dto.LoginCodeRequest) (*LoginResult, error) {
+	var code *model.LoginCode
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		code, err = s.consumeLoginCodeByRedis(ctx, hashOpaqueToken(request.Code))
+	} else {
+		code, err = s.consumeLoginCodeByDB(ctx, hashOpaqueToken(request.Code))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(code.ExpiresAt) {
+		return nil, authError.NewAuthError(401, "invalid or expired login code")
+	}
+
+	modelUser, err := s.findLoginUser(ctx, code.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, "invalid or expired login code")
+		}
+		return nil, err
+	}
+
+	return s.completeLogin(ctx, &modelUser, request.TrustedDeviceToken)
+}
@@ -0,0 +1,65 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+)
+
+// googleLoginCode logs in with a mocked Google account and returns the code of the redirect.
+func googleLoginCode(t *testing.T, userService *service.UserService) string {
+	t.Helper()
+
+	state, binding := startGoogleLogin(t, userService)
+	q := googleCallbackQuery(t, userService, state, binding)
+	if q.Get("code") == "" || q.Get("token") != "" || q.Get("refreshToken") != "" {
+		t.Fatalf("expected a login code and no tokens, got %v", q)
+	}
+
+	return q.Get("code")
+}
+
+func TestExchangeLoginCode(t *testing.T) {
+	t.Run("code is redeemed once", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockGoogleAccount(t, "gid-code", "code@example.com", true)
+
+		code := googleLoginCode(t, userService)
+
+		result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: code})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		user := result.User
+		if user == nil || user.Email != "code@example.com" || user.Token == "" || user.RefreshToken == "" {
+			t.Fatalf("unexpected user %+v", user)
+		}
+		if err := userService.ValidateUserToken(context.Background(), user.Token, user.ID); err != nil {
+			t.Fatalf("expected a valid session, err: %v", err)
+		}
+
+		_, err = userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: code})
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("unknown code", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		_, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: "nope"})
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("expired code", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.LoginCodeExpiry = -1
+		mockGoogleAccount(t, "gid-late", "late@example.com", true)
+
+		code := googleLoginCode(t, userService)
+
+		_, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: code})
+		expectAuthErrorStatus(t, err, 401)
+	})
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const OauthFlowPrefix = "oauth_flow:"
+
+func buildOauthFlowKey(stateHash string) string {
+	return OauthFlowPrefix + stateHash
+}
+
+// startOauthFlow stores the PKCE verifier and the nonce of a new round trip, bound to the browser that starts it.
+// It returns the round trip, and the binding the handler stores in a cookie.
+func (s *UserService) startOauthFlow(ctx context.Context, state string) (*model.OauthFlow, string, error) {
+	binding, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	codeVerifier, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	nonce, err := generateOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	flow := &model.OauthFlow{
+		StateHash:    hashOpaqueToken(state),
+		BindingHash:  hashOpaqueToken(binding),
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(time.Duration(s.Dep.Cfg.OauthStateTokenExpiry) * time.Second),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createOauthFlowByRedis(ctx, flow)
+	} else {
+		err = s.createOauthFlowByDB(ctx, flow)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return flow, binding, nil
+}
+
+func (s *UserService) createOauthFlowByDB(ctx context.Context, flow *model.OauthFlow) error {
+	// Abandoned round trips are cleaned up whenever a new one starts.
+	_, err := gorm.G[model.OauthFlow](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.OauthFlow](s.Dep.DB).Create(ctx, flow)
+}
+
+func (s *UserService) createOauthFlowByRedis(ctx context.Context, flow *model.OauthFlow) error {
+	key := buildOauthFlowKey(flow.StateHash)
+	err := s.Dep.Redis.HSet(ctx, key,
+		"bindingHash", flow.BindingHash,
+		"codeVerifier", flow.CodeVerifier,
+		"nonce", flow.Nonce,
+		"expiresAt", flow.ExpiresAt.Unix(),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return s.Dep.Redis.ExpireAt(ctx, key, flow.ExpiresAt).Err()
+}
+
+// consumeOauthFlowByDB returns the round trip and deletes it, a replayed state finds nothing.
+func (s *UserService) consumeOauthFlowByDB(ctx context.Context, stateHash string) (*model.OauthFlow, error) {
+	flow, err := gorm.G[model.OauthFlow](s.Dep.DB).Where("state_hash = ?", stateHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, "unknown or replayed oauth state")
+		}
+		return nil, err
+	}
+
+	// The row count guards against two concurrent callbacks with the same state.
+	rows, err := gorm.G[model.OauthFlow](s.Dep.DB.Unscoped()).Where("id = ?", flow.ID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, authError.NewAuthError(400, "unknown or replayed oauth state")
+	}
+
+	return &flow, nil
+}
+
+func (s *UserService) consumeOauthFlowByRedis(ctx context.Context, stateHash string) (*model.OauthFlow, error) {
+	key := buildOauthFlowKey(stateHash)
+
+	var getCmd *redis.MapStringStringCmd
+	_, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := getCmd.Val()
+	if len(values) == 0 {
+		return nil, authError.NewAuthError(400, "unknown or replayed oauth state")
+	}
+
+	expiresAt, err := strconv.ParseInt(values["expiresAt"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.OauthFlow{
+		StateHash:    stateHash,
+		BindingHash:  values["bindingHash"],
+		CodeVerifier: values["codeVerifier"],
+		Nonce:        values["nonce"],
+		ExpiresAt:    time.Unix(expiresAt, 0),
+	}, nil
+}
+
+// consumeOauthFlow ends the round trip of the state, it must come back to the browser that started it.
+func (s *UserService) consumeOauthFlow(ctx context.Context, state string, binding string) (*model.OauthFlow, error) {
+	var flow *model.OauthFlow
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		flow, err = s.consumeOauthFlowByRedis(ctx, hashOpaqueToken(state))
+	} else {
+		flow, err = s.consumeOauthFlowByDB(ctx, hashOpaqueToken(state))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(flow.ExpiresAt) {
+		return nil, authError.NewAuthError(400, "expired oauth state")
+	}
+
+	if binding == "" || subtle.ConstantTimeCompare([]byte(hashOpaqueToken(binding)), []byte(flow.BindingHash)) != 1 {
+		return nil, authError.NewAuthError(400, "oauth state was started by another browser")
+	}
+
+	return flow, nil
+}
@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
+	"gorm.io/gorm"
+)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func (s *UserService) getOauthProvider(name string) (*oauth.Provider, error) {
+	provider, ok := s.Dep.OauthProviders[name]
+	if !ok {
+		return nil, authError.NewAuthError(404, "unknown oauth provider")
+	}
+
+	return provider, nil
+}
+
+func assembleFrontendOauthRedirectURL(dep *dependency.Dependency, provider string, q url.Values) string {
+	u, err := url.Parse(dep.Cfg.FrontendUrl + "/user/oauth-callback")
+	if err != nil {
+		dep.Logger.Error("failed to parse frontend redirect url:", "err", err)
+		return "/unrecovered-error"
+	}
+
+	q.Set("provider", provider)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func handleOauthCallbackError(dep *dependency.Dependency, provider string, err error, errMsg string) string {
+	dep.Logger.Error(errMsg, "provider", provider, "error", err)
+	return assembleFrontendOauthRedirectURL(dep, provider, url.Values{"error": {"Failed to handle OAuth callback."}})
+}
+
+// ListOauthProviders returns the names of the configured providers, for the login buttons of the frontend.
+func (s *UserService) ListOauthProviders() *dto.OauthProvidersResponse {
+	providers := make([]string, 0, len(s.Dep.OauthProviders))
+	for name := range s.Dep.OauthProviders {
+		providers = append(providers, name)
+	}
+	slices.Sort(providers)
+
+	return &dto.OauthProvidersResponse{Providers: providers}
+}
+
+// GetOauthLoginURL starts a login with the provider. It returns the provider URL, and the binding the handler stores in a cookie.
+func (s *UserService) GetOauthLoginURL(ctx context.Context, providerName string) (string, string, error) {
+	provider, err := s.getOauthProvider(providerName)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := jwt.SignOauthProviderStateToken(s.Dep, providerName, 0)
+	if err != nil {
+		return "", "", err
+	}
+
+	return s.startProviderOauthFlow(ctx, provider, state)
+}
+
+// GetOauthLinkURL starts a round trip that links the provider account to the logged in user.
+// Like GetOauthLoginURL, it also returns the binding for the cookie.
+func (s *UserService) GetOauthLinkURL(ctx context.Context, providerName string, userID uint) (*dto.OauthLinkURLResponse, string, error) {
+	provider, err := s.getOauthProvider(providerName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = gorm.G[model.UserIdentity](s.Dep.DB).Where("user_id = ? AND provider = ?", userID, providerName).First(ctx)
+	if err == nil {
+		return nil, "", authError.NewAuthError(409, providerName+" account already linked")
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", err
+	}
+
+	state, err := jwt.SignOauthProviderStateToken(s.Dep, providerName, userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	providerURL, binding, err := s.startProviderOauthFlow(ctx, provider, state)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &dto.OauthLinkURLResponse{URL: providerURL}, binding, nil
+}
+
+// GetOauthReauthURL starts a round trip where the logged in user proves they still own their linked provider account,
+// in place of a password they do not have. It re-authenticates the session of the access token only.
+// Like GetOauthLoginURL, it also returns the binding for the cookie.
+func (s *UserService) GetOauthReauthURL(ctx context.Context, providerName string, userID uint, token string) (*dto.OauthLinkURLResponse, string, error) {
+	provider, err := s.getOauthProvider(providerName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = gorm.G[model.UserIdentity](s.Dep.DB).Where("user_id = ? AND provider = ?", userID, providerName).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", authError.NewAuthError(400, "no "+providerName+" account linked")
+		}
+		return nil, "", err
+	}
+
+	session, err := s.getSession(ctx, userID, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state, err := jwt.SignOauthReauthStateToken(s.Dep, providerName, userID, session)
+	if err != nil {
+		return nil, "", err
+	}
+
+	providerURL, binding, err := s.startProviderOauthFlow(ctx, provider, state)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &dto.OauthLinkURLResponse{URL: providerURL}, binding, nil
+}
+
+// startProviderOauthFlow starts the round trip of the state, and returns the provider URL and the binding for the cookie.
+func (s *UserService) startProviderOauthFlow(ctx context.Context, provider *oauth.Provider, state string) (string, string, error) {
+	flow, binding, err := s.startOauthFlow(ctx, state)
+	if err != nil {
+		return "", "", err
+	}
+
+	return provider.AuthCodeURL(state, flow.CodeVerifier, flow.Nonce), binding, nil
+}
+
+func (s *UserService) linkOauthIdentity(ctx context.Context, userID uint, providerName string, identity *oauth.Identity) error {
+	err := gorm.G[model.UserIdentity](s.Dep.DB).Create(ctx, newUserIdentity(userID, providerName, identity.Subject, identity.Email, identity.Profile))
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return authError.NewAuthError(409, providerName+" account already linked")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// oauthUsername turns the provider username into a valid, free-looking one; a random one is used on retry.
+func oauthUsername(providerName string, identity *oauth.Identity, isRetry bool) string {
+	username := usernameInvalidChars.ReplaceAllString(identity.Username, "")
+	if len(username) > 50 {
+		username = username[:50]
+	}
+
+	if isRetry || len(username) < 3 {
+		return providerName + "_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	}
+
+	return username
+}
+
+func (s *UserService) createUserFromOauthIdentity(ctx context.Context, providerName string, identity *oauth.Identity, isRetry bool) (*model.User, error) {
+	modelUser := model.User{
+		Username: oauthUsername(providerName, identity, isRetry),
+		Email:    identity.Email,
+		Avatar:   identity.Avatar,
+	}
+	if identity.EmailVerified {
+		now := time.Now()
+		modelUser.EmailVerifiedAt = &now
+	}
+
+	err := s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := gorm.G[model.User](tx).Create(ctx, &modelUser); err != nil {
+			return err
+		}
+
+		return gorm.G[model.UserIdentity](tx).Create(ctx, newUserIdentity(modelUser.ID, providerName, identity.Subject, identity.Email, identity.Profile))
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			// Most likely the username is taken, the email was checked by the caller.
+			if !isRetry {
+				return s.createUserFromOauthIdentity(ctx, providerName, identity, true)
+			}
+			return nil, authError.NewAuthError(409, "username or email already in use")
+		}
+		return nil, err
+	}
+
+	return &modelUser, nil
+}
+
+// HandleOauthCallback finishes a round trip with a provider of OAUTH_PROVIDERS, and returns where to send the browser.
+// It logs in the user of the provider account, links it to the logged in user, or creates a new user.
+// Binding is the cookie set when the round trip started.
+func (s *UserService) HandleOauthCallback(ctx context.Context, providerName string, code string, state string, binding string) string {
+	provider, err := s.getOauthProvider(providerName)
+	if err != nil {
+		return handleOauthCallbackError(s.Dep, providerName, err, "unknown oauth provider")
+	}
+
+	claims, err := jwt.ValidateOauthStateToken(s.Dep, state)
+	if err != nil || claims.Provider != providerName {
+		return handleOauthCallbackError(s.Dep, providerName, err, "invalid oauth state token")
+	}
+
+	flow, err := s.consumeOauthFlow(ctx, state, binding)
+	if err != nil {
+		return handleOauthCallbackError(s.Dep, providerName, err, "invalid oauth round trip")
+	}
+
+	accessToken, err := provider.Exchange(ctx, code, flow.CodeVerifier, flow.Nonce)
+	if err != nil {
+		return handleOauthCallbackError(s.Dep, providerName, err, "failed to exchange code for tokens")
+	}
+
+	identity, err := provider.FetchIdentity(ctx, accessToken)
+	if err != nil {
+		return handleOauthCallbackError(s.Dep, providerName, err, "failed to fetch oauth user info")
+	}
+
+	// A logged in user re-authenticating their session, only the account they linked will do.
+	if claims.Reauth {
+		modelIdentity, err := gorm.G[model.UserIdentity](s.Dep.DB).Where("user_id = ? AND provider = ?", claims.UserID, providerName).First(ctx)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to query user identity to re-authenticate")
+		}
+		if modelIdentity.Subject != identity.Subject {
+			return handleOauthCallbackError(s.Dep, providerName, authError.NewAuthError(403, "other account"), "re-authenticated with another oauth account")
+		}
+
+		err = s.refreshIdentitySnapshot(ctx, modelIdentity.ID, identity.Email, identity.Profile)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to refresh user identity")
+		}
+
+		err = s.markSessionReauthenticated(ctx, claims.UserID, claims.Session, time.Now())
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to re-authenticate session")
+		}
+
+		return assembleFrontendOauthRedirectURL(s.Dep, providerName, url.Values{"reauthenticated": {providerName}})
+	}
+
+	// A logged in user linking their account, they are not logged in again.
+	if claims.UserID != 0 {
+		err = s.linkOauthIdentity(ctx, claims.UserID, providerName, identity)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to link oauth account to logged in user")
+		}
+
+		return assembleFrontendOauthRedirectURL(s.Dep, providerName, url.Values{"linked": {providerName}})
+	}
+
+	var modelUser model.User
+	modelIdentity, err := gorm.G[model.UserIdentity](s.Dep.DB).Where("provider = ? AND subject = ?", providerName, identity.Subject).First(ctx)
+	if err == nil {
+		err = s.refreshIdentitySnapshot(ctx, modelIdentity.ID, identity.Email, identity.Profile)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to refresh user identity")
+		}
+
+		modelUser, err = s.findLoginUser(ctx, modelIdentity.UserID)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to query user of the identity")
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return handleOauthCallbackError(s.Dep, providerName, err, "failed to query user identity")
+	} else {
+		if identity.Email == "" {
+			return handleOauthCallbackError(s.Dep, providerName, authError.NewAuthError(400, "no email"), "oauth account has no email")
+		}
+
+		// An existing user links the provider from their profile, the email alone does not prove it is theirs.
+		// Accounts pending deletion still hold their email.
+		err = s.Dep.DB.WithContext(ctx).Unscoped().Where("email = ?", identity.Email).First(&model.User{}).Error
+		if err == nil {
+			return handleOauthCallbackError(s.Dep, providerName, authError.NewAuthError(409, "same email exists"), "oauth account email belongs to an existing user")
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to query user by email")
+		}
+
+		newUser, err := s.createUserFromOauthIdentity(ctx, providerName, identity, false)
+		if err != nil {
+			return handleOauthCallbackError(s.Dep, providerName, err, "failed to create new user from oauth info")
+		}
+		modelUser = *newUser
+	}
+
+	// The same rule as a password login, the provider is only trusted with the email when it says so.
+	if s.Dep.Cfg.EmailVerificationPolicy == config.EmailVerificationPolicyLogin && modelUser.EmailVerifiedAt == nil {
+		s.Dep.Logger.Info("oauth login refused, email not verified", "provider", providerName, "userID", modelUser.ID)
+		return assembleFrontendOauthRedirectURL(s.Dep, providerName, url.Values{"error": {"email not verified"}})
+	}
+
+	loginCode, err := s.issueLoginCode(ctx, modelUser.ID)
+	if err != nil {
+		return handleOauthCallbackError(s.Dep, providerName, err, "failed to issue login code for user")
+	}
+
+	return assembleFrontendOauthRedirectURL(s.Dep, providerName, url.Values{"code": {loginCode}})
+}
+
+// UnlinkOauthIdentity removes the provider account of the user, as long as they can still log in another way.
+func (s *UserService) UnlinkOauthIdentity(ctx context.Context, providerName string, userID uint) (*dto.UserWithoutTokenResponse, error) {
+	if _, err := s.getOauthProvider(providerName); err != nil {
+		return nil, err
+	}
+
+	return s.unlinkIdentity(ctx, providerName, userID)
+}
+
+// unlinkIdentity removes the account of the user at the provider, refused when nothing else would be left to log in with.
+func (s *UserService) unlinkIdentity(ctx context.Context, providerName string, userID uint) (*dto.UserWithoutTokenResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	modelIdentity := findIdentity(&modelUser, providerName)
+	if modelIdentity == nil {
+		return nil, authError.NewAuthError(400, "no "+providerName+" account linked")
+	}
+
+	loginMethods := len(modelUser.Identities)
+	if modelUser.PasswordHash != nil {
+		loginMethods++
+	}
+	if loginMethods <= 1 {
+		return nil, authError.NewAuthError(400, "cannot unlink the only login method, set a password first")
+	}
+
+	_, err = gorm.G[model.UserIdentity](s.Dep.DB.Unscoped()).Where("id = ?", modelIdentity.ID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	modelUser.Identities = slices.DeleteFunc(modelUser.Identities, func(identity model.UserIdentity) bool {
+		return identity.Provider == providerName
+	})
+
+	return userToUserWithoutTokenResponse(&modelUser), nil
+}
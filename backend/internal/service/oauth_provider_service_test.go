@@ -0,0 +1,369 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
+	"gorm.io/gorm"
+)
+
+// mockOauthProvider registers a "github" provider whose token and userinfo endpoints answer with the given profile.
+func mockOauthProvider(t *testing.T, userService *service.UserService, profile map[string]any) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code_verifier") == "" {
+			w.WriteHeader(400)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(profile)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	userService.Dep.OauthProviders["github"] = &oauth.Provider{
+		Name:         "github",
+		AuthorizeURL: srv.URL + "/authorize",
+		TokenURL:     srv.URL + "/token",
+		UserInfoURL:  srv.URL + "/user",
+		Claims:       oauth.ClaimMapping{Subject: "id", Email: "email", EmailVerified: "email_verified", Username: "login"},
+		HTTPClient:   srv.Client(),
+	}
+}
+
+// startOauthLogin starts a provider login like OauthLoginHandler, and returns the state and the cookie binding.
+func startOauthLogin(t *testing.T, userService *service.UserService, provider string) (string, string) {
+	t.Helper()
+
+	loginURL, binding, err := userService.GetOauthLoginURL(context.Background(), provider)
+	if err != nil {
+		t.Fatalf("failed to start %s login, err: %v", provider, err)
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("failed to parse login url, err: %v", err)
+	}
+	return u.Query().Get("state"), binding
+}
+
+func oauthCallbackQuery(t *testing.T, userService *service.UserService, provider string, state string, binding string) url.Values {
+	t.Helper()
+
+	redirect := userService.HandleOauthCallback(context.Background(), provider, "code", state, binding)
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatalf("failed to parse redirect url, err: %v", err)
+	}
+	if u.Query().Get("provider") != provider {
+		t.Fatalf("expected provider query param, got %v", u.Query())
+	}
+	return u.Query()
+}
+
+func TestOauthProviderLogin(t *testing.T) {
+	t.Run("unknown provider", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		_, _, err := userService.GetOauthLoginURL(context.Background(), "gitlab")
+		expectAuthErrorStatus(t, err, 404)
+	})
+
+	t.Run("new user is created then logged in", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 42, "login": "octo cat!", "email": "octocat@example.com", "email_verified": true})
+
+		if providers := userService.ListOauthProviders().Providers; len(providers) != 1 || providers[0] != "github" {
+			t.Fatalf("expected github to be listed, got %v", providers)
+		}
+
+		loginURL, binding, err := userService.GetOauthLoginURL(context.Background(), "github")
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		u, err := url.Parse(loginURL)
+		if err != nil {
+			t.Fatalf("failed to parse login url, err: %v", err)
+		}
+		state := u.Query().Get("state")
+		if u.Query().Get("code_challenge_method") != "S256" || u.Query().Get("nonce") == "" {
+			t.Fatalf("expected pkce and nonce params, got %v", u.Query())
+		}
+
+		q := oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("code") == "" || q.Get("token") != "" {
+			t.Fatalf("expected a login code instead of tokens, got %v", q)
+		}
+		result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: q.Get("code")})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		loggedIn := result.User
+		if loggedIn == nil || loggedIn.Token == "" || loggedIn.RefreshToken == "" || len(loggedIn.LinkedProviders) != 1 {
+			t.Fatalf("unexpected login %+v", loggedIn)
+		}
+
+		modelUser, err := gorm.G[db.User](myDB).Where("email = ?", "octocat@example.com").First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to load user, err: %v", err)
+		}
+		if modelUser.Username != "octocat" || modelUser.PasswordHash != nil || modelUser.EmailVerifiedAt == nil {
+			t.Fatalf("unexpected user %+v", modelUser)
+		}
+
+		// Logging in again reuses the identity
+		state, binding = startOauthLogin(t, userService, "github")
+		q = oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("code") == "" {
+			t.Fatalf("expected code, got %v", q)
+		}
+		count, err := gorm.G[db.User](myDB).Count(context.Background(), "id")
+		if err != nil || count != 1 {
+			t.Fatalf("expected a single user, got %d, err: %v", count, err)
+		}
+	})
+
+	t.Run("taken username gets a generated one", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+		mockOauthProvider(t, userService, map[string]any{"id": "7", "login": "alice", "email": "alice.gh@example.com"})
+
+		state, binding := startOauthLogin(t, userService, "github")
+
+		q := oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("code") == "" {
+			t.Fatalf("expected code, got %v", q)
+		}
+
+		modelUser, err := gorm.G[db.User](myDB).Where("email = ?", "alice.gh@example.com").First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to load user, err: %v", err)
+		}
+		if modelUser.Username == "alice" || modelUser.EmailVerifiedAt != nil {
+			t.Fatalf("unexpected user %+v", modelUser)
+		}
+	})
+
+	t.Run("existing email is not taken over", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+		mockOauthProvider(t, userService, map[string]any{"id": "7", "login": "alice", "email": "alice@example.com", "email_verified": true})
+
+		state, binding := startOauthLogin(t, userService, "github")
+
+		q := oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+
+	t.Run("login policy refuses an unverified email", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.EmailVerificationPolicy = config.EmailVerificationPolicyLogin
+		mockOauthProvider(t, userService, map[string]any{"id": 21, "login": "frank", "email": "frank@example.com", "email_verified": false})
+
+		state, binding := startOauthLogin(t, userService, "github")
+		q := oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("error") != "email not verified" || q.Get("code") != "" {
+			t.Fatalf("expected an email not verified error and no code, got %v", q)
+		}
+
+		mockOauthProvider(t, userService, map[string]any{"id": 22, "login": "grace", "email": "grace@example.com", "email_verified": true})
+		state, binding = startOauthLogin(t, userService, "github")
+		if q := oauthCallbackQuery(t, userService, "github", state, binding); q.Get("code") == "" {
+			t.Fatalf("expected code, got %v", q)
+		}
+	})
+
+	t.Run("state of another provider is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": "7", "login": "bob", "email": "bob@example.com"})
+
+		googleState, binding := startGoogleLogin(t, userService)
+
+		q := oauthCallbackQuery(t, userService, "github", googleState, binding)
+		if q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+}
+
+func TestOauthProviderFlowBinding(t *testing.T) {
+	t.Run("callback without the binding cookie is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 11, "login": "mallory", "email": "mallory@example.com", "email_verified": true})
+
+		state, _ := startOauthLogin(t, userService, "github")
+		_, otherBinding := startOauthLogin(t, userService, "github")
+
+		if q := oauthCallbackQuery(t, userService, "github", state, ""); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+
+		state, _ = startOauthLogin(t, userService, "github")
+		if q := oauthCallbackQuery(t, userService, "github", state, otherBinding); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+
+	t.Run("replayed state is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 12, "login": "replay", "email": "replay@example.com", "email_verified": true})
+
+		state, binding := startOauthLogin(t, userService, "github")
+
+		if q := oauthCallbackQuery(t, userService, "github", state, binding); q.Get("code") == "" {
+			t.Fatalf("expected code query param, got %v", q)
+		}
+		if q := oauthCallbackQuery(t, userService, "github", state, binding); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected the replay to fail, got %v", q)
+		}
+	})
+
+	t.Run("signed state without a round trip is rejected", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 13, "login": "forged", "email": "forged@example.com", "email_verified": true})
+
+		state, err := jwt.SignOauthProviderStateToken(userService.Dep, "github", 0)
+		if err != nil {
+			t.Fatalf("failed to sign state token, err: %v", err)
+		}
+
+		if q := oauthCallbackQuery(t, userService, "github", state, "binding"); q.Get("error") == "" || q.Get("code") != "" {
+			t.Fatalf("expected an error and no code, got %v", q)
+		}
+	})
+}
+
+func TestOauthProviderLinking(t *testing.T) {
+	t.Run("logged in user links and unlinks", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+		mockOauthProvider(t, userService, map[string]any{"id": 99, "login": "alice-gh", "email": "alice@example.com"})
+
+		resp, binding, err := userService.GetOauthLinkURL(context.Background(), "github", user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		linkURL, err := url.Parse(resp.URL)
+		if err != nil {
+			t.Fatalf("failed to parse link url, err: %v", err)
+		}
+
+		q := oauthCallbackQuery(t, userService, "github", linkURL.Query().Get("state"), binding)
+		if q.Get("linked") != "github" || q.Get("code") != "" {
+			t.Fatalf("expected linked without a new session, got %v", q)
+		}
+
+		_, _, err = userService.GetOauthLinkURL(context.Background(), "github", user.ID)
+		expectAuthErrorStatus(t, err, 409)
+
+		profile, err := userService.GetUserByID(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(profile.LinkedProviders) != 1 || profile.LinkedProviders[0] != "github" {
+			t.Fatalf("expected github to be linked, got %v", profile.LinkedProviders)
+		}
+
+		// The linked account now logs in as alice
+		state, binding := startOauthLogin(t, userService, "github")
+		q = oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("code") == "" {
+			t.Fatalf("expected code, got %v", q)
+		}
+
+		if _, err := userService.UnlinkOauthIdentity(context.Background(), "github", user.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		_, err = userService.UnlinkOauthIdentity(context.Background(), "github", user.ID)
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("only login method cannot be unlinked", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 5, "login": "carol", "email": "carol@example.com"})
+
+		state, binding := startOauthLogin(t, userService, "github")
+		oauthCallbackQuery(t, userService, "github", state, binding)
+
+		modelUser, err := gorm.G[db.User](myDB).Where("username = ?", "carol").First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to load user, err: %v", err)
+		}
+
+		_, err = userService.UnlinkOauthIdentity(context.Background(), "github", modelUser.ID)
+		expectAuthErrorStatus(t, err, 400)
+
+		// A google account is another way in
+		identity := googleIdentities("gid-carol")[0]
+		identity.UserID = modelUser.ID
+		if err := gorm.G[db.UserIdentity](myDB).Create(context.Background(), &identity); err != nil {
+			t.Fatalf("failed to link google account, err: %v", err)
+		}
+		if _, err := userService.UnlinkOauthIdentity(context.Background(), "github", modelUser.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("re-authentication is bound to the session", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+		mockOauthProvider(t, userService, map[string]any{"id": 7, "login": "dave", "email": "dave@example.com"})
+
+		state, binding := startOauthLogin(t, userService, "github")
+		q := oauthCallbackQuery(t, userService, "github", state, binding)
+		result, err := userService.ExchangeLoginCode(context.Background(), &dto.LoginCodeRequest{Code: q.Get("code")})
+		if err != nil || result.User == nil {
+			t.Fatalf("expected a logged in user, got %+v, err: %v", result, err)
+		}
+		user := result.User
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+
+		_, _, err = userService.GetOauthReauthURL(context.Background(), "unknown", user.ID, user.Token)
+		expectAuthErrorStatus(t, err, 404)
+
+		startReauth := func() (string, string) {
+			resp, binding, err := userService.GetOauthReauthURL(context.Background(), "github", user.ID, user.Token)
+			if err != nil {
+				t.Fatalf("unexpected error, err: %v", err)
+			}
+			reauthURL, err := url.Parse(resp.URL)
+			if err != nil {
+				t.Fatalf("failed to parse reauth url, err: %v", err)
+			}
+			return reauthURL.Query().Get("state"), binding
+		}
+
+		// Another account at the provider does not prove anything.
+		mockOauthProvider(t, userService, map[string]any{"id": 8, "login": "eve", "email": "eve@example.com"})
+		state, binding = startReauth()
+		q = oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("error") == "" || q.Get("reauthenticated") != "" {
+			t.Fatalf("expected an error, got %v", q)
+		}
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+
+		mockOauthProvider(t, userService, map[string]any{"id": 7, "login": "dave", "email": "dave@example.com"})
+		state, binding = startReauth()
+		q = oauthCallbackQuery(t, userService, "github", state, binding)
+		if q.Get("reauthenticated") != "github" || q.Get("code") != "" {
+			t.Fatalf("expected a re-authentication without a new session, got %v", q)
+		}
+		expectRecentAuth(t, userService, user.ID, user.Token, true)
+	})
+}
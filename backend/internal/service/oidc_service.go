@@ -0,0 +1,333 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const OidcCodePrefix = "oidc_code:"
+
+// The error messages of the OIDC endpoints are the OAuth 2.0 error codes, relying parties depend on them.
+const (
+	OidcErrInvalidRequest       = "invalid_request"
+	OidcErrInvalidClient        = "invalid_client"
+	OidcErrInvalidGrant         = "invalid_grant"
+	OidcErrInvalidScope         = "invalid_scope"
+	OidcErrInvalidToken         = "invalid_token"
+	OidcErrUnsupportedGrantType = "unsupported_grant_type"
+)
+
+func buildOidcCodeKey(codeHash string) string {
+	return OidcCodePrefix + codeHash
+}
+
+// isOidcRedirectURIAllowed checks the pair against OIDC_CLIENTS, entries look like "client_id=redirect_uri".
+func (s *UserService) isOidcRedirectURIAllowed(clientID string, redirectURI string) bool {
+	for _, entry := range s.Dep.Cfg.OidcClients {
+		id, uri, ok := strings.Cut(entry, "=")
+		if ok && id == clientID && uri == redirectURI {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *UserService) validateOidcAuthorizeRequest(request *dto.OidcAuthorizeRequest) error {
+	if !s.isOidcRedirectURIAllowed(request.ClientID, request.RedirectURI) {
+		return authError.NewAuthError(400, OidcErrInvalidClient)
+	}
+
+	if !slices.Contains(strings.Fields(request.Scope), "openid") {
+		return authError.NewAuthError(400, OidcErrInvalidScope)
+	}
+
+	return nil
+}
+
+// verifyPKCE checks the S256 code challenge, the only method we support.
+func verifyPKCE(codeVerifier string, codeChallenge string) bool {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
+
+func (s *UserService) GetOidcDiscovery() *dto.OidcDiscoveryResponse {
+	issuer := strings.TrimSuffix(s.Dep.Cfg.OidcIssuer, "/")
+
+	return &dto.OidcDiscoveryResponse{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/api/oidc/authorize",
+		TokenEndpoint:                     issuer + "/api/oidc/token",
+		UserinfoEndpoint:                  issuer + "/api/oidc/userinfo",
+		IntrospectionEndpoint:             issuer + "/api/oidc/introspect",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{jwt.SigningAlg(s.Dep)},
+		ScopesSupported:                   []string{"openid", "profile"},
+		ClaimsSupported:                   []string{"sub", "preferred_username", "picture", "nonce"},
+		TokenEndpointAuthMethodsSupported: []string{"none", "client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+}
+
+// GetOidcConsentURL validates the authorization request and returns the frontend page that asks the logged in user to continue.
+func (s *UserService) GetOidcConsentURL(request *dto.OidcAuthorizeRequest) (string, error) {
+	if err := s.validateOidcAuthorizeRequest(request); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(s.Dep.Cfg.FrontendUrl + "/oidc/authorize")
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", request.ResponseType)
+	q.Set("client_id", request.ClientID)
+	q.Set("redirect_uri", request.RedirectURI)
+	q.Set("scope", request.Scope)
+	q.Set("code_challenge", request.CodeChallenge)
+	q.Set("code_challenge_method", request.CodeChallengeMethod)
+	if request.State != "" {
+		q.Set("state", request.State)
+	}
+	if request.Nonce != "" {
+		q.Set("nonce", request.Nonce)
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (s *UserService) createOidcCodeByDB(ctx context.Context, code *model.OidcAuthorizationCode) error {
+	// Codes live for seconds, expired ones are cleaned up whenever a new one is issued.
+	_, err := gorm.G[model.OidcAuthorizationCode](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.OidcAuthorizationCode](s.Dep.DB).Create(ctx, code)
+}
+
+func (s *UserService) createOidcCodeByRedis(ctx context.Context, code *model.OidcAuthorizationCode) error {
+	key := buildOidcCodeKey(code.CodeHash)
+	err := s.Dep.Redis.HSet(ctx, key,
+		"userId", code.UserID,
+		"clientId", code.ClientID,
+		"redirectUri", code.RedirectURI,
+		"scope", code.Scope,
+		"nonce", code.Nonce,
+		"codeChallenge", code.CodeChallenge,
+		"expiresAt", code.ExpiresAt.Unix(),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return s.Dep.Redis.ExpireAt(ctx, key, code.ExpiresAt).Err()
+}
+
+// consumeOidcCodeByDB returns the code and deletes it, a code can only be redeemed once.
+func (s *UserService) consumeOidcCodeByDB(ctx context.Context, codeHash string) (*model.OidcAuthorizationCode, error) {
+	code, err := gorm.G[model.OidcAuthorizationCode](s.Dep.DB).Where("code_hash = ?", codeHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, OidcErrInvalidGrant)
+		}
+		return nil, err
+	}
+
+	// The row count guards against two concurrent redemptions of the same code.
+	rows, err := gorm.G[model.OidcAuthorizationCode](s.Dep.DB.Unscoped()).Where("id = ?", code.ID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		return nil, authError.NewAuthError(400, OidcErrInvalidGrant)
+	}
+
+	return &code, nil
+}
+
+func (s *UserService) consumeOidcCodeByRedis(ctx context.Context, codeHash string) (*model.OidcAuthorizationCode, error) {
+	key := buildOidcCodeKey(codeHash)
+
+	var getCmd *redis.MapStringStringCmd
+	_, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := getCmd.Val()
+	if len(values) == 0 {
+		return nil, authError.NewAuthError(400, OidcErrInvalidGrant)
+	}
+
+	userID, err := strconv.ParseUint(values["userId"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt, err := strconv.ParseInt(values["expiresAt"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.OidcAuthorizationCode{
+		UserID:        uint(userID),
+		CodeHash:      codeHash,
+		ClientID:      values["clientId"],
+		RedirectURI:   values["redirectUri"],
+		Scope:         values["scope"],
+		Nonce:         values["nonce"],
+		CodeChallenge: values["codeChallenge"],
+		ExpiresAt:     time.Unix(expiresAt, 0),
+	}, nil
+}
+
+// CreateOidcAuthorizationCode issues a code for the logged in user, and returns where to send the user with it.
+func (s *UserService) CreateOidcAuthorizationCode(ctx context.Context, userID uint, request *dto.OidcAuthorizeRequest) (*dto.OidcAuthorizeResponse, error) {
+	if err := s.validateOidcAuthorizeRequest(request); err != nil {
+		return nil, err
+	}
+
+	redirectURL, err := url.Parse(request.RedirectURI)
+	if err != nil {
+		return nil, authError.NewAuthError(400, OidcErrInvalidRequest)
+	}
+
+	code, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	modelCode := &model.OidcAuthorizationCode{
+		UserID:        userID,
+		CodeHash:      hashOpaqueToken(code),
+		ClientID:      request.ClientID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         request.Scope,
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		ExpiresAt:     time.Now().Add(time.Duration(s.Dep.Cfg.OidcCodeExpiry) * time.Second),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createOidcCodeByRedis(ctx, modelCode)
+	} else {
+		err = s.createOidcCodeByDB(ctx, modelCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q := redirectURL.Query()
+	q.Set("code", code)
+	if request.State != "" {
+		q.Set("state", request.State)
+	}
+	redirectURL.RawQuery = q.Encode()
+
+	return &dto.OidcAuthorizeResponse{RedirectURL: redirectURL.String()}, nil
+}
+
+// ExchangeOidcCode redeems an authorization code for an access token and an ID token.
+func (s *UserService) ExchangeOidcCode(ctx context.Context, request *dto.OidcTokenRequest) (*dto.OidcTokenResponse, error) {
+	if request.GrantType != "authorization_code" {
+		return nil, authError.NewAuthError(400, OidcErrUnsupportedGrantType)
+	}
+
+	if request.Code == "" || request.RedirectURI == "" || request.ClientID == "" || request.CodeVerifier == "" {
+		return nil, authError.NewAuthError(400, OidcErrInvalidRequest)
+	}
+
+	var code *model.OidcAuthorizationCode
+	var err error
+
+	codeHash := hashOpaqueToken(request.Code)
+	if s.Dep.Cfg.IsRedisEnabled {
+		code, err = s.consumeOidcCodeByRedis(ctx, codeHash)
+	} else {
+		code, err = s.consumeOidcCodeByDB(ctx, codeHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(code.ExpiresAt) ||
+		code.ClientID != request.ClientID ||
+		code.RedirectURI != request.RedirectURI ||
+		!verifyPKCE(request.CodeVerifier, code.CodeChallenge) {
+		return nil, authError.NewAuthError(400, OidcErrInvalidGrant)
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", code.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, OidcErrInvalidGrant)
+		}
+		return nil, err
+	}
+
+	accessToken, err := jwt.SignOidcAccessToken(s.Dep, modelUser.ID, code.ClientID, code.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, err := jwt.SignOidcIDToken(s.Dep, modelUser.ID, code.ClientID, code.Nonce, modelUser.Username, modelUser.Avatar)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.OidcTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   s.Dep.Cfg.UserTokenExpiry,
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	}, nil
+}
+
+func (s *UserService) GetOidcUserInfo(ctx context.Context, accessToken string) (*dto.OidcUserInfoResponse, error) {
+	claims, err := jwt.ValidateOidcAccessToken(s.Dep, accessToken)
+	if err != nil {
+		return nil, authError.NewAuthError(401, OidcErrInvalidToken)
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", claims.UserID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, OidcErrInvalidToken)
+		}
+		return nil, err
+	}
+
+	return &dto.OidcUserInfoResponse{
+		Sub:               strconv.FormatUint(uint64(modelUser.ID), 10),
+		PreferredUsername: modelUser.Username,
+		Picture:           modelUser.Avatar,
+	}, nil
+}
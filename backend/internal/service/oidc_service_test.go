@@ -0,0 +1,183 @@
+package service_test
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	libjwt "github.com/golang-jwt/jwt/v5"
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"gorm.io/gorm"
+)
+
+// RFC 7636 appendix B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func newOidcAuthorizeRequest() *dto.OidcAuthorizeRequest {
+	return &dto.OidcAuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "test-client",
+		RedirectURI:         "http://localhost:4000/callback",
+		Scope:               "openid profile",
+		State:               "xyz",
+		Nonce:               "abc",
+		CodeChallenge:       testCodeChallenge,
+		CodeChallengeMethod: "S256",
+	}
+}
+
+func issueOidcCode(t *testing.T, userService *service.UserService, userID uint) string {
+	t.Helper()
+
+	resp, err := userService.CreateOidcAuthorizationCode(context.Background(), userID, newOidcAuthorizeRequest())
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+
+	redirectURL, err := url.Parse(resp.RedirectURL)
+	if err != nil {
+		t.Fatalf("failed to parse redirect url, err: %v", err)
+	}
+
+	return redirectURL.Query().Get("code")
+}
+
+func newOidcTokenRequest(code string) *dto.OidcTokenRequest {
+	return &dto.OidcTokenRequest{
+		GrantType:    "authorization_code",
+		Code:         code,
+		RedirectURI:  "http://localhost:4000/callback",
+		ClientID:     "test-client",
+		CodeVerifier: testCodeVerifier,
+	}
+}
+
+func TestOidcAuthorize(t *testing.T) {
+	userService, _ := testutil.NewTestUserService(t)
+
+	t.Run("unregistered redirect uri", func(t *testing.T) {
+		request := newOidcAuthorizeRequest()
+		request.RedirectURI = "http://localhost:4000/other"
+
+		_, err := userService.GetOidcConsentURL(request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("unknown client", func(t *testing.T) {
+		request := newOidcAuthorizeRequest()
+		request.ClientID = "other-client"
+
+		_, err := userService.CreateOidcAuthorizationCode(context.Background(), 1, request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("missing openid scope", func(t *testing.T) {
+		request := newOidcAuthorizeRequest()
+		request.Scope = "profile"
+
+		_, err := userService.GetOidcConsentURL(request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+}
+
+func TestExchangeOidcCode(t *testing.T) {
+	t.Run("id token claims", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		avatar := "https://example.com/alice.png"
+		user := testutil.CreateUser(t, myDB, "alice", "alice@example.com", &avatar)
+
+		resp, err := userService.ExchangeOidcCode(context.Background(), newOidcTokenRequest(issueOidcCode(t, userService, user.ID)))
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		claims := &dto.OidcIDTokenClaims{}
+		_, _, err = new(libjwt.Parser).ParseUnverified(resp.IDToken, claims)
+		if err != nil {
+			t.Fatalf("failed to parse id token, err: %v", err)
+		}
+		if claims.Subject != strconv.FormatUint(uint64(user.ID), 10) ||
+			claims.PreferredUsername != "alice" ||
+			claims.Picture == nil || *claims.Picture != avatar ||
+			claims.Nonce != "abc" ||
+			claims.Issuer != userService.Dep.Cfg.OidcIssuer ||
+			len(claims.Audience) != 1 || claims.Audience[0] != "test-client" {
+			t.Fatalf("unexpected id token claims: %+v", claims)
+		}
+
+		userInfo, err := userService.GetOidcUserInfo(context.Background(), resp.AccessToken)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if userInfo.Sub != claims.Subject || userInfo.PreferredUsername != "alice" {
+			t.Fatalf("unexpected userinfo: %+v", userInfo)
+		}
+	})
+
+	t.Run("wrong code verifier", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := testutil.CreateUser(t, myDB, "alice", "alice@example.com", nil)
+
+		request := newOidcTokenRequest(issueOidcCode(t, userService, user.ID))
+		request.CodeVerifier = testCodeVerifier[1:] + "x"
+
+		_, err := userService.ExchangeOidcCode(context.Background(), request)
+		expectAuthErrorStatus(t, err, 400)
+
+		// A failed attempt burns the code
+		request.CodeVerifier = testCodeVerifier
+		_, err = userService.ExchangeOidcCode(context.Background(), request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("wrong redirect uri", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := testutil.CreateUser(t, myDB, "alice", "alice@example.com", nil)
+
+		request := newOidcTokenRequest(issueOidcCode(t, userService, user.ID))
+		request.RedirectURI = "http://localhost:4000/other"
+
+		_, err := userService.ExchangeOidcCode(context.Background(), request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("expired code", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := testutil.CreateUser(t, myDB, "alice", "alice@example.com", nil)
+		code := issueOidcCode(t, userService, user.ID)
+
+		_, err := gorm.G[db.OidcAuthorizationCode](myDB).Where("user_id = ?", user.ID).Update(context.Background(), "expires_at", time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("failed to expire code, err: %v", err)
+		}
+
+		_, err = userService.ExchangeOidcCode(context.Background(), newOidcTokenRequest(code))
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("unsupported grant type", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		request := newOidcTokenRequest("code")
+		request.GrantType = "password"
+
+		_, err := userService.ExchangeOidcCode(context.Background(), request)
+		expectAuthErrorStatus(t, err, 400)
+	})
+}
+
+func TestGetOidcUserInfo(t *testing.T) {
+	userService, myDB := testutil.NewTestUserService(t)
+	createAndLoginUser(t, userService, myDB)
+
+	_, err := userService.GetOidcUserInfo(context.Background(), "not-a-token")
+	expectAuthErrorStatus(t, err, 401)
+}
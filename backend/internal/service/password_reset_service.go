@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const PasswordResetPrefix = "password_reset:"
+
+func buildPasswordResetKey(tokenHash string) string {
+	return PasswordResetPrefix + tokenHash
+}
+
+func buildPasswordResetUserKey(userID uint) string {
+	return fmt.Sprintf("%suser:%d", PasswordResetPrefix, userID)
+}
+
+// createPasswordResetTokenByDB stores a new token, the older tokens of the user stop working.
+func (s *UserService) createPasswordResetTokenByDB(ctx context.Context, userID uint, tokenHash string, expiresAt time.Time) error {
+	_, err := gorm.G[model.PasswordResetToken](s.Dep.DB.Unscoped()).Where("user_id = ? OR expires_at < ?", userID, time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.PasswordResetToken](s.Dep.DB).Create(ctx, &model.PasswordResetToken{
+		UserID:    userID,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (s *UserService) createPasswordResetTokenByRedis(ctx context.Context, userID uint, tokenHash string, expiresAt time.Time) error {
+	userKey := buildPasswordResetUserKey(userID)
+
+	oldTokenHash, err := s.Dep.Redis.Get(ctx, userKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	ttl := time.Until(expiresAt)
+	_, err = s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if oldTokenHash != "" {
+			pipe.Del(ctx, buildPasswordResetKey(oldTokenHash))
+		}
+		pipe.Set(ctx, buildPasswordResetKey(tokenHash), userID, ttl)
+		pipe.Set(ctx, userKey, tokenHash, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// findPasswordResetTokenByDB returns the user of the token without using it up, so a rejected password keeps the link working.
+func (s *UserService) findPasswordResetTokenByDB(ctx context.Context, tokenHash string) (uint, error) {
+	resetToken, err := gorm.G[model.PasswordResetToken](s.Dep.DB).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, authError.NewAuthError(400, "invalid or expired reset token")
+		}
+		return 0, err
+	}
+	if time.Now().After(resetToken.ExpiresAt) {
+		return 0, authError.NewAuthError(400, "invalid or expired reset token")
+	}
+
+	return resetToken.UserID, nil
+}
+
+func (s *UserService) findPasswordResetTokenByRedis(ctx context.Context, tokenHash string) (uint, error) {
+	value, err := s.Dep.Redis.Get(ctx, buildPasswordResetKey(tokenHash)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, authError.NewAuthError(400, "invalid or expired reset token")
+		}
+		return 0, err
+	}
+
+	userID, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(userID), nil
+}
+
+// consumePasswordResetTokenByDB returns the user of the token and deletes it, a token can only be used once.
+func (s *UserService) consumePasswordResetTokenByDB(ctx context.Context, tokenHash string) (uint, error) {
+	resetToken, err := gorm.G[model.PasswordResetToken](s.Dep.DB).Where("token_hash = ?", tokenHash).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, authError.NewAuthError(400, "invalid or expired reset token")
+		}
+		return 0, err
+	}
+
+	// The row count guards against two concurrent resets with the same token.
+	rows, err := gorm.G[model.PasswordResetToken](s.Dep.DB.Unscoped()).Where("id = ?", resetToken.ID).Delete(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 || time.Now().After(resetToken.ExpiresAt) {
+		return 0, authError.NewAuthError(400, "invalid or expired reset token")
+	}
+
+	return resetToken.UserID, nil
+}
+
+func (s *UserService) consumePasswordResetTokenByRedis(ctx context.Context, tokenHash string) (uint, error) {
+	value, err := s.Dep.Redis.GetDel(ctx, buildPasswordResetKey(tokenHash)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, authError.NewAuthError(400, "invalid or expired reset token")
+		}
+		return 0, err
+	}
+
+	userID, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.Dep.Redis.Del(ctx, buildPasswordResetUserKey(uint(userID))).Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(userID), nil
+}
+
+// RequestPasswordReset emails a reset link when the email belongs to a user with a password.
+// It succeeds either way, so it cannot be used to find out which emails are registered.
+func (s *UserService) RequestPasswordReset(ctx context.Context, request *dto.ForgotPasswordRequest) error {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("email = ?", request.Email).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	// OAuth users have no password to reset.
+	if modelUser.PasswordHash == nil {
+		return nil
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	tokenHash := hashOpaqueToken(token)
+	expiresAt := time.Now().Add(time.Duration(s.Dep.Cfg.PasswordResetTokenExpiry) * time.Second)
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createPasswordResetTokenByRedis(ctx, modelUser.ID, tokenHash, expiresAt)
+	} else {
+		err = s.createPasswordResetTokenByDB(ctx, modelUser.ID, tokenHash, expiresAt)
+	}
+	if err != nil {
+		return err
+	}
+
+	resetURL := fmt.Sprintf("%s/user/reset-password?token=%s", s.Dep.Cfg.FrontendUrl, token)
+	s.sendMail(mailer.Message{
+		To:      modelUser.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password of your account. Open the link below to choose a new one:\n\n%s\n\nThe link expires in %d minutes. If it was not you, you can ignore this email.\n",
+			modelUser.Username, resetURL, s.Dep.Cfg.PasswordResetTokenExpiry/60,
+		),
+	})
+
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token, and logs the user out everywhere.
+// It does not log in: the user logs in with the new password, and goes through 2FA like any login.
+func (s *UserService) ResetPassword(ctx context.Context, request *dto.ResetPasswordRequest) (*dto.UserWithoutTokenResponse, error) {
+	var userID uint
+	var err error
+
+	tokenHash := hashOpaqueToken(request.Token)
+	if s.Dep.Cfg.IsRedisEnabled {
+		userID, err = s.findPasswordResetTokenByRedis(ctx, tokenHash)
+	} else {
+		userID, err = s.findPasswordResetTokenByDB(ctx, tokenHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(400, "invalid or expired reset token")
+		}
+		return nil, err
+	}
+
+	// Checked before the link is used up, the user can pick another password with the same link.
+	if err := s.checkPasswordPolicy("newPassword", request.NewPassword.NewPassword, modelUser.Username, modelUser.Email); err != nil {
+		return nil, err
+	}
+
+	// A concurrent reset may have used the link in the meantime.
+	var consumedUserID uint
+	if s.Dep.Cfg.IsRedisEnabled {
+		consumedUserID, err = s.consumePasswordResetTokenByRedis(ctx, tokenHash)
+	} else {
+		consumedUserID, err = s.consumePasswordResetTokenByDB(ctx, tokenHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if consumedUserID != userID {
+		return nil, authError.NewAuthError(400, "invalid or expired reset token")
+	}
+
+	newPasswordHash, err := s.Dep.Passwords.Hash(request.NewPassword.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "password_hash", newPasswordHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = logoutUserByRedis(ctx, s.Dep.Redis, userID)
+	} else {
+		err = logoutUserByDB(ctx, s.Dep.DB, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ForgetTrustedDevices(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	// The user proved they own the email, lift the lockout of their account.
+	counters := append(
+		s.loginAttemptCounters(context.Background(), "identifier", modelUser.Username),
+		s.loginAttemptCounters(context.Background(), "identifier", modelUser.Email)...,
+	)
+	if err := s.resetAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	return userToUserWithoutTokenResponse(&modelUser), nil
+}
@@ -0,0 +1,217 @@
+package service_test
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/mailer"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+)
+
+var mailLinkRegexp = regexp.MustCompile(`https?://\S+`)
+
+// waitForMails waits for the background sender, and returns the sent emails once there are n of them.
+func waitForMails(t *testing.T, userService *service.UserService, n int) []mailer.Message {
+	t.Helper()
+
+	memoryMailer := userService.Dep.Mailer.(*mailer.MemoryMailer)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		messages := memoryMailer.Messages()
+		if len(messages) >= n || time.Now().After(deadline) {
+			if len(messages) != n {
+				t.Fatalf("expected %d emails, got %d", n, len(messages))
+			}
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func tokenFromMail(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+
+	link, err := url.Parse(mailLinkRegexp.FindString(msg.Body))
+	if err != nil {
+		t.Fatalf("failed to parse the link, err: %v", err)
+	}
+	token := link.Query().Get("token")
+	if token == "" {
+		t.Fatalf("expected a token in the email: %s", msg.Body)
+	}
+	return token
+}
+
+func TestPasswordReset(t *testing.T) {
+	resetRequest := func(token string) *dto.ResetPasswordRequest {
+		return &dto.ResetPasswordRequest{
+			Token:       token,
+			NewPassword: dto.NewPassword{NewPassword: "NewPassword.888"},
+		}
+	}
+
+	t.Run("reset password and revoke sessions", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		messages := waitForMails(t, userService, 1)
+		if messages[0].To != "alice@example.com" {
+			t.Fatalf("expected email to alice, got %s", messages[0].To)
+		}
+
+		resp, err := userService.ResetPassword(context.Background(), resetRequest(tokenFromMail(t, messages[0])))
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.ID != user.ID {
+			t.Fatalf("expected user %d, got %d", user.ID, resp.ID)
+		}
+
+		err = userService.ValidateUserToken(context.Background(), user.Token, user.ID)
+		expectAuthErrorStatus(t, err, 401)
+
+		_, err = userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "alice"},
+			Password:   dto.Password{Password: "NewPassword.888"},
+		})
+		if err != nil {
+			t.Fatalf("expected login with the new password, err: %v", err)
+		}
+	})
+
+	t.Run("2FA still applies after a reset", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+		enableTwoFA(t, userService, user.ID)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if _, err := userService.ResetPassword(context.Background(), resetRequest(tokenFromMail(t, waitForMails(t, userService, 1)[0]))); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		result, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "alice"},
+			Password:   dto.Password{Password: "NewPassword.888"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if result.User != nil || result.TwoFAPending == nil {
+			t.Fatalf("expected a 2FA challenge, got %+v", result)
+		}
+	})
+
+	t.Run("token is single use", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		token := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+
+		if _, err := userService.ResetPassword(context.Background(), resetRequest(token)); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		_, err = userService.ResetPassword(context.Background(), resetRequest(token))
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("rejected password keeps the token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		token := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+
+		_, err = userService.ResetPassword(context.Background(), &dto.ResetPasswordRequest{
+			Token:       token,
+			NewPassword: dto.NewPassword{NewPassword: "Alice.Password.888"},
+		})
+		expectAuthErrorStatus(t, err, 400)
+
+		if _, err := userService.ResetPassword(context.Background(), resetRequest(token)); err != nil {
+			t.Fatalf("expected the token to still work, err: %v", err)
+		}
+	})
+
+	t.Run("new request invalidates the old token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createAndLoginUser(t, userService, myDB)
+
+		for range 2 {
+			err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+			if err != nil {
+				t.Fatalf("unexpected error, err: %v", err)
+			}
+		}
+		messages := waitForMails(t, userService, 2)
+
+		tokens := map[string]bool{}
+		for _, msg := range messages {
+			tokens[tokenFromMail(t, msg)] = true
+		}
+
+		succeeded := 0
+		for token := range tokens {
+			if _, err := userService.ResetPassword(context.Background(), resetRequest(token)); err == nil {
+				succeeded++
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("expected only the latest token to work, %d did", succeeded)
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.PasswordResetTokenExpiry = -1
+		createAndLoginUser(t, userService, myDB)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		token := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+
+		_, err = userService.ResetPassword(context.Background(), resetRequest(token))
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("unknown email sends nothing", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "nobody@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		waitForMails(t, userService, 0)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		_, err := userService.ResetPassword(context.Background(), resetRequest("nope"))
+		expectAuthErrorStatus(t, err, 400)
+	})
+}
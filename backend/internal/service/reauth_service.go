@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+func (s *UserService) getSessionByDB(ctx context.Context, userID uint, token string) (string, error) {
+	modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("user_id = ? AND token = ?", userID, token).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", authError.NewAuthError(401, "invalid token")
+		}
+		return "", err
+	}
+
+	return strconv.FormatUint(uint64(modelToken.ID), 10), nil
+}
+
+func (s *UserService) getSessionByRedis(ctx context.Context, userID uint, token string) (string, error) {
+	familyID, err := s.Dep.Redis.Get(ctx, buildTokenKey(userID, token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", authError.NewAuthError(401, "invalid token")
+		}
+		return "", err
+	}
+
+	return familyID, nil
+}
+
+// getSession returns the login of the access token, which outlives the access token across refreshes:
+// the token row with the database, the token family with Redis.
+func (s *UserService) getSession(ctx context.Context, userID uint, token string) (string, error) {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.getSessionByRedis(ctx, userID, token)
+	}
+	return s.getSessionByDB(ctx, userID, token)
+}
+
+func (s *UserService) markSessionReauthenticatedByDB(ctx context.Context, userID uint, session string, at time.Time) error {
+	rows, err := gorm.G[model.Token](s.Dep.DB).Where("id = ? AND user_id = ?", session, userID).Update(ctx, "reauthenticated_at", at)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return authError.NewAuthError(401, "invalid token")
+	}
+
+	return nil
+}
+
+func (s *UserService) markSessionReauthenticatedByRedis(ctx context.Context, userID uint, session string, at time.Time) error {
+	familyKey := buildTokenFamilyKey(userID, session)
+
+	// A logged out session must not come back as a family without expiry.
+	exists, err := s.Dep.Redis.Exists(ctx, familyKey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return authError.NewAuthError(401, "invalid token")
+	}
+
+	return s.Dep.Redis.HSet(ctx, familyKey, "reauthenticatedAt", strconv.FormatInt(at.Unix(), 10)).Err()
+}
+
+// markSessionReauthenticated allows the sensitive actions of the session for REAUTH_MAX_AGE from at.
+func (s *UserService) markSessionReauthenticated(ctx context.Context, userID uint, session string, at time.Time) error {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.markSessionReauthenticatedByRedis(ctx, userID, session, at)
+	}
+	return s.markSessionReauthenticatedByDB(ctx, userID, session, at)
+}
+
+func (s *UserService) getSessionReauthenticatedAtByDB(ctx context.Context, userID uint, token string) (time.Time, error) {
+	modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("user_id = ? AND token = ?", userID, token).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if modelToken.ReauthenticatedAt == nil {
+		return time.Time{}, nil
+	}
+
+	return *modelToken.ReauthenticatedAt, nil
+}
+
+func (s *UserService) getSessionReauthenticatedAtByRedis(ctx context.Context, userID uint, token string) (time.Time, error) {
+	familyID, err := s.Dep.Redis.Get(ctx, buildTokenKey(userID, token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	value, err := s.Dep.Redis.HGet(ctx, buildTokenFamilyKey(userID, familyID), "reauthenticatedAt").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	at, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(at, 0), nil
+}
+
+// HasRecentAuth tells whether the session of the access token re-authenticated within REAUTH_MAX_AGE.
+func (s *UserService) HasRecentAuth(ctx context.Context, userID uint, token string) (bool, error) {
+	var at time.Time
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		at, err = s.getSessionReauthenticatedAtByRedis(ctx, userID, token)
+	} else {
+		at, err = s.getSessionReauthenticatedAtByDB(ctx, userID, token)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return at.After(time.Now().Add(-time.Duration(s.Dep.Cfg.ReauthMaxAge) * time.Second)), nil
+}
+
+// requireRecentAuth returns the reauth_required error when the session did not re-authenticate recently.
+func (s *UserService) requireRecentAuth(ctx context.Context, userID uint, token string) error {
+	recent, err := s.HasRecentAuth(ctx, userID, token)
+	if err != nil {
+		return err
+	}
+	if !recent {
+		return authError.NewAuthErrorWithCode(401, authError.CodeReauthRequired, "recent authentication required")
+	}
+
+	return nil
+}
+
+// Reauthenticate checks the password or a TOTP code, and marks the session of the access token as recently
+// authenticated for REAUTH_MAX_AGE. Users without either re-authenticate with a round trip to their provider.
+func (s *UserService) Reauthenticate(ctx context.Context, userID uint, token string, request *dto.ReauthRequest) (*dto.ReauthResponse, error) {
+	counters := s.loginAttemptCounters(ctx, "reauth", strconv.FormatUint(uint64(userID), 10))
+	if err := s.checkAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	switch {
+	case request.Password != "":
+		if modelUser.PasswordHash == nil {
+			return nil, authError.NewAuthError(400, "this account has no password")
+		}
+		err = s.verifyPassword(*modelUser.PasswordHash, request.Password)
+		if err != nil {
+			if errors.Is(err, password.ErrMismatchedPassword) {
+				return nil, s.failAttempt(ctx, counters, authError.NewAuthError(401, "invalid credentials"))
+			}
+			return nil, err
+		}
+	case request.TwoFACode != "":
+		if modelUser.TotpSecret == nil {
+			return nil, authError.NewAuthError(400, "TOTP is not enabled for this user")
+		}
+		opts, err := s.userTotpOptions(&modelUser)
+		if err != nil {
+			return nil, err
+		}
+		valid, err := s.validateTotpOnce(ctx, request.TwoFACode, *modelUser.TotpSecret, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(401, "invalid 2FA code"))
+		}
+	default:
+		return nil, authError.NewAuthError(400, "password or 2FA code required, or re-authenticate with your provider")
+	}
+
+	if err := s.resetAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	session, err := s.getSession(ctx, userID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := s.markSessionReauthenticated(ctx, userID, session, now); err != nil {
+		return nil, err
+	}
+
+	return &dto.ReauthResponse{
+		ReauthenticatedUntil: now.Add(time.Duration(s.Dep.Cfg.ReauthMaxAge) * time.Second).Unix(),
+	}, nil
+}
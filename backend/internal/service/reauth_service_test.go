@@ -0,0 +1,189 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+// recentSession creates a session of the user that just re-authenticated, and returns its access token.
+func recentSession(t *testing.T, myDB *gorm.DB, userID uint) string {
+	t.Helper()
+
+	now := time.Now()
+	modelToken := model.Token{
+		UserID:            userID,
+		Token:             fmt.Sprintf("recent-session-%d", userID),
+		LastUsedAt:        now,
+		ReauthenticatedAt: &now,
+	}
+	if err := gorm.G[model.Token](myDB).Create(context.Background(), &modelToken); err != nil {
+		t.Fatalf("failed to create session, err: %v", err)
+	}
+
+	return modelToken.Token
+}
+
+func expectRecentAuth(t *testing.T, userService *service.UserService, userID uint, token string, want bool) {
+	t.Helper()
+
+	recent, err := userService.HasRecentAuth(context.Background(), userID, token)
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if recent != want {
+		t.Fatalf("expected recent auth %v, got %v", want, recent)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	t.Run("password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		// Logging in is not a re-authentication.
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+
+		_, err := userService.Reauthenticate(context.Background(), user.ID, user.Token, &dto.ReauthRequest{Password: "Wrong.777"})
+		expectAuthErrorStatus(t, err, 401)
+		expectRecentAuth(t, userService, user.ID, user.Token, false)
+
+		resp, err := userService.Reauthenticate(context.Background(), user.ID, user.Token, &dto.ReauthRequest{Password: "Password.777"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.ReauthenticatedUntil <= time.Now().Unix() {
+			t.Fatalf("unexpected expiry %d", resp.ReauthenticatedUntil)
+		}
+		expectRecentAuth(t, userService, user.ID, user.Token, true)
+
+		// The claim belongs to the session and survives a refresh.
+		refreshed, err := userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: user.RefreshToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectRecentAuth(t, userService, user.ID, refreshed.Token, true)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		token := recentSession(t, myDB, user.ID)
+		expectRecentAuth(t, userService, user.ID, token, true)
+
+		old := time.Now().Add(-time.Duration(userService.Dep.Cfg.ReauthMaxAge+1) * time.Second)
+		_, err := gorm.G[model.Token](myDB).Where("token = ?", token).Update(context.Background(), "reauthenticated_at", old)
+		if err != nil {
+			t.Fatalf("failed to age the session, err: %v", err)
+		}
+		expectRecentAuth(t, userService, user.ID, token, false)
+	})
+
+	t.Run("TOTP code", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+		token := recentSession(t, myDB, user.ID)
+		_, err := gorm.G[model.Token](myDB).Where("token = ?", token).Update(context.Background(), "reauthenticated_at", nil)
+		if err != nil {
+			t.Fatalf("failed to reset the session, err: %v", err)
+		}
+
+		_, err = userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{TwoFACode: "000000"})
+		expectAuthErrorStatus(t, err, 401)
+
+		modelUser, err := gorm.G[model.User](myDB).Where("id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query user, err: %v", err)
+		}
+		code, err := totp.GenerateCode(*modelUser.TotpSecret, time.Now().Add(30*time.Second))
+		if err != nil {
+			t.Fatalf("failed to generate code, err: %v", err)
+		}
+		if _, err := userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{TwoFACode: code}); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectRecentAuth(t, userService, user.ID, token, true)
+
+		// A code is only good once.
+		_, err = userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{TwoFACode: code})
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("provider login is not a re-authentication", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := model.User{Username: "carol", Email: "carol@example.com"}
+		if err := gorm.G[model.User](myDB).Create(context.Background(), &user); err != nil {
+			t.Fatalf("failed to create user, err: %v", err)
+		}
+		token := recentSession(t, myDB, user.ID)
+		_, err := gorm.G[model.Token](myDB).Where("token = ?", token).Update(context.Background(), "reauthenticated_at", nil)
+		if err != nil {
+			t.Fatalf("failed to reset the session, err: %v", err)
+		}
+
+		_, err = userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{Password: "Password.777"})
+		expectAuthErrorStatus(t, err, 400)
+		_, err = userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{})
+		expectAuthErrorStatus(t, err, 400)
+
+		now := time.Now()
+		identity := model.UserIdentity{
+			UserID:          user.ID,
+			Provider:        "google",
+			Subject:         "carol-google",
+			Email:           user.Email,
+			LinkedAt:        now,
+			Profile:         "{}",
+			AuthenticatedAt: &now,
+		}
+		if err := gorm.G[model.UserIdentity](myDB).Create(context.Background(), &identity); err != nil {
+			t.Fatalf("failed to create identity, err: %v", err)
+		}
+
+		// A recent login with the provider, or a link, belongs to another session.
+		_, err = userService.Reauthenticate(context.Background(), user.ID, token, &dto.ReauthRequest{})
+		expectAuthErrorStatus(t, err, 400)
+		expectRecentAuth(t, userService, user.ID, token, false)
+	})
+
+	t.Run("email change", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		request := &dto.UpdateUserRequest{
+			User: dto.User{
+				UserName: dto.UserName{Username: "alice"},
+				Email:    "alice2@example.com",
+			},
+		}
+		_, err := userService.UpdateUserProfile(context.Background(), user.ID, user.Token, request)
+		expectAuthErrorStatus(t, err, 401)
+
+		// Other changes do not need it.
+		_, err = userService.UpdateUserProfile(context.Background(), user.ID, user.Token, &dto.UpdateUserRequest{
+			User: dto.User{
+				UserName: dto.UserName{Username: "alice2"},
+				Email:    "alice@example.com",
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		if _, err := userService.Reauthenticate(context.Background(), user.ID, user.Token, &dto.ReauthRequest{Password: "Password.777"}); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if _, err := userService.UpdateUserProfile(context.Background(), user.ID, user.Token, request); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
+	"gorm.io/gorm"
+)
+
+const RecoveryCodeCount = 10
+
+// 32 letters and digits without the look-alikes 0, 1, l and o, so a byte maps to one without bias.
+const recoveryCodeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCode returns a code like "k7dxq-m2pwa", 50 random bits.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = recoveryCodeAlphabet[int(b[i])%len(recoveryCodeAlphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// normalizeRecoveryCode accepts the code the way users type it back, in any case and with or without the dash.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashRecoveryCode keys the hash with a server secret and the user, a leaked table alone does not allow guessing the codes offline.
+func (s *UserService) hashRecoveryCode(userID uint, code string) string {
+	mac := hmac.New(sha256.New, []byte(s.Dep.Cfg.RecoveryCodeKey))
+	mac.Write([]byte(strconv.FormatUint(uint64(userID), 10) + ":" + normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replaceRecoveryCodes drops the codes of the user and returns a new set, db may be a transaction.
+func (s *UserService) replaceRecoveryCodes(ctx context.Context, db *gorm.DB, userID uint) ([]string, error) {
+	_, err := gorm.G[model.RecoveryCode](db.Unscoped()).Where("user_id = ?", userID).Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	modelCodes := make([]model.RecoveryCode, 0, RecoveryCodeCount)
+	for range RecoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		modelCodes = append(modelCodes, model.RecoveryCode{UserID: userID, CodeHash: s.hashRecoveryCode(userID, code)})
+	}
+
+	if err := gorm.G[model.RecoveryCode](db).CreateInBatches(ctx, &modelCodes, RecoveryCodeCount); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// consumeRecoveryCode deletes the code when it belongs to the user, and tells whether it did.
+// Codes stored before the HMAC, as a plain SHA-256, are still accepted until the user gets a new set.
+func (s *UserService) consumeRecoveryCode(ctx context.Context, userID uint, code string) (bool, error) {
+	hashes := []string{s.hashRecoveryCode(userID, code), hashOpaqueToken(normalizeRecoveryCode(code))}
+	rows, err := gorm.G[model.RecoveryCode](s.Dep.DB.Unscoped()).Where("user_id = ? AND code_hash IN ?", userID, hashes).Delete(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+func (s *UserService) countRecoveryCodes(ctx context.Context, userID uint) (int, error) {
+	count, err := gorm.G[model.RecoveryCode](s.Dep.DB).Where("user_id = ?", userID).Count(ctx, "id")
+	return int(count), err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, after they proved their password.
+func (s *UserService) RegenerateRecoveryCodes(ctx context.Context, userID uint, request *dto.RegenerateRecoveryCodesRequest) (*dto.RecoveryCodesResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	if !isTwoFAEnabled(&modelUser) || modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(400, "2FA is not enabled")
+	}
+
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
+	if err != nil {
+		if errors.Is(err, password.ErrMismatchedPassword) {
+			return nil, authError.NewAuthError(401, "invalid credentials")
+		}
+		return nil, err
+	}
+
+	codes, err := s.replaceRecoveryCodes(ctx, s.Dep.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
@@ -0,0 +1,204 @@
+package service_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+// enableTwoFA turns on 2FA for the user and returns the recovery codes of the confirmation.
+func enableTwoFA(t *testing.T, userService *service.UserService, userID uint) []string {
+	t.Helper()
+
+	setup, err := userService.StartTwoFaSetup(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("failed to start 2FA setup, err: %v", err)
+	}
+	code, err := totp.GenerateCode(setup.TwoFASecret, time.Now())
+	if err != nil {
+		t.Fatalf("failed to generate code, err: %v", err)
+	}
+
+	resp, err := userService.ConfirmTwoFaSetup(context.Background(), userID, &dto.TwoFAConfirmRequest{
+		TwoFACode:  code,
+		SetupToken: setup.SetupToken,
+	})
+	if err != nil {
+		t.Fatalf("failed to confirm 2FA setup, err: %v", err)
+	}
+
+	return resp.RecoveryCodes
+}
+
+func submitRecoveryCode(t *testing.T, userService *service.UserService, userID uint, code string) (*dto.TwoFAChallengeResponse, error) {
+	t.Helper()
+
+	sessionToken, err := jwt.SignTwoFAToken(userService.Dep, userID)
+	if err != nil {
+		t.Fatalf("failed to sign session token, err: %v", err)
+	}
+
+	return userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+		RecoveryCode: code,
+		SessionToken: sessionToken,
+	})
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	t.Run("confirm returns the codes", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		codes := enableTwoFA(t, userService, user.ID)
+		if len(codes) != service.RecoveryCodeCount {
+			t.Fatalf("expected %d codes, got %d", service.RecoveryCodeCount, len(codes))
+		}
+
+		seen := map[string]bool{}
+		for _, code := range codes {
+			if len(code) != 11 || code[5] != '-' || seen[code] {
+				t.Fatalf("unexpected code %q in %v", code, codes)
+			}
+			seen[code] = true
+		}
+
+		count, err := gorm.G[model.RecoveryCode](myDB).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("failed to count codes, err: %v", err)
+		}
+		if count != int64(service.RecoveryCodeCount) {
+			t.Fatalf("expected %d stored codes, got %d", service.RecoveryCodeCount, count)
+		}
+		stored, err := gorm.G[model.RecoveryCode](myDB).Where("user_id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query code, err: %v", err)
+		}
+		if seen[stored.CodeHash] {
+			t.Fatalf("expected codes to be stored hashed")
+		}
+		for code := range seen {
+			sum := sha256.Sum256([]byte(strings.ReplaceAll(code, "-", "")))
+			if stored.CodeHash == hex.EncodeToString(sum[:]) {
+				t.Fatalf("expected codes to be stored with a keyed hash")
+			}
+		}
+	})
+
+	t.Run("codes stored as plain SHA-256 still work", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+
+		sum := sha256.Sum256([]byte("abcdefghij"))
+		legacy := model.RecoveryCode{UserID: user.ID, CodeHash: hex.EncodeToString(sum[:])}
+		if err := gorm.G[model.RecoveryCode](myDB).Create(context.Background(), &legacy); err != nil {
+			t.Fatalf("failed to create code, err: %v", err)
+		}
+
+		if _, err := submitRecoveryCode(t, userService, user.ID, "abcde-fghij"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		_, err := submitRecoveryCode(t, userService, user.ID, "abcde-fghij")
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("code logs in once", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, user.ID)
+
+		// Typed back without the dash and in upper case.
+		typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+		resp, err := submitRecoveryCode(t, userService, user.ID, typed)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.Token == "" || resp.RecoveryCodesLeft != service.RecoveryCodeCount-1 {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+
+		_, err = submitRecoveryCode(t, userService, user.ID, codes[0])
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("codes of another user", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, alice.ID)
+
+		bob := registerUser(t, userService)
+		enableTwoFA(t, userService, bob.ID)
+
+		_, err := submitRecoveryCode(t, userService, bob.ID, codes[0])
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("regenerate needs the password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		oldCodes := enableTwoFA(t, userService, user.ID)
+
+		_, err := userService.RegenerateRecoveryCodes(context.Background(), user.ID, &dto.RegenerateRecoveryCodesRequest{
+			Password: dto.Password{Password: "Wrong.777"},
+		})
+		expectAuthErrorStatus(t, err, 401)
+
+		resp, err := userService.RegenerateRecoveryCodes(context.Background(), user.ID, &dto.RegenerateRecoveryCodesRequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(resp.RecoveryCodes) != service.RecoveryCodeCount {
+			t.Fatalf("expected %d codes, got %d", service.RecoveryCodeCount, len(resp.RecoveryCodes))
+		}
+
+		_, err = submitRecoveryCode(t, userService, user.ID, oldCodes[0])
+		expectAuthErrorStatus(t, err, 400)
+		if _, err := submitRecoveryCode(t, userService, user.ID, resp.RecoveryCodes[0]); err != nil {
+			t.Fatalf("expected a new code to work, err: %v", err)
+		}
+	})
+
+	t.Run("regenerate without 2FA", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		_, err := userService.RegenerateRecoveryCodes(context.Background(), user.ID, &dto.RegenerateRecoveryCodesRequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		expectAuthErrorStatus(t, err, 400)
+	})
+
+	t.Run("disable drops the codes", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, user.ID)
+
+		_, err := userService.DisableTwoFA(context.Background(), user.ID, &dto.DisableTwoFARequest{
+			Password: dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		count, err := gorm.G[model.RecoveryCode](myDB.Unscoped()).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("failed to count codes, err: %v", err)
+		}
+		if count != 0 {
+			t.Fatalf("expected no codes left, got %d", count)
+		}
+	})
+}
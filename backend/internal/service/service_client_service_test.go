@@ -0,0 +1,94 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+)
+
+func TestServiceClients(t *testing.T) {
+	t.Run("client credentials grant", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		secret, err := userService.CreateServiceClient(context.Background(), "game", "Game service")
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		resp, err := userService.IssueServiceToken(context.Background(), "game", secret)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		claims, err := jwt.ValidateServiceToken(userService.Dep, resp.AccessToken)
+		if err != nil {
+			t.Fatalf("expected a service token, err: %v", err)
+		}
+		if claims.ClientID != "game" || claims.Subject != "game" {
+			t.Fatalf("unexpected claims: %+v", claims)
+		}
+
+		// A service token is not a user token
+		if _, err := jwt.ValidateUserTokenGeneric(userService.Dep, resp.AccessToken); err == nil {
+			t.Fatalf("expected service token to be rejected as a user token")
+		}
+
+		introspection, err := userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: resp.AccessToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if !introspection.Active || introspection.TokenType != jwt.ServiceTokenType || introspection.ClientID != "game" {
+			t.Fatalf("unexpected introspection response: %+v", introspection)
+		}
+
+		// Deleting the client revokes its tokens
+		if err := userService.DeleteServiceClient(context.Background(), "game"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		err = userService.ValidateServiceClient(context.Background(), "game")
+		expectAuthErrorStatus(t, err, 401)
+
+		introspection, err = userService.IntrospectToken(context.Background(), &dto.IntrospectRequest{Token: resp.AccessToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if introspection.Active {
+			t.Fatalf("expected token of a deleted client to be inactive")
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		if _, err := userService.CreateServiceClient(context.Background(), "game", "Game service"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		_, err := userService.IssueServiceToken(context.Background(), "game", "nope")
+		expectAuthErrorStatus(t, err, 401)
+
+		_, err = userService.IssueServiceToken(context.Background(), "other", "nope")
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("duplicate client id", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		if _, err := userService.CreateServiceClient(context.Background(), "game", "Game service"); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		_, err := userService.CreateServiceClient(context.Background(), "game", "Another game service")
+		expectAuthErrorStatus(t, err, 409)
+	})
+
+	t.Run("delete unknown client", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		err := userService.DeleteServiceClient(context.Background(), "game")
+		expectAuthErrorStatus(t, err, 404)
+	})
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"gorm.io/gorm"
+)
+
+// Last-used timestamps are only written when they are older than this, to avoid a write on every request.
+const SessionTouchInterval = 1 * time.Minute
+
+func (s *UserService) touchSessionByDB(modelToken *model.Token) {
+	if time.Since(modelToken.LastUsedAt) < SessionTouchInterval {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		_, err := gorm.G[model.Token](s.Dep.DB).Where("id = ?", modelToken.ID).Update(ctx, "last_used_at", time.Now())
+		if err != nil {
+			s.Dep.Logger.Warn("failed to update session last used time", "tokenID", modelToken.ID, "err", err)
+		}
+	}()
+}
+
+func (s *UserService) touchSessionByRedis(userID uint, familyID string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		familyKey := buildTokenFamilyKey(userID, familyID)
+		err := s.Dep.Redis.HSet(ctx, familyKey, "lastUsedAt", strconv.FormatInt(time.Now().Unix(), 10)).Err()
+		if err != nil {
+			s.Dep.Logger.Warn("failed to update session last used time", "userID", userID, "err", err)
+		}
+	}()
+}
+
+func (s *UserService) getUserSessionsByDB(ctx context.Context, userID uint, currentToken string) ([]dto.SessionResponse, error) {
+	modelTokens, err := gorm.G[model.Token](s.Dep.DB).Where("user_id = ?", userID).Order("created_at DESC").Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]dto.SessionResponse, 0, len(modelTokens))
+	for _, mt := range modelTokens {
+		sessions = append(sessions, dto.SessionResponse{
+			ID:          strconv.FormatUint(uint64(mt.ID), 10),
+			DeviceLabel: mt.DeviceLabel,
+			ClientIP:    mt.ClientIP,
+			UserAgent:   mt.UserAgent,
+			CreatedAt:   mt.CreatedAt.Unix(),
+			LastUsedAt:  mt.LastUsedAt.Unix(),
+			Current:     mt.Token == currentToken,
+		})
+	}
+
+	return sessions, nil
+}
+
+func (s *UserService) getUserSessionsByRedis(ctx context.Context, userID uint, currentToken string) ([]dto.SessionResponse, error) {
+	sessions := make([]dto.SessionResponse, 0)
+
+	prefix := buildTokenFamilyKey(userID, "")
+	iter := s.Dep.Redis.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := s.Dep.Redis.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 { // Expired in between
+			continue
+		}
+
+		createdAt, _ := strconv.ParseInt(values["createdAt"], 10, 64)
+		lastUsedAt, _ := strconv.ParseInt(values["lastUsedAt"], 10, 64)
+
+		sessions = append(sessions, dto.SessionResponse{
+			ID:          strings.TrimPrefix(iter.Val(), prefix),
+			DeviceLabel: values["deviceLabel"],
+			ClientIP:    values["clientIp"],
+			UserAgent:   values["userAgent"],
+			CreatedAt:   createdAt,
+			LastUsedAt:  lastUsedAt,
+			Current:     values["accessToken"] == currentToken,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetUserSessions lists the active logins of the user, the one making the request is marked as current.
+func (s *UserService) GetUserSessions(ctx context.Context, userID uint, currentToken string) ([]dto.SessionResponse, error) {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.getUserSessionsByRedis(ctx, userID, currentToken)
+	} else {
+		return s.getUserSessionsByDB(ctx, userID, currentToken)
+	}
+}
+
+func (s *UserService) revokeUserSessionByDB(ctx context.Context, userID uint, sessionID string) error {
+	tokenID, err := strconv.ParseUint(sessionID, 10, 64)
+	if err != nil {
+		return authError.NewAuthError(404, "session not found")
+	}
+
+	modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("id = ? AND user_id = ?", tokenID, userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return authError.NewAuthError(404, "session not found")
+		}
+		return err
+	}
+
+	return revokeTokenFamilyByDB(ctx, s.Dep.DB, modelToken.ID)
+}
+
+func (s *UserService) revokeUserSessionByRedis(ctx context.Context, userID uint, sessionID string) error {
+	exists, err := s.Dep.Redis.Exists(ctx, buildTokenFamilyKey(userID, sessionID)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return authError.NewAuthError(404, "session not found")
+	}
+
+	return revokeTokenFamilyByRedis(ctx, s.Dep.Redis, userID, sessionID)
+}
+
+// RevokeUserSession ends one session of the user, its access and refresh tokens stop working immediately.
+func (s *UserService) RevokeUserSession(ctx context.Context, userID uint, sessionID string) error {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.revokeUserSessionByRedis(ctx, userID, sessionID)
+	} else {
+		return s.revokeUserSessionByDB(ctx, userID, sessionID)
+	}
+}
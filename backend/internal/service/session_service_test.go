@@ -0,0 +1,71 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"gorm.io/gorm"
+)
+
+func TestGetUserSessions(t *testing.T) {
+	t.Run("marks current session", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		sessions, err := userService.GetUserSessions(context.Background(), user.ID, user.Token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(sessions) != 1 || !sessions[0].Current {
+			t.Fatalf("expected one current session, got %+v", sessions)
+		}
+	})
+}
+
+func TestRevokeUserSession(t *testing.T) {
+	t.Run("invalid session id", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		err := userService.RevokeUserSession(context.Background(), user.ID, "abc")
+		expectAuthErrorStatus(t, err, 404)
+	})
+
+	t.Run("session of another user", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+		other := testutil.CreateUser(t, myDB, "bob", "bob@example.com", nil)
+
+		sessions, err := userService.GetUserSessions(context.Background(), user.ID, user.Token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		err = userService.RevokeUserSession(context.Background(), other.ID, sessions[0].ID)
+		expectAuthErrorStatus(t, err, 404)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		sessions, err := userService.GetUserSessions(context.Background(), user.ID, user.Token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		if err := userService.RevokeUserSession(context.Background(), user.ID, sessions[0].ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		count, err := gorm.G[db.RefreshToken](myDB).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("failed to count refresh tokens, err: %v", err)
+		}
+		if count != 0 {
+			t.Fatalf("expected refresh tokens of the session to be deleted, got %d", count)
+		}
+	})
+}
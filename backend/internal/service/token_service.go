@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const RefreshTokenPrefix = "refresh_token:"
+
+func buildTokenFamilyKey(userID uint, familyID string) string {
+	return fmt.Sprintf("token_family:%d:%s", userID, familyID)
+}
+
+func buildRefreshTokenKey(tokenHash string) string {
+	return RefreshTokenPrefix + tokenHash
+}
+
+// generateOpaqueToken returns a random URL-safe token, only its hash is stored server side.
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshTokenExpiry caps the refresh token lifetime by the absolute lifetime of its family.
+func (s *UserService) refreshTokenExpiry(familyCreatedAt time.Time) time.Time {
+	expiresAt := time.Now().Add(time.Duration(s.Dep.Cfg.RefreshTokenExpiry) * time.Second)
+	familyExpiresAt := familyCreatedAt.Add(time.Duration(s.Dep.Cfg.UserTokenAbsoluteExpiry) * time.Second)
+
+	if familyExpiresAt.Before(expiresAt) {
+		return familyExpiresAt
+	}
+	return expiresAt
+}
+
+func (s *UserService) createRefreshTokenByDB(ctx context.Context, modelToken *model.Token) (string, error) {
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = gorm.G[model.RefreshToken](s.Dep.DB).Create(ctx, &model.RefreshToken{
+		UserID:    modelToken.UserID,
+		TokenID:   modelToken.ID,
+		TokenHash: hashOpaqueToken(refreshToken),
+		ExpiresAt: s.refreshTokenExpiry(modelToken.CreatedAt),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+func (s *UserService) createRefreshTokenByRedis(ctx context.Context, userID uint, familyID string, familyTTL time.Duration) (string, error) {
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	ttl := time.Duration(s.Dep.Cfg.RefreshTokenExpiry) * time.Second
+	if familyTTL < ttl {
+		ttl = familyTTL
+	}
+
+	key := buildRefreshTokenKey(hashOpaqueToken(refreshToken))
+	_, err = s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "userId", userID, "familyId", familyID, "used", 0)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+func revokeTokenFamilyByDB(ctx context.Context, db *gorm.DB, tokenID uint) error {
+	_, err := gorm.G[model.RefreshToken](db.Unscoped()).Where("token_id = ?", tokenID).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = gorm.G[model.Token](db.Unscoped()).Where("id = ?", tokenID).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func revokeTokenFamilyByRedis(ctx context.Context, redisClient *redis.Client, userID uint, familyID string) error {
+	accessToken, err := redisClient.HGet(ctx, buildTokenFamilyKey(userID, familyID), "accessToken").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	keys := []string{buildTokenFamilyKey(userID, familyID)}
+	if accessToken != "" {
+		keys = append(keys, buildTokenKey(userID, accessToken))
+	}
+
+	return redisClient.Del(ctx, keys...).Err()
+}
+
+func (s *UserService) refreshUserTokenByDB(ctx context.Context, refreshToken string) (*userTokens, error) {
+	modelRefreshToken, err := gorm.G[model.RefreshToken](s.Dep.DB).Where("token_hash = ?", hashOpaqueToken(refreshToken)).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, "invalid refresh token")
+		}
+		return nil, err
+	}
+
+	// An already used refresh token means it has been leaked, the whole family goes.
+	if modelRefreshToken.UsedAt != nil {
+		s.Dep.Logger.Warn("refresh token reuse detected", "userID", modelRefreshToken.UserID)
+		if err := revokeTokenFamilyByDB(ctx, s.Dep.DB, modelRefreshToken.TokenID); err != nil {
+			return nil, err
+		}
+		return nil, authError.NewAuthError(401, "invalid refresh token")
+	}
+
+	if time.Now().After(modelRefreshToken.ExpiresAt) {
+		return nil, authError.NewAuthError(401, "refresh token expired")
+	}
+
+	// Mark as used, the condition guards against two concurrent refreshes with the same token.
+	rows, err := gorm.G[model.RefreshToken](s.Dep.DB).Where("id = ? AND used_at IS NULL", modelRefreshToken.ID).Update(ctx, "used_at", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 {
+		if err := revokeTokenFamilyByDB(ctx, s.Dep.DB, modelRefreshToken.TokenID); err != nil {
+			return nil, err
+		}
+		return nil, authError.NewAuthError(401, "invalid refresh token")
+	}
+
+	modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("id = ?", modelRefreshToken.TokenID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(401, "invalid refresh token")
+		}
+		return nil, err
+	}
+
+	accessToken, err := jwt.SignUserToken(s.Dep, modelToken.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gorm.G[model.Token](s.Dep.DB).Where("id = ?", modelToken.ID).Updates(ctx, model.Token{Token: accessToken, LastUsedAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	newRefreshToken, err := s.createRefreshTokenByDB(ctx, &modelToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s.updateHeartBeat(modelToken.UserID)
+
+	return &userTokens{AccessToken: accessToken, RefreshToken: newRefreshToken}, nil
+}
+
+func (s *UserService) refreshUserTokenByRedis(ctx context.Context, refreshToken string) (*userTokens, error) {
+	key := buildRefreshTokenKey(hashOpaqueToken(refreshToken))
+
+	values, err := s.Dep.Redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, authError.NewAuthError(401, "invalid refresh token")
+	}
+
+	parsedUserID, err := strconv.ParseUint(values["userId"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	userID := uint(parsedUserID)
+	familyID := values["familyId"]
+
+	// Atomically mark as used, anything but the first use means the token has been leaked.
+	// If the key expired since it was read, HINCRBY recreates it without a TTL, which the TTL in the same transaction shows.
+	var usedCmd *redis.IntCmd
+	var ttlCmd *redis.DurationCmd
+	if _, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		usedCmd = pipe.HIncrBy(ctx, key, "used", 1)
+		ttlCmd = pipe.TTL(ctx, key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if ttlCmd.Val() < 0 {
+		if err := s.Dep.Redis.Del(ctx, key).Err(); err != nil {
+			return nil, err
+		}
+		return nil, authError.NewAuthError(401, "invalid refresh token")
+	}
+	used := usedCmd.Val()
+	if used != 1 {
+		s.Dep.Logger.Warn("refresh token reuse detected", "userID", userID)
+		if err := revokeTokenFamilyByRedis(ctx, s.Dep.Redis, userID, familyID); err != nil {
+			return nil, err
+		}
+		return nil, authError.NewAuthError(401, "invalid refresh token")
+	}
+
+	familyKey := buildTokenFamilyKey(userID, familyID)
+	oldAccessToken, err := s.Dep.Redis.HGet(ctx, familyKey, "accessToken").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, authError.NewAuthError(401, "invalid refresh token")
+		}
+		return nil, err
+	}
+
+	familyTTL, err := s.Dep.Redis.TTL(ctx, familyKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := jwt.SignUserToken(s.Dep, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Dep.Redis.Set(ctx, buildTokenKey(userID, accessToken), familyID, time.Duration(s.Dep.Cfg.UserTokenExpiry)*time.Second).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Dep.Redis.HSet(ctx, familyKey, "accessToken", accessToken, "lastUsedAt", strconv.FormatInt(time.Now().Unix(), 10)).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Dep.Redis.Del(ctx, buildTokenKey(userID, oldAccessToken)).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	newRefreshToken, err := s.createRefreshTokenByRedis(ctx, userID, familyID, familyTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	s.updateHeartBeat(userID)
+
+	return &userTokens{AccessToken: accessToken, RefreshToken: newRefreshToken}, nil
+}
+
+// RefreshUserToken rotates the refresh token and issues a new access token for the same login.
+func (s *UserService) RefreshUserToken(ctx context.Context, request *dto.RefreshTokenRequest) (*dto.RefreshTokenResponse, error) {
+	var tokens *userTokens
+	var err error
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		tokens, err = s.refreshUserTokenByRedis(ctx, request.RefreshToken)
+	} else {
+		tokens, err = s.refreshUserTokenByDB(ctx, request.RefreshToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.RefreshTokenResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
+
+// GetJWKS returns the public keys other services can verify our tokens with.
+func (s *UserService) GetJWKS() *dto.JWKSResponse {
+	if s.Dep.Keys == nil {
+		return &dto.JWKSResponse{Keys: []dto.JWK{}}
+	}
+
+	return s.Dep.Keys.JWKS()
+}
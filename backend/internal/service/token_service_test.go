@@ -0,0 +1,136 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// createPasswordUser creates alice with the password Password.777, without logging her in.
+func createPasswordUser(t *testing.T, myDB *gorm.DB) db.User {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("Password.777"), 10)
+	if err != nil {
+		t.Fatalf("failed to hash password, err: %v", err)
+	}
+	passwordHash := string(hash)
+	user := db.User{
+		Username:     "alice",
+		Email:        "alice@example.com",
+		PasswordHash: &passwordHash,
+	}
+	if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
+		t.Fatalf("failed to create user, err: %v", err)
+	}
+
+	return user
+}
+
+func createAndLoginUser(t *testing.T, userService *service.UserService, myDB *gorm.DB) *dto.UserWithTokenResponse {
+	t.Helper()
+
+	createPasswordUser(t, myDB)
+
+	result, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+		Identifier: dto.Identifier{Identifier: "alice"},
+		Password:   dto.Password{Password: "Password.777"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if result.User == nil || result.User.RefreshToken == "" {
+		t.Fatalf("expected refresh token")
+	}
+
+	return result.User
+}
+
+func expectAuthErrorStatus(t *testing.T, err error, status int) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	var authErr *authError.AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected auth error, got: %v", err)
+	}
+	if authErr.Status != status {
+		t.Fatalf("expected status %d, got %d", status, authErr.Status)
+	}
+}
+
+func TestRefreshUserToken(t *testing.T) {
+	t.Run("invalid refresh token", func(t *testing.T) {
+		userService, _ := testutil.NewTestUserService(t)
+
+		_, err := userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: "nope"})
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("expired refresh token", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		_, err := gorm.G[db.RefreshToken](myDB).Where("user_id = ?", user.ID).Update(context.Background(), "expires_at", time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("failed to expire refresh token, err: %v", err)
+		}
+
+		_, err = userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: user.RefreshToken})
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		resp, err := userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: user.RefreshToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.RefreshToken == user.RefreshToken || resp.Token == user.Token {
+			t.Fatalf("expected tokens to be rotated")
+		}
+
+		if err := userService.ValidateUserToken(context.Background(), resp.Token, user.ID); err != nil {
+			t.Fatalf("expected new access token to be valid, err: %v", err)
+		}
+		err = userService.ValidateUserToken(context.Background(), user.Token, user.ID)
+		expectAuthErrorStatus(t, err, 401)
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createAndLoginUser(t, userService, myDB)
+
+		resp, err := userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: user.RefreshToken})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		_, err = userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: user.RefreshToken})
+		expectAuthErrorStatus(t, err, 401)
+
+		_, err = userService.RefreshUserToken(context.Background(), &dto.RefreshTokenRequest{RefreshToken: resp.RefreshToken})
+		expectAuthErrorStatus(t, err, 401)
+
+		count, err := gorm.G[db.Token](myDB).Where("user_id = ?", user.ID).Count(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("failed to count tokens, err: %v", err)
+		}
+		if count != 0 {
+			t.Fatalf("expected token family to be revoked, got %d tokens", count)
+		}
+	})
+}
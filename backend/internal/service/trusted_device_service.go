@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"gorm.io/gorm"
+)
+
+const TrustedDevicePrefix = "trusted_device:"
+
+func buildTrustedDeviceKey(userID uint, deviceHash string) string {
+	return fmt.Sprintf("%s%d:%s", TrustedDevicePrefix, userID, deviceHash)
+}
+
+func (s *UserService) createTrustedDeviceByDB(ctx context.Context, device *model.TrustedDevice) error {
+	_, err := gorm.G[model.TrustedDevice](s.Dep.DB.Unscoped()).Where("user_id = ? AND expires_at < ?", device.UserID, time.Now()).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	return gorm.G[model.TrustedDevice](s.Dep.DB).Create(ctx, device)
+}
+
+func (s *UserService) createTrustedDeviceByRedis(ctx context.Context, device *model.TrustedDevice) error {
+	key := buildTrustedDeviceKey(device.UserID, device.DeviceHash)
+	err := s.Dep.Redis.HSet(ctx, key,
+		"deviceLabel", device.DeviceLabel,
+		"clientIp", device.ClientIP,
+		"userAgent", device.UserAgent,
+		"createdAt", strconv.FormatInt(device.LastUsedAt.Unix(), 10),
+		"lastUsedAt", strconv.FormatInt(device.LastUsedAt.Unix(), 10),
+		"expiresAt", strconv.FormatInt(device.ExpiresAt.Unix(), 10),
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return s.Dep.Redis.ExpireAt(ctx, key, device.ExpiresAt).Err()
+}
+
+// trustDevice remembers the device the request comes from, and returns the token of its cookie.
+func (s *UserService) trustDevice(ctx context.Context, userID uint) (string, error) {
+	deviceID, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	clientInfo := util.ClientInfoFromContext(ctx)
+	now := time.Now()
+	device := &model.TrustedDevice{
+		UserID:      userID,
+		DeviceHash:  hashOpaqueToken(deviceID),
+		ExpiresAt:   now.Add(time.Duration(s.Dep.Cfg.TrustedDeviceExpiry) * time.Second),
+		LastUsedAt:  now,
+		ClientIP:    clientInfo.IP,
+		UserAgent:   clientInfo.UserAgent,
+		DeviceLabel: util.DeviceLabelFromUserAgent(clientInfo.UserAgent),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		err = s.createTrustedDeviceByRedis(ctx, device)
+	} else {
+		err = s.createTrustedDeviceByDB(ctx, device)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return jwt.SignTrustedDeviceToken(s.Dep, userID, deviceID)
+}
+
+// trustedDeviceHash returns the stored hash of the device of the token, or "" when the token is not one of the user.
+func (s *UserService) trustedDeviceHash(userID uint, token string) string {
+	if token == "" {
+		return ""
+	}
+
+	claims, err := jwt.ValidateTrustedDeviceToken(s.Dep, token)
+	if err != nil || claims.UserID != userID || claims.DeviceID == "" {
+		return ""
+	}
+
+	return hashOpaqueToken(claims.DeviceID)
+}
+
+func (s *UserService) touchTrustedDeviceByDB(ctx context.Context, userID uint, deviceHash string) (bool, error) {
+	rows, err := gorm.G[model.TrustedDevice](s.Dep.DB).
+		Where("user_id = ? AND device_hash = ? AND expires_at > ?", userID, deviceHash, time.Now()).
+		Update(ctx, "last_used_at", time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+func (s *UserService) touchTrustedDeviceByRedis(ctx context.Context, userID uint, deviceHash string) (bool, error) {
+	key := buildTrustedDeviceKey(userID, deviceHash)
+	exists, err := s.Dep.Redis.Exists(ctx, key).Result()
+	if err != nil || exists == 0 {
+		return false, err
+	}
+
+	err = s.Dep.Redis.HSet(ctx, key, "lastUsedAt", strconv.FormatInt(time.Now().Unix(), 10)).Err()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// isTrustedDevice tells whether the token of the cookie belongs to a device the user still trusts.
+func (s *UserService) isTrustedDevice(ctx context.Context, userID uint, token string) (bool, error) {
+	deviceHash := s.trustedDeviceHash(userID, token)
+	if deviceHash == "" {
+		return false, nil
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.touchTrustedDeviceByRedis(ctx, userID, deviceHash)
+	}
+	return s.touchTrustedDeviceByDB(ctx, userID, deviceHash)
+}
+
+func (s *UserService) getTrustedDevicesByDB(ctx context.Context, userID uint, currentHash string) ([]dto.TrustedDeviceResponse, error) {
+	modelDevices, err := gorm.G[model.TrustedDevice](s.Dep.DB).
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]dto.TrustedDeviceResponse, 0, len(modelDevices))
+	for _, md := range modelDevices {
+		devices = append(devices, dto.TrustedDeviceResponse{
+			ID:          strconv.FormatUint(uint64(md.ID), 10),
+			DeviceLabel: md.DeviceLabel,
+			ClientIP:    md.ClientIP,
+			UserAgent:   md.UserAgent,
+			CreatedAt:   md.CreatedAt.Unix(),
+			LastUsedAt:  md.LastUsedAt.Unix(),
+			ExpiresAt:   md.ExpiresAt.Unix(),
+			Current:     md.DeviceHash == currentHash,
+		})
+	}
+
+	return devices, nil
+}
+
+func (s *UserService) getTrustedDevicesByRedis(ctx context.Context, userID uint, currentHash string) ([]dto.TrustedDeviceResponse, error) {
+	devices := make([]dto.TrustedDeviceResponse, 0)
+
+	prefix := buildTrustedDeviceKey(userID, "")
+	iter := s.Dep.Redis.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := s.Dep.Redis.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 { // Expired in between
+			continue
+		}
+
+		deviceHash := strings.TrimPrefix(iter.Val(), prefix)
+		createdAt, _ := strconv.ParseInt(values["createdAt"], 10, 64)
+		lastUsedAt, _ := strconv.ParseInt(values["lastUsedAt"], 10, 64)
+		expiresAt, _ := strconv.ParseInt(values["expiresAt"], 10, 64)
+
+		devices = append(devices, dto.TrustedDeviceResponse{
+			ID:          deviceHash,
+			DeviceLabel: values["deviceLabel"],
+			ClientIP:    values["clientIp"],
+			UserAgent:   values["userAgent"],
+			CreatedAt:   createdAt,
+			LastUsedAt:  lastUsedAt,
+			ExpiresAt:   expiresAt,
+			Current:     deviceHash == currentHash,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// GetTrustedDevices lists the devices that skip the 2FA step, the one of the cookie is marked as current.
+func (s *UserService) GetTrustedDevices(ctx context.Context, userID uint, currentToken string) ([]dto.TrustedDeviceResponse, error) {
+	currentHash := s.trustedDeviceHash(userID, currentToken)
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.getTrustedDevicesByRedis(ctx, userID, currentHash)
+	} else {
+		return s.getTrustedDevicesByDB(ctx, userID, currentHash)
+	}
+}
+
+func (s *UserService) revokeTrustedDeviceByDB(ctx context.Context, userID uint, deviceID string) error {
+	id, err := strconv.ParseUint(deviceID, 10, 64)
+	if err != nil {
+		return authError.NewAuthError(404, "trusted device not found")
+	}
+
+	rows, err := gorm.G[model.TrustedDevice](s.Dep.DB.Unscoped()).Where("id = ? AND user_id = ?", id, userID).Delete(ctx)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return authError.NewAuthError(404, "trusted device not found")
+	}
+
+	return nil
+}
+
+func (s *UserService) revokeTrustedDeviceByRedis(ctx context.Context, userID uint, deviceID string) error {
+	deleted, err := s.Dep.Redis.Del(ctx, buildTrustedDeviceKey(userID, deviceID)).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return authError.NewAuthError(404, "trusted device not found")
+	}
+
+	return nil
+}
+
+// RevokeTrustedDevice makes one device ask for the 2FA code again.
+func (s *UserService) RevokeTrustedDevice(ctx context.Context, userID uint, deviceID string) error {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.revokeTrustedDeviceByRedis(ctx, userID, deviceID)
+	} else {
+		return s.revokeTrustedDeviceByDB(ctx, userID, deviceID)
+	}
+}
+
+// ForgetTrustedDevices makes every device of the user ask for the 2FA code again.
+func (s *UserService) ForgetTrustedDevices(ctx context.Context, userID uint) error {
+	if s.Dep.Cfg.IsRedisEnabled {
+		return deleteRedisKeysByPattern(ctx, s.Dep.Redis, buildTrustedDeviceKey(userID, "*"))
+	}
+
+	_, err := gorm.G[model.TrustedDevice](s.Dep.DB.Unscoped()).Where("user_id = ?", userID).Delete(ctx)
+	return err
+}
@@ -0,0 +1,163 @@
+package service_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+)
+
+// rememberDevice passes the 2FA step with a recovery code and rememberDevice, and returns the cookie token.
+func rememberDevice(t *testing.T, userService *service.UserService, userID uint, recoveryCode string) string {
+	t.Helper()
+
+	sessionToken, err := jwt.SignTwoFAToken(userService.Dep, userID)
+	if err != nil {
+		t.Fatalf("failed to sign session token, err: %v", err)
+	}
+
+	resp, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+		RecoveryCode:   recoveryCode,
+		SessionToken:   sessionToken,
+		RememberDevice: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	if resp.TrustedDeviceToken == "" {
+		t.Fatalf("expected a trusted device token")
+	}
+
+	return resp.TrustedDeviceToken
+}
+
+func loginAlice(t *testing.T, userService *service.UserService, trustedDeviceToken string) *service.LoginResult {
+	t.Helper()
+
+	result, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+		Identifier:         dto.Identifier{Identifier: "alice"},
+		Password:           dto.Password{Password: "Password.777"},
+		TrustedDeviceToken: trustedDeviceToken,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+
+	return result
+}
+
+func TestTrustedDevices(t *testing.T) {
+	t.Run("remembered device skips 2FA", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, user.ID)
+
+		token := rememberDevice(t, userService, user.ID, codes[0])
+
+		if result := loginAlice(t, userService, token); result.User == nil || result.TwoFAPending != nil {
+			t.Fatalf("expected a login without 2FA, got %+v", result)
+		}
+		if result := loginAlice(t, userService, ""); result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step without the cookie")
+		}
+		if result := loginAlice(t, userService, "garbage"); result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step with an invalid cookie")
+		}
+	})
+
+	t.Run("not remembered by default", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, user.ID)
+
+		resp, err := submitRecoveryCode(t, userService, user.ID, codes[0])
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if resp.TrustedDeviceToken != "" {
+			t.Fatalf("expected no trusted device token")
+		}
+	})
+
+	t.Run("cookie of another user", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		alice := createPasswordUser(t, myDB)
+		enableTwoFA(t, userService, alice.ID)
+
+		bob := registerUser(t, userService)
+		bobCodes := enableTwoFA(t, userService, bob.ID)
+		bobToken := rememberDevice(t, userService, bob.ID, bobCodes[0])
+
+		if result := loginAlice(t, userService, bobToken); result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step with the cookie of another user")
+		}
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, user.ID)
+		token := rememberDevice(t, userService, user.ID, codes[0])
+		rememberDevice(t, userService, user.ID, codes[1])
+
+		devices, err := userService.GetTrustedDevices(context.Background(), user.ID, token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(devices) != 2 {
+			t.Fatalf("expected 2 devices, got %d", len(devices))
+		}
+		var current *dto.TrustedDeviceResponse
+		for i := range devices {
+			if devices[i].Current {
+				current = &devices[i]
+			}
+		}
+		if current == nil || current.ExpiresAt <= current.CreatedAt {
+			t.Fatalf("unexpected devices %+v", devices)
+		}
+
+		expectAuthErrorStatus(t, userService.RevokeTrustedDevice(context.Background(), user.ID+1, current.ID), 404)
+		if err := userService.RevokeTrustedDevice(context.Background(), user.ID, current.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		expectAuthErrorStatus(t, userService.RevokeTrustedDevice(context.Background(), user.ID, current.ID), 404)
+
+		if result := loginAlice(t, userService, token); result.TwoFAPending == nil {
+			t.Fatalf("expected the 2FA step after the revocation")
+		}
+		devices, err = userService.GetTrustedDevices(context.Background(), user.ID, token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(devices) != 1 || devices[0].Current {
+			t.Fatalf("unexpected devices %+v", devices)
+		}
+	})
+
+	t.Run("password change forgets all devices", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		codes := enableTwoFA(t, userService, user.ID)
+		token := rememberDevice(t, userService, user.ID, codes[0])
+
+		_, err := userService.UpdateUserPassword(context.Background(), user.ID, &dto.UpdateUserPasswordRequest{
+			OldPassword: dto.OldPassword{OldPassword: "Password.777"},
+			NewPassword: dto.NewPassword{NewPassword: "Password.888"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		devices, err := userService.GetTrustedDevices(context.Background(), user.ID, token)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if len(devices) != 0 {
+			t.Fatalf("expected no trusted devices, got %d", len(devices))
+		}
+	})
+}
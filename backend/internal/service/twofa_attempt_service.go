@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/pquerna/otp/totp"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const UsedTotpCodePrefix = "totp_used:"
+const TwoFASessionPrefix = "2fa_session:"
+
+func buildUsedTotpCodeKey(codeKey string) string {
+	return UsedTotpCodePrefix + codeKey
+}
+
+func buildTwoFASessionKey(jti string) string {
+	return TwoFASessionPrefix + jti
+}
+
+// matchTotpStep returns the time step the code belongs to, when it is valid now.
+func matchTotpStep(code string, secret string, now time.Time, opts totp.ValidateOpts) (int64, bool) {
+	period := int64(opts.Period)
+	current := now.Unix() / period
+
+	for offset := -int64(opts.Skew); offset <= int64(opts.Skew); offset++ {
+		step := current + offset
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func (s *UserService) markTotpStepUsedByDB(ctx context.Context, used *model.UsedTotpCode) (bool, error) {
+	_, err := gorm.G[model.UsedTotpCode](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// The unique key makes the insert fail for the second of two concurrent uses.
+	result := s.Dep.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(used)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func (s *UserService) markTotpStepUsedByRedis(ctx context.Context, used *model.UsedTotpCode) (bool, error) {
+	return s.Dep.Redis.SetNX(ctx, buildUsedTotpCodeKey(used.CodeKey), 1, time.Until(used.ExpiresAt)).Result()
+}
+
+// validateTotpOnce checks the code like totp.Validate, and refuses a code of a time step that was already used.
+func (s *UserService) validateTotpOnce(ctx context.Context, code string, secret string, opts totp.ValidateOpts) (bool, error) {
+	step, ok := matchTotpStep(code, secret, time.Now(), opts)
+	if !ok {
+		return false, nil
+	}
+
+	// The code stays valid until the skew no longer reaches its step.
+	period := int64(opts.Period)
+	used := &model.UsedTotpCode{
+		CodeKey:   hashOpaqueToken(secret + ":" + strconv.FormatInt(step, 10)),
+		ExpiresAt: time.Unix((step+1+int64(opts.Skew))*period, 0),
+	}
+
+	if s.Dep.Cfg.IsRedisEnabled {
+		return s.markTotpStepUsedByRedis(ctx, used)
+	}
+	return s.markTotpStepUsedByDB(ctx, used)
+}
+
+func (s *UserService) getTwoFASessionAttemptsByDB(ctx context.Context, jti string) (int, error) {
+	session, err := gorm.G[model.TwoFASession](s.Dep.DB).Where("jti = ?", jti).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return session.Attempts, nil
+}
+
+func (s *UserService) getTwoFASessionAttemptsByRedis(ctx context.Context, jti string) (int, error) {
+	attempts, err := s.Dep.Redis.Get(ctx, buildTwoFASessionKey(jti)).Int()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return attempts, nil
+}
+
+// checkTwoFASession refuses a session token, by its jti, that already used up its codes.
+func (s *UserService) checkTwoFASession(ctx context.Context, jti string) error {
+	var attempts int
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		attempts, err = s.getTwoFASessionAttemptsByRedis(ctx, jti)
+	} else {
+		attempts, err = s.getTwoFASessionAttemptsByDB(ctx, jti)
+	}
+	if err != nil {
+		return err
+	}
+
+	if attempts >= s.Dep.Cfg.TwoFaMaxAttempts {
+		return authError.NewAuthError(400, "invalid session token")
+	}
+
+	return nil
+}
+
+func (s *UserService) countTwoFASessionAttemptByDB(ctx context.Context, jti string, expiresAt time.Time) (int, error) {
+	_, err := gorm.G[model.TwoFASession](s.Dep.DB.Unscoped()).Where("expires_at < ?", time.Now()).Delete(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	session := model.TwoFASession{
+		Jti:       jti,
+		Attempts:  1,
+		ExpiresAt: expiresAt,
+	}
+	err = s.Dep.DB.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "jti"}},
+			DoUpdates: clause.Assignments(map[string]any{"attempts": gorm.Expr("attempts + 1"), "updated_at": time.Now()}),
+		},
+		clause.Returning{Columns: []clause.Column{{Name: "attempts"}}},
+	).Create(&session).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return session.Attempts, nil
+}
+
+func (s *UserService) countTwoFASessionAttemptByRedis(ctx context.Context, jti string, expiresAt time.Time) (int, error) {
+	key := buildTwoFASessionKey(jti)
+	var incr *redis.IntCmd
+	_, err := s.Dep.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.ExpireAt(ctx, key, expiresAt)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(incr.Val()), nil
+}
+
+// claimTwoFASessionAttempt counts a submitted code against the session token before it is checked,
+// so concurrent requests can not try more codes than allowed.
+func (s *UserService) claimTwoFASessionAttempt(ctx context.Context, claims *dto.TwoFaJwtPayload) error {
+	var attempts int
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		attempts, err = s.countTwoFASessionAttemptByRedis(ctx, claims.ID, claims.ExpiresAt.Time)
+	} else {
+		attempts, err = s.countTwoFASessionAttemptByDB(ctx, claims.ID, claims.ExpiresAt.Time)
+	}
+	if err != nil {
+		return err
+	}
+
+	if attempts > s.Dep.Cfg.TwoFaMaxAttempts {
+		return authError.NewAuthError(400, "invalid session token")
+	}
+
+	return nil
+}
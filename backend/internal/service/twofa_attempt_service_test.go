@@ -0,0 +1,123 @@
+package service_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+func TestTwoFAReplay(t *testing.T) {
+	userService, myDB := testutil.NewTestUserService(t)
+	user := createPasswordUser(t, myDB)
+	enableTwoFA(t, userService, user.ID)
+
+	modelUser, err := gorm.G[model.User](myDB).Where("id = ?", user.ID).First(context.Background())
+	if err != nil {
+		t.Fatalf("failed to query user, err: %v", err)
+	}
+	code, err := totp.GenerateCode(*modelUser.TotpSecret, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Fatalf("failed to generate code, err: %v", err)
+	}
+
+	submit := func() error {
+		sessionToken, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+		if err != nil {
+			t.Fatalf("failed to sign session token, err: %v", err)
+		}
+
+		_, err = userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+			TwoFACode:    code,
+			SessionToken: sessionToken,
+		})
+		return err
+	}
+
+	if err := submit(); err != nil {
+		t.Fatalf("unexpected error, err: %v", err)
+	}
+	expectAuthErrorStatus(t, submit(), 400)
+
+	// The code is remembered until the skew no longer accepts it.
+	used, err := gorm.G[model.UsedTotpCode](myDB).Order("expires_at desc").First(context.Background())
+	if err != nil {
+		t.Fatalf("failed to query used code, err: %v", err)
+	}
+	if used.ExpiresAt.Before(time.Now().Add(60*time.Second)) || used.ExpiresAt.After(time.Now().Add(90*time.Second)) {
+		t.Fatalf("unexpected expiry %v", used.ExpiresAt)
+	}
+}
+
+func TestTwoFASessionAttempts(t *testing.T) {
+	userService, myDB := testutil.NewTestUserService(t)
+	user := createPasswordUser(t, myDB)
+	codes := enableTwoFA(t, userService, user.ID)
+
+	sessionToken, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+	if err != nil {
+		t.Fatalf("failed to sign session token, err: %v", err)
+	}
+
+	// Wrong recovery codes count against the session token too.
+	for i := 0; i < userService.Dep.Cfg.TwoFaMaxAttempts; i++ {
+		_, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+			RecoveryCode: "wrong-code",
+			SessionToken: sessionToken,
+		})
+		expectAuthErrorStatus(t, err, 400)
+	}
+
+	_, err = userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+		RecoveryCode: codes[0],
+		SessionToken: sessionToken,
+	})
+	expectAuthErrorStatus(t, err, 400)
+
+	// The refused code was not spent.
+	if _, err := submitRecoveryCode(t, userService, user.ID, codes[0]); err != nil {
+		t.Fatalf("expected the code to work with a new session token, err: %v", err)
+	}
+}
+
+func TestTwoFASessionAttemptsConcurrent(t *testing.T) {
+	userService, myDB := testutil.NewTestUserService(t)
+	user := createPasswordUser(t, myDB)
+	codes := enableTwoFA(t, userService, user.ID)
+
+	sessionToken, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+	if err != nil {
+		t.Fatalf("failed to sign session token, err: %v", err)
+	}
+
+	// Every code is counted before it is checked, so concurrent requests can not get past the limit.
+	attempts := 2 * userService.Dep.Cfg.TwoFaMaxAttempts
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(code string) {
+			defer wg.Done()
+			_, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+				RecoveryCode: code,
+				SessionToken: sessionToken,
+			})
+			if err == nil {
+				accepted.Add(1)
+			}
+		}(codes[i])
+	}
+	wg.Wait()
+
+	if got := int(accepted.Load()); got == 0 || got > userService.Dep.Cfg.TwoFaMaxAttempts {
+		t.Fatalf("expected between 1 and %d accepted codes, got %d", userService.Dep.Cfg.TwoFaMaxAttempts, got)
+	}
+}
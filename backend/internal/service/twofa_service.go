@@ -1,21 +1,111 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"image/png"
+	"strconv"
 	"strings"
 
 	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+// Size in pixels of the QR code returned by StartTwoFaSetup.
+const TwoFaQrCodeSize = 200
+
+// Authenticators set up before the TOTP parameters were stored with the user use the defaults of the time.
+const (
+	legacyTotpDigits    = 6
+	legacyTotpPeriod    = 30
+	legacyTotpAlgorithm = "SHA1"
+)
+
+// totpOptions returns the TOTP parameters of the config, used for new authenticators. An error names the invalid one.
+func totpOptions(cfg *config.Config) (totp.ValidateOpts, error) {
+	return buildTotpOptions(cfg.TwoFaDigits, cfg.TwoFaPeriod, cfg.TwoFaAlgorithm, cfg.TwoFaSkew)
+}
+
+// storedTotpOptions returns the TOTP parameters an authenticator was set up with, zero values stand for the legacy defaults.
+// Only the skew comes from the config, it is not part of what the authenticator computes.
+func storedTotpOptions(cfg *config.Config, digits int, period int, algorithm string) (totp.ValidateOpts, error) {
+	if digits == 0 {
+		digits = legacyTotpDigits
+	}
+	if period == 0 {
+		period = legacyTotpPeriod
+	}
+	if algorithm == "" {
+		algorithm = legacyTotpAlgorithm
+	}
+
+	return buildTotpOptions(digits, period, algorithm, cfg.TwoFaSkew)
+}
+
+func (s *UserService) userTotpOptions(user *model.User) (totp.ValidateOpts, error) {
+	return storedTotpOptions(s.Dep.Cfg, user.TotpDigits, user.TotpPeriod, user.TotpAlgorithm)
+}
+
+func buildTotpOptions(digits int, period int, algorithmName string, skew int) (totp.ValidateOpts, error) {
+	var algorithm otp.Algorithm
+	switch strings.ToUpper(algorithmName) {
+	case "SHA1":
+		algorithm = otp.AlgorithmSHA1
+	case "SHA256":
+		algorithm = otp.AlgorithmSHA256
+	case "SHA512":
+		algorithm = otp.AlgorithmSHA512
+	default:
+		return totp.ValidateOpts{}, fmt.Errorf("unknown TOTP algorithm %q", algorithmName)
+	}
+
+	if digits != 6 && digits != 8 {
+		return totp.ValidateOpts{}, fmt.Errorf("TOTP digits must be 6 or 8, got %d", digits)
+	}
+
+	if period <= 0 {
+		return totp.ValidateOpts{}, fmt.Errorf("TOTP period must be positive, got %d", period)
+	}
+
+	if skew < 0 {
+		return totp.ValidateOpts{}, fmt.Errorf("TOTP skew must not be negative, got %d", skew)
+	}
+
+	return totp.ValidateOpts{
+		Period:    uint(period),
+		Skew:      uint(skew),
+		Digits:    otp.Digits(digits),
+		Algorithm: algorithm,
+	}, nil
+}
+
+// qrCodeDataURI renders the otpauth URI of the key as a PNG data URI, for the frontend to show as an image.
+func qrCodeDataURI(key *otp.Key) (string, error) {
+	img, err := key.Image(TwoFaQrCodeSize, TwoFaQrCodeSize)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
 func (s *UserService) StartTwoFaSetup(ctx context.Context, userID uint) (*dto.TwoFASetupResponse, error) {
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -23,29 +113,37 @@ func (s *UserService) StartTwoFaSetup(ctx context.Context, userID uint) (*dto.Tw
 		return nil, err
 	}
 
-	if isTwoFAEnabled(modelUser.TwoFAToken) {
-		return nil, authError.NewAuthError(400, "2FA is already enabled")
+	if modelUser.TotpSecret != nil {
+		return nil, authError.NewAuthError(400, "TOTP is already enabled")
+	}
+
+	// 2FA is disabled with the password, OAuth users set one first.
+	if modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(400, "set a password before enabling 2FA")
 	}
 
-	if modelUser.GoogleOauthID != nil {
-		return nil, authError.NewAuthError(400, "2FA cannot be enabled for Google OAuth users")
+	opts, err := totpOptions(s.Dep.Cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	secret, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Transcendence",
+		Issuer:      s.Dep.Cfg.TwoFaIssuer,
 		AccountName: modelUser.Email,
+		Period:      opts.Period,
+		Digits:      opts.Digits,
+		Algorithm:   opts.Algorithm,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	twoFAToken := TwoFAPrePrefix + secret.Secret()
-
-	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "two_fa_token", twoFAToken)
+	qrCode, err := qrCodeDataURI(secret)
 	if err != nil {
 		return nil, err
 	}
 
+	// The secret is only stored once confirmed, until then the setup token carries it.
 	setupToken, err := jwt.SignTwoFASetupToken(s.Dep, userID, secret.Secret())
 	if err != nil {
 		return nil, err
@@ -55,10 +153,12 @@ func (s *UserService) StartTwoFaSetup(ctx context.Context, userID uint) (*dto.Tw
 		TwoFASecret: secret.Secret(),
 		SetupToken:  setupToken,
 		TwoFaUri:    secret.URL(),
+		TwoFaQrCode: qrCode,
 	}, nil
 }
 
-func (s *UserService) ConfirmTwoFaSetup(ctx context.Context, userID uint, request *dto.TwoFAConfirmRequest) (*dto.UserWithTokenResponse, error) {
+// ConfirmTwoFaSetup enables TOTP. When it is the first 2FA method of the user, it returns the recovery codes that stand in for it once each.
+func (s *UserService) ConfirmTwoFaSetup(ctx context.Context, userID uint, request *dto.TwoFAConfirmRequest) (*dto.TwoFAConfirmResponse, error) {
 	claims, err := jwt.ValidateTwoFASetupToken(s.Dep, request.SetupToken)
 	if err != nil || claims.Type != jwt.TwoFASetupType {
 		return nil, authError.NewAuthError(400, "invalid setup token")
@@ -68,7 +168,7 @@ func (s *UserService) ConfirmTwoFaSetup(ctx context.Context, userID uint, reques
 		return nil, authError.NewAuthError(400, "setup token does not match user")
 	}
 
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -76,40 +176,103 @@ func (s *UserService) ConfirmTwoFaSetup(ctx context.Context, userID uint, reques
 		return nil, err
 	}
 
-	if modelUser.TwoFAToken == nil {
-		return nil, authError.NewAuthError(400, "2FA setup was not initiated")
+	if modelUser.TotpSecret != nil {
+		return nil, authError.NewAuthError(400, "TOTP is already enabled")
 	}
 
-	if isTwoFAEnabled(modelUser.TwoFAToken) {
-		return nil, authError.NewAuthError(400, "2FA is already enabled")
+	if modelUser.PasswordHash == nil {
+		return nil, authError.NewAuthError(400, "set a password before enabling 2FA")
 	}
 
-	if modelUser.GoogleOauthID != nil {
-		return nil, authError.NewAuthError(400, "2FA cannot be enabled for Google OAuth users")
+	// The authenticator was set up with the parameters of the setup token, they stay with the user even if the config changes.
+	opts, err := storedTotpOptions(s.Dep.Cfg, claims.Digits, claims.Period, claims.Algorithm)
+	if err != nil {
+		return nil, err
 	}
 
-	twoFaSecret := strings.TrimPrefix(*modelUser.TwoFAToken, TwoFAPrePrefix)
-	valid := totp.Validate(request.TwoFACode, twoFaSecret)
+	twoFaSecret := claims.Secret
+	valid, err := s.validateTotpOnce(ctx, request.TwoFACode, twoFaSecret, opts)
+	if err != nil {
+		return nil, err
+	}
 	if !valid {
 		return nil, authError.NewAuthError(400, "invalid 2FA code")
 	}
 
-	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "two_fa_token", twoFaSecret)
+	firstMethod := !isTwoFAEnabled(&modelUser)
+
+	var recoveryCodes []string
+	err = s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret":    twoFaSecret,
+			"totp_digits":    int(opts.Digits),
+			"totp_period":    int(opts.Period),
+			"totp_algorithm": opts.Algorithm.String(),
+		}).Error
+		if err != nil || !firstMethod {
+			return err
+		}
+
+		recoveryCodes, err = s.replaceRecoveryCodes(ctx, tx, userID)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	modelUser.TwoFAToken = &twoFaSecret
+	modelUser.TotpSecret = &twoFaSecret
+	modelUser.TotpDigits = int(opts.Digits)
+	modelUser.TotpPeriod = int(opts.Period)
+	modelUser.TotpAlgorithm = opts.Algorithm.String()
 
-	userToken, err := s.issueNewTokenForUser(ctx, userID, true)
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return userToUserWithTokenResponse(&modelUser, userToken), nil
+	return &dto.TwoFAConfirmResponse{
+		UserWithTokenResponse: *userToUserWithTokenResponse(&modelUser, userTokens),
+		RecoveryCodes:         recoveryCodes,
+	}, nil
+}
+
+// turnOffTwoFAMethods turns off the chosen methods. Once none is left, the recovery codes and trusted devices go too.
+func (s *UserService) turnOffTwoFAMethods(ctx context.Context, modelUser *model.User, totp bool, email bool) error {
+	updates := map[string]any{}
+	if totp {
+		modelUser.TotpSecret = nil
+		modelUser.TotpDigits = 0
+		modelUser.TotpPeriod = 0
+		modelUser.TotpAlgorithm = ""
+		updates["totp_secret"] = nil
+		updates["totp_digits"] = 0
+		updates["totp_period"] = 0
+		updates["totp_algorithm"] = ""
+	}
+	if email {
+		modelUser.EmailOtpEnabled = false
+		updates["email_otp_enabled"] = false
+	}
+	lastMethod := !isTwoFAEnabled(modelUser)
+
+	err := s.Dep.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("id = ?", modelUser.ID).Updates(updates).Error
+		if err != nil || !lastMethod {
+			return err
+		}
+
+		_, err = gorm.G[model.RecoveryCode](tx.Unscoped()).Where("user_id = ?", modelUser.ID).Delete(ctx)
+		return err
+	})
+	if err != nil || !lastMethod {
+		return err
+	}
+
+	return s.ForgetTrustedDevices(ctx, modelUser.ID)
 }
 
+// DisableTwoFA turns off every 2FA method of the user.
 func (s *UserService) DisableTwoFA(ctx context.Context, userID uint, request *dto.DisableTwoFARequest) (*dto.UserWithTokenResponse, error) {
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -118,42 +281,50 @@ func (s *UserService) DisableTwoFA(ctx context.Context, userID uint, request *dt
 	}
 
 	if modelUser.PasswordHash == nil {
-		return nil, authError.NewAuthError(400, "2FA cannot be disabled for OAuth users")
+		return nil, authError.NewAuthError(400, "2FA cannot be disabled without a password")
 	}
 
-	if !isTwoFAEnabled(modelUser.TwoFAToken) {
+	if !isTwoFAEnabled(&modelUser) {
 		return nil, authError.NewAuthError(400, "2FA is not enabled")
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(*modelUser.PasswordHash), []byte(request.Password.Password))
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		if errors.Is(err, password.ErrMismatchedPassword) {
 			return nil, authError.NewAuthError(401, "invalid credentials")
 		}
 		return nil, err
 	}
 
-	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "two_fa_token", nil)
-	if err != nil {
+	if err := s.turnOffTwoFAMethods(ctx, &modelUser, true, true); err != nil {
 		return nil, err
 	}
-	modelUser.TwoFAToken = nil
 
-	userToken, err := s.issueNewTokenForUser(ctx, userID, true)
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return userToUserWithTokenResponse(&modelUser, userToken), nil
+	return userToUserWithTokenResponse(&modelUser, userTokens), nil
 }
 
-func (s *UserService) SubmitTwoFAChallenge(ctx context.Context, request *dto.TwoFAChallengeRequest) (*dto.UserWithTokenResponse, error) {
+// SubmitTwoFAChallenge finishes a login with the code of the authenticator, the emailed code, or one of the recovery codes.
+func (s *UserService) SubmitTwoFAChallenge(ctx context.Context, request *dto.TwoFAChallengeRequest) (*dto.TwoFAChallengeResponse, error) {
 	claims, err := jwt.ValidateTwoFAToken(s.Dep, request.SessionToken)
 	if err != nil || claims.Type != jwt.TwoFATokenType {
 		return nil, authError.NewAuthError(400, "invalid session token")
 	}
 
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", claims.UserID).First(ctx)
+	counters := s.loginAttemptCounters(ctx, "2fa", strconv.FormatUint(uint64(claims.UserID), 10))
+	if err := s.checkAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	if err := s.claimTwoFASessionAttempt(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	modelUser, err := s.findLoginUser(ctx, claims.UserID)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -161,19 +332,76 @@ func (s *UserService) SubmitTwoFAChallenge(ctx context.Context, request *dto.Two
 		return nil, err
 	}
 
-	if !isTwoFAEnabled(modelUser.TwoFAToken) || modelUser.TwoFAToken == nil {
+	if !isTwoFAEnabled(&modelUser) {
 		return nil, authError.NewAuthError(400, "2FA is not enabled for this user")
 	}
 
-	valid := totp.Validate(request.TwoFACode, *modelUser.TwoFAToken)
-	if !valid {
-		return nil, authError.NewAuthError(400, "invalid 2FA code")
+	switch {
+	case request.RecoveryCode != "":
+		used, err := s.consumeRecoveryCode(ctx, modelUser.ID, request.RecoveryCode)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(400, "invalid recovery code"))
+		}
+	case request.EmailCode != "":
+		if !modelUser.EmailOtpEnabled {
+			return nil, authError.NewAuthError(400, "email 2FA is not enabled for this user")
+		}
+		used, err := s.consumeEmailOtp(ctx, modelUser.ID, request.SessionToken, request.EmailCode)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(400, "invalid email code"))
+		}
+	default:
+		if modelUser.TotpSecret == nil {
+			return nil, authError.NewAuthError(400, "TOTP is not enabled for this user")
+		}
+		opts, err := s.userTotpOptions(&modelUser)
+		if err != nil {
+			return nil, err
+		}
+		valid, err := s.validateTotpOnce(ctx, request.TwoFACode, *modelUser.TotpSecret, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(400, "invalid 2FA code"))
+		}
+	}
+
+	if err := s.resetAttemptCounters(ctx, counters); err != nil {
+		return nil, err
 	}
 
-	userToken, err := s.issueNewTokenForUser(ctx, modelUser.ID, false)
+	if err := s.restoreOnLogin(ctx, &modelUser); err != nil {
+		return nil, err
+	}
+
+	recoveryCodesLeft, err := s.countRecoveryCodes(ctx, modelUser.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	return userToUserWithTokenResponse(&modelUser, userToken), nil
+	var trustedDeviceToken string
+	if request.RememberDevice {
+		trustedDeviceToken, err = s.trustDevice(ctx, modelUser.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	userTokens, err := s.issueNewTokenForUser(ctx, modelUser.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.TwoFAChallengeResponse{
+		UserWithTokenResponse: *userToUserWithTokenResponse(&modelUser, userTokens),
+		RecoveryCodesLeft:     recoveryCodesLeft,
+		TrustedDeviceToken:    trustedDeviceToken,
+	}, nil
 }
@@ -1,16 +1,24 @@
 package service_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"image/png"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
 	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	"github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/service"
 	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -40,7 +48,7 @@ func TestStartTwoFaSetup(t *testing.T) {
 		user := db.User{
 			Username:   "user1",
 			Email:      "user1@example.com",
-			TwoFAToken: &secret,
+			TotpSecret: &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -59,14 +67,15 @@ func TestStartTwoFaSetup(t *testing.T) {
 		}
 	})
 
-	t.Run("google oauth user", func(t *testing.T) {
+	t.Run("google oauth user without a password", func(t *testing.T) {
 		userService, myDB := testutil.NewTestUserService(t)
 
-		googleID := "gid-1"
 		user := db.User{
-			Username:      "user2",
-			Email:         "user2@example.com",
-			GoogleOauthID: &googleID,
+			Username: "user2",
+			Email:    "user2@example.com",
+			Identities: []db.UserIdentity{
+				{Provider: "google", Subject: "gid-1", Email: "user2@example.com", LinkedAt: time.Now(), Profile: "{}"},
+			},
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -85,12 +94,35 @@ func TestStartTwoFaSetup(t *testing.T) {
 		}
 	})
 
+	t.Run("google oauth user with a password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+
+		passwordHash := "hash"
+		user := db.User{
+			Username:     "user2",
+			Email:        "user2@example.com",
+			PasswordHash: &passwordHash,
+			Identities: []db.UserIdentity{
+				{Provider: "google", Subject: "gid-1", Email: "user2@example.com", LinkedAt: time.Now(), Profile: "{}"},
+			},
+		}
+		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
+			t.Fatalf("failed to create user, err: %v", err)
+		}
+
+		if _, err := userService.StartTwoFaSetup(context.Background(), user.ID); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
 	t.Run("success", func(t *testing.T) {
 		userService, myDB := testutil.NewTestUserService(t)
 
+		passwordHash := "hash"
 		user := db.User{
-			Username: "user3",
-			Email:    "user3@example.com",
+			Username:     "user3",
+			Email:        "user3@example.com",
+			PasswordHash: &passwordHash,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -108,12 +140,121 @@ func TestStartTwoFaSetup(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to query user, err: %v", err)
 		}
-		if modelUser.TwoFAToken == nil || *modelUser.TwoFAToken != "pre-"+resp.TwoFASecret {
-			t.Fatalf("expected two_fa_token to be prefixed")
+		if modelUser.TotpSecret != nil {
+			t.Fatalf("expected the secret to be stored only once confirmed")
+		}
+
+		data, ok := strings.CutPrefix(resp.TwoFaQrCode, "data:image/png;base64,")
+		if !ok {
+			t.Fatalf("expected a PNG data URI, got %.40q", resp.TwoFaQrCode)
+		}
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatalf("failed to decode QR code, err: %v", err)
+		}
+		img, err := png.Decode(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("failed to decode PNG, err: %v", err)
+		}
+		if img.Bounds().Dx() != service.TwoFaQrCodeSize {
+			t.Fatalf("expected a %d pixel QR code, got %d", service.TwoFaQrCodeSize, img.Bounds().Dx())
+		}
+	})
+
+	t.Run("configured parameters", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		userService.Dep.Cfg.TwoFaIssuer = "Acme Pong"
+		userService.Dep.Cfg.TwoFaDigits = 8
+		userService.Dep.Cfg.TwoFaPeriod = 60
+		userService.Dep.Cfg.TwoFaAlgorithm = "SHA256"
+		user := createPasswordUser(t, myDB)
+
+		resp, err := userService.StartTwoFaSetup(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		uri, err := url.Parse(resp.TwoFaUri)
+		if err != nil {
+			t.Fatalf("failed to parse uri, err: %v", err)
+		}
+		q := uri.Query()
+		if q.Get("issuer") != "Acme Pong" || q.Get("digits") != "8" || q.Get("period") != "60" || q.Get("algorithm") != "SHA256" {
+			t.Fatalf("unexpected uri %s", resp.TwoFaUri)
+		}
+
+		code, err := totp.GenerateCodeCustom(resp.TwoFASecret, time.Now(), totp.ValidateOpts{
+			Period:    60,
+			Digits:    otp.DigitsEight,
+			Algorithm: otp.AlgorithmSHA256,
+		})
+		if err != nil {
+			t.Fatalf("failed to generate code, err: %v", err)
+		}
+		if _, err := userService.ConfirmTwoFaSetup(context.Background(), user.ID, &dto.TwoFAConfirmRequest{
+			TwoFACode:  code,
+			SetupToken: resp.SetupToken,
+		}); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		modelUser, err := gorm.G[db.User](myDB).Where("id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query user, err: %v", err)
+		}
+		if modelUser.TotpDigits != 8 || modelUser.TotpPeriod != 60 || modelUser.TotpAlgorithm != "SHA256" {
+			t.Fatalf("expected the parameters to be stored, got %d %d %q", modelUser.TotpDigits, modelUser.TotpPeriod, modelUser.TotpAlgorithm)
+		}
+
+		// A later config change does not break the authenticator that is already set up.
+		userService.Dep.Cfg.TwoFaDigits = 6
+		userService.Dep.Cfg.TwoFaPeriod = 30
+		userService.Dep.Cfg.TwoFaAlgorithm = "SHA1"
+		code, err = totp.GenerateCodeCustom(resp.TwoFASecret, time.Now().Add(60*time.Second), totp.ValidateOpts{
+			Period:    60,
+			Digits:    otp.DigitsEight,
+			Algorithm: otp.AlgorithmSHA256,
+		})
+		if err != nil {
+			t.Fatalf("failed to generate code, err: %v", err)
+		}
+		sessionToken, err := jwt.SignTwoFAToken(userService.Dep, user.ID)
+		if err != nil {
+			t.Fatalf("failed to sign session token, err: %v", err)
+		}
+		if _, err := userService.SubmitTwoFAChallenge(context.Background(), &dto.TwoFAChallengeRequest{
+			TwoFACode:    code,
+			SessionToken: sessionToken,
+		}); err != nil {
+			t.Fatalf("expected the stored parameters to be used, err: %v", err)
 		}
 	})
 }
 
+func TestTotpConfig(t *testing.T) {
+	testCases := []struct {
+		name   string
+		update func(cfg *config.Config)
+	}{
+		{name: "algorithm", update: func(cfg *config.Config) { cfg.TwoFaAlgorithm = "MD5" }},
+		{name: "digits", update: func(cfg *config.Config) { cfg.TwoFaDigits = 7 }},
+		{name: "period", update: func(cfg *config.Config) { cfg.TwoFaPeriod = 0 }},
+		{name: "skew", update: func(cfg *config.Config) { cfg.TwoFaSkew = -1 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testutil.NewTestConfig()
+			tc.update(cfg)
+
+			_, myDB := testutil.NewTestUserService(t)
+			if _, err := service.NewUserService(testutil.NewTestDependency(cfg, myDB, nil, nil)); err == nil {
+				t.Fatalf("expected an invalid config to be refused")
+			}
+		})
+	}
+}
+
 func TestConfirmTwoFaSetup(t *testing.T) {
 	t.Run("invalid setup token", func(t *testing.T) {
 		userService, _ := testutil.NewTestUserService(t)
@@ -158,7 +299,7 @@ func TestConfirmTwoFaSetup(t *testing.T) {
 		}
 	})
 
-	t.Run("setup not initiated", func(t *testing.T) {
+	t.Run("user without password", func(t *testing.T) {
 		userService, myDB := testutil.NewTestUserService(t)
 
 		user := db.User{
@@ -194,11 +335,11 @@ func TestConfirmTwoFaSetup(t *testing.T) {
 		userService, myDB := testutil.NewTestUserService(t)
 
 		secret := "JBSWY3DPEHPK3PXP"
-		preSecret := "pre-" + secret
+		passwordHash := "hash"
 		user := db.User{
-			Username:   "user2",
-			Email:      "user2@example.com",
-			TwoFAToken: &preSecret,
+			Username:     "user2",
+			Email:        "user2@example.com",
+			PasswordHash: &passwordHash,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -235,11 +376,11 @@ func TestConfirmTwoFaSetup(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to generate secret, err: %v", err)
 		}
-		preSecret := "pre-" + secret.Secret()
+		passwordHash := "hash"
 		user := db.User{
-			Username:   "user3",
-			Email:      "user3@example.com",
-			TwoFAToken: &preSecret,
+			Username:     "user3",
+			Email:        "user3@example.com",
+			PasswordHash: &passwordHash,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -269,8 +410,8 @@ func TestConfirmTwoFaSetup(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to query user, err: %v", err)
 		}
-		if modelUser.TwoFAToken == nil || *modelUser.TwoFAToken != secret.Secret() {
-			t.Fatalf("expected two_fa_token to be enabled")
+		if modelUser.TotpSecret == nil || *modelUser.TotpSecret != secret.Secret() {
+			t.Fatalf("expected totp_secret to be set")
 		}
 	})
 }
@@ -283,7 +424,7 @@ func TestDisableTwoFA(t *testing.T) {
 		user := db.User{
 			Username:   "user1",
 			Email:      "user1@example.com",
-			TwoFAToken: &secret,
+			TotpSecret: &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -349,7 +490,7 @@ func TestDisableTwoFA(t *testing.T) {
 			Username:     "user3",
 			Email:        "user3@example.com",
 			PasswordHash: &passwordHash,
-			TwoFAToken:   &secret,
+			TotpSecret:   &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -383,7 +524,7 @@ func TestDisableTwoFA(t *testing.T) {
 			Username:     "user4",
 			Email:        "user4@example.com",
 			PasswordHash: &passwordHash,
-			TwoFAToken:   &secret,
+			TotpSecret:   &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -403,8 +544,8 @@ func TestDisableTwoFA(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to query user, err: %v", err)
 		}
-		if modelUser.TwoFAToken != nil {
-			t.Fatalf("expected two_fa_token to be cleared")
+		if modelUser.TotpSecret != nil {
+			t.Fatalf("expected totp_secret to be cleared")
 		}
 	})
 }
@@ -468,7 +609,7 @@ func TestSubmitTwoFAChallenge(t *testing.T) {
 		user := db.User{
 			Username:   "user2",
 			Email:      "user2@example.com",
-			TwoFAToken: &secret,
+			TotpSecret: &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -509,7 +650,7 @@ func TestSubmitTwoFAChallenge(t *testing.T) {
 		user := db.User{
 			Username:   "user3",
 			Email:      "user3@example.com",
-			TwoFAToken: &secretStr,
+			TotpSecret: &secretStr,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -5,23 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"strings"
-	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	model "github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
 	"github.com/redis/go-redis/v9"
 )
 
-const TwoFAPrePrefix = "pre-"
+const TwoFAMethodTotp = "totp"
+const TwoFAMethodEmail = "email"
 const BcryptSaltRounds = 10
 const MaxAvatarSize = 1 * 1024 * 1024 // 1 MB
 const BaseGoogleOAuthURL = "https://accounts.google.com/o/oauth2/v2/auth"
+const GoogleProvider = "google"
 
 type UserService struct {
 	Dep *dependency.Dependency
@@ -37,6 +40,16 @@ func NewUserService(dep *dependency.Dependency) (*UserService, error) {
 		return nil, fmt.Errorf("UserService: redis is enabled but redis client is nil")
 	}
 
+	switch dep.Cfg.EmailVerificationPolicy {
+	case config.EmailVerificationPolicyNone, config.EmailVerificationPolicyActions, config.EmailVerificationPolicyLogin:
+	default:
+		return nil, fmt.Errorf("UserService: unknown email verification policy %q", dep.Cfg.EmailVerificationPolicy)
+	}
+
+	if _, err := totpOptions(dep.Cfg); err != nil {
+		return nil, fmt.Errorf("UserService: %w", err)
+	}
+
 	return &UserService{
 		Dep: dep,
 	}, nil
@@ -47,21 +60,20 @@ func (s *UserService) GetDependency() *dependency.Dependency {
 }
 
 func (s *UserService) CreateUser(ctx context.Context, request *dto.CreateUserRequest) (*dto.UserWithoutTokenResponse, error) {
+	if err := s.checkPasswordPolicy("password", request.Password.Password, request.Username, request.Email); err != nil {
+		return nil, err
+	}
 
-	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(request.Password.Password), BcryptSaltRounds)
+	passwordHash, err := s.Dep.Passwords.Hash(request.Password.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	passwordHash := string(passwordBytes)
-
 	modelUser := model.User{
-		Username:      request.Username,
-		Email:         request.Email,
-		PasswordHash:  &passwordHash,
-		Avatar:        request.Avatar,
-		GoogleOauthID: nil,
-		TwoFAToken:    nil,
+		Username:     request.Username,
+		Email:        request.Email,
+		PasswordHash: &passwordHash,
+		Avatar:       request.Avatar,
 	}
 
 	err = gorm.G[model.User](s.Dep.DB).Create(ctx, &modelUser)
@@ -72,6 +84,11 @@ func (s *UserService) CreateUser(ctx context.Context, request *dto.CreateUserReq
 		return nil, err
 	}
 
+	// The account exists either way, the user can ask for a new link.
+	if err := s.sendVerificationEmail(ctx, &modelUser); err != nil {
+		s.Dep.Logger.Warn("failed to send verification email", "userID", modelUser.ID, "err", err.Error())
+	}
+
 	return userToUserWithoutTokenResponse(&modelUser), nil
 }
 
@@ -80,7 +97,69 @@ type LoginResult struct {
 	TwoFAPending *dto.TwoFAPendingUserResponse
 }
 
+// upgradePasswordHash rehashes the password just checked when its hash is outdated.
+// A failure only delays the upgrade to the next login, so it does not fail the login.
+func (s *UserService) upgradePasswordHash(ctx context.Context, modelUser *model.User, plainPassword string) {
+	if !s.Dep.Passwords.NeedsRehash(*modelUser.PasswordHash) {
+		return
+	}
+
+	passwordHash, err := s.Dep.Passwords.Hash(plainPassword)
+	if err == nil {
+		_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", modelUser.ID).Update(ctx, "password_hash", passwordHash)
+	}
+	if err != nil {
+		s.Dep.Logger.Warn("failed to upgrade password hash", "userID", modelUser.ID, "err", err.Error())
+		return
+	}
+	modelUser.PasswordHash = &passwordHash
+}
+
+// checkPasswordPolicy returns the validation error listing every rule of the password policy the new password breaks,
+// including being found in the breached passwords when the check is on.
+func (s *UserService) checkPasswordPolicy(field string, newPassword string, username string, email string) error {
+	violations := s.Dep.PasswordPolicy.Check(newPassword, username, email)
+	if s.Dep.BreachedPasswords != nil {
+		breached, err := s.Dep.BreachedPasswords.Contains(newPassword)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, password.Violation{
+				Rule:    password.RuleBreached,
+				Message: "password appears in a known data breach, choose another one",
+			})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	details := make([]authError.Violation, 0, len(violations))
+	for _, v := range violations {
+		details = append(details, authError.Violation{Field: field, Rule: v.Rule, Message: v.Message})
+	}
+	return authError.NewValidationError(authError.CodePasswordPolicy, details)
+}
+
+// verifyPassword checks the password against the stored hash. A hash made with a pepper that is no longer configured
+// cannot be checked, the user is told to reset the password instead of getting a server error.
+func (s *UserService) verifyPassword(hash string, plain string) error {
+	err := s.Dep.Passwords.Verify(hash, plain)
+	if errors.Is(err, password.ErrUnknownPepper) {
+		s.Dep.Logger.Warn("password hash uses an unknown pepper, add it to PASSWORD_PREVIOUS_PEPPERS", "err", err)
+		return authError.NewAuthErrorWithCode(401, authError.CodePasswordResetRequired, "password must be reset")
+	}
+
+	return err
+}
+
 func (s *UserService) LoginUser(ctx context.Context, request *dto.LoginUserRequest) (*LoginResult, error) {
+	// Checked before the user lookup, so a lockout looks the same for existing and unknown accounts.
+	counters := s.loginAttemptCounters(ctx, "identifier", request.Identifier.Identifier)
+	if err := s.checkAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
 
 	var identifierField string
 	if strings.Contains(request.Identifier.Identifier, "@") {
@@ -89,49 +168,93 @@ func (s *UserService) LoginUser(ctx context.Context, request *dto.LoginUserReque
 		identifierField = "username"
 	}
 
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where(identifierField+" = ?", request.Identifier.Identifier).First(ctx)
+	// Accounts pending deletion can still log in, which restores them.
+	var modelUser model.User
+	err := s.Dep.DB.WithContext(ctx).Unscoped().Preload("Identities").
+		Where(identifierField+" = ? AND (deleted_at IS NULL OR deleted_at > ?)", request.Identifier.Identifier, s.deletionCutoff()).
+		First(&modelUser).Error
 	if err != nil || modelUser.PasswordHash == nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) || modelUser.PasswordHash == nil {
-			return nil, authError.NewAuthError(401, "invalid credentials")
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(401, "invalid credentials"))
 		}
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(*modelUser.PasswordHash), []byte(request.Password.Password))
+	err = s.verifyPassword(*modelUser.PasswordHash, request.Password.Password)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return nil, authError.NewAuthError(401, "invalid credentials")
+		if errors.Is(err, password.ErrMismatchedPassword) {
+			return nil, s.failAttempt(ctx, counters, authError.NewAuthError(401, "invalid credentials"))
 		}
 		return nil, err
 	}
 
-	isTwoFAEnabled := isTwoFAEnabled(modelUser.TwoFAToken)
-	if isTwoFAEnabled {
+	if err := s.resetAttemptCounters(ctx, counters); err != nil {
+		return nil, err
+	}
+
+	s.upgradePasswordHash(ctx, &modelUser, request.Password.Password)
+
+	if s.Dep.Cfg.EmailVerificationPolicy == config.EmailVerificationPolicyLogin && modelUser.EmailVerifiedAt == nil {
+		return nil, authError.NewAuthError(403, "email not verified")
+	}
+
+	return s.completeLogin(ctx, &modelUser, request.TrustedDeviceToken)
+}
+
+// completeLogin logs in a user who has proven their password: asks for the 2FA code when enabled, issues tokens otherwise.
+// A device the user trusts with trustedDeviceToken skips the 2FA code. An account pending deletion is only restored
+// once the tokens are issued, here or after the 2FA step.
+func (s *UserService) completeLogin(ctx context.Context, modelUser *model.User, trustedDeviceToken string) (*LoginResult, error) {
+	methods := twoFAMethods(modelUser)
+	needsTwoFA := len(methods) > 0
+	if needsTwoFA {
+		trusted, err := s.isTrustedDevice(ctx, modelUser.ID, trustedDeviceToken)
+		if err != nil {
+			return nil, err
+		}
+		needsTwoFA = !trusted
+	}
+
+	if needsTwoFA {
 		sessionToken, err := jwt.SignTwoFAToken(s.Dep, modelUser.ID)
 		if err != nil {
 			return nil, err
 		}
 
+		// The code is emailed right away when there is no authenticator to ask for it first.
+		method := methods[0]
+		if method == TwoFAMethodEmail {
+			if err := s.sendEmailOtp(ctx, modelUser, sessionToken); err != nil {
+				return nil, err
+			}
+		}
+
 		return &LoginResult{
 			TwoFAPending: &dto.TwoFAPendingUserResponse{
 				Message:      "2FA_REQUIRED",
 				SessionToken: sessionToken,
+				Method:       method,
+				Methods:      methods,
 			},
 		}, nil
 	}
 
-	userToken, err := s.issueNewTokenForUser(ctx, modelUser.ID, false)
+	if err := s.restoreOnLogin(ctx, modelUser); err != nil {
+		return nil, err
+	}
+
+	userTokens, err := s.issueNewTokenForUser(ctx, modelUser.ID, false)
 	if err != nil {
 		return nil, err
 	}
 
 	return &LoginResult{
-		User: userToUserWithTokenResponse(&modelUser, userToken),
+		User: userToUserWithTokenResponse(modelUser, userTokens),
 	}, nil
 }
 
 func (s *UserService) GetUserByID(ctx context.Context, userID uint) (*dto.UserWithoutTokenResponse, error) {
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -143,7 +266,7 @@ func (s *UserService) GetUserByID(ctx context.Context, userID uint) (*dto.UserWi
 }
 
 func (s *UserService) UpdateUserPassword(ctx context.Context, userID uint, request *dto.UpdateUserPasswordRequest) (*dto.UserWithTokenResponse, error) {
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -152,37 +275,92 @@ func (s *UserService) UpdateUserPassword(ctx context.Context, userID uint, reque
 	}
 
 	if modelUser.PasswordHash == nil {
-		return nil, authError.NewAuthError(400, "password cannot be changed for OAuth users")
+		return nil, authError.NewAuthError(400, "no password set, set one with a recent OAuth login instead")
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(*modelUser.PasswordHash), []byte(request.OldPassword.OldPassword))
+	err = s.verifyPassword(*modelUser.PasswordHash, request.OldPassword.OldPassword)
 	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		if errors.Is(err, password.ErrMismatchedPassword) {
 			return nil, authError.NewAuthError(401, "invalid credentials")
 		}
 		return nil, err
 	}
 
-	newPasswordBytes, err := bcrypt.GenerateFromPassword([]byte(request.NewPassword.NewPassword), BcryptSaltRounds)
+	if err := s.checkPasswordPolicy("newPassword", request.NewPassword.NewPassword, modelUser.Username, modelUser.Email); err != nil {
+		return nil, err
+	}
+
+	newPasswordHash, err := s.Dep.Passwords.Hash(request.NewPassword.NewPassword)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "password_hash", string(newPasswordBytes))
+	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "password_hash", newPasswordHash)
 	if err != nil {
 		return nil, err
 	}
 
-	userToken, err := s.issueNewTokenForUser(ctx, userID, true)
+	if err := s.ForgetTrustedDevices(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return userToUserWithTokenResponse(&modelUser, userToken), nil
+	return userToUserWithTokenResponse(&modelUser, userTokens), nil
 }
 
-func (s *UserService) UpdateUserProfile(ctx context.Context, userID uint, request *dto.UpdateUserRequest) (*dto.UserWithoutTokenResponse, error) {
-	modelUser, err := gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).First(ctx)
+// SetUserPassword gives a password to a user who only logs in with OAuth, so they can also log in with it and enable 2FA.
+// The old password is replaced by a recent re-authentication of the session with a linked provider.
+func (s *UserService) SetUserPassword(ctx context.Context, userID uint, token string, request *dto.SetUserPasswordRequest) (*dto.UserWithTokenResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, authError.NewAuthError(404, "user not found")
+		}
+		return nil, err
+	}
+
+	if modelUser.PasswordHash != nil {
+		return nil, authError.NewAuthError(400, "password already set, change it with the old password instead")
+	}
+
+	if err := s.requireRecentAuth(ctx, userID, token); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkPasswordPolicy("newPassword", request.NewPassword.NewPassword, modelUser.Username, modelUser.Email); err != nil {
+		return nil, err
+	}
+
+	passwordHash, err := s.Dep.Passwords.Hash(request.NewPassword.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Update(ctx, "password_hash", passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	modelUser.PasswordHash = &passwordHash
+
+	if err := s.ForgetTrustedDevices(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	userTokens, err := s.issueNewTokenForUser(ctx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return userToUserWithTokenResponse(&modelUser, userTokens), nil
+}
+
+// UpdateUserProfile updates the username, avatar and email, changing the email needs a recent re-authentication of the session.
+func (s *UserService) UpdateUserProfile(ctx context.Context, userID uint, token string, request *dto.UpdateUserRequest) (*dto.UserWithoutTokenResponse, error) {
+	modelUser, err := gorm.G[model.User](s.Dep.DB).Preload("Identities", nil).Where("id = ?", userID).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, authError.NewAuthError(404, "user not found")
@@ -196,9 +374,24 @@ func (s *UserService) UpdateUserProfile(ctx context.Context, userID uint, reques
 	} else {
 		modelUser.Avatar = request.Avatar
 	}
-	modelUser.Email = request.Email
+	emailChanged := modelUser.Email != request.Email
+	if emailChanged {
+		if err := s.requireRecentAuth(ctx, userID, token); err != nil {
+			return nil, err
+		}
+		// Emailed codes would go to an address nobody has verified yet. With an authenticator
+		// to fall back on they are turned off, otherwise the change would take away the second factor.
+		if modelUser.EmailOtpEnabled {
+			if modelUser.TotpSecret == nil {
+				return nil, authError.NewAuthError(400, "turn off email 2FA or add an authenticator before changing your email")
+			}
+			modelUser.EmailOtpEnabled = false
+		}
+		modelUser.Email = request.Email
+		modelUser.EmailVerifiedAt = nil
+	}
 
-	err = s.Dep.DB.WithContext(ctx).Save(&modelUser).Error
+	err = s.Dep.DB.WithContext(ctx).Omit(clause.Associations).Save(&modelUser).Error
 
 	if err != nil {
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
@@ -207,27 +400,44 @@ func (s *UserService) UpdateUserProfile(ctx context.Context, userID uint, reques
 		return nil, err
 	}
 
+	if emailChanged {
+		if err := s.sendVerificationEmail(ctx, &modelUser); err != nil {
+			s.Dep.Logger.Warn("failed to send verification email", "userID", modelUser.ID, "err", err.Error())
+		}
+	}
+
 	return userToUserWithoutTokenResponse(&modelUser), nil
 }
 
+// DeleteUser marks the account as pending deletion and logs it out everywhere. Logging in within
+// ACCOUNT_DELETION_GRACE_PERIOD_IN_SECONDS restores it, PurgeDeletedUsers deletes it for good afterwards.
 func (s *UserService) DeleteUser(ctx context.Context, userID uint) error {
+	var err error
 	if s.Dep.Cfg.IsRedisEnabled {
-		err := logoutUserByRedis(ctx, s.Dep.Redis, userID)
-		if err != nil {
-			return err
-		}
+		err = logoutUserByRedis(ctx, s.Dep.Redis, userID)
+	} else {
+		err = logoutUserByDB(ctx, s.Dep.DB, userID)
+	}
+	if err != nil {
+		return err
 	}
 
-	res := s.Dep.DB.WithContext(ctx).Unscoped().Delete(&model.User{}, userID)
-	if res.Error != nil {
-		return res.Error
+	err = s.ForgetTrustedDevices(ctx, userID)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	_, err = gorm.G[model.User](s.Dep.DB).Where("id = ?", userID).Delete(ctx)
+	return err
 }
 
 func logoutUserByDB(ctx context.Context, db *gorm.DB, userID uint) error {
-	_, err := gorm.G[model.Token](db.Unscoped()).Where("user_id = ?", userID).Delete(ctx)
+	_, err := gorm.G[model.RefreshToken](db.Unscoped()).Where("user_id = ?", userID).Delete(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = gorm.G[model.Token](db.Unscoped()).Where("user_id = ?", userID).Delete(ctx)
 	if err != nil {
 		return err
 	}
@@ -235,58 +445,101 @@ func logoutUserByDB(ctx context.Context, db *gorm.DB, userID uint) error {
 	return nil
 }
 
-func logoutUserByRedis(ctx context.Context, redis *redis.Client, userID uint) error {
-
-	iter := redis.Scan(ctx, 0, buildTokenKey(userID, "*"), 100).Iterator()
+// A rough way to delete all keys matching the pattern
+func deleteRedisKeysByPattern(ctx context.Context, redis *redis.Client, pattern string) error {
+	iter := redis.Scan(ctx, 0, pattern, 100).Iterator()
 	for iter.Next(ctx) {
 		err := redis.Del(ctx, iter.Val()).Err()
 		if err != nil {
 			return err
 		}
 	}
-	if err := iter.Err(); err != nil {
-		return err
+
+	return iter.Err()
+}
+
+func logoutUserByRedis(ctx context.Context, redis *redis.Client, userID uint) error {
+	// Refresh tokens are bound to a token family, so they die with it.
+	for _, pattern := range []string{buildTokenKey(userID, "*"), buildTokenFamilyKey(userID, "*")} {
+		err := deleteRedisKeysByPattern(ctx, redis, pattern)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s *UserService) LogoutUser(ctx context.Context, userID uint) error {
+// LogoutUser ends the session the token belongs to, other sessions of the user stay alive.
+func (s *UserService) LogoutUser(ctx context.Context, userID uint, token string) error {
 	if s.Dep.Cfg.IsRedisEnabled {
-		return logoutUserByRedis(ctx, s.Dep.Redis, userID)
+		familyID, err := s.Dep.Redis.Get(ctx, buildTokenKey(userID, token)).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			return err
+		}
+		return revokeTokenFamilyByRedis(ctx, s.Dep.Redis, userID, familyID)
 	} else {
-		return logoutUserByDB(ctx, s.Dep.DB, userID)
+		modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("token = ? AND user_id = ?", token, userID).First(ctx)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		return revokeTokenFamilyByDB(ctx, s.Dep.DB, modelToken.ID)
 	}
 }
 
-func (s *UserService) validateUserTokenDB(ctx context.Context, token string, userId uint) error {
+func (s *UserService) findUserTokenByDB(ctx context.Context, token string, userId uint) (*model.Token, error) {
 	modelToken, err := gorm.G[model.Token](s.Dep.DB).Where("token = ?", token).First(ctx)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return authError.NewAuthError(401, "invalid token")
+			return nil, authError.NewAuthError(401, "invalid token")
 		}
-		return err
+		return nil, err
 	}
 
 	if modelToken.UserID != userId {
-		return authError.NewAuthError(401, "token does not match user")
+		return nil, authError.NewAuthError(401, "token does not match user")
 	}
 
+	return &modelToken, nil
+}
+
+// findUserTokenByRedis returns the token family of the session.
+func (s *UserService) findUserTokenByRedis(ctx context.Context, token string, userId uint) (string, error) {
+	familyID, err := s.Dep.Redis.Get(ctx, buildTokenKey(userId, token)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", authError.NewAuthError(401, "invalid token")
+		}
+		return "", err
+	}
+
+	return familyID, nil
+}
+
+func (s *UserService) validateUserTokenDB(ctx context.Context, token string, userId uint) error {
+	modelToken, err := s.findUserTokenByDB(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+
+	s.touchSessionByDB(modelToken)
 	s.updateHeartBeat(userId)
 	return nil
 }
 
 func (s *UserService) validateUserTokenRedis(ctx context.Context, token string, userId uint) error {
-	_, err := s.Dep.Redis.Get(ctx, buildTokenKey(userId, token)).Result()
+	familyID, err := s.findUserTokenByRedis(ctx, token, userId)
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return authError.NewAuthError(401, "invalid token")
-		}
 		return err
 	}
 
-	// A rough way to implement sliding expiration
-	s.Dep.Redis.Expire(ctx, buildTokenKey(userId, token), time.Duration(s.Dep.Cfg.UserTokenExpiry)*time.Second)
+	s.touchSessionByRedis(userId, familyID)
 
 	s.updateHeartBeat(userId)
 	return nil
@@ -299,3 +552,14 @@ func (s *UserService) ValidateUserToken(ctx context.Context, token string, userI
 		return s.validateUserTokenDB(ctx, token, userId)
 	}
 }
+
+// checkUserToken is ValidateUserToken without marking the user online or the session used, for lookups on behalf of others.
+func (s *UserService) checkUserToken(ctx context.Context, token string, userId uint) error {
+	var err error
+	if s.Dep.Cfg.IsRedisEnabled {
+		_, err = s.findUserTokenByRedis(ctx, token, userId)
+	} else {
+		_, err = s.findUserTokenByDB(ctx, token, userId)
+	}
+	return err
+}
@@ -2,12 +2,16 @@ package service_test
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"strings"
 	"testing"
 
 	authError "github.com/paularynty/transcendence/auth-service-go/internal/auth_error"
 	"github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
 	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -244,7 +248,7 @@ func TestLoginUser(t *testing.T) {
 			Username:     "alice",
 			Email:        "alice@example.com",
 			PasswordHash: &passwordHash,
-			TwoFAToken:   &secret,
+			TotpSecret:   &secret,
 		}
 		if err := gorm.G[db.User](myDB).Create(context.Background(), &user); err != nil {
 			t.Fatalf("failed to create user, err: %v", err)
@@ -261,6 +265,93 @@ func TestLoginUser(t *testing.T) {
 			t.Fatalf("expected 2FA pending session token")
 		}
 	})
+
+	t.Run("upgrades bcrypt hash", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		_, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "alice"},
+			Password:   dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		modelUser, err := gorm.G[db.User](myDB).Where("id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query user, err: %v", err)
+		}
+		if !strings.HasPrefix(*modelUser.PasswordHash, "$argon2id$") {
+			t.Fatalf("expected an argon2id hash, got %q", *modelUser.PasswordHash)
+		}
+		if userService.Dep.Passwords.NeedsRehash(*modelUser.PasswordHash) {
+			t.Fatalf("expected a current hash")
+		}
+
+		// The new hash still logs in.
+		_, err = userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+			Identifier: dto.Identifier{Identifier: "alice"},
+			Password:   dto.Password{Password: "Password.777"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("rotated pepper", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+		cfg := userService.Dep.Cfg
+
+		usePeppers := func(pepper string, previous ...string) {
+			t.Helper()
+			cfg.PasswordPepper = pepper
+			cfg.PasswordPreviousPeppers = previous
+			hasher, err := password.New(cfg)
+			if err != nil {
+				t.Fatalf("unexpected error, err: %v", err)
+			}
+			userService.Dep.Passwords = hasher
+		}
+		login := func() error {
+			_, err := userService.LoginUser(context.Background(), &dto.LoginUserRequest{
+				Identifier: dto.Identifier{Identifier: "alice"},
+				Password:   dto.Password{Password: "Password.777"},
+			})
+			return err
+		}
+
+		usePeppers("pepper-1")
+		if err := login(); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+
+		// A dropped pepper asks for a password reset instead of failing with a server error.
+		usePeppers("pepper-2")
+		err := login()
+		var authErr *authError.AuthError
+		if !errors.As(err, &authErr) || authErr.Status != 401 || authErr.Code != authError.CodePasswordResetRequired {
+			t.Fatalf("expected 401 %s, got %v", authError.CodePasswordResetRequired, err)
+		}
+
+		// Kept as a previous pepper, the login works and moves the hash to the new one.
+		usePeppers("pepper-2", "pepper-1")
+		if err := login(); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		modelUser, err := gorm.G[db.User](myDB).Where("id = ?", user.ID).First(context.Background())
+		if err != nil {
+			t.Fatalf("failed to query user, err: %v", err)
+		}
+		usePeppers("pepper-2")
+		if userService.Dep.Passwords.NeedsRehash(*modelUser.PasswordHash) {
+			t.Fatalf("expected the hash to use the new pepper")
+		}
+		if err := login(); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
 }
 
 func TestGetUserByID(t *testing.T) {
@@ -416,7 +507,7 @@ func TestUpdateUserPassword(t *testing.T) {
 		if modelUser.PasswordHash == nil {
 			t.Fatalf("expected password hash to be set")
 		}
-		if bcrypt.CompareHashAndPassword([]byte(*modelUser.PasswordHash), []byte("Password.888")) != nil {
+		if userService.Dep.Passwords.Verify(*modelUser.PasswordHash, "Password.888") != nil {
 			t.Fatalf("expected password hash to match new password")
 		}
 	})
@@ -426,7 +517,7 @@ func TestUpdateUserProfile(t *testing.T) {
 	t.Run("user not found", func(t *testing.T) {
 		userService, _ := testutil.NewTestUserService(t)
 
-		_, err := userService.UpdateUserProfile(context.Background(), 9999, &dto.UpdateUserRequest{
+		_, err := userService.UpdateUserProfile(context.Background(), 9999, "", &dto.UpdateUserRequest{
 			User: dto.User{
 				UserName: dto.UserName{Username: "user1"},
 				Email:    "user1@example.com",
@@ -456,7 +547,7 @@ func TestUpdateUserProfile(t *testing.T) {
 			t.Fatalf("failed to create user2, err: %v", err)
 		}
 
-		_, err := userService.UpdateUserProfile(context.Background(), user2.ID, &dto.UpdateUserRequest{
+		_, err := userService.UpdateUserProfile(context.Background(), user2.ID, "", &dto.UpdateUserRequest{
 			User: dto.User{
 				UserName: dto.UserName{Username: "user1"},
 				Email:    "user2@example.com",
@@ -486,7 +577,7 @@ func TestUpdateUserProfile(t *testing.T) {
 			t.Fatalf("failed to create user2, err: %v", err)
 		}
 
-		_, err := userService.UpdateUserProfile(context.Background(), user2.ID, &dto.UpdateUserRequest{
+		_, err := userService.UpdateUserProfile(context.Background(), user2.ID, recentSession(t, myDB, user2.ID), &dto.UpdateUserRequest{
 			User: dto.User{
 				UserName: dto.UserName{Username: "user2"},
 				Email:    "user1@example.com",
@@ -514,7 +605,7 @@ func TestUpdateUserProfile(t *testing.T) {
 		}
 
 		blank := "   "
-		_, err := userService.UpdateUserProfile(context.Background(), user.ID, &dto.UpdateUserRequest{
+		_, err := userService.UpdateUserProfile(context.Background(), user.ID, "", &dto.UpdateUserRequest{
 			User: dto.User{
 				UserName: dto.UserName{Username: "user1"},
 				Email:    "user1@example.com",
@@ -543,7 +634,7 @@ func TestUpdateUserProfile(t *testing.T) {
 		}
 
 		newAvatar := "https://example.com/new.png"
-		_, err := userService.UpdateUserProfile(context.Background(), user.ID, &dto.UpdateUserRequest{
+		_, err := userService.UpdateUserProfile(context.Background(), user.ID, recentSession(t, myDB, user.ID), &dto.UpdateUserRequest{
 			User: dto.User{
 				UserName: dto.UserName{Username: "user1-updated"},
 				Email:    "user1-updated@example.com",
@@ -611,8 +702,15 @@ func TestLogoutUser(t *testing.T) {
 		if err := gorm.G[db.Token](myDB).Create(context.Background(), &token); err != nil {
 			t.Fatalf("failed to create token, err: %v", err)
 		}
+		otherToken := db.Token{
+			UserID: user.ID,
+			Token:  "token-2",
+		}
+		if err := gorm.G[db.Token](myDB).Create(context.Background(), &otherToken); err != nil {
+			t.Fatalf("failed to create token, err: %v", err)
+		}
 
-		if err := userService.LogoutUser(context.Background(), user.ID); err != nil {
+		if err := userService.LogoutUser(context.Background(), user.ID, "token-1"); err != nil {
 			t.Fatalf("unexpected error, err: %v", err)
 		}
 
@@ -620,6 +718,11 @@ func TestLogoutUser(t *testing.T) {
 		if !errors.Is(err, gorm.ErrRecordNotFound) {
 			t.Fatalf("expected token to be deleted")
 		}
+
+		_, err = gorm.G[db.Token](myDB).Where("token = ?", "token-2").First(context.Background())
+		if err != nil {
+			t.Fatalf("expected other session to survive logout, err: %v", err)
+		}
 	})
 
 	t.Run("no tokens", func(t *testing.T) {
@@ -630,7 +733,7 @@ func TestLogoutUser(t *testing.T) {
 			t.Fatalf("failed to create user, err: %v", err)
 		}
 
-		if err := userService.LogoutUser(context.Background(), user.ID); err != nil {
+		if err := userService.LogoutUser(context.Background(), user.ID, "token-1"); err != nil {
 			t.Fatalf("unexpected error, err: %v", err)
 		}
 	})
@@ -713,3 +816,108 @@ func TestValidateUserToken(t *testing.T) {
 		}
 	})
 }
+
+// expectViolations checks the error is the password policy error, with these rules broken on field.
+func expectViolations(t *testing.T, err error, field string, rules ...string) {
+	t.Helper()
+
+	expectAuthErrorStatus(t, err, 400)
+	var authErr *authError.AuthError
+	errors.As(err, &authErr)
+	if authErr.Code != authError.CodePasswordPolicy {
+		t.Fatalf("expected code %s, got %q", authError.CodePasswordPolicy, authErr.Code)
+	}
+	if len(authErr.Violations) != len(rules) {
+		t.Fatalf("expected rules %v, got %+v", rules, authErr.Violations)
+	}
+	for i, v := range authErr.Violations {
+		if v.Field != field || v.Rule != rules[i] {
+			t.Fatalf("expected rules %v on %s, got %+v", rules, field, authErr.Violations)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Run("register", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+
+		_, err := userService.CreateUser(context.Background(), &dto.CreateUserRequest{
+			User: dto.User{
+				UserName: dto.UserName{Username: "alice"},
+				Email:    "alice@example.com",
+			},
+			Password: dto.Password{Password: "alice12"},
+		})
+		expectViolations(t, err, "password", password.RuleMinLength, password.RuleContainsUsername, password.RuleContainsEmail)
+
+		count, err := gorm.G[db.User](myDB).Count(context.Background(), "id")
+		if err != nil || count != 0 {
+			t.Fatalf("expected no user created, got %d, err: %v", count, err)
+		}
+	})
+
+	t.Run("change password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		_, err := userService.UpdateUserPassword(context.Background(), user.ID, &dto.UpdateUserPasswordRequest{
+			OldPassword: dto.OldPassword{OldPassword: "Password.777"},
+			NewPassword: dto.NewPassword{NewPassword: "qwerty123"},
+		})
+		expectViolations(t, err, "newPassword", password.RuleCommon)
+	})
+
+	t.Run("breached password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		user := createPasswordUser(t, myDB)
+
+		filter, err := password.NewBloomFilter(1, 0.001)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		sum := sha1.Sum([]byte("Password.888"))
+		if err := filter.AddHash(hex.EncodeToString(sum[:])); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		userService.Dep.BreachedPasswords = filter
+
+		request := &dto.UpdateUserPasswordRequest{
+			OldPassword: dto.OldPassword{OldPassword: "Password.777"},
+			NewPassword: dto.NewPassword{NewPassword: "Password.888"},
+		}
+		_, err = userService.UpdateUserPassword(context.Background(), user.ID, request)
+		expectViolations(t, err, "newPassword", password.RuleBreached)
+
+		// Off by default.
+		userService.Dep.BreachedPasswords = nil
+		if _, err := userService.UpdateUserPassword(context.Background(), user.ID, request); err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+
+	t.Run("reset password", func(t *testing.T) {
+		userService, myDB := testutil.NewTestUserService(t)
+		createPasswordUser(t, myDB)
+
+		err := userService.RequestPasswordReset(context.Background(), &dto.ForgotPasswordRequest{Email: "alice@example.com"})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		token := tokenFromMail(t, waitForMails(t, userService, 1)[0])
+
+		_, err = userService.ResetPassword(context.Background(), &dto.ResetPasswordRequest{
+			Token:       token,
+			NewPassword: dto.NewPassword{NewPassword: "short"},
+		})
+		expectViolations(t, err, "newPassword", password.RuleMinLength)
+
+		// A rejected password does not use up the link.
+		_, err = userService.ResetPassword(context.Background(), &dto.ResetPasswordRequest{
+			Token:       token,
+			NewPassword: dto.NewPassword{NewPassword: "correct horse battery staple"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+	})
+}
@@ -2,6 +2,8 @@ package testutil
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"log/slog"
@@ -12,7 +14,9 @@ import (
 	"github.com/paularynty/transcendence/auth-service-go/internal/config"
 	"github.com/paularynty/transcendence/auth-service-go/internal/db"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
+	"github.com/paularynty/transcendence/auth-service-go/internal/password"
 	"github.com/paularynty/transcendence/auth-service-go/internal/service"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwks"
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
@@ -28,21 +32,56 @@ func NewTestConfig() *config.Config {
 		GinMode:                         "test",
 		DbAddress:                       "file::memory:?cache=shared",
 		JwtSecret:                       "test-jwt-secret",
+		RecoveryCodeKey:                 "test-recovery-code-key",
 		UserTokenExpiry:                 5,
 		OauthStateTokenExpiry:           5,
 		GoogleClientId:                  "test-google-client-id",
 		GoogleClientSecret:              "test-google-client-secret",
 		GoogleRedirectUri:               "test-google-redirect-uri",
 		FrontendUrl:                     "http://localhost:5173",
-		TwoFaUrlPrefix:                  "otpauth://totp/Transcendence?secret=",
+		TwoFaIssuer:                     "Transcendence",
+		TwoFaDigits:                     6,
+		TwoFaPeriod:                     30,
+		TwoFaAlgorithm:                  "SHA1",
+		TwoFaSkew:                       1,
 		TwoFaTokenExpiry:                5,
+		TwoFaMaxAttempts:                3,
+		TwoFaEmailMaxSends:              3,
+		TwoFaEmailResendCooldown:        60,
+		TrustedDeviceExpiry:             60,
 		RedisURL:                        "",
 		IsRedisEnabled:                  false,
 		UserTokenAbsoluteExpiry:         2592000,
+		RefreshTokenExpiry:              60,
+		OidcIssuer:                      "http://localhost:3003",
+		OidcClients:                     []string{"test-client=http://localhost:4000/callback"},
+		OidcCodeExpiry:                  5,
+		LoginCodeExpiry:                 5,
+		ReauthMaxAge:                    60,
+		AccountDeletionGracePeriodInSec: 60,
+		AccountPurgeIntervalInSec:       60,
+		ServiceTokenExpiry:              5,
 		Port:                            3003,
 		RateLimiterDurationInSec:        5,
 		RateLimiterRequestLimit:         10,
 		RateLimiterCleanupIntervalInSec: 10,
+		LoginFreeAttempts:               3,
+		LoginMaxAttempts:                5,
+		LoginMaxAttemptsPerIP:           50,
+		LoginBackoffBaseInSec:           1,
+		LoginLockoutDurationInSec:       60,
+		PasswordHashAlgorithm:           "argon2id",
+		Argon2MemoryKiB:                 1024,
+		Argon2Iterations:                1,
+		Argon2Parallelism:               1,
+		BcryptCost:                      4,
+		PasswordMinLength:               8,
+		PasswordMaxLength:               128,
+		PasswordResetTokenExpiry:        60,
+		EmailVerificationTokenExpiry:    60,
+		EmailVerificationPolicy:         "none",
+		MailerDriver:                    "memory",
+		MailFrom:                        "test@localhost",
 	}
 }
 
@@ -61,7 +100,21 @@ func NewTestDependency(cfg *config.Config, db *gorm.DB, redis *redis.Client, log
 			cfg.RedisURL = "redis://test"
 		}
 	}
-	return dependency.NewDependency(cfg, db, redis, logger)
+	dep := dependency.NewDependency(cfg, db, redis, logger)
+	// The cheap argon2id parameters of the test config, the defaults would slow down every test.
+	if passwords, err := password.New(cfg); err == nil {
+		dep.Passwords = passwords
+	}
+	if policy, err := password.NewPolicy(cfg); err == nil {
+		dep.PasswordPolicy = policy
+	}
+	// OIDC needs an asymmetric key, like JWT_SIGNING_KEY_FILE in production.
+	if _, private, err := ed25519.GenerateKey(rand.Reader); err == nil {
+		if keys, err := jwks.NewSigningKeySet(private); err == nil {
+			dep.Keys = keys
+		}
+	}
+	return dep
 }
 
 func NewMiddlewareTestRouter(middleware1 gin.HandlerFunc, middleware2 gin.HandlerFunc) *gin.Engine {
@@ -0,0 +1,235 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Key is one asymmetric JWT key, Private is nil for keys that are only kept for verification.
+type Key struct {
+	Kid     string
+	Alg     string
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// KeySet holds the key new tokens are signed with, and every key tokens are still accepted from.
+// Rotated keys stay in the set for a grace period, until the tokens signed with them have expired.
+type KeySet struct {
+	Signing *Key
+	keys    map[string]*Key
+	order   []string
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]*Key)}
+}
+
+func (ks *KeySet) add(key *Key) {
+	if _, exists := ks.keys[key.Kid]; exists {
+		return
+	}
+
+	ks.keys[key.Kid] = key
+	ks.order = append(ks.order, key.Kid)
+}
+
+// Lookup returns the key with the given kid.
+func (ks *KeySet) Lookup(kid string) (*Key, bool) {
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// LoadKeySet loads the signing key and the verification-only keys from PEM files.
+// An empty signing key file means no asymmetric signing, tokens are signed with the shared secret.
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	ks := NewKeySet()
+
+	if signingKeyFile != "" {
+		key, err := loadKeyFile(signingKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.Private == nil {
+			return nil, fmt.Errorf("signing key file %s does not contain a private key", signingKeyFile)
+		}
+		ks.Signing = key
+		ks.add(key)
+	}
+
+	for _, file := range verificationKeyFiles {
+		key, err := loadKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ks.add(key)
+	}
+
+	return ks, nil
+}
+
+// NewSigningKeySet creates a key set that signs with an RSA or Ed25519 key kept in memory.
+func NewSigningKeySet(private crypto.Signer) (*KeySet, error) {
+	key := &Key{Private: private, Public: private.Public()}
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		key.Alg = AlgRS256
+	case ed25519.PrivateKey:
+		key.Alg = AlgEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	var err error
+	key.Kid, err = thumbprint(publicJWK(key))
+	if err != nil {
+		return nil, err
+	}
+
+	ks := NewKeySet()
+	ks.Signing = key
+	ks.add(key)
+	return ks, nil
+}
+
+func loadKeyFile(file string) (*Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %w", file, err)
+	}
+
+	key, err := ParseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", file, err)
+	}
+
+	return key, nil
+}
+
+// ParseKeyPEM parses an RSA or Ed25519 key, either private (PKCS#1/PKCS#8) or public (PKIX).
+func ParseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Alg, key.Private, key.Public = AlgRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Alg, key.Public = AlgRS256, k
+	case ed25519.PrivateKey:
+		key.Alg, key.Private, key.Public = AlgEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Alg, key.Public = AlgEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	jwk := publicJWK(key)
+	key.Kid, err = thumbprint(jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func publicJWK(key *Key) dto.JWK {
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		return dto.JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return dto.JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(pub),
+		}
+	default:
+		return dto.JWK{}
+	}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, so the kid is stable for the same key.
+func thumbprint(jwk dto.JWK) (string, error) {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// JWKS returns the public keys of the set, the signing key first.
+func (ks *KeySet) JWKS() *dto.JWKSResponse {
+	resp := &dto.JWKSResponse{Keys: make([]dto.JWK, 0, len(ks.order))}
+
+	for _, kid := range ks.order {
+		key := ks.keys[kid]
+		jwk := publicJWK(key)
+		jwk.Kid = key.Kid
+		jwk.Alg = key.Alg
+		jwk.Use = "sig"
+		resp.Keys = append(resp.Keys, jwk)
+	}
+
+	return resp
+}
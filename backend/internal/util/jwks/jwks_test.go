@@ -0,0 +1,109 @@
+package jwks_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwks"
+)
+
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write pem file, err: %v", err)
+	}
+	return path
+}
+
+func TestLoadKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key, err: %v", err)
+	}
+	rsaPrivateFile := writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	rsaPublicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	rsaPublicFile := writePEM(t, "rsa.pub.pem", "PUBLIC KEY", rsaPublicDER)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key, err: %v", err)
+	}
+	edPrivateDER, _ := x509.MarshalPKCS8PrivateKey(edPrivate)
+	edPrivateFile := writePEM(t, "ed.pem", "PRIVATE KEY", edPrivateDER)
+	edPublicDER, _ := x509.MarshalPKIXPublicKey(edPublic)
+	edPublicFile := writePEM(t, "ed.pub.pem", "PUBLIC KEY", edPublicDER)
+
+	t.Run("no signing key", func(t *testing.T) {
+		ks, err := jwks.LoadKeySet("", nil)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if ks.Signing != nil || len(ks.JWKS().Keys) != 0 {
+			t.Fatalf("expected an empty key set")
+		}
+	})
+
+	t.Run("signing and verification keys", func(t *testing.T) {
+		ks, err := jwks.LoadKeySet(edPrivateFile, []string{rsaPublicFile, edPublicFile})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if ks.Signing == nil || ks.Signing.Alg != jwks.AlgEdDSA {
+			t.Fatalf("expected EdDSA signing key")
+		}
+
+		set := ks.JWKS()
+		if len(set.Keys) != 2 {
+			t.Fatalf("expected 2 keys (duplicates dropped), got %d", len(set.Keys))
+		}
+		if set.Keys[0].Kid != ks.Signing.Kid || set.Keys[0].Kty != "OKP" || set.Keys[0].X == "" {
+			t.Fatalf("expected signing key first, got %+v", set.Keys[0])
+		}
+		if set.Keys[1].Kty != "RSA" || set.Keys[1].Alg != jwks.AlgRS256 || set.Keys[1].N == "" || set.Keys[1].E != "AQAB" {
+			t.Fatalf("unexpected rsa jwk, got %+v", set.Keys[1])
+		}
+	})
+
+	t.Run("kid is stable for the same key", func(t *testing.T) {
+		private, err := jwks.LoadKeySet(rsaPrivateFile, nil)
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		public, err := jwks.LoadKeySet("", []string{rsaPublicFile})
+		if err != nil {
+			t.Fatalf("unexpected error, err: %v", err)
+		}
+		if _, ok := public.Lookup(private.Signing.Kid); !ok {
+			t.Fatalf("expected the public key to share the kid of the private key")
+		}
+	})
+
+	t.Run("public key cannot sign", func(t *testing.T) {
+		_, err := jwks.LoadKeySet(rsaPublicFile, nil)
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := jwks.LoadKeySet("", []string{filepath.Join(t.TempDir(), "missing.pem")})
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+	})
+
+	t.Run("not a pem file", func(t *testing.T) {
+		_, err := jwks.ParseKeyPEM([]byte("not a key"))
+		if err == nil {
+			t.Fatalf("expected error, got nil")
+		}
+	})
+}
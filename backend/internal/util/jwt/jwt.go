@@ -1,6 +1,9 @@
 package jwt
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	libjwt "github.com/golang-jwt/jwt/v5"
@@ -8,13 +11,18 @@ import (
 
 	"github.com/paularynty/transcendence/auth-service-go/internal/dependency"
 	"github.com/paularynty/transcendence/auth-service-go/internal/dto"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwks"
 )
 
 const (
 	UserTokenType        = "USER"
 	GoogleOAuthStateType = "GoogleOAuthState"
+	GoogleLinkTokenType  = "GOOGLE_LINK"
 	TwoFASetupType       = "2FA_SETUP"
 	TwoFATokenType       = "2FA"
+	TrustedDeviceType    = "TRUSTED_DEVICE"
+	OidcAccessTokenType  = "OIDC_ACCESS"
+	ServiceTokenType     = "SERVICE"
 )
 
 func generateRegisteredClaims(expiration int) libjwt.RegisteredClaims {
@@ -25,59 +33,148 @@ func generateRegisteredClaims(expiration int) libjwt.RegisteredClaims {
 	}
 }
 
-func SignUserToken(dep *dependency.Dependency, userID uint) (string, error) {
-	userTokenExpiry := dep.Cfg.UserTokenExpiry
-	// For Redis mode, use absolute expiry to limit max token lifetime,
-	// because the actual expiry is managed in Redis with sliding expiration.
-	if dep.Cfg.IsRedisEnabled {
-		userTokenExpiry = dep.Cfg.UserTokenAbsoluteExpiry
+// signToken signs with the active asymmetric key when one is configured, otherwise with the shared secret.
+func signToken(dep *dependency.Dependency, claims libjwt.Claims) (string, error) {
+	if dep.Keys == nil || dep.Keys.Signing == nil {
+		token := libjwt.NewWithClaims(libjwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(dep.Cfg.JwtSecret))
+	}
+
+	key := dep.Keys.Signing
+	token := libjwt.NewWithClaims(libjwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.Private)
+}
+
+// acceptsSharedSecret tells whether HS256 tokens are valid: always without a signing key,
+// and with one only until JWT_SECRET_ACCEPTED_UNTIL, so tokens issued before the switch can expire.
+func acceptsSharedSecret(dep *dependency.Dependency) bool {
+	if dep.Keys == nil || dep.Keys.Signing == nil {
+		return true
+	}
+
+	return time.Now().Before(dep.Cfg.JwtSecretAcceptedUntil)
+}
+
+// validMethods lists the algorithms a token may be signed with.
+func validMethods(dep *dependency.Dependency) []string {
+	if acceptsSharedSecret(dep) {
+		return []string{libjwt.SigningMethodHS256.Alg(), jwks.AlgRS256, jwks.AlgEdDSA}
+	}
+
+	return []string{jwks.AlgRS256, jwks.AlgEdDSA}
+}
+
+// keyFunc picks the verification key by the kid header, and makes sure the key matches the algorithm.
+func keyFunc(dep *dependency.Dependency) libjwt.Keyfunc {
+	return func(token *libjwt.Token) (any, error) {
+		if _, ok := token.Method.(*libjwt.SigningMethodHMAC); ok {
+			if !acceptsSharedSecret(dep) {
+				return nil, libjwt.ErrTokenUnverifiable
+			}
+			return []byte(dep.Cfg.JwtSecret), nil
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		if dep.Keys == nil || kid == "" {
+			return nil, libjwt.ErrTokenUnverifiable
+		}
+
+		key, ok := dep.Keys.Lookup(kid)
+		if !ok || key.Alg != token.Method.Alg() {
+			return nil, libjwt.ErrTokenUnverifiable
+		}
+
+		return key.Public, nil
 	}
+}
 
+func SignUserToken(dep *dependency.Dependency, userID uint) (string, error) {
+	// User tokens are short-lived access tokens, clients renew them with a refresh token.
 	claims := dto.UserJwtPayload{
 		UserID:           userID,
 		Type:             UserTokenType,
-		RegisteredClaims: generateRegisteredClaims(userTokenExpiry),
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.UserTokenExpiry),
 	}
 
-	token := libjwt.NewWithClaims(libjwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(dep.Cfg.JwtSecret))
-	if err != nil {
-		return "", err
+	return signToken(dep, claims)
+}
+
+func SignOauthStateToken(dep *dependency.Dependency) (string, error) {
+	claims := dto.OauthStateJwtPayload{
+		Type:             GoogleOAuthStateType,
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.OauthStateTokenExpiry),
 	}
 
-	return signedToken, nil
+	return signToken(dep, claims)
 }
 
-func SignOauthStateToken(dep *dependency.Dependency) (string, error) {
+// SignOauthLinkStateToken signs the state of a Google round trip that links the Google account to a logged in user.
+func SignOauthLinkStateToken(dep *dependency.Dependency, userID uint) (string, error) {
 	claims := dto.OauthStateJwtPayload{
+		UserID:           userID,
 		Type:             GoogleOAuthStateType,
 		RegisteredClaims: generateRegisteredClaims(dep.Cfg.OauthStateTokenExpiry),
 	}
 
-	token := libjwt.NewWithClaims(libjwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(dep.Cfg.JwtSecret))
-	if err != nil {
-		return "", err
+	return signToken(dep, claims)
+}
+
+// SignOauthReauthStateToken signs the state of a round trip where a logged in user proves they still own their linked account.
+// provider is empty for Google, session is the login that gets re-authenticated.
+func SignOauthReauthStateToken(dep *dependency.Dependency, provider string, userID uint, session string) (string, error) {
+	claims := dto.OauthStateJwtPayload{
+		UserID:           userID,
+		Provider:         provider,
+		Reauth:           true,
+		Session:          session,
+		Type:             GoogleOAuthStateType,
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.OauthStateTokenExpiry),
 	}
 
-	return signedToken, nil
+	return signToken(dep, claims)
 }
 
+// SignOauthProviderStateToken signs the state of a round trip with a provider of OAUTH_PROVIDERS.
+// userID is set when the round trip links the account to a logged in user.
+func SignOauthProviderStateToken(dep *dependency.Dependency, provider string, userID uint) (string, error) {
+	claims := dto.OauthStateJwtPayload{
+		UserID:           userID,
+		Provider:         provider,
+		Type:             GoogleOAuthStateType,
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.OauthStateTokenExpiry),
+	}
+
+	return signToken(dep, claims)
+}
+
+// SignGoogleLinkToken signs a pending link of a Google account to an existing user, the user confirms it with their password.
+func SignGoogleLinkToken(dep *dependency.Dependency, userID uint, googleID string, email string) (string, error) {
+	claims := dto.GoogleLinkJwtPayload{
+		UserID:           userID,
+		GoogleID:         googleID,
+		Email:            email,
+		Type:             GoogleLinkTokenType,
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.OauthStateTokenExpiry),
+	}
+
+	return signToken(dep, claims)
+}
+
+// SignTwoFASetupToken carries the secret until it is confirmed, with the TOTP parameters of the config it was issued with.
 func SignTwoFASetupToken(dep *dependency.Dependency, userID uint, secret string) (string, error) {
 	claims := dto.TwoFaSetupJwtPayload{
 		UserID:           userID,
 		Secret:           secret,
+		Digits:           dep.Cfg.TwoFaDigits,
+		Period:           dep.Cfg.TwoFaPeriod,
+		Algorithm:        strings.ToUpper(dep.Cfg.TwoFaAlgorithm),
 		Type:             TwoFASetupType,
 		RegisteredClaims: generateRegisteredClaims(dep.Cfg.TwoFaTokenExpiry),
 	}
 
-	token := libjwt.NewWithClaims(libjwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(dep.Cfg.JwtSecret))
-	if err != nil {
-		return "", err
-	}
-
-	return signedToken, nil
+	return signToken(dep, claims)
 }
 
 func SignTwoFAToken(dep *dependency.Dependency, userID uint) (string, error) {
@@ -87,22 +184,93 @@ func SignTwoFAToken(dep *dependency.Dependency, userID uint) (string, error) {
 		RegisteredClaims: generateRegisteredClaims(dep.Cfg.TwoFaTokenExpiry),
 	}
 
-	token := libjwt.NewWithClaims(libjwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(dep.Cfg.JwtSecret))
-	if err != nil {
-		return "", err
+	return signToken(dep, claims)
+}
+
+// SignTrustedDeviceToken signs the cookie of a device that skips the 2FA step, only the hash of deviceID is stored.
+func SignTrustedDeviceToken(dep *dependency.Dependency, userID uint, deviceID string) (string, error) {
+	claims := dto.TrustedDeviceJwtPayload{
+		UserID:           userID,
+		DeviceID:         deviceID,
+		Type:             TrustedDeviceType,
+		RegisteredClaims: generateRegisteredClaims(dep.Cfg.TrustedDeviceExpiry),
+	}
+
+	return signToken(dep, claims)
+}
+
+// SignServiceToken signs the token of a service client, it carries no user.
+func SignServiceToken(dep *dependency.Dependency, clientID string) (string, error) {
+	registeredClaims := generateRegisteredClaims(dep.Cfg.ServiceTokenExpiry)
+	registeredClaims.Issuer = dep.Cfg.OidcIssuer
+	registeredClaims.Subject = clientID
+
+	claims := dto.ServiceJwtPayload{
+		ClientID:         clientID,
+		Type:             ServiceTokenType,
+		RegisteredClaims: registeredClaims,
+	}
+
+	return signToken(dep, claims)
+}
+
+// SignOidcAccessToken signs the access token a relying party calls /userinfo with.
+func SignOidcAccessToken(dep *dependency.Dependency, userID uint, clientID string, scope string) (string, error) {
+	registeredClaims := generateRegisteredClaims(dep.Cfg.UserTokenExpiry)
+	registeredClaims.Issuer = dep.Cfg.OidcIssuer
+	registeredClaims.Audience = libjwt.ClaimStrings{clientID}
+
+	claims := dto.OidcAccessJwtPayload{
+		UserID:           userID,
+		ClientID:         clientID,
+		Scope:            scope,
+		Type:             OidcAccessTokenType,
+		RegisteredClaims: registeredClaims,
+	}
+
+	return signToken(dep, claims)
+}
+
+// ErrNoSigningKey is returned for tokens that must be verifiable by others, when no asymmetric key is configured.
+var ErrNoSigningKey = errors.New("no asymmetric signing key configured")
+
+// SignOidcIDToken signs an OIDC ID token, it has no type claim so it is never accepted as one of our own tokens.
+// It is never signed with the shared secret, relying parties verify it with the JWKS.
+func SignOidcIDToken(dep *dependency.Dependency, userID uint, clientID string, nonce string, username string, picture *string) (string, error) {
+	if dep.Keys == nil || dep.Keys.Signing == nil {
+		return "", ErrNoSigningKey
+	}
+
+	registeredClaims := generateRegisteredClaims(dep.Cfg.UserTokenExpiry)
+	registeredClaims.Issuer = dep.Cfg.OidcIssuer
+	registeredClaims.Subject = strconv.FormatUint(uint64(userID), 10)
+	registeredClaims.Audience = libjwt.ClaimStrings{clientID}
+
+	claims := dto.OidcIDTokenClaims{
+		Nonce:             nonce,
+		PreferredUsername: username,
+		Picture:           picture,
+		RegisteredClaims:  registeredClaims,
 	}
 
-	return signedToken, nil
+	return signToken(dep, claims)
+}
+
+// SigningAlg returns the algorithm new tokens are signed with.
+func SigningAlg(dep *dependency.Dependency) string {
+	if dep.Keys == nil || dep.Keys.Signing == nil {
+		return libjwt.SigningMethodHS256.Alg()
+	}
+
+	return dep.Keys.Signing.Alg
 }
 
 func validateToken[T libjwt.Claims](dep *dependency.Dependency, signedToken string, claims T) (T, error) {
 	token, err := libjwt.ParseWithClaims(
 		signedToken,
 		claims,
-		func(token *libjwt.Token) (any, error) {
-			return []byte(dep.Cfg.JwtSecret), nil
-		},
+		keyFunc(dep),
+		libjwt.WithValidMethods(validMethods(dep)),
 	)
 	if err != nil {
 		return claims, err
@@ -143,6 +311,20 @@ func ValidateOauthStateToken(dep *dependency.Dependency, signedToken string) (*d
 	return parsedClaims, nil
 }
 
+func ValidateGoogleLinkToken(dep *dependency.Dependency, signedToken string) (*dto.GoogleLinkJwtPayload, error) {
+	claims := &dto.GoogleLinkJwtPayload{}
+	parsedClaims, err := validateToken(dep, signedToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedClaims.Type != GoogleLinkTokenType {
+		return nil, libjwt.ErrTokenInvalidClaims
+	}
+
+	return parsedClaims, nil
+}
+
 func ValidateTwoFAToken(dep *dependency.Dependency, signedToken string) (*dto.TwoFaJwtPayload, error) {
 	claims := &dto.TwoFaJwtPayload{}
 	parsedClaims, err := validateToken(dep, signedToken, claims)
@@ -170,3 +352,61 @@ func ValidateTwoFASetupToken(dep *dependency.Dependency, signedToken string) (*d
 
 	return parsedClaims, nil
 }
+
+func ValidateTrustedDeviceToken(dep *dependency.Dependency, signedToken string) (*dto.TrustedDeviceJwtPayload, error) {
+	claims := &dto.TrustedDeviceJwtPayload{}
+	parsedClaims, err := validateToken(dep, signedToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedClaims.Type != TrustedDeviceType {
+		return nil, libjwt.ErrTokenInvalidClaims
+	}
+
+	return parsedClaims, nil
+}
+
+func ValidateOidcAccessToken(dep *dependency.Dependency, signedToken string) (*dto.OidcAccessJwtPayload, error) {
+	claims := &dto.OidcAccessJwtPayload{}
+	parsedClaims, err := validateToken(dep, signedToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedClaims.Type != OidcAccessTokenType {
+		return nil, libjwt.ErrTokenInvalidClaims
+	}
+
+	return parsedClaims, nil
+}
+
+func ValidateServiceToken(dep *dependency.Dependency, signedToken string) (*dto.ServiceJwtPayload, error) {
+	claims := &dto.ServiceJwtPayload{}
+	parsedClaims, err := validateToken(dep, signedToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedClaims.Type != ServiceTokenType {
+		return nil, libjwt.ErrTokenInvalidClaims
+	}
+
+	return parsedClaims, nil
+}
+
+// ValidateAnyToken checks the signature and the expiry of any token we issue, the caller decides by its type.
+func ValidateAnyToken(dep *dependency.Dependency, signedToken string) (*dto.AnyJwtPayload, error) {
+	claims := &dto.AnyJwtPayload{}
+	parsedClaims, err := validateToken(dep, signedToken, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedClaims.Type {
+	case UserTokenType, GoogleOAuthStateType, GoogleLinkTokenType, TwoFASetupType, TwoFATokenType, OidcAccessTokenType, ServiceTokenType:
+		return parsedClaims, nil
+	default:
+		return nil, libjwt.ErrTokenInvalidClaims
+	}
+}
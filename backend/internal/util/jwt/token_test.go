@@ -1,9 +1,19 @@
 package jwt_test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	libjwt "github.com/golang-jwt/jwt/v5"
 	"github.com/paularynty/transcendence/auth-service-go/internal/testutil"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwks"
 	"github.com/paularynty/transcendence/auth-service-go/internal/util/jwt"
 )
 
@@ -148,3 +158,132 @@ func TestTwoFAToken(t *testing.T) {
 		t.Fatalf("expected error, got nil")
 	}
 }
+
+func newEd25519KeySet(t *testing.T, verificationKeys ...*jwks.Key) *jwks.KeySet {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key, err: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to marshal ed25519 key, err: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write key file, err: %v", err)
+	}
+
+	// Verification only: keep the public part like a rotated key would.
+	var verificationFiles []string
+	for _, key := range verificationKeys {
+		der, err := x509.MarshalPKIXPublicKey(key.Public)
+		if err != nil {
+			t.Fatalf("failed to marshal public key, err: %v", err)
+		}
+		pubPath := filepath.Join(t.TempDir(), "verification.pem")
+		if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+			t.Fatalf("failed to write key file, err: %v", err)
+		}
+		verificationFiles = append(verificationFiles, pubPath)
+	}
+
+	ks, err := jwks.LoadKeySet(path, verificationFiles)
+	if err != nil {
+		t.Fatalf("failed to load key set, err: %v", err)
+	}
+
+	return ks
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	oldDep := testutil.NewTestDependency(nil, nil, nil, nil)
+	oldDep.Keys = newEd25519KeySet(t)
+
+	token, err := jwt.SignUserToken(oldDep, 5)
+	if err != nil {
+		t.Fatalf("failed to generate token, got an error: %v", err)
+	}
+
+	parsed, _, err := new(libjwt.Parser).ParseUnverified(token, &libjwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatalf("failed to parse token header, err: %v", err)
+	}
+	if parsed.Header["alg"] != jwks.AlgEdDSA || parsed.Header["kid"] != oldDep.Keys.Signing.Kid {
+		t.Fatalf("unexpected token header: %v", parsed.Header)
+	}
+
+	if _, err := jwt.ValidateUserTokenGeneric(oldDep, token); err != nil {
+		t.Fatalf("failed to validate token, err: %v", err)
+	}
+
+	// After rotation, the old key is kept for verification during the grace period.
+	rotatedDep := testutil.NewTestDependency(nil, nil, nil, nil)
+	rotatedDep.Keys = newEd25519KeySet(t, oldDep.Keys.Signing)
+	if _, err := jwt.ValidateUserTokenGeneric(rotatedDep, token); err != nil {
+		t.Fatalf("expected token of the rotated key to validate, err: %v", err)
+	}
+
+	newToken, err := jwt.SignUserToken(rotatedDep, 5)
+	if err != nil {
+		t.Fatalf("failed to generate token, got an error: %v", err)
+	}
+	if _, err := jwt.ValidateUserTokenGeneric(oldDep, newToken); err == nil {
+		t.Fatalf("expected token of an unknown key to be rejected")
+	}
+
+	// Once the grace period is over, the old key is dropped.
+	droppedDep := testutil.NewTestDependency(nil, nil, nil, nil)
+	droppedDep.Keys = newEd25519KeySet(t)
+	if _, err := jwt.ValidateUserTokenGeneric(droppedDep, token); err == nil {
+		t.Fatalf("expected token of a dropped key to be rejected")
+	}
+
+	// Tokens signed with the shared secret are rejected once a signing key is configured,
+	// unless they are still inside the configured transition.
+	legacyDep := testutil.NewTestDependency(nil, nil, nil, nil)
+	legacyDep.Keys = jwks.NewKeySet()
+	legacyToken, err := jwt.SignUserToken(legacyDep, 5)
+	if err != nil {
+		t.Fatalf("failed to generate token, got an error: %v", err)
+	}
+	if _, err := jwt.ValidateUserTokenGeneric(legacyDep, legacyToken); err != nil {
+		t.Fatalf("expected HS256 token to validate without a signing key, err: %v", err)
+	}
+	if _, err := jwt.ValidateUserTokenGeneric(rotatedDep, legacyToken); err == nil {
+		t.Fatalf("expected HS256 token to be rejected with a signing key")
+	}
+
+	rotatedDep.Cfg.JwtSecretAcceptedUntil = time.Now().Add(time.Hour)
+	if _, err := jwt.ValidateUserTokenGeneric(rotatedDep, legacyToken); err != nil {
+		t.Fatalf("expected HS256 token to validate during the transition, err: %v", err)
+	}
+
+	rotatedDep.Cfg.JwtSecretAcceptedUntil = time.Now().Add(-time.Second)
+	if _, err := jwt.ValidateUserTokenGeneric(rotatedDep, legacyToken); err == nil {
+		t.Fatalf("expected HS256 token to be rejected after the transition")
+	}
+}
+
+func TestOidcIDTokenNeedsSigningKey(t *testing.T) {
+	dep := testutil.NewTestDependency(nil, nil, nil, nil)
+	dep.Keys = jwks.NewKeySet()
+
+	if _, err := jwt.SignOidcIDToken(dep, 5, "client", "", "alice", nil); !errors.Is(err, jwt.ErrNoSigningKey) {
+		t.Fatalf("expected ErrNoSigningKey, got: %v", err)
+	}
+
+	token, err := jwt.SignOidcIDToken(testDep, 5, "client", "", "alice", nil)
+	if err != nil {
+		t.Fatalf("failed to sign ID token, err: %v", err)
+	}
+	parsed, _, err := libjwt.NewParser().ParseUnverified(token, libjwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("failed to parse ID token, err: %v", err)
+	}
+	if parsed.Header["alg"] != jwks.AlgEdDSA {
+		t.Fatalf("expected an EdDSA ID token, got header: %v", parsed.Header)
+	}
+}
@@ -0,0 +1,392 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+)
+
+// Provider types with a preset, any other type is a generic OIDC issuer.
+const (
+	TypeGitHub = "github"
+	Type42     = "42"
+	TypeOIDC   = "oidc"
+)
+
+// ClaimMapping names the userinfo fields of a provider, nested fields are written with dots, like "image.link".
+type ClaimMapping struct {
+	Subject       string
+	Email         string
+	EmailVerified string
+	Username      string
+	Avatar        string
+}
+
+// Provider is an external OAuth 2.0 / OIDC login provider.
+type Provider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthorizeURL string
+	TokenURL     string
+	UserInfoURL  string
+	// EmailsURL lists the emails of the user, for providers whose userinfo leaves out private emails (GitHub).
+	EmailsURL   string
+	RedirectURI string
+	Scopes      []string
+	Claims      ClaimMapping
+	HTTPClient  *http.Client
+}
+
+// Identity is the user as the provider sees them.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Avatar        *string
+	Profile       map[string]any
+}
+
+var presets = map[string]Provider{
+	TypeGitHub: {
+		AuthorizeURL: "https://github.com/login/oauth/authorize",
+		TokenURL:     "https://github.com/login/oauth/access_token",
+		UserInfoURL:  "https://api.github.com/user",
+		EmailsURL:    "https://api.github.com/user/emails",
+		Scopes:       []string{"read:user", "user:email"},
+		Claims:       ClaimMapping{Subject: "id", Email: "email", Username: "login", Avatar: "avatar_url"},
+	},
+	Type42: {
+		AuthorizeURL: "https://api.intra.42.fr/oauth/authorize",
+		TokenURL:     "https://api.intra.42.fr/oauth/token",
+		UserInfoURL:  "https://api.intra.42.fr/v2/me",
+		Scopes:       []string{"public"},
+		Claims:       ClaimMapping{Subject: "id", Email: "email", Username: "login", Avatar: "image.link"},
+	},
+	TypeOIDC: {
+		Scopes: []string{"openid", "email", "profile"},
+		Claims: ClaimMapping{Subject: "sub", Email: "email", EmailVerified: "email_verified", Username: "preferred_username", Avatar: "picture"},
+	},
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// New builds a provider from its config on top of the preset of its type.
+// A generic OIDC provider with an issuer and no explicit URLs is set up from the discovery document of the issuer.
+func New(ctx context.Context, cfg config.OauthProviderConfig) (*Provider, error) {
+	preset, ok := presets[cfg.Type]
+	if !ok {
+		preset = presets[TypeOIDC]
+	}
+
+	p := &Provider{
+		Name:         cfg.Name,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		AuthorizeURL: firstNonEmpty(cfg.AuthorizeURL, preset.AuthorizeURL),
+		TokenURL:     firstNonEmpty(cfg.TokenURL, preset.TokenURL),
+		UserInfoURL:  firstNonEmpty(cfg.UserInfoURL, preset.UserInfoURL),
+		EmailsURL:    preset.EmailsURL,
+		RedirectURI:  cfg.RedirectURI,
+		Scopes:       preset.Scopes,
+		Claims: ClaimMapping{
+			Subject:       firstNonEmpty(cfg.ClaimSubject, preset.Claims.Subject),
+			Email:         firstNonEmpty(cfg.ClaimEmail, preset.Claims.Email),
+			EmailVerified: firstNonEmpty(cfg.ClaimEmailVerified, preset.Claims.EmailVerified),
+			Username:      firstNonEmpty(cfg.ClaimUsername, preset.Claims.Username),
+			Avatar:        firstNonEmpty(cfg.ClaimAvatar, preset.Claims.Avatar),
+		},
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(cfg.Scopes) > 0 {
+		p.Scopes = cfg.Scopes
+	}
+
+	if cfg.Issuer != "" && (p.AuthorizeURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+		if err := p.discover(ctx, cfg.Issuer); err != nil {
+			return nil, fmt.Errorf("oauth provider %s: %w", cfg.Name, err)
+		}
+	}
+
+	if p.AuthorizeURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+		return nil, fmt.Errorf("oauth provider %s: authorize, token and userinfo URLs are required", cfg.Name)
+	}
+
+	return p, nil
+}
+
+// LoadProviders builds every configured provider, by name.
+func LoadProviders(ctx context.Context, cfgs []config.OauthProviderConfig) (map[string]*Provider, error) {
+	providers := make(map[string]*Provider, len(cfgs))
+	for _, cfg := range cfgs {
+		p, err := New(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		providers[cfg.Name] = p
+	}
+
+	return providers, nil
+}
+
+func (p *Provider) discover(ctx context.Context, issuer string) error {
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, "", &doc); err != nil {
+		return fmt.Errorf("failed to fetch discovery document: %w", err)
+	}
+
+	p.AuthorizeURL = firstNonEmpty(p.AuthorizeURL, doc.AuthorizationEndpoint)
+	p.TokenURL = firstNonEmpty(p.TokenURL, doc.TokenEndpoint)
+	p.UserInfoURL = firstNonEmpty(p.UserInfoURL, doc.UserinfoEndpoint)
+
+	return nil
+}
+
+// CodeChallenge returns the PKCE S256 challenge of the code verifier.
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns where to send the browser to log in with the provider.
+// The code verifier is sent back by Exchange, the nonce comes back in the ID token of OIDC providers.
+func (p *Provider) AuthCodeURL(state string, codeVerifier string, nonce string) string {
+	q := url.Values{}
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURI)
+	q.Set("response_type", "code")
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", CodeChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+	q.Set("nonce", nonce)
+
+	separator := "?"
+	if strings.Contains(p.AuthorizeURL, "?") {
+		separator = "&"
+	}
+
+	return p.AuthorizeURL + separator + q.Encode()
+}
+
+// Exchange redeems the authorization code for an access token, with the code verifier of AuthCodeURL.
+// An ID token in the answer must carry the nonce of AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (string, error) {
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", p.RedirectURI)
+	data.Set("client_id", p.ClientID)
+	data.Set("client_secret", p.ClientSecret)
+	data.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub answers with a form unless asked for JSON.
+	req.Header.Set("Accept", "application/json")
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.doJSON(req, &token); err != nil {
+		return "", err
+	}
+
+	if token.Error != "" {
+		return "", fmt.Errorf("token endpoint error: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+
+	if token.IDToken != "" {
+		if err := checkIDTokenNonce(token.IDToken, nonce); err != nil {
+			return "", err
+		}
+	}
+
+	return token.AccessToken, nil
+}
+
+// checkIDTokenNonce compares the nonce of the ID token with the one of the round trip.
+// The token comes straight from the token endpoint over TLS, so its signature is not checked.
+func checkIDTokenNonce(idToken string, nonce string) error {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed id token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed id token: %w", err)
+	}
+
+	var claims struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed id token: %w", err)
+	}
+
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return errors.New("id token nonce mismatch")
+	}
+
+	return nil
+}
+
+// FetchIdentity reads the user from the userinfo endpoint, through the claim mapping.
+func (p *Provider) FetchIdentity(ctx context.Context, accessToken string) (*Identity, error) {
+	var profile map[string]any
+	if err := p.getJSON(ctx, p.UserInfoURL, accessToken, &profile); err != nil {
+		return nil, fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+
+	identity := &Identity{
+		Subject:  claimString(profile, p.Claims.Subject),
+		Email:    claimString(profile, p.Claims.Email),
+		Username: claimString(profile, p.Claims.Username),
+		Profile:  profile,
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("userinfo has no subject")
+	}
+
+	if verified, ok := claim(profile, p.Claims.EmailVerified).(bool); ok {
+		identity.EmailVerified = verified
+	}
+
+	if avatar := claimString(profile, p.Claims.Avatar); avatar != "" {
+		identity.Avatar = &avatar
+	}
+
+	if p.EmailsURL != "" && (identity.Email == "" || !identity.EmailVerified) {
+		if err := p.fetchPrimaryEmail(ctx, accessToken, identity); err != nil {
+			return nil, err
+		}
+	}
+
+	return identity, nil
+}
+
+// fetchPrimaryEmail fills in the primary email with its verification status, GitHub leaves both out of the userinfo.
+func (p *Provider) fetchPrimaryEmail(ctx context.Context, accessToken string, identity *Identity) error {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.getJSON(ctx, p.EmailsURL, accessToken, &emails); err != nil {
+		return fmt.Errorf("failed to fetch emails: %w", err)
+	}
+
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email = e.Email
+			identity.EmailVerified = e.Verified
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return p.doJSON(req, v)
+}
+
+func (p *Provider) doJSON(req *http.Request, v any) error {
+	// GitHub refuses requests without a User-Agent.
+	req.Header.Set("User-Agent", "transcendence-auth-service")
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	// Token endpoints report errors in the body with a 400, it is decoded by the caller.
+	if resp.StatusCode >= 300 && !(resp.StatusCode == 400 && req.Method == http.MethodPost) {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.Host)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// claim looks up a dotted path in the profile.
+func claim(profile map[string]any, path string) any {
+	if path == "" {
+		return nil
+	}
+
+	var current any = profile
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = m[key]
+	}
+
+	return current
+}
+
+// claimString returns a claim as a string, numeric ids included.
+func claimString(profile map[string]any, path string) string {
+	switch v := claim(profile, path).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,230 @@
+package oauth_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/paularynty/transcendence/auth-service-go/internal/config"
+	"github.com/paularynty/transcendence/auth-service-go/internal/util/oauth"
+)
+
+// newProviderServer serves a token endpoint and the given JSON documents by path.
+// The token endpoint wants the "verifier" code verifier, and answers with an ID token for the "provider-nonce" nonce.
+func newProviderServer(t *testing.T, docs map[string]any) *httptest.Server {
+	t.Helper()
+
+	idTokenPayload, _ := json.Marshal(map[string]string{"sub": "1", "nonce": "provider-nonce"})
+	idToken := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(idTokenPayload) + ".sig"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("code") != "good-code" || r.PostForm.Get("code_verifier") != "verifier" {
+			w.WriteHeader(400)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token", "id_token": idToken})
+	})
+	for path, doc := range docs {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if path != "/.well-known/openid-configuration" && r.Header.Get("Authorization") != "Bearer access-token" {
+				w.WriteHeader(401)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(doc)
+		})
+	}
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNew(t *testing.T) {
+	t.Run("preset fills in urls and scopes", func(t *testing.T) {
+		p, err := oauth.New(context.Background(), config.OauthProviderConfig{Name: "github", Type: oauth.TypeGitHub, ClientID: "id"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if p.AuthorizeURL != "https://github.com/login/oauth/authorize" || p.EmailsURL == "" {
+			t.Fatalf("expected github preset, got %+v", p)
+		}
+		if len(p.Scopes) != 2 {
+			t.Fatalf("expected preset scopes, got %v", p.Scopes)
+		}
+	})
+
+	t.Run("explicit config wins over preset", func(t *testing.T) {
+		p, err := oauth.New(context.Background(), config.OauthProviderConfig{
+			Name:        "intra",
+			Type:        oauth.Type42,
+			UserInfoURL: "https://intra.example.com/me",
+			Scopes:      []string{"public", "profile"},
+			ClaimEmail:  "mail",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if p.UserInfoURL != "https://intra.example.com/me" || p.TokenURL != "https://api.intra.42.fr/oauth/token" {
+			t.Fatalf("unexpected urls %+v", p)
+		}
+		if len(p.Scopes) != 2 || p.Claims.Email != "mail" || p.Claims.Avatar != "image.link" {
+			t.Fatalf("unexpected scopes or claims %+v", p)
+		}
+	})
+
+	t.Run("generic oidc provider uses discovery", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{})
+		srv.Config.Handler.(*http.ServeMux).HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"authorization_endpoint": srv.URL + "/authorize",
+				"token_endpoint":         srv.URL + "/token",
+				"userinfo_endpoint":      srv.URL + "/userinfo",
+			})
+		})
+
+		p, err := oauth.New(context.Background(), config.OauthProviderConfig{Name: "keycloak", Type: "keycloak", Issuer: srv.URL + "/"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if p.AuthorizeURL != srv.URL+"/authorize" || p.TokenURL != srv.URL+"/token" || p.UserInfoURL != srv.URL+"/userinfo" {
+			t.Fatalf("expected discovered urls, got %+v", p)
+		}
+		if p.Claims.Subject != "sub" {
+			t.Fatalf("expected oidc claims, got %+v", p.Claims)
+		}
+	})
+
+	t.Run("missing urls", func(t *testing.T) {
+		if _, err := oauth.New(context.Background(), config.OauthProviderConfig{Name: "custom", Type: "custom"}); err == nil {
+			t.Fatalf("expected error for provider without urls")
+		}
+	})
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := &oauth.Provider{
+		ClientID:     "client",
+		AuthorizeURL: "https://provider.example.com/authorize?prompt=login",
+		RedirectURI:  "http://localhost:3003/api/users/oauth/custom/callback",
+		Scopes:       []string{"openid", "email"},
+	}
+
+	u, err := url.Parse(p.AuthCodeURL("state-value", "verifier", "nonce-value"))
+	if err != nil {
+		t.Fatalf("failed to parse url, err: %v", err)
+	}
+	q := u.Query()
+	if q.Get("prompt") != "login" || q.Get("client_id") != "client" || q.Get("state") != "state-value" {
+		t.Fatalf("unexpected query %v", q)
+	}
+	if q.Get("scope") != "openid email" || q.Get("response_type") != "code" {
+		t.Fatalf("unexpected query %v", q)
+	}
+	if q.Get("code_challenge") != oauth.CodeChallenge("verifier") || q.Get("code_challenge_method") != "S256" || q.Get("nonce") != "nonce-value" {
+		t.Fatalf("expected pkce and nonce params, got %v", q)
+	}
+}
+
+func TestExchangeAndFetchIdentity(t *testing.T) {
+	t.Run("nested claims", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{
+			"/me": map[string]any{
+				"id":    12345,
+				"email": "student@example.com",
+				"login": "student",
+				"image": map[string]any{"link": "https://cdn.example.com/student.png"},
+			},
+		})
+		p := &oauth.Provider{
+			TokenURL:    srv.URL + "/token",
+			UserInfoURL: srv.URL + "/me",
+			Claims:      oauth.ClaimMapping{Subject: "id", Email: "email", Username: "login", Avatar: "image.link"},
+			HTTPClient:  srv.Client(),
+		}
+
+		accessToken, err := p.Exchange(context.Background(), "good-code", "verifier", "provider-nonce")
+		if err != nil {
+			t.Fatalf("unexpected exchange error: %v", err)
+		}
+
+		identity, err := p.FetchIdentity(context.Background(), accessToken)
+		if err != nil {
+			t.Fatalf("unexpected fetch error: %v", err)
+		}
+		if identity.Subject != "12345" || identity.Email != "student@example.com" || identity.Username != "student" {
+			t.Fatalf("unexpected identity %+v", identity)
+		}
+		if identity.Avatar == nil || *identity.Avatar != "https://cdn.example.com/student.png" {
+			t.Fatalf("unexpected avatar %v", identity.Avatar)
+		}
+		if identity.EmailVerified {
+			t.Fatalf("did not expect email to be verified without a claim")
+		}
+	})
+
+	t.Run("emails endpoint fills in the primary email", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{
+			"/user": map[string]any{"id": 1, "login": "octocat", "email": nil},
+			"/user/emails": []map[string]any{
+				{"email": "other@example.com", "primary": false, "verified": true},
+				{"email": "octocat@example.com", "primary": true, "verified": true},
+			},
+		})
+		p := &oauth.Provider{
+			UserInfoURL: srv.URL + "/user",
+			EmailsURL:   srv.URL + "/user/emails",
+			Claims:      oauth.ClaimMapping{Subject: "id", Email: "email", Username: "login"},
+			HTTPClient:  srv.Client(),
+		}
+
+		identity, err := p.FetchIdentity(context.Background(), "access-token")
+		if err != nil {
+			t.Fatalf("unexpected fetch error: %v", err)
+		}
+		if identity.Email != "octocat@example.com" || !identity.EmailVerified {
+			t.Fatalf("expected verified primary email, got %+v", identity)
+		}
+	})
+
+	t.Run("token endpoint error", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{})
+		p := &oauth.Provider{TokenURL: srv.URL + "/token", HTTPClient: srv.Client()}
+
+		if _, err := p.Exchange(context.Background(), "bad-code", "verifier", "provider-nonce"); err == nil {
+			t.Fatalf("expected exchange error")
+		}
+	})
+
+	t.Run("wrong code verifier", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{})
+		p := &oauth.Provider{TokenURL: srv.URL + "/token", HTTPClient: srv.Client()}
+
+		if _, err := p.Exchange(context.Background(), "good-code", "other-verifier", "provider-nonce"); err == nil {
+			t.Fatalf("expected exchange error")
+		}
+	})
+
+	t.Run("id token of another round trip", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{})
+		p := &oauth.Provider{TokenURL: srv.URL + "/token", HTTPClient: srv.Client()}
+
+		if _, err := p.Exchange(context.Background(), "good-code", "verifier", "other-nonce"); err == nil {
+			t.Fatalf("expected nonce mismatch error")
+		}
+	})
+
+	t.Run("missing subject", func(t *testing.T) {
+		srv := newProviderServer(t, map[string]any{"/me": map[string]any{"email": "a@example.com"}})
+		p := &oauth.Provider{UserInfoURL: srv.URL + "/me", Claims: oauth.ClaimMapping{Subject: "sub"}, HTTPClient: srv.Client()}
+
+		if _, err := p.FetchIdentity(context.Background(), "access-token"); err == nil {
+			t.Fatalf("expected error for userinfo without subject")
+		}
+	})
+}
@@ -1,6 +1,10 @@
 import { PUBLIC_API_BASE_URL, PUBLIC_API_HEALTH_CHECK_URL } from '$env/static/public';
 
+const apiBaseUrl = PUBLIC_API_BASE_URL || 'http://localhost:3003/api/users';
+
 export const cfg = {
-	apiBaseUrl: PUBLIC_API_BASE_URL || 'http://localhost:3003/api/users',
+	apiBaseUrl,
+	// The OIDC endpoints sit next to the users API
+	apiOidcUrl: new URL('../oidc', `${apiBaseUrl}/`).href,
 	apiHealthCheckUrl: PUBLIC_API_HEALTH_CHECK_URL || 'http://localhost:3003/api/ping'
 };
@@ -2,11 +2,13 @@ export type AuthErrorStatus = 400 | 401 | 404 | 409 | 428 | 429 | 500;
 
 export class AuthError extends Error {
 	readonly status: AuthErrorStatus;
+	readonly code?: string; // Set on errors the caller can recover from, e.g. 'reauth_required'
 
-	constructor(status: AuthErrorStatus, message: string) {
+	constructor(status: AuthErrorStatus, message: string, code?: string) {
 		super(message);
 		this.name = 'AuthError';
 		this.status = status;
+		this.code = code;
 
 		if (Error.captureStackTrace) {
 			Error.captureStackTrace(this, AuthError);
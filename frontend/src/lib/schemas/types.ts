@@ -4,11 +4,24 @@ import {
 	AddNewFriendRequestSchema,
 	CreateUserFormSchema,
 	CreateUserSchema,
+	ForgotPasswordRequestSchema,
 	FriendResponseSchema,
 	GetFriendsResponseSchema,
+	GoogleLinkConfirmRequestSchema,
 	LoginUserByEmailRequestSchema,
+	LoginCodeRequestSchema,
 	LoginUserByIdentifierRequestSchema,
 	LoginUserRequestSchema,
+	OauthProvidersResponseSchema,
+	OauthUrlResponseSchema,
+	OidcAuthorizeRequestSchema,
+	OidcAuthorizeResponseSchema,
+	ReauthRequestSchema,
+	RefreshTokenRequestSchema,
+	RefreshTokenResponseSchema,
+	ReauthResponseSchema,
+	ResendVerificationEmailRequestSchema,
+	ResetPasswordRequestSchema,
 	SimpleUserResponseSchema,
 	TwoFaChallengeRequestSchema,
 	TwoFaConfirmRequestSchema,
@@ -21,16 +34,23 @@ import {
 	UserSchema,
 	UsersResponseSchema,
 	UserWithoutTokenResponseSchema,
-	UserWithTokenResponseSchema
+	UserWithTokenResponseSchema,
+	VerifyEmailRequestSchema
 } from './userSchema.js';
 
 export type User = z.infer<typeof UserSchema>;
 export type CreateUserRequest = z.infer<typeof CreateUserSchema>;
 export type CreateUserForm = z.infer<typeof CreateUserFormSchema>;
 export type UpdateUserPasswordRequest = z.infer<typeof UpdateUserPasswordRequestSchema>;
+export type ForgotPasswordRequest = z.infer<typeof ForgotPasswordRequestSchema>;
+export type ResetPasswordRequest = z.infer<typeof ResetPasswordRequestSchema>;
+export type VerifyEmailRequest = z.infer<typeof VerifyEmailRequestSchema>;
+export type ResendVerificationEmailRequest = z.infer<typeof ResendVerificationEmailRequestSchema>;
 export type LoginUserRequest = z.infer<typeof LoginUserRequestSchema>;
 export type LoginUserByEmailRequest = z.infer<typeof LoginUserByEmailRequestSchema>;
 export type LoginUserByIdentifierRequest = z.infer<typeof LoginUserByIdentifierRequestSchema>;
+export type LoginCodeRequest = z.infer<typeof LoginCodeRequestSchema>;
+export type GoogleLinkConfirmRequest = z.infer<typeof GoogleLinkConfirmRequestSchema>;
 
 export type TwoFaChallengeRequest = z.infer<typeof TwoFaChallengeRequestSchema>;
 export type TwoFaConfirmRequest = z.infer<typeof TwoFaConfirmRequestSchema>;
@@ -38,6 +58,14 @@ export type UserWithTokenResponse = z.infer<typeof UserWithTokenResponseSchema>;
 export type TwoFaDisableRequest = z.infer<typeof TwoFaDisableRequestSchema>;
 export type TwoFaSetupResponse = z.infer<typeof TwoFaSetupResponseSchema>;
 export type TwoFaPendingUserResponse = z.infer<typeof TwoFaPendingUserResponseSchema>;
+export type ReauthRequest = z.infer<typeof ReauthRequestSchema>;
+export type ReauthResponse = z.infer<typeof ReauthResponseSchema>;
+export type OauthUrlResponse = z.infer<typeof OauthUrlResponseSchema>;
+export type OauthProvidersResponse = z.infer<typeof OauthProvidersResponseSchema>;
+export type RefreshTokenRequest = z.infer<typeof RefreshTokenRequestSchema>;
+export type RefreshTokenResponse = z.infer<typeof RefreshTokenResponseSchema>;
+export type OidcAuthorizeRequest = z.infer<typeof OidcAuthorizeRequestSchema>;
+export type OidcAuthorizeResponse = z.infer<typeof OidcAuthorizeResponseSchema>;
 
 export type UpdateUserRequest = z.infer<typeof UpdateUserRequestSchema>;
 export type UserWithoutTokenResponse = z.infer<typeof UserWithoutTokenResponseSchema>;
@@ -1,7 +1,5 @@
 import * as z from 'zod';
 
-const isAlphaNumericLegalSymbols = (val: string): boolean => /^[a-z0-9,.#$%@^;|_!*&?]+$/i.test(val);
-
 // For user CRUD
 const usernameSchema = z
 	.string()
@@ -15,9 +13,9 @@ const usernameSchema = z
 		message: 'Username may only contain letters, numbers, ".", "_" or "-"'
 	});
 
-const passwordSchema = z.string().trim().min(6).max(20).refine(isAlphaNumericLegalSymbols, {
-	error: 'Password may only contain letters, numbers, and the following symbols: ,.#$%@^;|_!*&?'
-});
+// Any characters; the server checks new passwords against its password policy
+const passwordSchema = z.string().min(1).max(128);
+const newPasswordSchema = z.string().min(8).max(128);
 
 export const UserSchema = z.object({
 	username: usernameSchema,
@@ -27,13 +25,13 @@ export const UserSchema = z.object({
 
 export const CreateUserSchema = z.object({
 	...UserSchema.shape,
-	password: passwordSchema
+	password: newPasswordSchema
 });
 
 export const CreateUserFormSchema = z
 	.object({
 		...CreateUserSchema.shape,
-		confirmPassword: z.string().trim()
+		confirmPassword: z.string()
 	})
 	.refine((data) => data.password === data.confirmPassword, {
 		message: 'Passwords do not match',
@@ -42,13 +40,13 @@ export const CreateUserFormSchema = z
 
 export const UpdateUserPasswordRequestSchema = z.object({
 	oldPassword: passwordSchema,
-	newPassword: passwordSchema
+	newPassword: newPasswordSchema
 });
 
 export const UpdateUserPasswordFormSchema = z
 	.object({
 		...UpdateUserPasswordRequestSchema.shape,
-		confirmNewPassword: z.string().trim()
+		confirmNewPassword: z.string()
 	})
 	.refine((data) => data.newPassword === data.confirmNewPassword, {
 		message: 'New passwords do not match',
@@ -59,6 +57,35 @@ export const UpdateUserPasswordFormSchema = z
 		path: ['newPassword']
 	});
 
+// Password reset by email
+export const ForgotPasswordRequestSchema = z.object({
+	email: z.email().trim()
+});
+
+export const ResetPasswordRequestSchema = z.object({
+	token: z.string().min(1),
+	newPassword: newPasswordSchema
+});
+
+export const ResetPasswordFormSchema = z
+	.object({
+		newPassword: newPasswordSchema,
+		confirmNewPassword: z.string()
+	})
+	.refine((data) => data.newPassword === data.confirmNewPassword, {
+		message: 'New passwords do not match',
+		path: ['confirmNewPassword']
+	});
+
+// Email verification
+export const VerifyEmailRequestSchema = z.object({
+	token: z.string().min(1)
+});
+
+export const ResendVerificationEmailRequestSchema = z.object({
+	email: z.email().trim()
+});
+
 export const LoginUserRequestSchema = z.object({
 	username: usernameSchema,
 	password: passwordSchema
@@ -74,18 +101,40 @@ export const LoginUserByIdentifierRequestSchema = z.object({
 	password: passwordSchema
 });
 
+export const LoginCodeRequestSchema = z.object({
+	code: z.string().min(1)
+});
+
+export const GoogleLinkConfirmRequestSchema = z.object({
+	linkToken: z.string().min(1),
+	password: passwordSchema
+});
+
 const responseAdditionalFields = z.object({
 	id: z.int(),
 	twoFa: z.boolean(),
 	email: z.email().trim(),
 	googleOauthId: z.string().trim().nullish(),
+	linkedProviders: z.array(z.string()).nullish(),
+	emailVerified: z.boolean().optional(),
 	createdAt: z.number()
 });
 
 export const UserWithTokenResponseSchema = z.object({
 	...UserSchema.shape,
 	...responseAdditionalFields.shape,
-	token: z.string()
+	token: z.string(),
+	refreshToken: z.string().optional()
+});
+
+// Access tokens are short-lived, the refresh token is rotated on every use
+export const RefreshTokenRequestSchema = z.object({
+	refreshToken: z.string()
+});
+
+export const RefreshTokenResponseSchema = z.object({
+	token: z.string(),
+	refreshToken: z.string()
 });
 
 export const UpdateUserAvatarFormSchema = z.object({
@@ -117,32 +166,73 @@ export const UsersResponseSchema = z.array(SimpleUserResponseSchema);
 export const TwoFaSetupResponseSchema = z.object({
 	twoFaSecret: z.string(),
 	setupToken: z.string(),
-	twoFaUri: z.string()
+	twoFaUri: z.string(),
+	twoFaQrCode: z.string()
 });
 
 export const TwoFaConfirmFormSchema = z.object({
-	twoFaCode: z.string().min(6).max(6)
+	twoFaCode: z.string().min(6).max(8)
 });
 
 // 2FA confirm
 export const TwoFaConfirmRequestSchema = z.object({
-	twoFaCode: z.string().min(6).max(6),
+	twoFaCode: z.string().min(6).max(8),
 	setupToken: z.string()
 });
 
+// Step-up re-authentication before sensitive actions
+export const ReauthRequestSchema = z.object({
+	password: z.string().max(128).optional(),
+	twoFaCode: z.string().min(6).max(8).optional()
+});
+
+export const ReauthResponseSchema = z.object({
+	reauthenticatedUntil: z.number()
+});
+
+// Provider round trips started by a logged in user, e.g. to re-authenticate without a password
+export const OauthUrlResponseSchema = z.object({
+	url: z.url()
+});
+
+// Configured external login providers, Google is not one of them
+export const OauthProvidersResponseSchema = z.object({
+	providers: z.array(z.string())
+});
+
+// The query of the OIDC authorization request, passed on unchanged
+export const OidcAuthorizeRequestSchema = z.object({
+	response_type: z.string(),
+	client_id: z.string(),
+	redirect_uri: z.string(),
+	scope: z.string(),
+	state: z.string().max(512).optional(),
+	nonce: z.string().max(512).optional(),
+	code_challenge: z.string(),
+	code_challenge_method: z.string()
+});
+
+export const OidcAuthorizeResponseSchema = z.object({
+	redirectUrl: z.url()
+});
+
 // Disable 2FA
 export const TwoFaDisableRequestSchema = z.object({
 	password: passwordSchema
 });
 
 export const TwoFaChallengeRequestSchema = z.object({
-	twoFaCode: z.string(),
-	sessionToken: z.string()
+	twoFaCode: z.string().optional(),
+	emailCode: z.string().optional(),
+	sessionToken: z.string(),
+	rememberDevice: z.boolean().optional()
 });
 
 export const TwoFaPendingUserResponseSchema = z.object({
 	message: z.literal('2FA_REQUIRED'),
-	sessionToken: z.string()
+	sessionToken: z.string(),
+	method: z.enum(['totp', 'email']),
+	methods: z.array(z.string())
 });
 
 //
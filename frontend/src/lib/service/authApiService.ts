@@ -1,8 +1,20 @@
 import type {
 	AddNewFriendRequest,
 	CreateUserRequest,
+	ForgotPasswordRequest,
 	GetFriendsResponse,
+	GoogleLinkConfirmRequest,
+	LoginCodeRequest,
 	LoginUserByIdentifierRequest,
+	OauthProvidersResponse,
+	OauthUrlResponse,
+	OidcAuthorizeRequest,
+	OidcAuthorizeResponse,
+	ReauthRequest,
+	ReauthResponse,
+	RefreshTokenRequest,
+	ResendVerificationEmailRequest,
+	ResetPasswordRequest,
 	TwoFaChallengeRequest,
 	TwoFaConfirmRequest,
 	TwoFaDisableRequest,
@@ -12,13 +24,27 @@ import type {
 	UpdateUserRequest,
 	UsersResponse,
 	UserWithoutTokenResponse,
-	UserWithTokenResponse
+	UserWithTokenResponse,
+	VerifyEmailRequest
 } from '$lib/schemas/types.js';
 import {
 	AddNewFriendRequestSchema,
 	CreateUserSchema,
+	ForgotPasswordRequestSchema,
 	GetFriendsResponseSchema,
+	GoogleLinkConfirmRequestSchema,
+	LoginCodeRequestSchema,
 	LoginUserByIdentifierRequestSchema,
+	OauthProvidersResponseSchema,
+	OauthUrlResponseSchema,
+	OidcAuthorizeRequestSchema,
+	OidcAuthorizeResponseSchema,
+	ReauthRequestSchema,
+	ReauthResponseSchema,
+	RefreshTokenRequestSchema,
+	RefreshTokenResponseSchema,
+	ResendVerificationEmailRequestSchema,
+	ResetPasswordRequestSchema,
 	TwoFaChallengeRequestSchema,
 	TwoFaConfirmRequestSchema,
 	TwoFaDisableRequestSchema,
@@ -28,9 +54,10 @@ import {
 	UpdateUserRequestSchema,
 	UsersResponseSchema,
 	UserWithoutTokenResponseSchema,
-	UserWithTokenResponseSchema
+	UserWithTokenResponseSchema,
+	VerifyEmailRequestSchema
 } from '$lib/schemas/userSchema.js';
-import { STORAGE_TOKEN } from '$lib/stores/userStore.js';
+import { STORAGE_REFRESH_TOKEN, STORAGE_TOKEN, userStore } from '$lib/stores/userStore.js';
 import * as z from 'zod';
 import { AuthError, type AuthErrorStatus } from '../errors/error.js';
 import { cfg } from '$lib/config/config.js';
@@ -46,13 +73,67 @@ export const healthCheck = async (): Promise<boolean> => {
 	}
 };
 
+// Refresh a little before the access token expires, so a request never races its expiry
+const REFRESH_MARGIN_MS = 30_000;
+
+const expiresSoon = (token: string): boolean => {
+	try {
+		const payload = token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/');
+		const { exp } = JSON.parse(atob(payload));
+		return typeof exp === 'number' && exp * 1000 - Date.now() < REFRESH_MARGIN_MS;
+	} catch {
+		return false;
+	}
+};
+
+const refreshTokens = async (): Promise<string | null> => {
+	// Another tab may have refreshed already, a refresh token is single use
+	const current = localStorage.getItem(STORAGE_TOKEN);
+	if (current && !expiresSoon(current)) return current;
+
+	const refreshToken = localStorage.getItem(STORAGE_REFRESH_TOKEN);
+	if (!refreshToken) return null;
+
+	const request: RefreshTokenRequest = { refreshToken };
+	const response = await fetch(`${cfg.apiBaseUrl}/token/refresh`, {
+		method: 'POST',
+		credentials: 'include',
+		headers: { 'Content-Type': 'application/json' },
+		body: JSON.stringify(RefreshTokenRequestSchema.parse(request))
+	});
+	if (!response.ok) return null;
+
+	const tokens = RefreshTokenResponseSchema.safeParse(await response.json());
+	if (!tokens.success) return null;
+
+	userStore.saveTokens(tokens.data.token, tokens.data.refreshToken);
+	return tokens.data.token;
+};
+
+let refreshing: Promise<string | null> | null = null;
+
+// Concurrent requests share one refresh, and tabs take turns through a lock
+const refreshAccessToken = (): Promise<string | null> => {
+	refreshing ??= (
+		navigator.locks
+			? navigator.locks.request('auth_refresh', refreshTokens)
+			: refreshTokens()
+	)
+		.catch(() => null)
+		.finally(() => {
+			refreshing = null;
+		});
+	return refreshing;
+};
+
 const apiFetcher = async <TRequest, TResponse>(
 	path: string,
 	method: MethodType,
 	data?: unknown,
 	requestSchema?: z.ZodType<TRequest>,
 	responseSchema?: z.ZodType<TResponse>,
-	surpressAuthRedirect = false
+	surpressAuthRedirect = false,
+	baseUrl = cfg.apiBaseUrl
 ): Promise<TResponse> => {
 	if (data !== undefined && !requestSchema) {
 		throw new AuthError(400, 'Request schema is required when data is provided');
@@ -71,8 +152,14 @@ const apiFetcher = async <TRequest, TResponse>(
 		// Ignore localStorage errors
 	}
 
-	const response = await fetch(`${cfg.apiBaseUrl}${path}`, {
+	// Without a refresh the request fails with 401 and the user is sent to log in again
+	if (token && expiresSoon(token)) {
+		token = (await refreshAccessToken()) ?? token;
+	}
+
+	const response = await fetch(`${baseUrl}${path}`, {
 		method,
+		credentials: 'include',
 		headers: {
 			'Content-Type': 'application/json',
 			...(token ? { Authorization: `Bearer ${token}` } : {})
@@ -83,17 +170,27 @@ const apiFetcher = async <TRequest, TResponse>(
 	if (response.status === 428) return (await response.json()) as TResponse;
 
 	if (!response.ok) {
+		// eslint-disable-next-line @typescript-eslint/no-explicit-any
+		let errorData: any;
 		try {
-			const errorData = await response.json();
-			const message =
-				typeof errorData?.error === 'string' ? errorData.error : 'Unknown error occurred';
-
-			if (!surpressAuthRedirect && response.status == 401) window.location.href = '/user/reset';
-
-			throw new AuthError(response.status as AuthErrorStatus, message);
+			errorData = await response.json();
 		} catch {
 			throw new AuthError(response.status as AuthErrorStatus, 'Unknown error occurred');
 		}
+		// Validation errors, like a password the policy rejects, list every message
+		const message =
+			typeof errorData?.error === 'string'
+				? errorData.error
+				: Array.isArray(errorData?.error)
+					? errorData.error.join('\n')
+					: 'Unknown error occurred';
+		const code = typeof errorData?.code === 'string' ? errorData.code : undefined;
+
+		// A missing re-authentication is not a logout, the caller asks for the password again
+		if (!surpressAuthRedirect && response.status == 401 && code !== 'reauth_required')
+			window.location.href = '/user/reset';
+
+		throw new AuthError(response.status as AuthErrorStatus, message, code);
 	}
 
 	if (!responseSchema) return undefined as unknown as TResponse;
@@ -150,6 +247,52 @@ export const loginUser = async (
 	return response;
 };
 
+export const loginByCode = async (
+	request: LoginCodeRequest
+): Promise<UserWithTokenResponse | TwoFaPendingUserResponse> => {
+	const response = await apiFetcher<
+		LoginCodeRequest,
+		UserWithTokenResponse | TwoFaPendingUserResponse
+	>('/loginByCode', 'POST', request, LoginCodeRequestSchema, UserWithTokenResponseSchema, true);
+
+	if ('message' in response && response.message === '2FA_REQUIRED') {
+		const validated = TwoFaPendingUserResponseSchema.safeParse(response);
+		if (!validated.success) {
+			throw new AuthError(500, `Invalid response format: ${validated.error.message}`);
+		}
+		return validated.data;
+	}
+
+	return response;
+};
+
+// The link token comes in the fragment of the Google callback, when a password account already has the Google email
+export const confirmGoogleLink = async (
+	request: GoogleLinkConfirmRequest
+): Promise<UserWithTokenResponse | TwoFaPendingUserResponse> => {
+	const response = await apiFetcher<
+		GoogleLinkConfirmRequest,
+		UserWithTokenResponse | TwoFaPendingUserResponse
+	>(
+		'/google/link/confirm',
+		'POST',
+		request,
+		GoogleLinkConfirmRequestSchema,
+		UserWithTokenResponseSchema,
+		true
+	);
+
+	if ('message' in response && response.message === '2FA_REQUIRED') {
+		const validated = TwoFaPendingUserResponseSchema.safeParse(response);
+		if (!validated.success) {
+			throw new AuthError(500, `Invalid response format: ${validated.error.message}`);
+		}
+		return validated.data;
+	}
+
+	return response;
+};
+
 export const logoutUser = async (): Promise<void> => {
 	await apiFetcher<undefined, undefined>('/logout', 'DELETE');
 };
@@ -177,6 +320,52 @@ export const updatePassword = async (
 	);
 };
 
+export const forgotPassword = async (request: ForgotPasswordRequest): Promise<void> => {
+	await apiFetcher<ForgotPasswordRequest, undefined>(
+		'/password/forgot',
+		'POST',
+		request,
+		ForgotPasswordRequestSchema
+	);
+};
+
+// Sessions are all revoked, the user logs in again with the new password
+export const resetPassword = async (request: ResetPasswordRequest): Promise<void> => {
+	await apiFetcher<ResetPasswordRequest, undefined>(
+		'/password/reset',
+		'POST',
+		request,
+		ResetPasswordRequestSchema,
+		undefined,
+		true
+	);
+};
+
+// The link of the verification email carries the token
+export const verifyEmail = async (
+	request: VerifyEmailRequest
+): Promise<UserWithoutTokenResponse> => {
+	return await apiFetcher<VerifyEmailRequest, UserWithoutTokenResponse>(
+		'/email/verify',
+		'POST',
+		request,
+		VerifyEmailRequestSchema,
+		UserWithoutTokenResponseSchema,
+		true
+	);
+};
+
+export const resendVerificationEmail = async (
+	request: ResendVerificationEmailRequest
+): Promise<void> => {
+	await apiFetcher<ResendVerificationEmailRequest, undefined>(
+		'/email/verify/resend',
+		'POST',
+		request,
+		ResendVerificationEmailRequestSchema
+	);
+};
+
 export const updateProfile = async (
 	request: UpdateUserRequest
 ): Promise<UserWithoutTokenResponse> => {
@@ -189,6 +378,89 @@ export const updateProfile = async (
 	);
 };
 
+export const reauthenticate = async (request: ReauthRequest): Promise<ReauthResponse> => {
+	return await apiFetcher<ReauthRequest, ReauthResponse>(
+		'/reauth',
+		'POST',
+		request,
+		ReauthRequestSchema,
+		ReauthResponseSchema,
+		true
+	);
+};
+
+// The Google callback re-authenticates this session, then comes back with reauthenticated=google
+export const startGoogleReauth = async (): Promise<string> => {
+	const response = await apiFetcher<undefined, OauthUrlResponse>(
+		'/google/reauth',
+		'POST',
+		undefined,
+		undefined,
+		OauthUrlResponseSchema
+	);
+	return response.url;
+};
+
+export const getOauthProviders = async (): Promise<string[]> => {
+	const response = await apiFetcher<undefined, OauthProvidersResponse>(
+		'/oauth/providers',
+		'GET',
+		undefined,
+		undefined,
+		OauthProvidersResponseSchema,
+		true
+	);
+	return response.providers;
+};
+
+// The callback links the provider account, then comes back with linked=<provider>
+export const startOauthLink = async (provider: string): Promise<string> => {
+	const response = await apiFetcher<undefined, OauthUrlResponse>(
+		`/oauth/${encodeURIComponent(provider)}/link`,
+		'POST',
+		undefined,
+		undefined,
+		OauthUrlResponseSchema
+	);
+	return response.url;
+};
+
+export const unlinkOauth = async (provider: string): Promise<UserWithoutTokenResponse> => {
+	return await apiFetcher<undefined, UserWithoutTokenResponse>(
+		`/oauth/${encodeURIComponent(provider)}/link`,
+		'DELETE',
+		undefined,
+		undefined,
+		UserWithoutTokenResponseSchema
+	);
+};
+
+// Like startGoogleReauth, for accounts that log in with another provider
+export const startOauthReauth = async (provider: string): Promise<string> => {
+	const response = await apiFetcher<undefined, OauthUrlResponse>(
+		`/oauth/${encodeURIComponent(provider)}/reauth`,
+		'POST',
+		undefined,
+		undefined,
+		OauthUrlResponseSchema
+	);
+	return response.url;
+};
+
+// Issues the code for the logged in user, the browser then goes back to the client with it
+export const authorizeOidc = async (request: OidcAuthorizeRequest): Promise<string> => {
+	const response = await apiFetcher<OidcAuthorizeRequest, OidcAuthorizeResponse>(
+		'/authorize',
+		'POST',
+		request,
+		OidcAuthorizeRequestSchema,
+		OidcAuthorizeResponseSchema,
+		true,
+		cfg.apiOidcUrl
+	);
+	return response.redirectUrl;
+};
+
 export const deleteAccount = async (): Promise<void> => {
 	await apiFetcher<undefined, undefined>('/me', 'DELETE');
 };
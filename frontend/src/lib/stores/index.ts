@@ -1,3 +1,3 @@
-import { STORAGE_TOKEN, userStore } from './userStore';
+import { STORAGE_REFRESH_TOKEN, STORAGE_TOKEN, userStore } from './userStore';
 
-export { STORAGE_TOKEN, userStore };
+export { STORAGE_REFRESH_TOKEN, STORAGE_TOKEN, userStore };
@@ -2,7 +2,9 @@ import type { UserWithoutTokenResponse, UserWithTokenResponse } from '$lib/schem
 import { writable } from 'svelte/store';
 
 const STORAGE_USER = 'auth_user';
+const STORAGE_RETURN_TO = 'auth_return_to';
 export const STORAGE_TOKEN = 'auth_token';
+export const STORAGE_REFRESH_TOKEN = 'auth_refresh_token';
 
 type UserStore = {
 	user: UserWithoutTokenResponse | null;
@@ -28,6 +30,7 @@ const removeFromLocalStorage = () => {
 
 	localStorage.removeItem(STORAGE_USER);
 	localStorage.removeItem(STORAGE_TOKEN);
+	localStorage.removeItem(STORAGE_REFRESH_TOKEN);
 };
 
 const getFromLocalStorage = (): UserStore => {
@@ -55,13 +58,26 @@ export const userStore = {
 	},
 
 	login(user: UserWithTokenResponse) {
-		const { token, ...userWithoutToken } = user;
+		const { token, refreshToken, ...userWithoutToken } = user;
 		const nextState: UserStore = {
 			user: userWithoutToken,
 			token
 		};
 		set(nextState);
 		saveToLocalStorage(nextState);
+		if (refreshToken && typeof window !== 'undefined') {
+			localStorage.setItem(STORAGE_REFRESH_TOKEN, refreshToken);
+		}
+	},
+
+	// After a refresh, both tokens are replaced
+	saveTokens(token: string, refreshToken: string) {
+		const { user } = getFromLocalStorage();
+		set({ user, token });
+		saveTokenToLocalStorage(token);
+		if (typeof window !== 'undefined') {
+			localStorage.setItem(STORAGE_REFRESH_TOKEN, refreshToken);
+		}
 	},
 
 	// This is used only for Oauth callback
@@ -81,5 +97,21 @@ export const userStore = {
 	logout() {
 		set({ user: null, token: null });
 		removeFromLocalStorage();
+	},
+
+	// A page that needs a logged in user, like the OIDC consent page, is resumed after the login
+	setReturnTo(path: string) {
+		if (typeof window === 'undefined') return;
+
+		sessionStorage.setItem(STORAGE_RETURN_TO, path);
+	},
+
+	takeReturnTo(): string {
+		if (typeof window === 'undefined') return '/';
+
+		const path = sessionStorage.getItem(STORAGE_RETURN_TO);
+		sessionStorage.removeItem(STORAGE_RETURN_TO);
+		// Only paths of this app, never another origin
+		return path && path.startsWith('/') && !path.startsWith('//') ? path : '/';
 	}
 };
@@ -11,3 +11,8 @@ export type WithoutChild<T> = T extends { child?: any } ? Omit<T, 'child'> : T;
 export type WithoutChildren<T> = T extends { children?: any } ? Omit<T, 'children'> : T;
 export type WithoutChildrenOrChild<T> = WithoutChildren<WithoutChild<T>>;
 export type WithElementRef<T, U extends HTMLElement = HTMLElement> = T & { ref?: U | null };
+
+// Provider names come from OAUTH_PROVIDERS, e.g. "github"
+export function providerLabel(name: string): string {
+	return name.charAt(0).toUpperCase() + name.slice(1);
+}
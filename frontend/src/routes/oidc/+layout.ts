@@ -0,0 +1 @@
+export const ssr = false;